@@ -0,0 +1,20 @@
+package habitat
+
+// Code generated by lexgen. DO NOT EDIT.
+
+// NetworkHabitatNotificationsDeliverNotificationNotification represents a notification object
+type NetworkHabitatNotificationsDeliverNotificationNotification struct {
+	CreatedAt string `json:"createdAt"`
+	Effect    string `json:"effect,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Grantee   string `json:"grantee"`
+	Kind      string `json:"kind"`
+	NotBefore string `json:"notBefore,omitempty"`
+	Object    string `json:"object"`
+	Owner     string `json:"owner"`
+}
+
+// NetworkHabitatNotificationsDeliverNotificationInput represents the input for network.habitat.notifications.deliverNotification
+type NetworkHabitatNotificationsDeliverNotificationInput struct {
+	Notification NetworkHabitatNotificationsDeliverNotificationNotification `json:"notification"`
+}
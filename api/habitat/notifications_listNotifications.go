@@ -0,0 +1,27 @@
+package habitat
+
+// Code generated by lexgen. DO NOT EDIT.
+
+// NetworkHabitatNotificationsListNotificationsParams represents the input parameters for network.habitat.notifications.listNotifications
+type NetworkHabitatNotificationsListNotificationsParams struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int64  `json:"limit,omitempty"`
+}
+
+// NetworkHabitatNotificationsListNotificationsOutput represents the output for network.habitat.notifications.listNotifications
+type NetworkHabitatNotificationsListNotificationsOutput struct {
+	Cursor        string                                                     `json:"cursor,omitempty"`
+	Notifications []NetworkHabitatNotificationsListNotificationsNotification `json:"notifications"`
+}
+
+// NetworkHabitatNotificationsListNotificationsNotification represents a notification object
+type NetworkHabitatNotificationsListNotificationsNotification struct {
+	CreatedAt string `json:"createdAt"`
+	Effect    string `json:"effect,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Grantee   string `json:"grantee"`
+	Kind      string `json:"kind"`
+	NotBefore string `json:"notBefore,omitempty"`
+	Object    string `json:"object"`
+	Owner     string `json:"owner"`
+}
@@ -0,0 +1,27 @@
+package habitat
+
+// Code generated by lexgen. DO NOT EDIT.
+
+// NetworkHabitatPermissionsExplainParams represents the input parameters for network.habitat.permissions.explain
+type NetworkHabitatPermissionsExplainParams struct {
+	Collection string `json:"collection"`
+	Grantee    string `json:"grantee"`
+	Rkey       string `json:"rkey,omitempty"`
+}
+
+// NetworkHabitatPermissionsExplainOutput represents the output for network.habitat.permissions.explain
+type NetworkHabitatPermissionsExplainOutput struct {
+	Allowed      bool                                   `json:"allowed"`
+	DecidingRule *NetworkHabitatPermissionsExplainRule  `json:"decidingRule,omitempty"`
+	Reason       string                                 `json:"reason"`
+	Rules        []NetworkHabitatPermissionsExplainRule `json:"rules"`
+}
+
+// NetworkHabitatPermissionsExplainRule represents a rule object
+type NetworkHabitatPermissionsExplainRule struct {
+	Active    bool   `json:"active"`
+	Effect    string `json:"effect"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	NotBefore string `json:"notBefore,omitempty"`
+	Object    string `json:"object"`
+}
@@ -210,6 +210,10 @@ func generateQueryCode(id string, defName string, defData *lex.TypeSchema, schem
 				isRequired := slices.Contains(defData.Parameters.Required, propName)
 				if !isRequired {
 					jsonTag += ",omitempty"
+					// omitempty has no effect on structs, so optional objects are pointers
+					if propSchema.Type == "ref" {
+						goType = "*" + goType
+					}
 				}
 
 				fieldName := toFieldName(propName)
@@ -244,6 +248,10 @@ func generateQueryCode(id string, defName string, defData *lex.TypeSchema, schem
 				isRequired := slices.Contains(defData.Output.Schema.Required, propName)
 				if !isRequired {
 					jsonTag += ",omitempty"
+					// omitempty has no effect on structs, so optional objects are pointers
+					if propSchema.Type == "ref" {
+						goType = "*" + goType
+					}
 				}
 
 				fieldName := toFieldName(propName)
@@ -289,6 +297,10 @@ func generateProcedureCode(id string, defName string, defData *lex.TypeSchema, s
 				isRequired := slices.Contains(defData.Input.Schema.Required, propName)
 				if !isRequired {
 					jsonTag += ",omitempty"
+					// omitempty has no effect on structs, so optional objects are pointers
+					if propSchema.Type == "ref" {
+						goType = "*" + goType
+					}
 				}
 
 				fieldName := toFieldName(propName)
@@ -323,6 +335,10 @@ func generateProcedureCode(id string, defName string, defData *lex.TypeSchema, s
 				isRequired := slices.Contains(defData.Output.Schema.Required, propName)
 				if !isRequired {
 					jsonTag += ",omitempty"
+					// omitempty has no effect on structs, so optional objects are pointers
+					if propSchema.Type == "ref" {
+						goType = "*" + goType
+					}
 				}
 
 				fieldName := toFieldName(propName)
@@ -365,6 +381,10 @@ func generateRecordCode(id string, defName string, defData *lex.TypeSchema) (str
 				isRequired := slices.Contains(defData.Record.Required, propName)
 				if !isRequired {
 					jsonTag += ",omitempty"
+					// omitempty has no effect on structs, so optional objects are pointers
+					if propSchema.Type == "ref" {
+						goType = "*" + goType
+					}
 				}
 
 				fieldName := toFieldName(propName)
@@ -403,6 +423,10 @@ func generateObjectCode(id string, defName string, defData *lex.TypeSchema) (str
 			isRequired := slices.Contains(defData.Required, propName)
 			if !isRequired {
 				jsonTag += ",omitempty"
+				// omitempty has no effect on structs, so optional objects are pointers
+				if propSchema.Type == "ref" {
+					goType = "*" + goType
+				}
 			}
 
 			fieldName := toFieldName(propName)
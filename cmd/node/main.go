@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -10,13 +11,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	"github.com/docker/docker/client"
 	"github.com/eagraf/habitat-new/internal/app"
 	"github.com/eagraf/habitat-new/internal/auth"
+	"github.com/eagraf/habitat-new/internal/directory"
 	"github.com/eagraf/habitat-new/internal/docker"
 	"github.com/eagraf/habitat-new/internal/node/api"
 	"github.com/eagraf/habitat-new/internal/node/appstore"
@@ -31,7 +37,6 @@ import (
 	"github.com/eagraf/habitat-new/internal/privi"
 	"github.com/eagraf/habitat-new/internal/process"
 	"github.com/eagraf/habitat-new/internal/web"
-	"github.com/gorilla/sessions"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
@@ -108,10 +113,6 @@ func main() {
 	}
 	addr := fmt.Sprintf(":%s", nodeConfig.ReverseProxyPort())
 
-	// Gorilla sessions persisted in the browser's cookies.
-	// TODO These need to actually be persisted somewhere
-	sessionStoreKey := []byte("FaKe_DeV-SeSsIoN-KeY")
-
 	proxy := reverse_proxy.NewProxyServer(logger, nodeConfig.WebBundlePath())
 	proxyServer := &http.Server{
 		Addr:    addr,
@@ -151,7 +152,7 @@ func main() {
 		log.Fatal().Err(err).Msg("error creating node control server")
 	}
 
-	sessionStore := sessions.NewCookieStore(sessionStoreKey)
+	sessionStore := setupSessionStore(ctx, nodeConfig)
 
 	// Set up the main API server
 	// TODO: create a less tedious way to register all the routes in the future. It might be as simple
@@ -160,7 +161,12 @@ func main() {
 		// Node routes
 		api.NewVersionHandler(),
 	}
-	authRoutes, err := auth.GetRoutes(nodeConfig, sessionStore)
+	clientKeys, err := auth.LoadOrCreateClientKeys(nodeConfig.ClientKeysFile())
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading oauth client keys")
+	}
+	dir := directory.New(nodeConfig.DirectoryOptions()...)
+	authRoutes, err := auth.GetRoutes(ctx, nodeConfig, sessionStore, clientKeys, dir)
 	if err != nil {
 		log.Fatal().Err(err).Msg("error getting auth routes")
 	}
@@ -171,7 +177,7 @@ func main() {
 		routes = append(routes, appstore.NewAvailableAppsRoute(nodeConfig.HabitatPath()))
 	}
 
-	priviServer := setupPrivi(nodeConfig)
+	priviServer := setupPrivi(ctx, nodeConfig, dir)
 	routes = append(routes, priviServer.GetRoutes()...)
 
 	router := api.NewRouter(routes, logger)
@@ -219,27 +225,33 @@ func main() {
 	log.Info().Msg("Finished!")
 }
 
-func setupPrivi(nodeConfig *config.NodeConfig) *privi.Server {
-	policiesDirPath := nodeConfig.PermissionPolicyFilesDir()
-	perms, err := permissions.NewStore(
-		fileadapter.NewAdapter(filepath.Join(policiesDirPath, "policies.csv")),
-		true,
-	)
+// setupSessionStore returns a session store persisted in the habitat directory. The cookie only
+// carries an opaque session ID; login state such as DPoP keys and tokens stays on the node.
+func setupSessionStore(ctx context.Context, nodeConfig *config.NodeConfig) *auth.SQLiteSessionStore {
+	keys, err := auth.LoadOrCreateSessionKeys(nodeConfig.SessionKeysFile())
 	if err != nil {
-		log.Fatal().Err(err).Msgf("error creating permission store")
+		log.Fatal().Err(err).Msg("error loading session keys")
 	}
-
-	// FOR DEMO PURPOSES ONLY
-	sashankDID := "did:plc:v3amhno5wvyfams6aioqqj66"
-	arushiDID := "did:plc:l3k2mbu6qa6rxjej5tvjj7zz"
-	err = perms.AddLexiconReadPermission(arushiDID, sashankDID, "com.habitat.test")
+	sessionDB, err := gorm.Open(sqlite.Open(nodeConfig.SessionDBFile()), &gorm.Config{})
 	if err != nil {
-		log.Fatal().Err(err).Msgf("error adding test lexicon for sashank demo")
+		log.Fatal().Err(err).Msg("unable to open sqlite file backing sessions")
+	}
+	sessionStore, err := auth.NewSQLiteSessionStore(sessionDB, keys...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error creating session store")
 	}
+	go sessionStore.PurgeExpiredSessionsEvery(ctx, time.Hour)
+	return sessionStore
+}
 
+func setupPrivi(
+	ctx context.Context,
+	nodeConfig *config.NodeConfig,
+	dir identity.Directory,
+) *privi.Server {
 	// Create database file if it does not exist
 	priviRepoPath := nodeConfig.PriviRepoFile()
-	_, err = os.Stat(priviRepoPath)
+	_, err := os.Stat(priviRepoPath)
 	if errors.Is(err, os.ErrNotExist) {
 		_, err := os.Create(priviRepoPath)
 		if err != nil {
@@ -254,20 +266,135 @@ func setupPrivi(nodeConfig *config.NodeConfig) *privi.Server {
 		log.Fatal().Err(err).Msg("unable to open sqlite file backing privi server")
 	}
 
+	perms, err := permissions.NewSQLiteStore(priviDB)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("error creating permission store")
+	}
+	migrateCasbinPolicies(nodeConfig, perms)
+	// Expired grants are kept for a week so owners can see what lapsed, then purged.
+	go perms.PurgeExpiredPermissionsEvery(ctx, time.Hour, 7*24*time.Hour)
+
+	// FOR DEMO PURPOSES ONLY
+	sashankDID := "did:plc:v3amhno5wvyfams6aioqqj66"
+	arushiDID := "did:plc:l3k2mbu6qa6rxjej5tvjj7zz"
+	err = perms.AddLexiconReadPermission(arushiDID, sashankDID, "com.habitat.test")
+	if err != nil {
+		log.Fatal().Err(err).Msgf("error adding test lexicon for sashank demo")
+	}
+
 	repo, err := privi.NewSQLiteRepo(priviDB)
 	if err != nil {
 		log.Fatal().Err(err).Msg("unable to setup privi sqlite db")
 	}
 
+	// Grantees hosted on other nodes are notified with requests signed by this node's did:web,
+	// whose DID document publishes the signing key.
+	nodeKey, err := loadOrCreateNodeKey(nodeConfig.NodeSigningKeyFile())
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading node signing key")
+	}
+	nodeDID := syntax.DID("did:web:" + nodeConfig.Domain())
+	err = writeNodeDIDDocument(nodeConfig.WellKnownDir(), nodeDID, nodeConfig.ExternalURL(), nodeKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error writing node DID document")
+	}
+
 	// Add privy routes
 	priviServer := privi.NewServer(
+		ctx,
 		perms,
 		repo,
 		nil,
+		privi.WithDirectory(dir),
+		privi.WithNotificationSender(nodeDID, nodeConfig.ExternalURL(), nodeKey),
 	)
 	return priviServer
 }
 
+// loadOrCreateNodeKey reads the multibase-encoded signing key at path, generating and persisting
+// a new one if the file does not exist.
+func loadOrCreateNodeKey(path string) (atcrypto.PrivateKey, error) {
+	encoded, err := os.ReadFile(path)
+	if err == nil {
+		return atcrypto.ParsePrivateMultibase(strings.TrimSpace(string(encoded)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path, []byte(key.Multibase()), 0o600)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("created node signing key at %s", path)
+	return key, nil
+}
+
+// writeNodeDIDDocument writes the did:web document served at /.well-known/did.json. Its #atproto
+// key lets other nodes verify requests this node signs.
+func writeNodeDIDDocument(dir string, did syntax.DID, endpoint string, key atcrypto.PrivateKey) error {
+	pub, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	doc := map[string]any{
+		"id": did.String(),
+		"@context": []string{
+			"https://www.w3.org/ns/did/v1",
+			"https://w3id.org/security/multikey/v1",
+		},
+		"verificationMethod": []map[string]string{{
+			"id":                 did.String() + "#atproto",
+			"type":               "Multikey",
+			"controller":         did.String(),
+			"publicKeyMultibase": pub.Multibase(),
+		}},
+		"service": []map[string]string{{
+			"id":              "#habitat",
+			"type":            "HabitatServer",
+			"serviceEndpoint": endpoint,
+		}},
+	}
+	bytes, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "did.json"), bytes, 0o644)
+}
+
+// migrateCasbinPolicies moves permissions from the casbin policy file nodes used to store them in
+// into the sqlite permission store. The file is renamed afterwards so the migration only runs once.
+func migrateCasbinPolicies(nodeConfig *config.NodeConfig, perms permissions.Store) {
+	policiesPath := filepath.Join(nodeConfig.PermissionPolicyFilesDir(), "policies.csv")
+	_, err := os.Stat(policiesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Fatal().Err(err).Msgf("error finding casbin policy file")
+	}
+
+	n, err := permissions.MigrateCasbinPolicies(fileadapter.NewAdapter(policiesPath), perms)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("error migrating casbin policies from %s", policiesPath)
+	}
+	err = os.Rename(policiesPath, policiesPath+".migrated")
+	if err != nil {
+		log.Fatal().Err(err).Msgf("error renaming migrated casbin policy file")
+	}
+	log.Info().Msgf("migrated %d permission rules from %s", n, policiesPath)
+}
+
 func generateDefaultReverseProxyRules(config *config.NodeConfig) ([]*reverse_proxy.Rule, error) {
 	frontendRule := &reverse_proxy.Rule{
 		ID:      "default-rule-frontend",
@@ -327,6 +454,36 @@ func generateDefaultReverseProxyRules(config *config.NodeConfig) ([]*reverse_pro
 			Matcher: "/xrpc/com.habitat.removePermission",
 			Target:  apiURL.String() + "/xrpc/com.habitat.removePermission",
 		},
+		{
+			ID:      "habitat-export-permissions",
+			Type:    reverse_proxy.ProxyRuleRedirect,
+			Matcher: "/xrpc/com.habitat.exportPermissions",
+			Target:  apiURL.String() + "/xrpc/com.habitat.exportPermissions",
+		},
+		{
+			ID:      "habitat-import-permissions",
+			Type:    reverse_proxy.ProxyRuleRedirect,
+			Matcher: "/xrpc/com.habitat.importPermissions",
+			Target:  apiURL.String() + "/xrpc/com.habitat.importPermissions",
+		},
+		{
+			ID:      "habitat-explain-permission",
+			Type:    reverse_proxy.ProxyRuleRedirect,
+			Matcher: "/xrpc/network.habitat.permissions.explain",
+			Target:  apiURL.String() + "/xrpc/network.habitat.permissions.explain",
+		},
+		{
+			ID:      "habitat-list-notifications",
+			Type:    reverse_proxy.ProxyRuleRedirect,
+			Matcher: "/xrpc/network.habitat.notifications.listNotifications",
+			Target:  apiURL.String() + "/xrpc/network.habitat.notifications.listNotifications",
+		},
+		{
+			ID:      "habitat-deliver-notification",
+			Type:    reverse_proxy.ProxyRuleRedirect,
+			Matcher: "/xrpc/network.habitat.notifications.deliverNotification",
+			Target:  apiURL.String() + "/xrpc/network.habitat.notifications.deliverNotification",
+		},
 		// Serve a DID document for habitat
 		// This rule is currently broken because it clashes with the one above for PDS / OAuth
 		// We should delete the PDS side car because we never use it
@@ -334,7 +491,7 @@ func generateDefaultReverseProxyRules(config *config.NodeConfig) ([]*reverse_pro
 			ID:      "did-rule",
 			Type:    reverse_proxy.ProxyRuleFileServer,
 			Matcher: "/.well-known/",
-			Target:  config.HabitatPath() + "/well-known/",
+			Target:  config.WellKnownDir() + "/",
 		},
 		frontendRule,
 	}
@@ -7,7 +7,10 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/eagraf/habitat-new/internal/auth"
+	"github.com/eagraf/habitat-new/internal/node/config"
 	"github.com/eagraf/habitat-new/internal/node/constants"
 	"github.com/eagraf/habitat-new/internal/node/controller"
 	"github.com/eagraf/habitat-new/internal/process"
@@ -177,6 +180,37 @@ func uninstallApp() *cli.Command {
 	}
 }
 
+func rotateClientKey() *cli.Command {
+	var grace time.Duration
+	return &cli.Command{
+		Name:  "rotate-client-key",
+		Usage: "Replace the key the node authenticates to PDSes with, keeping the old one published for a grace period. Takes effect on restart.",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:        "grace",
+				Usage:       "How long the old key stays published for PDSes that cached it",
+				Value:       7 * 24 * time.Hour,
+				Destination: &grace,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			// The keys are read from disk rather than through the ctrl server, so this must run
+			// with the node's config
+			nodeConfig, err := config.NewNodeConfig()
+			if err != nil {
+				return err
+			}
+			path := nodeConfig.ClientKeysFile()
+			keys, err := auth.RotateClientKeys(path, grace)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Rotated the client key in %s; %d previous keys are still published\n", path, len(keys.Retired))
+			return nil
+		},
+	}
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "node_ctl",
@@ -208,6 +242,7 @@ func main() {
 				Usage: "Commands related to general node actions.",
 				Subcommands: []*cli.Command{
 					getState(),
+					rotateClientKey(),
 				},
 			},
 			{
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+const cClientID = "client"
+
+func getApprovalsCommand() *cli.Command {
+	ownerFlag := &cli.StringFlag{
+		Name:     cOwner,
+		Usage:    "The DID of the user whose approvals to operate on",
+		Required: true,
+	}
+	return &cli.Command{
+		Name:  "approvals",
+		Usage: "Manage the apps users have consented to, so they aren't asked again",
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the apps a user has consented to",
+				Flags:  []cli.Flag{ownerFlag},
+				Action: runListApprovals,
+			},
+			{
+				Name:  "revoke",
+				Usage: "Forget a user's consent to an app, so they are asked again next time",
+				Flags: []cli.Flag{
+					ownerFlag,
+					&cli.StringFlag{
+						Name:     cClientID,
+						Usage:    "The client ID of the app, as printed by list",
+						Required: true,
+					},
+				},
+				Action: runRevokeApproval,
+			},
+		},
+	}
+}
+
+func runListApprovals(ctx context.Context, cmd *cli.Command) error {
+	oauthServer := setupOAuthServer(cmd, loadKeyFile(cmd), setupDB(cmd), setupDirectory(cmd))
+	approvals, err := oauthServer.ListApprovals(ctx, cmd.String(cOwner))
+	if err != nil {
+		return err
+	}
+	for _, approval := range approvals {
+		fmt.Printf(
+			"%s\t%s\t%s\n",
+			approval.ClientID,
+			approval.ApprovedAt.Format("2006-01-02 15:04:05"),
+			strings.Join(approval.Scopes, " "),
+		)
+	}
+	return nil
+}
+
+func runRevokeApproval(ctx context.Context, cmd *cli.Command) error {
+	oauthServer := setupOAuthServer(cmd, loadKeyFile(cmd), setupDB(cmd), setupDirectory(cmd))
+	err := oauthServer.RevokeApproval(ctx, cmd.String(cOwner), cmd.String(cClientID))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Revoked approval of %s\n", cmd.String(cClientID))
+	return nil
+}
@@ -17,6 +17,10 @@ var (
 	cHttpsCerts = "httpscerts"
 	cKeyFile    = "keyfile"
 	cPgUrl      = "pgurl"
+	cSecrets    = "secrets"
+	cSecretFile = "secretsfile"
+	cPlcUrl     = "plcurl"
+	cLocalIdUrl = "localidentitiesurl"
 )
 var profiles []string
 
@@ -57,6 +61,27 @@ func getFlags() ([]cli.Flag, []cli.MutuallyExclusiveFlags) {
 				TakesFile: true,
 				Sources:   getSources(cKeyFile),
 			},
+			&cli.StringFlag{
+				Name:      cSecretFile,
+				Usage:     "The path to the file holding the secrets tokens and cookies are signed with; defaults to secrets.json next to the key file",
+				TakesFile: true,
+				Sources:   getSources(cSecretFile),
+			},
+			&cli.StringSliceFlag{
+				Name:    cSecrets,
+				Usage:   "Base64 encoded secrets to use instead of the secrets file, with the current secret first",
+				Sources: getSources(cSecrets),
+			},
+			&cli.StringFlag{
+				Name:    cPlcUrl,
+				Usage:   "The PLC directory to resolve did:plc identities with; defaults to https://plc.directory",
+				Sources: getSources(cPlcUrl),
+			},
+			&cli.StringFlag{
+				Name:    cLocalIdUrl,
+				Usage:   "A local identities server to resolve every identity with instead of the network, e.g. in offline tests",
+				Sources: getSources(cLocalIdUrl),
+			},
 		}, []cli.MutuallyExclusiveFlags{
 			{
 				Flags: [][]cli.Flag{
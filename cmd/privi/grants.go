@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+const cGrantID = "grant"
+
+func getGrantsCommand() *cli.Command {
+	ownerFlag := &cli.StringFlag{
+		Name:     cOwner,
+		Usage:    "The DID of the user whose authorized apps to operate on",
+		Required: true,
+	}
+	return &cli.Command{
+		Name:  "grants",
+		Usage: "Manage the apps users have authorized through the OAuth server",
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the apps a user has authorized",
+				Flags:  []cli.Flag{ownerFlag},
+				Action: runListGrants,
+			},
+			{
+				Name:  "revoke",
+				Usage: "Revoke an app's access, along with the PDS session behind it",
+				Flags: []cli.Flag{
+					ownerFlag,
+					&cli.StringFlag{
+						Name:     cGrantID,
+						Usage:    "The ID of the grant to revoke, as printed by list",
+						Required: true,
+					},
+				},
+				Action: runRevokeGrant,
+			},
+		},
+	}
+}
+
+func runListGrants(ctx context.Context, cmd *cli.Command) error {
+	oauthServer := setupOAuthServer(cmd, loadKeyFile(cmd), setupDB(cmd), setupDirectory(cmd))
+	grants, err := oauthServer.ListGrants(ctx, cmd.String(cOwner))
+	if err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		fmt.Printf(
+			"%s\t%s\t%s\t%s\n",
+			grant.ID,
+			grant.ClientID,
+			grant.CreatedAt.Format("2006-01-02 15:04:05"),
+			strings.Join(grant.Scopes, " "),
+		)
+	}
+	return nil
+}
+
+func runRevokeGrant(ctx context.Context, cmd *cli.Command) error {
+	oauthServer := setupOAuthServer(cmd, loadKeyFile(cmd), setupDB(cmd), setupDirectory(cmd))
+	err := oauthServer.RevokeGrant(ctx, cmd.String(cOwner), cmd.String(cGrantID))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Revoked grant %s\n", cmd.String(cGrantID))
+	return nil
+}
@@ -11,14 +11,19 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"path/filepath"
+	"time"
 
 	jose "github.com/go-jose/go-jose/v3"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
 	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/eagraf/habitat-new/internal/auth"
+	"github.com/eagraf/habitat-new/internal/directory"
 	"github.com/eagraf/habitat-new/internal/oauthserver"
 	"github.com/eagraf/habitat-new/internal/permissions"
 	"github.com/eagraf/habitat-new/internal/privi"
@@ -33,27 +38,46 @@ func main() {
 		Flags:                  flags,
 		MutuallyExclusiveFlags: mutuallyExclusiveFlags,
 		Action:                 run,
+		Commands: []*cli.Command{
+			getPermissionsCommand(),
+			getGrantsCommand(),
+			getApprovalsCommand(),
+			getSecretsCommand(),
+		},
 	}
 	if err := cmd.Run(context.Background(), os.Args); err != nil {
 		log.Fatal().Err(err).Msg("error running command")
 	}
 }
 
-func run(_ context.Context, cmd *cli.Command) error {
+func run(ctx context.Context, cmd *cli.Command) error {
 	for _, flag := range cmd.FlagNames() {
 		log.Info().Msgf("%s: %v", flag, cmd.Value(flag))
 	}
 	db := setupDB(cmd)
-	oauthServer := setupOAuthServer(cmd)
-	priviServer := setupPriviServer(db, oauthServer)
+	jwkBytes := loadKeyFile(cmd)
+	nodeKey := getNodeKey(jwkBytes)
+	dir := setupDirectory(cmd)
+	oauthServer := setupOAuthServer(cmd, jwkBytes, db, dir)
+	go oauthServer.RefreshTokensEvery(ctx, time.Minute)
+	priviServer := setupPriviServer(ctx, cmd, db, oauthServer, nodeKey, dir)
 
 	mux := http.NewServeMux()
 
 	// auth routes
 	mux.HandleFunc("/oauth-callback", oauthServer.HandleCallback)
 	mux.HandleFunc("/client-metadata.json", oauthServer.HandleClientMetadata)
-	mux.HandleFunc("/oauth/authorize", oauthServer.HandleAuthorize)
-	mux.HandleFunc("/oauth/token", oauthServer.HandleToken)
+	mux.HandleFunc(oauthserver.AuthorizePath, oauthServer.HandleAuthorize)
+	mux.HandleFunc(oauthserver.TokenPath, oauthServer.HandleToken)
+	mux.HandleFunc(oauthserver.RevokePath, oauthServer.HandleRevoke)
+	mux.HandleFunc(
+		oauthserver.AuthorizationServerMetadataPath,
+		oauthServer.HandleAuthorizationServerMetadata,
+	)
+	mux.HandleFunc(
+		oauthserver.ProtectedResourceMetadataPath,
+		oauthServer.HandleProtectedResourceMetadata,
+	)
 
 	// privi routes
 	mux.HandleFunc("/xrpc/com.habitat.putRecord", priviServer.PutRecord)
@@ -63,25 +87,49 @@ func run(_ context.Context, cmd *cli.Command) error {
 	mux.HandleFunc("/xrpc/com.habitat.listPermissions", priviServer.ListPermissions)
 	mux.HandleFunc("/xrpc/com.habitat.addPermission", priviServer.AddPermission)
 	mux.HandleFunc("/xrpc/com.habitat.removePermission", priviServer.RemovePermission)
+	mux.HandleFunc("/xrpc/com.habitat.exportPermissions", priviServer.ExportPermissions)
+	mux.HandleFunc("/xrpc/com.habitat.importPermissions", priviServer.ImportPermissions)
+	mux.HandleFunc("/xrpc/network.habitat.permissions.explain", priviServer.ExplainPermission)
+	mux.HandleFunc(
+		"/xrpc/network.habitat.notifications.listNotifications",
+		priviServer.ListNotifications,
+	)
+	mux.HandleFunc(
+		"/xrpc/network.habitat.notifications.deliverNotification",
+		priviServer.DeliverNotification,
+	)
 
+	nodePublicKey, err := nodeKey.PublicKey()
+	if err != nil {
+		return err
+	}
 	mux.HandleFunc("/.well-known/did.json", func(w http.ResponseWriter, r *http.Request) {
+		// The #atproto key lets other nodes verify requests this node signs, e.g. notifications.
 		template := `{
-  "id": "did:web:%s",
+  "id": "did:web:%[1]s",
   "@context": [
     "https://www.w3.org/ns/did/v1",
     "https://w3id.org/security/multikey/v1", 
     "https://w3id.org/security/suites/secp256k1-2019/v1"
   ],
+  "verificationMethod": [
+    {
+      "id": "did:web:%[1]s#atproto",
+      "type": "Multikey",
+      "controller": "did:web:%[1]s",
+      "publicKeyMultibase": "%[2]s"
+    }
+  ],
   "service": [
     {
       "id": "#habitat",
-      "serviceEndpoint": "https://%s",
+      "serviceEndpoint": "https://%[1]s",
       "type": "HabitatServer"
     }
   ]
 }`
 		domain := cmd.String(cDomain)
-		_, err := fmt.Fprintf(w, template, domain, domain)
+		_, err := fmt.Fprintf(w, template, domain, nodePublicKey.Multibase())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -123,7 +171,14 @@ func setupDB(cmd *cli.Command) *gorm.DB {
 	return priviDB
 }
 
-func setupPriviServer(db *gorm.DB, oauthServer *oauthserver.OAuthServer) *privi.Server {
+func setupPriviServer(
+	ctx context.Context,
+	cmd *cli.Command,
+	db *gorm.DB,
+	oauthServer *oauthserver.OAuthServer,
+	nodeKey atcrypto.PrivateKey,
+	dir identity.Directory,
+) *privi.Server {
 	repo, err := privi.NewSQLiteRepo(db)
 	if err != nil {
 		log.Fatal().Err(err).Msg("unable to setup privi sqlite db")
@@ -133,10 +188,22 @@ func setupPriviServer(db *gorm.DB, oauthServer *oauthserver.OAuthServer) *privi.
 	if err != nil {
 		log.Fatal().Err(err).Msg("unable to setup permissions store")
 	}
-	return privi.NewServer(adapter, repo, oauthServer)
+	// Expired grants are kept for a week so owners can see what lapsed, then purged.
+	go adapter.PurgeExpiredPermissionsEvery(ctx, time.Hour, 7*24*time.Hour)
+
+	domain := cmd.String(cDomain)
+	return privi.NewServer(
+		ctx,
+		adapter,
+		repo,
+		oauthServer,
+		privi.WithNotificationSender(syntax.DID("did:web:"+domain), "https://"+domain, nodeKey),
+		privi.WithDirectory(dir),
+	)
 }
 
-func setupOAuthServer(cmd *cli.Command) *oauthserver.OAuthServer {
+// loadKeyFile returns the node's JWK, generating and saving one if the key file doesn't exist.
+func loadKeyFile(cmd *cli.Command) []byte {
 	keyFile := cmd.String(cKeyFile)
 
 	jwkBytes := []byte{}
@@ -168,8 +235,78 @@ func setupOAuthServer(cmd *cli.Command) *oauthserver.OAuthServer {
 	} else {
 		// Read JWK from file
 		jwkBytes, err = os.ReadFile(keyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("failed to read key file")
+		}
+	}
+	return jwkBytes
+}
+
+// getNodeKey converts the node's JWK into the key it signs requests to other nodes with.
+func getNodeKey(jwkBytes []byte) atcrypto.PrivateKey {
+	var jwk jose.JSONWebKey
+	err := json.Unmarshal(jwkBytes, &jwk)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("failed to parse JWK")
+	}
+	ecKey, ok := jwk.Key.(*ecdsa.PrivateKey)
+	if !ok {
+		log.Fatal().Msgf("key file must contain an ECDSA private key")
+	}
+	ecdhKey, err := ecKey.ECDH()
+	if err != nil {
+		log.Fatal().Err(err).Msgf("failed to convert key")
+	}
+	key, err := atcrypto.ParsePrivateBytesP256(ecdhKey.Bytes())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("failed to parse node key")
+	}
+	return key
+}
+
+// secretsFilePath returns where the server's secrets are stored, next to the key file by default.
+func secretsFilePath(cmd *cli.Command) string {
+	path := cmd.String(cSecretFile)
+	if path == "" {
+		path = filepath.Join(filepath.Dir(cmd.String(cKeyFile)), "secrets.json")
+	}
+	return path
+}
+
+func loadSecrets(cmd *cli.Command) *oauthserver.Secrets {
+	if encoded := cmd.StringSlice(cSecrets); len(encoded) > 0 {
+		secrets, err := oauthserver.ParseSecrets(encoded)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("invalid secrets")
+		}
+		return secrets
+	}
+	secrets, err := oauthserver.LoadOrCreateSecrets(secretsFilePath(cmd))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("unable to load secrets")
+	}
+	return secrets
+}
+
+// setupDirectory returns the directory identities are resolved with, over the network unless the
+// flags point it at a local PLC directory or identities server.
+func setupDirectory(cmd *cli.Command) identity.Directory {
+	opts := []directory.Option{}
+	if url := cmd.String(cPlcUrl); url != "" {
+		opts = append(opts, directory.WithPLCURL(url))
+	}
+	if url := cmd.String(cLocalIdUrl); url != "" {
+		opts = append(opts, directory.WithLocalIdentities(url))
 	}
+	return directory.New(opts...)
+}
 
+func setupOAuthServer(
+	cmd *cli.Command,
+	jwkBytes []byte,
+	db *gorm.DB,
+	dir identity.Directory,
+) *oauthserver.OAuthServer {
 	domain := cmd.String(cDomain)
 	oauthClient, err := auth.NewOAuthClient(
 		"https://"+domain+"/client-metadata.json", /*clientId*/
@@ -181,10 +318,18 @@ func setupOAuthServer(cmd *cli.Command) *oauthserver.OAuthServer {
 		log.Fatal().Err(err).Msgf("unable to setup oauth client")
 	}
 
+	secrets := loadSecrets(cmd)
+	cookieKeys, err := secrets.CookieKeyPairs()
+	if err != nil {
+		log.Fatal().Err(err).Msgf("unable to derive cookie keys")
+	}
 	oauthServer, err := oauthserver.NewOAuthServer(
 		oauthClient,
-		sessions.NewCookieStore([]byte("my super secret signing password")),
-		identity.DefaultDirectory(),
+		sessions.NewCookieStore(cookieKeys...),
+		dir,
+		db,
+		secrets,
+		oauthserver.WithIssuer("https://"+domain),
 	)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("unable to setup oauth server")
@@ -209,7 +354,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().
-			Set("Access-Control-Allow-Headers", "Content-Type, Authorization, habitat-auth-method, User-Agent")
+			Set("Access-Control-Allow-Headers", "Content-Type, Authorization, DPoP, habitat-auth-method, User-Agent")
+		// Apps need these to retry requests with the DPoP nonce Habitat asks for
+		w.Header().Set("Access-Control-Expose-Headers", "DPoP-Nonce, WWW-Authenticate")
 		w.Header().Set("Access-Control-Max-Age", "86400") // Cache preflight for 24 hours
 
 		// Handle preflight OPTIONS request
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"github.com/eagraf/habitat-new/internal/permissions"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	cCasbinPolicies = "casbin-policies"
+	cOwner          = "owner"
+	cPolicyFile     = "file"
+	cImportMode     = "mode"
+)
+
+func getPermissionsCommand() *cli.Command {
+	ownerFlag := &cli.StringFlag{
+		Name:     cOwner,
+		Usage:    "The DID of the user whose permissions to operate on",
+		Required: true,
+	}
+	return &cli.Command{
+		Name:  "permissions",
+		Usage: "Manage the permissions stored in the backing database",
+		Commands: []*cli.Command{
+			{
+				Name:  "migrate-casbin",
+				Usage: "Copy the policies from a casbin policy CSV into the permissions store",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:      cCasbinPolicies,
+						Usage:     "The path to the casbin policies CSV to migrate",
+						Required:  true,
+						TakesFile: true,
+					},
+				},
+				Action: runMigrateCasbin,
+			},
+			{
+				Name:  "export",
+				Usage: "Write every permission rule of a user to a policy document",
+				Flags: []cli.Flag{
+					ownerFlag,
+					&cli.StringFlag{
+						Name:      cPolicyFile,
+						Usage:     "The path to write the policy document to; defaults to stdout",
+						TakesFile: true,
+					},
+				},
+				Action: runExportPermissions,
+			},
+			{
+				Name:  "import",
+				Usage: "Apply a policy document to the permissions of a user",
+				Flags: []cli.Flag{
+					ownerFlag,
+					&cli.StringFlag{
+						Name:      cPolicyFile,
+						Usage:     "The path of the policy document to import",
+						Required:  true,
+						TakesFile: true,
+					},
+					&cli.StringFlag{
+						Name:  cImportMode,
+						Usage: "Either merge, to keep existing rules, or replace, to remove them first",
+						Value: string(permissions.ImportMerge),
+					},
+				},
+				Action: runImportPermissions,
+			},
+		},
+	}
+}
+
+func runMigrateCasbin(_ context.Context, cmd *cli.Command) error {
+	store, err := permissions.NewSQLiteStore(setupDB(cmd))
+	if err != nil {
+		return err
+	}
+	n, err := permissions.MigrateCasbinPolicies(
+		fileadapter.NewAdapter(cmd.String(cCasbinPolicies)),
+		store,
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d permission rules\n", n)
+	return nil
+}
+
+func runExportPermissions(_ context.Context, cmd *cli.Command) error {
+	store, err := permissions.NewSQLiteStore(setupDB(cmd))
+	if err != nil {
+		return err
+	}
+	doc, err := permissions.ExportPolicies(store, cmd.String(cOwner))
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := cmd.String(cPolicyFile)
+	if path == "" {
+		fmt.Println(string(bytes))
+		return nil
+	}
+	return os.WriteFile(path, bytes, 0o600)
+}
+
+func runImportPermissions(_ context.Context, cmd *cli.Command) error {
+	mode, err := permissions.ParseImportMode(cmd.String(cImportMode))
+	if err != nil {
+		return err
+	}
+	bytes, err := os.ReadFile(cmd.String(cPolicyFile))
+	if err != nil {
+		return err
+	}
+	doc := &permissions.PolicyDocument{}
+	err = json.Unmarshal(bytes, doc)
+	if err != nil {
+		return fmt.Errorf("parsing policy document: %w", err)
+	}
+
+	store, err := permissions.NewSQLiteStore(setupDB(cmd))
+	if err != nil {
+		return err
+	}
+	result, err := permissions.ImportPolicies(store, cmd.String(cOwner), doc, mode)
+	for _, conflict := range result.Conflicts {
+		fmt.Printf(
+			"Conflict for %s on %s: %s and %s\n",
+			conflict.Grantee,
+			conflict.Object,
+			conflict.Existing,
+			conflict.Imported,
+		)
+	}
+	if errors.Is(err, permissions.ErrConflictingPolicies) {
+		return fmt.Errorf("%w; nothing was imported", err)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d and imported %d permission rules\n", result.Removed, result.Added)
+	return nil
+}
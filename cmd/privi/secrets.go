@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eagraf/habitat-new/internal/oauthserver"
+	"github.com/urfave/cli/v3"
+)
+
+const cGracePeriod = "grace"
+
+func getSecretsCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "secrets",
+		Usage: "Manage the secrets tokens and cookies are signed with",
+		Commands: []*cli.Command{
+			{
+				Name:  "rotate",
+				Usage: "Replace the current secret, keeping the old one valid for a grace period. Takes effect on restart",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  cGracePeriod,
+						Usage: "How long tokens and cookies signed with the old secret stay valid",
+						Value: 30 * 24 * time.Hour,
+					},
+				},
+				Action: runRotateSecrets,
+			},
+		},
+	}
+}
+
+func runRotateSecrets(_ context.Context, cmd *cli.Command) error {
+	path := secretsFilePath(cmd)
+	secrets, err := oauthserver.RotateSecrets(path, cmd.Duration(cGracePeriod))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rotated the secret in %s; %d previous secrets are still valid\n", path, len(secrets.Previous))
+	return nil
+}
@@ -9,7 +9,7 @@ export default (domain: string) =>
          `https://${domain}/oauth-login`,
          `https://${domain}/#/oauth-login`,
       ],
-      scope: "atproto transition:generic",
+      scope: "atproto transition:generic repo:* blob:*/*",
       grant_types: ["authorization_code", "refresh_token"],
       response_types: ["code"],
       token_endpoint_auth_method: "none",
@@ -4,12 +4,16 @@ import * as client from "openid-client";
 const handleLocalStorageKey = "handle";
 const tokenLocalStorageKey = "token";
 const stateLocalStorageKey = "state";
+const dpopKeyLocalStorageKey = "dpopKey";
+
+const dpopKeyAlgorithm = { name: "ECDSA", namedCurve: "P-256" };
 
 export class AuthManager {
   handle: string | null;
   private serverDomain: string;
   private accessToken: string | null;
   private config: client.Configuration;
+  private dpop: Promise<client.DPoPHandle> | null = null;
   private onUnauthenticated: () => void;
 
   constructor(serverDomain: string, onUnauthenticated: () => void) {
@@ -41,6 +45,7 @@ export class AuthManager {
     return client.buildAuthorizationUrl(this.config, {
       redirect_uri: redirectUri,
       response_type: "code",
+      scope: "repo:* blob:*/*",
       handle,
       state,
     });
@@ -59,6 +64,8 @@ export class AuthManager {
       {
         expectedState: state,
       },
+      undefined,
+      { DPoP: await this.dpopHandle() },
     );
     this.accessToken = token.access_token;
     localStorage.setItem(tokenLocalStorageKey, token.access_token);
@@ -86,7 +93,7 @@ export class AuthManager {
       method,
       body,
       headers,
-      options,
+      { ...options, DPoP: await this.dpopHandle() },
     );
 
     if (response.status === 401) {
@@ -96,14 +103,57 @@ export class AuthManager {
     return response;
   }
 
+  // Habitat tokens are bound to this key pair, so it is kept for as long as the token is.
+  private dpopHandle() {
+    if (!this.dpop) {
+      this.dpop = loadDPoPKeyPair().then((keyPair) =>
+        client.getDPoPHandle(this.config, keyPair),
+      );
+    }
+    return this.dpop;
+  }
+
   private handleUnauthenticated() {
     this.handle = null;
     this.accessToken = null;
+    this.dpop = null;
     localStorage.removeItem(handleLocalStorageKey);
     localStorage.removeItem(tokenLocalStorageKey);
+    localStorage.removeItem(dpopKeyLocalStorageKey);
     this.onUnauthenticated();
     throw new UnauthenticatedError();
   }
 }
 
+async function loadDPoPKeyPair(): Promise<CryptoKeyPair> {
+  const stored = localStorage.getItem(dpopKeyLocalStorageKey);
+  if (stored) {
+    const privateKey = JSON.parse(stored) as JsonWebKey;
+    const { kty, crv, x, y } = privateKey;
+    return {
+      privateKey: await crypto.subtle.importKey(
+        "jwk",
+        privateKey,
+        dpopKeyAlgorithm,
+        false,
+        ["sign"],
+      ),
+      publicKey: await crypto.subtle.importKey(
+        "jwk",
+        { kty, crv, x, y },
+        dpopKeyAlgorithm,
+        true,
+        ["verify"],
+      ),
+    };
+  }
+  const keyPair = await crypto.subtle.generateKey(dpopKeyAlgorithm, true, [
+    "sign",
+    "verify",
+  ]);
+  const privateKey = await crypto.subtle.exportKey("jwk", keyPair.privateKey);
+  localStorage.setItem(dpopKeyLocalStorageKey, JSON.stringify(privateKey));
+  return keyPair;
+}
+
 export class UnauthenticatedError extends Error { }
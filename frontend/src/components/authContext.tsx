@@ -125,7 +125,14 @@ export const AuthProvider: React.FC<{ children: ReactNode }> = ({ children }) =>
         }
     };
 
-    const logout = () => {
+    const logout = async () => {
+        // Clear the node's session and revoke its PDS refresh token
+        try {
+            await fetch(`${window.location.origin}/habitat/api/logout`, { method: 'POST' });
+        } catch (err) {
+            console.error('Failed to end node session', err);
+        }
+
         Cookies.remove('access_token');
         Cookies.remove('refresh_token');
         Cookies.remove('chrome_extension_user_id');
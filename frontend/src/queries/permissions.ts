@@ -1,6 +1,15 @@
 import type { AuthManager } from "@/auth";
 import { queryOptions } from "@tanstack/react-query";
 
+export interface Permission {
+  grantee: string;
+  object: string;
+  effect: "allow" | "deny";
+  notBefore?: string;
+  expiresAt?: string;
+  expired: boolean;
+}
+
 export function listPermissions(authManager: AuthManager) {
   return queryOptions({
     queryKey: ["permissions"],
@@ -8,8 +17,15 @@ export function listPermissions(authManager: AuthManager) {
       const response = await authManager?.fetch(
         `/xrpc/com.habitat.listPermissions`,
       );
-      const json: Record<string, string[]> = await response?.json();
-      return json;
+      const json: { permissions: Permission[] } = await response?.json();
+      // Group the grantees allowed to read each lexicon or record
+      const byObject: Record<string, string[]> = {};
+      for (const { grantee, object, effect, expired } of json.permissions) {
+        if (effect === "allow" && !expired) {
+          byObject[object] = [...(byObject[object] ?? []), grantee];
+        }
+      }
+      return byObject;
     },
   });
 }
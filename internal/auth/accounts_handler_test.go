@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountsAndSwitchAccountHandlers(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+	accounts := &accountsHandler{sessionStore: store}
+	switchAccount := &switchAccountHandler{sessionStore: store}
+
+	listAccounts := func(r *http.Request) []Account {
+		w := httptest.NewRecorder()
+		accounts.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		var list []Account
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		return list
+	}
+
+	// No accounts are listed before logging in
+	require.Empty(t, listAccounts(httptest.NewRequest(http.MethodGet, "/accounts", nil)))
+
+	req := httptest.NewRequest(http.MethodGet, "/auth-callback", nil)
+	w := httptest.NewRecorder()
+	testLogin(t, req, store, testIdentity("https://personal.pds.com"), "https://personal.pds.com")
+	project := testLogin(t, req, store, &identity.Identity{
+		DID:    "did:plc:project",
+		Handle: "project.bsky.app",
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {URL: "https://project.pds.com"},
+		},
+	}, "https://project.pds.com")
+	project.Save(req, w)
+
+	require.Equal(t, []Account{
+		{DID: "did:plc:test123", Handle: "test.bsky.app", PDSURL: "https://personal.pds.com"},
+		{DID: "did:plc:project", Handle: "project.bsky.app", PDSURL: "https://project.pds.com", Active: true},
+	}, listAccounts(requestWithCookies(w)))
+
+	switchTo := func(did string) *httptest.ResponseRecorder {
+		form := url.Values{"did": {did}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/switch-account", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range w.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+		switchW := httptest.NewRecorder()
+		switchAccount.ServeHTTP(switchW, r)
+		return switchW
+	}
+
+	switchW := switchTo("did:plc:test123")
+	require.Equal(t, http.StatusSeeOther, switchW.Code)
+	cookies := map[string]string{}
+	for _, cookie := range switchW.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	require.Equal(t, "did:plc:test123", cookies["did"])
+	require.Equal(t, "test.bsky.app", cookies["handle"])
+	require.Equal(t, "https://personal.pds.com", cookies["pds_url"])
+
+	list := listAccounts(requestWithCookies(w))
+	require.True(t, list[0].Active)
+	require.False(t, list[1].Active)
+
+	// Only logged in accounts can be switched to
+	require.Equal(t, http.StatusBadRequest, switchTo("did:plc:other").Code)
+	require.Equal(t, http.StatusBadRequest, switchTo("").Code)
+}
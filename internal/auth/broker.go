@@ -1,7 +1,6 @@
 package auth
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -10,21 +9,49 @@ import (
 	"path"
 	"strings"
 
+	"github.com/eagraf/habitat-new/internal/utils"
 	"github.com/eagraf/habitat-new/util"
 	"github.com/gorilla/sessions"
-	"github.com/rs/zerolog/log"
 )
 
+const (
+	// AccountHeader selects which of the session's accounts a request is made as, by DID. Requests
+	// without it, or the equivalent query parameter, are made as the active account.
+	AccountHeader     = "Habitat-Account"
+	accountQueryParam = "habitatAccount"
+)
+
+// requestedAccount returns the DID of the account a request selects, or an empty string if it
+// doesn't select one.
+func requestedAccount(r *http.Request) string {
+	did := r.Header.Get(AccountHeader)
+	if did == "" {
+		did = r.URL.Query().Get(accountQueryParam)
+	}
+	return did
+}
+
 type xrpcBrokerHandler struct {
 	htuURL       string
-	oauthClient  OAuthClient
+	tokens       *TokenManager
 	sessionStore sessions.Store
 }
 
+// sessionUpdater is implemented by session stores that can modify a session outside of a
+// request, which lets tokens refreshed in the background be persisted straight away.
+type sessionUpdater interface {
+	Update(name, id string, fn func(*sessions.Session) error) error
+}
+
 func (h *xrpcBrokerHandler) Method() string {
 	return http.MethodPost
 }
 
+// Methods implements api.MultiMethodRoute, as XRPC queries are GETs and procedures are POSTs.
+func (h *xrpcBrokerHandler) Methods() []string {
+	return []string{http.MethodGet, http.MethodPost}
+}
+
 func (h *xrpcBrokerHandler) Pattern() string {
 	return "/xrpc/{rest...}"
 }
@@ -33,74 +60,100 @@ func (h *xrpcBrokerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Note: this is effectively acting as a reverse proxy in front of the XRPC endpoint.
 	// Using the main Habitat reverse proxy isn't sufficient because of the additional
 	// roundtrips DPoP requires.
-	dpopSession, err := getCookieSession(r, h.sessionStore)
+	dpopSession, err := getAccountSession(r, h.sessionStore, requestedAccount(r))
+	if errors.Is(err, errNotLoggedIn) {
+		utils.LogAndHTTPError(w, err, "getting session", http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, errUnknownAccount) {
+		utils.LogAndHTTPError(w, err, "getting requested account", http.StatusForbidden)
+		return
+	} else if err != nil {
+		utils.LogAndHTTPError(w, err, "getting session", http.StatusInternalServerError)
+		return
+	}
+
+	sessionID, err := h.trackSession(dpopSession)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		utils.LogAndHTTPError(w, err, "tracking session", http.StatusInternalServerError)
 		return
 	}
 
-	pdsDpopClient, err := h.getForwardingDpopClient(r, dpopSession)
+	// Tokens that are about to expire are refreshed before forwarding the request
+	tokenInfo, err := h.tokens.TokenInfo(sessionID)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "getting token", http.StatusUnauthorized)
+		return
+	}
+	err = syncTokenInfo(r, w, dpopSession, tokenInfo)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		utils.LogAndHTTPError(w, err, "saving token", http.StatusInternalServerError)
 		return
 	}
 
-	forwardReq, err := h.getForwardReq(r, dpopSession)
+	pdsDpopClient, err := h.getForwardingDpopClient(r, dpopSession, sessionID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		utils.LogAndHTTPError(w, err, "creating dpop client", http.StatusInternalServerError)
 		return
 	}
 
-	// Copy the request body without consuming it
-	bodyCopy, err := io.ReadAll(forwardReq.Body)
+	// The body is streamed to the PDS, but may need to be resent after a DPoP nonce error or a
+	// token refresh.
+	var body *replayableBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = newReplayableBody(r.Body)
+		defer func() { _ = body.Close() }()
+	}
+
+	forwardReq, err := h.getForwardReq(r, dpopSession, body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		utils.LogAndHTTPError(w, err, "building forwarded request", http.StatusInternalServerError)
 		return
 	}
-	forwardReq.Body = io.NopCloser(bytes.NewBuffer(bodyCopy))
 
 	// Forward the request to the PDS
 	resp, err := pdsDpopClient.Do(forwardReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		utils.LogAndHTTPError(w, err, "forwarding request", http.StatusInternalServerError)
 		return
 	}
 
-	// Check if we need to refresh the token
-	if resp.StatusCode == http.StatusUnauthorized {
+	// The PDS can still reject a token we thought was valid, e.g. if it was revoked. Bodies too
+	// large to resend are not retried, and the PDS's response is passed on.
+	if resp.StatusCode == http.StatusUnauthorized && (body == nil || body.replayable()) {
 		util.Close(resp.Body) // Close first response before retry
 
-		err = h.refreshSession(dpopSession)
+		tokenInfo, err = h.tokens.Refresh(sessionID, tokenInfo.AccessToken)
+		if err != nil {
+			utils.LogAndHTTPError(w, err, "refreshing token", http.StatusUnauthorized)
+			return
+		}
+		err = syncTokenInfo(r, w, dpopSession, tokenInfo)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			utils.LogAndHTTPError(w, err, "saving refreshed token", http.StatusInternalServerError)
 			return
 		}
-		dpopSession.Save(r, w)
 
-		forwardReq, err = h.getForwardReq(r, dpopSession)
+		forwardReq, err = h.getForwardReq(r, dpopSession, body)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			utils.LogAndHTTPError(w, err, "building forwarded request", http.StatusInternalServerError)
 			return
 		}
-		forwardReq.Body = io.NopCloser(bytes.NewBuffer(bodyCopy))
 
-		refreshedDpopClient, err := h.getForwardingDpopClient(r, dpopSession)
+		refreshedDpopClient, err := h.getForwardingDpopClient(r, dpopSession, sessionID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			closeRequestBody(forwardReq)
+			utils.LogAndHTTPError(w, err, "creating dpop client", http.StatusInternalServerError)
 			return
 		}
 
 		// Retry the request with the new token
 		resp, err = refreshedDpopClient.Do(forwardReq)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			utils.LogAndHTTPError(w, err, "forwarding request", http.StatusInternalServerError)
 			return
 		}
-		defer func() { _ = resp.Body.Close() }()
-		dpopSession.Save(r, w)
-	} else {
-		defer func() { _ = resp.Body.Close() }()
 	}
+	defer func() { _ = resp.Body.Close() }()
 
 	// Writing out the response as we got it.
 
@@ -120,13 +173,13 @@ func (h *xrpcBrokerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getForwardReq builds the request to send to the PDS. Each call returns a request with a fresh
+// reader over body, which may be nil for requests without one.
 func (h *xrpcBrokerHandler) getForwardReq(
 	r *http.Request,
 	dpopSession *cookieSession,
+	body *replayableBody,
 ) (*http.Request, error) {
-	// Clone the initial request. Note this only makes a shallow copy of the body
-	// newReq := r.Clone(r.Context())
-
 	// Get PDS URL from session
 	pdsURL, ok, err := dpopSession.GetPDSURL()
 	if !ok || err != nil {
@@ -145,21 +198,27 @@ func (h *xrpcBrokerHandler) getForwardReq(
 		Path:     r.URL.Path,
 		RawQuery: r.URL.RawQuery,
 	}
+	// The account selector is meant for the node, not the PDS
+	query := r.URL.Query()
+	if query.Has(accountQueryParam) {
+		query.Del(accountQueryParam)
+		newURL.RawQuery = query.Encode()
+	}
 
-	bodyCopy, err := io.ReadAll(r.Body)
+	newReq, err := http.NewRequestWithContext(r.Context(), r.Method, newURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyCopy))
-
-	newReq := &http.Request{
-		Method: r.Method,
-		URL:    newURL,
-		Header: make(http.Header),
-		Body:   io.NopCloser(bytes.NewBuffer(bodyCopy)),
+	if body != nil {
+		newReq.Body, err = body.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		newReq.GetBody = body.GetBody
+		newReq.ContentLength = r.ContentLength
 	}
 	for k, v := range r.Header {
-		if k == "Authorization" || k == "Content-Length" {
+		if k == "Authorization" || k == "Content-Length" || k == AccountHeader {
 			continue
 		}
 		for _, vv := range v {
@@ -170,25 +229,85 @@ func (h *xrpcBrokerHandler) getForwardReq(
 	return newReq, nil
 }
 
-func (h *xrpcBrokerHandler) getForwardingDpopClient(
-	originalRequest *http.Request,
-	dpopSession *cookieSession,
-) (*DpopHttpClient, error) {
-	// Get the key from the session
+// trackSession makes sure the token manager is tracking the session, returning its ID.
+func (h *xrpcBrokerHandler) trackSession(dpopSession *cookieSession) (string, error) {
 	key, ok, err := dpopSession.GetDpopKey()
 	if !ok || err != nil {
-		return nil, errors.New("no key in session")
+		return "", errors.New("no key in session")
+	}
+	sessionID, err := SessionID(key)
+	if err != nil {
+		return "", err
 	}
 
-	tokenInfo, ok, err := dpopSession.GetTokenInfo()
-	if !ok || err != nil {
-		return nil, fmt.Errorf("no token info in session: %w", err)
+	err = h.tokens.Track(sessionID, func() (*TokenSession, error) {
+		identity, ok, err := dpopSession.GetIdentity()
+		if !ok || err != nil {
+			return nil, errors.New("no identity in session")
+		}
+		issuer, ok, err := dpopSession.GetIssuer()
+		if !ok || err != nil {
+			return nil, errors.New("no issuer in session")
+		}
+		tokenInfo, ok, err := dpopSession.GetTokenInfo()
+		if !ok || err != nil {
+			return nil, fmt.Errorf("no token info in session: %w", err)
+		}
+
+		session := &TokenSession{
+			DpopKey:   key,
+			Identity:  identity,
+			Issuer:    issuer,
+			TokenInfo: tokenInfo,
+		}
+		updater, ok := h.sessionStore.(sessionUpdater)
+		if ok && dpopSession.session.ID != "" {
+			storeID := dpopSession.session.ID
+			account := dpopSession.account
+			session.Persist = func(tokenInfo *TokenResponse) error {
+				return updater.Update(SessionKeyDpop, storeID, func(s *sessions.Session) error {
+					return (&cookieSession{session: s, account: account}).SetTokenInfo(tokenInfo)
+				})
+			}
+		}
+		return session, nil
+	})
+	if err != nil {
+		return "", err
 	}
-	accessToken := tokenInfo.AccessToken
+	return sessionID, nil
+}
 
-	opts := []DpopOption{
-		WithAccessToken(accessToken),
+// syncTokenInfo saves the token manager's tokens to the session if they were refreshed since it
+// was last saved, so that the request doesn't write stale tokens back.
+func syncTokenInfo(
+	r *http.Request,
+	w http.ResponseWriter,
+	dpopSession *cookieSession,
+	tokenInfo *TokenResponse,
+) error {
+	current, ok, err := dpopSession.GetTokenInfo()
+	if err != nil {
+		return err
+	} else if ok &&
+		current.AccessToken == tokenInfo.AccessToken &&
+		current.RefreshToken == tokenInfo.RefreshToken {
+		return nil
 	}
+	err = dpopSession.SetTokenInfo(tokenInfo)
+	if err != nil {
+		return err
+	}
+	dpopSession.Save(r, w)
+	return nil
+}
+
+func (h *xrpcBrokerHandler) getForwardingDpopClient(
+	originalRequest *http.Request,
+	dpopSession *cookieSession,
+	sessionID string,
+) (*DpopHttpClient, error) {
+	opts := []DpopOption{}
 	pdsURL, ok, err := dpopSession.GetPDSURL()
 	if !ok || err != nil {
 		return nil, errors.New("no pds url found in session")
@@ -202,45 +321,5 @@ func (h *xrpcBrokerHandler) getForwardingDpopClient(
 		opts = append(opts, WithHTU(htu))
 	}
 
-	return NewDpopHttpClient(key, dpopSession, opts...), nil
-}
-
-func (h *xrpcBrokerHandler) refreshSession(dpopSession *cookieSession) error {
-	key, ok, err := dpopSession.GetDpopKey()
-	if !ok || err != nil {
-		return errors.New("no key in session")
-	}
-
-	authDpopClient := NewDpopHttpClient(key, dpopSession)
-	identity, ok, err := dpopSession.GetIdentity()
-	if !ok || err != nil {
-		return errors.New("no identity in session")
-	}
-
-	issuer, ok, err := dpopSession.GetIssuer()
-	if !ok || err != nil {
-		return errors.New("no issuer in session")
-	}
-
-	tokenInfo, ok, err := dpopSession.GetTokenInfo()
-	if !ok || err != nil {
-		return errors.New("no token info in session")
-	}
-
-	tokenResp, err := h.oauthClient.RefreshToken(
-		authDpopClient,
-		identity,
-		issuer,
-		tokenInfo.RefreshToken,
-	)
-	if err != nil {
-		return err
-	}
-	log.Info().Msgf("refreshed session: %+v", tokenResp)
-	err = dpopSession.SetTokenInfo(tokenResp)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return h.tokens.Client(sessionID, opts...)
 }
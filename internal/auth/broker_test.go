@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/gorilla/sessions"
@@ -22,7 +23,7 @@ func setupTestXrpcBrokerHandler(t *testing.T, oauthClient OAuthClient, htuURL st
 	sessionStore := sessions.NewCookieStore([]byte("test-key"))
 	return &xrpcBrokerHandler{
 		htuURL:       htuURL,
-		oauthClient:  oauthClient,
+		tokens:       NewTokenManager(oauthClient, time.Minute),
 		sessionStore: sessionStore,
 	}
 }
@@ -31,7 +32,7 @@ func setupTestXrpcBrokerHandler(t *testing.T, oauthClient OAuthClient, htuURL st
 func setupTestXrpcBrokerHandlerWithSessionStore(t *testing.T, oauthClient OAuthClient, htuURL string, sessionStore sessions.Store) *xrpcBrokerHandler {
 	return &xrpcBrokerHandler{
 		htuURL:       htuURL,
-		oauthClient:  oauthClient,
+		tokens:       NewTokenManager(oauthClient, time.Minute),
 		sessionStore: sessionStore,
 	}
 }
@@ -57,18 +58,20 @@ func setupTestRequestWithSession(t *testing.T, sessionStore sessions.Store, opts
 	session, err := sessionStore.New(sessionReq, "dpop-session")
 	require.NoError(t, err)
 
-	dpopSession := &cookieSession{session: session}
+	login := &cookieSession{session: session, account: pendingLogin}
 
-	err = dpopSession.SetDpopKey(key)
+	err = login.SetDpopKey(key)
 	require.NoError(t, err)
-	err = dpopSession.SetIdentity(identity)
+	err = login.SetIdentity(identity)
 	require.NoError(t, err)
-	err = dpopSession.SetPDSURL(opts.PdsURL)
+	err = login.SetPDSURL(opts.PdsURL)
+	require.NoError(t, err)
+	dpopSession, _, err := login.completeLogin()
 	require.NoError(t, err)
 
 	// Set issuer if provided
 	if opts.Issuer != nil {
-		dpopSession.session.Values[cIssuerSessionKey] = *opts.Issuer
+		dpopSession.session.Values[dpopSession.valueKey(cIssuerSessionKey)] = *opts.Issuer
 	}
 
 	// Set access token if provided
@@ -79,7 +82,7 @@ func setupTestRequestWithSession(t *testing.T, sessionStore sessions.Store, opts
 
 	// Remove identity if explicitly requested
 	if opts.RemoveIdentity {
-		delete(dpopSession.session.Values, cIdentitySessionKey)
+		delete(dpopSession.session.Values, dpopSession.valueKey(cIdentitySessionKey))
 	}
 
 	// Save the session only once at the end
@@ -128,7 +131,7 @@ func TestXrpcBrokerHandler_SuccessfulRequest(t *testing.T) {
 
 	handler := &xrpcBrokerHandler{
 		htuURL:       "https://test.com",
-		oauthClient:  oauthClient,
+		tokens:       NewTokenManager(oauthClient, time.Minute),
 		sessionStore: sessionStore,
 	}
 
@@ -165,7 +168,7 @@ func TestXrpcBrokerHandler_NoDPOPSession(t *testing.T) {
 
 	handler.ServeHTTP(w, req)
 
-	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
 func TestXrpcBrokerHandler_UnauthorizedResponse(t *testing.T) {
@@ -474,3 +477,161 @@ func TestXrpcBrokerHandler_RequestBodyCopying(t *testing.T) {
 	require.Equal(t, http.StatusOK, w.Code)
 	require.Equal(t, string(largeBody), w.Body.String())
 }
+
+func TestXrpcBrokerHandler_GetRequest(t *testing.T) {
+	mockPDS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/xrpc/com.atproto.repo.getRecord" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"rkey":"` + r.URL.Query().Get("rkey") + `"}`))
+			return
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer mockPDS.Close()
+
+	sessionStore := sessions.NewCookieStore([]byte("test-key"))
+	handler := setupTestXrpcBrokerHandlerWithSessionStore(t, testOAuthClient(t), "https://test.com", sessionStore)
+	require.ElementsMatch(t, []string{http.MethodGet, http.MethodPost}, handler.Methods())
+
+	req, w := setupTestRequestWithSession(t, sessionStore, DpopSessionOptions{
+		PdsURL:    mockPDS.URL,
+		Issuer:    stringPtr("https://example.com"),
+		TokenInfo: &TokenResponse{AccessToken: "test-access-token"},
+	})
+	req.Method = http.MethodGet
+	req.URL.RawQuery = "rkey=abc"
+
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"rkey":"abc"}`, w.Body.String())
+}
+
+func TestXrpcBrokerHandler_LargeBodyNonceRetry(t *testing.T) {
+	largeBody := bytes.Repeat([]byte("blob"), maxInMemoryBodySize)
+	attempts := 0
+	mockPDS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("DPoP") == "" {
+			http.Error(w, "missing dpop proof", http.StatusBadRequest)
+			return
+		}
+		if attempts == 1 {
+			// Reject the request before reading the body, as a PDS does for a stale nonce
+			w.Header().Set("DPoP-Nonce", "fresh-nonce")
+			w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !bytes.Equal(largeBody, body) {
+			http.Error(w, "body mismatch", http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"size":%d}`, len(body))
+	}))
+	defer mockPDS.Close()
+
+	sessionStore := sessions.NewCookieStore([]byte("test-key"))
+	handler := setupTestXrpcBrokerHandlerWithSessionStore(t, testOAuthClient(t), "https://test.com", sessionStore)
+	req, w := setupTestRequestWithSession(t, sessionStore, DpopSessionOptions{
+		PdsURL:    mockPDS.URL,
+		Issuer:    stringPtr("https://example.com"),
+		TokenInfo: &TokenResponse{AccessToken: "test-access-token"},
+	})
+	req.URL.Path = "/xrpc/com.atproto.repo.uploadBlob"
+	req.Body = io.NopCloser(bytes.NewReader(largeBody))
+	req.ContentLength = int64(len(largeBody))
+
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, fmt.Sprintf(`{"size":%d}`, len(largeBody)), w.Body.String())
+	require.Equal(t, 2, attempts)
+}
+
+func TestXrpcBrokerHandler_SelectsAccount(t *testing.T) {
+	// Each account's PDS reports which token it was called with, and what it was sent
+	newPDS := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"authorization": r.Header.Get("Authorization"),
+				"account":       r.Header.Get(AccountHeader),
+				"query":         r.URL.RawQuery,
+			})
+		}))
+	}
+	personalPDS := newPDS()
+	defer personalPDS.Close()
+	projectPDS := newPDS()
+	defer projectPDS.Close()
+
+	sessionStore := sessions.NewCookieStore([]byte("test-key"))
+	handler := setupTestXrpcBrokerHandlerWithSessionStore(t, testOAuthClient(t), "https://test.com", sessionStore)
+
+	sessionReq := httptest.NewRequest("GET", "/test", nil)
+	personal := testIdentity(personalPDS.URL)
+	project := &identity.Identity{
+		DID:    "did:plc:project",
+		Handle: "project.bsky.app",
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {URL: projectPDS.URL},
+		},
+	}
+	for _, account := range []struct {
+		id     *identity.Identity
+		pdsURL string
+		token  string
+	}{
+		{personal, personalPDS.URL, "personal-token"},
+		{project, projectPDS.URL, "project-token"},
+	} {
+		dpopSession := testLogin(t, sessionReq, sessionStore, account.id, account.pdsURL)
+		require.NoError(t, dpopSession.SetIssuer("https://example.com"))
+		require.NoError(t, dpopSession.SetTokenInfo(&TokenResponse{AccessToken: account.token}))
+	}
+	sessionW := httptest.NewRecorder()
+	require.NoError(t, sessions.Save(sessionReq, sessionW))
+
+	forward := func(header, query string) (int, map[string]string) {
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.repo.getRecord?"+query, nil)
+		for _, cookie := range sessionW.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		if header != "" {
+			req.Header.Set(AccountHeader, header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var resp map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	// The most recent login is used by default
+	code, resp := forward("", "rkey=abc")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "DPoP project-token", resp["authorization"])
+	require.Equal(t, "rkey=abc", resp["query"])
+
+	// Other accounts are selected by header or query parameter, which aren't forwarded
+	code, resp = forward(personal.DID.String(), "rkey=abc")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "DPoP personal-token", resp["authorization"])
+	require.Empty(t, resp["account"])
+
+	code, resp = forward("", "rkey=abc&habitatAccount="+personal.DID.String())
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "DPoP personal-token", resp["authorization"])
+	require.Equal(t, "rkey=abc", resp["query"])
+
+	// Accounts that aren't logged in can't be used
+	code, _ = forward("did:plc:other", "")
+	require.Equal(t, http.StatusForbidden, code)
+}
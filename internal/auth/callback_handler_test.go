@@ -102,6 +102,49 @@ func TestCallbackHandler_SuccessfulCallback(t *testing.T) {
 	require.NotEmpty(t, cookieMap["did"])
 }
 
+func TestCallbackHandler_RegeneratesSessionID(t *testing.T) {
+	fakeOAuthServer := fakeAuthServer(t, map[string]interface{}{
+		"token": TokenResponse{AccessToken: "test-access-token", TokenType: "DPoP", ExpiresIn: 3600},
+	})
+	defer fakeOAuthServer.Close()
+
+	sessionStore := testSQLiteSessionStore(t)
+	handler := setupTestCallbackHandler(t, testOAuthClient(t), sessionStore)
+
+	req := httptest.NewRequest("GET", "/auth-callback", nil)
+	w := httptest.NewRecorder()
+	authSession, err := sessionStore.New(req, SessionKeyAuth)
+	require.NoError(t, err)
+	stateJson, err := json.Marshal(&AuthorizeState{
+		Verifier:      "test-verifier",
+		State:         "test-state",
+		TokenEndpoint: fakeOAuthServer.URL + "/token",
+	})
+	require.NoError(t, err)
+	authSession.AddFlash(stateJson)
+	require.NoError(t, authSession.Save(req, w))
+	dpopSession, err := newCookieSession(req, sessionStore, testIdentity(fakeOAuthServer.URL), fakeOAuthServer.URL)
+	require.NoError(t, err)
+	dpopSession.Save(req, w)
+
+	// The ID the session had before login, e.g. one planted by an attacker
+	before := requestWithCookies(w)
+	before.URL.RawQuery = "code=test-code&iss=https://example.com"
+	plantedID := dpopSession.session.ID
+
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, before)
+	require.Equal(t, http.StatusSeeOther, w2.Code)
+
+	// The session is only reachable through the newly issued cookie
+	after := requestWithCookies(w2)
+	account, err := getCookieSession(after, sessionStore)
+	require.NoError(t, err)
+	require.NotEqual(t, plantedID, account.session.ID)
+	_, err = getCookieSession(requestWithCookies(w), sessionStore)
+	require.ErrorIs(t, err, errNotLoggedIn)
+}
+
 // parseSetCookieHeader parses a Set-Cookie header and returns individual cookies
 func parseSetCookieHeader(setCookieHeader string) []*http.Cookie {
 	var cookies []*http.Cookie
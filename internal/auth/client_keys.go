@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// ClientKeys are the private keys the node authenticates to PDSes with as a confidential atproto
+// OAuth client. The current key signs client assertions, while retired keys are still published
+// until they expire, so PDSes that cached the node's JWKS keep accepting its assertions during a
+// rollover.
+type ClientKeys struct {
+	Current jose.JSONWebKey
+	Retired []jose.JSONWebKey
+}
+
+// clientKeysFile is the on-disk format of ClientKeys.
+type clientKeysFile struct {
+	Current jose.JSONWebKey    `json:"current"`
+	Retired []retiredClientKey `json:"retired,omitempty"`
+}
+
+// retiredClientKey is a previous client key, published until it expires.
+type retiredClientKey struct {
+	Key       jose.JSONWebKey `json:"key"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+}
+
+// LoadOrCreateClientKeys reads the client keys file at path, generating and persisting a new key
+// if the file does not exist. Retired keys that have expired are left out.
+func LoadOrCreateClientKeys(path string) (*ClientKeys, error) {
+	file, err := readClientKeysFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		file = &clientKeysFile{}
+		file.Current, err = generateClientKey()
+		if err != nil {
+			return nil, err
+		}
+		err = writeClientKeysFile(path, file)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return file.keys(time.Now()), nil
+}
+
+// RotateClientKeys replaces the current key in the file at path with a new one. The replaced key
+// stays published for the given grace period, and retired keys that have expired are removed.
+// The node picks up the new keys when it is restarted.
+func RotateClientKeys(path string, grace time.Duration) (*ClientKeys, error) {
+	file, err := readClientKeysFile(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rotated := &clientKeysFile{
+		Retired: []retiredClientKey{{Key: file.Current, ExpiresAt: now.Add(grace).UTC()}},
+	}
+	for _, retired := range file.Retired {
+		if retired.ExpiresAt.After(now) {
+			rotated.Retired = append(rotated.Retired, retired)
+		}
+	}
+	rotated.Current, err = generateClientKey()
+	if err != nil {
+		return nil, err
+	}
+	err = writeClientKeysFile(path, rotated)
+	if err != nil {
+		return nil, err
+	}
+	return rotated.keys(now), nil
+}
+
+// PublicJWKS returns the public keys PDSes verify the node's client assertions with, the current
+// key first.
+func (k *ClientKeys) PublicJWKS() *jose.JSONWebKeySet {
+	jwks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k.Current.Public()}}
+	for _, retired := range k.Retired {
+		jwks.Keys = append(jwks.Keys, retired.Public())
+	}
+	return jwks
+}
+
+func (f *clientKeysFile) keys(now time.Time) *ClientKeys {
+	keys := &ClientKeys{Current: f.Current}
+	for _, retired := range f.Retired {
+		if retired.ExpiresAt.After(now) {
+			keys.Retired = append(keys.Retired, retired.Key)
+		}
+	}
+	return keys
+}
+
+// generateClientKey generates a new ES256 signing key, identified by its thumbprint.
+func generateClientKey() (jose.JSONWebKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("generating client key: %w", err)
+	}
+	jwk := jose.JSONWebKey{
+		Key:       key,
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return jwk, nil
+}
+
+func readClientKeysFile(path string) (*clientKeysFile, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &clientKeysFile{}
+	err = json.Unmarshal(bytes, file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing client keys at %s: %w", path, err)
+	}
+	if _, ok := file.Current.Key.(*ecdsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("current client key at %s must be an ECDSA private key", path)
+	}
+	return file, nil
+}
+
+func writeClientKeysFile(path string, file *clientKeysFile) error {
+	bytes, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a failed write can't lose the current key
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, bytes, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
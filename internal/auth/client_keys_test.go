@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateClientKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets", "client_keys.json")
+
+	keys, err := LoadOrCreateClientKeys(path)
+	require.NoError(t, err)
+	require.False(t, keys.Current.IsPublic())
+	require.NotEmpty(t, keys.Current.KeyID)
+	require.Empty(t, keys.Retired)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// The same key is loaded on the next start, and every node gets its own
+	loaded, err := LoadOrCreateClientKeys(path)
+	require.NoError(t, err)
+	require.Equal(t, keys.Current.KeyID, loaded.Current.KeyID)
+	other, err := LoadOrCreateClientKeys(filepath.Join(t.TempDir(), "client_keys.json"))
+	require.NoError(t, err)
+	require.NotEqual(t, keys.Current.KeyID, other.Current.KeyID)
+}
+
+func TestRotateClientKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_keys.json")
+	original, err := LoadOrCreateClientKeys(path)
+	require.NoError(t, err)
+
+	rotated, err := RotateClientKeys(path, time.Hour)
+	require.NoError(t, err)
+	require.NotEqual(t, original.Current.KeyID, rotated.Current.KeyID)
+	require.Len(t, rotated.Retired, 1)
+	require.Equal(t, original.Current.KeyID, rotated.Retired[0].KeyID)
+
+	// Both keys are published, the new one first, and without their private parts
+	jwks := rotated.PublicJWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, rotated.Current.KeyID, jwks.Keys[0].KeyID)
+	for _, key := range jwks.Keys {
+		require.True(t, key.IsPublic())
+	}
+
+	// Keys past their grace period are no longer published
+	_, err = RotateClientKeys(path, -time.Hour)
+	require.NoError(t, err)
+	loaded, err := LoadOrCreateClientKeys(path)
+	require.NoError(t, err)
+	require.Len(t, loaded.Retired, 1)
+	require.Equal(t, original.Current.KeyID, loaded.Retired[0].KeyID)
+}
+
+func TestClientKeysPublishedAtJwksURI(t *testing.T) {
+	keys, err := LoadOrCreateClientKeys(filepath.Join(t.TempDir(), "client_keys.json"))
+	require.NoError(t, err)
+	client := NewOAuthClientWithKeys(
+		"https://habitat.example.com/habitat/api/client-metadata.json",
+		"https://habitat.example.com",
+		"https://habitat.example.com/habitat/api/auth-callback",
+		"https://habitat.example.com/habitat/api/jwks.json",
+		keys,
+	)
+	metadata := client.ClientMetadata()
+	require.Equal(t, "https://habitat.example.com/habitat/api/jwks.json", metadata.JwksUri)
+	require.Nil(t, metadata.Jwks)
+
+	handler := &jwksHandler{jwks: keys.PublicJWKS()}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var jwks jose.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+
+	// Client assertions are signed with the published key
+	assertion, err := client.(*oauthClientImpl).getClientAssertion("https://pds.example.com")
+	require.NoError(t, err)
+	token, err := jwt.ParseSigned(assertion)
+	require.NoError(t, err)
+	require.Equal(t, keys.Current.KeyID, token.Headers[0].KeyID)
+	var claims jwt.Claims
+	require.NoError(t, token.Claims(jwks.Key(token.Headers[0].KeyID)[0].Key, &claims))
+	require.Equal(t, metadata.ClientId, claims.Issuer)
+}
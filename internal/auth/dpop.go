@@ -48,6 +48,9 @@ type DpopOptions struct {
 	// Access token to be used for PDS requests. If not provided, the access token
 	// hash will not be included in the DPoP token.
 	AccessToken string
+
+	// HTTP client used to send requests. If not provided, http.DefaultClient is used.
+	HTTPClient *http.Client
 }
 
 type DpopOption func(*DpopOptions)
@@ -64,6 +67,12 @@ func WithAccessToken(accessToken string) DpopOption {
 	}
 }
 
+func WithHTTPClient(client *http.Client) DpopOption {
+	return func(opts *DpopOptions) {
+		opts.HTTPClient = client
+	}
+}
+
 type DpopHttpClient struct {
 	key           *ecdsa.PrivateKey
 	nonceProvider DpopNonceProvider
@@ -84,24 +93,27 @@ func NewDpopHttpClient(
 	return &DpopHttpClient{key: key, nonceProvider: nonceProvider, opts: opts}
 }
 
+// Do sends the request with a DPoP proof, retrying once with a new nonce if the server asks for
+// one. If the request doesn't set GetBody, its body is streamed and recorded so it can be resent
+// without holding large bodies in memory. Bodies too large to record are sent once, and the
+// server's nonce error is returned as is.
 func (s *DpopHttpClient) Do(req *http.Request) (*http.Response, error) {
+	var body *replayableBody
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body = newReplayableBody(req.Body)
+		defer func() { _ = body.Close() }()
+		req.Body, _ = body.GetBody()
+		req.GetBody = body.GetBody
+	}
+
 	err := s.sign(req)
 	if err != nil {
+		closeRequestBody(req)
 		return nil, err
 	}
-	// Read out the body since we'll need it twice
-	bodyBytes := []byte{}
-	if req.Body != nil {
-		bodyBytes, err = io.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	req.Header.Set("Authorization", "DPoP "+s.opts.AccessToken)
 
-	req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +122,10 @@ func (s *DpopHttpClient) Do(req *http.Request) (*http.Response, error) {
 	if !isUseDPopNonceError(resp) {
 		return resp, nil
 	}
+	if body != nil && !body.replayable() {
+		return resp, nil
+	}
+	_ = resp.Body.Close()
 	if resp.Header.Get("DPoP-Nonce") != "" {
 		err := s.nonceProvider.SetDpopNonce(resp.Header.Get("DPoP-Nonce"))
 		if err != nil {
@@ -120,13 +136,33 @@ func (s *DpopHttpClient) Do(req *http.Request) (*http.Response, error) {
 	// retry with new nonce
 	req2 := req.Clone(req.Context())
 	req2.RequestURI = ""
-
-	req2.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	if req.GetBody != nil {
+		req2.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
 	err = s.sign(req2)
 	if err != nil {
+		closeRequestBody(req2)
 		return nil, err
 	}
-	return http.DefaultClient.Do(req2)
+	return s.httpClient().Do(req2)
+}
+
+func (s *DpopHttpClient) httpClient() *http.Client {
+	if s.opts.HTTPClient != nil {
+		return s.opts.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// closeRequestBody closes the body of a request that won't be sent. Sending a request closes its
+// body, which replayableBody relies on.
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
 }
 
 func (s *DpopHttpClient) sign(req *http.Request) error {
@@ -185,13 +221,13 @@ func (s *DpopHttpClient) generateClaims(req *http.Request) (*dpopClaims, error)
 	}
 
 	if s.opts.AccessToken != "" {
-		claims.AccessTokenHash = s.hashAccessToken(s.opts.AccessToken)
+		claims.AccessTokenHash = hashAccessToken(s.opts.AccessToken)
 	}
 
 	return claims, nil
 }
 
-func (s *DpopHttpClient) hashAccessToken(accessToken string) string {
+func hashAccessToken(accessToken string) string {
 	h := sha256.New()
 	h.Write([]byte(accessToken))
 	hash := h.Sum(nil)
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	// dpopNonceRotation is how often the nonce a verifier issues changes. Each nonce is accepted
+	// until the one after it has been issued too.
+	dpopNonceRotation = 5 * time.Minute
+	// dpopProofMaxAge is how long after it was issued a DPoP proof is accepted.
+	dpopProofMaxAge = 5 * time.Minute
+	// dpopProofMaxSkew is how far in the future a proof may claim to have been issued, to allow for
+	// clock differences between the client and the server.
+	dpopProofMaxSkew = time.Minute
+)
+
+var (
+	// ErrMissingDpopProof is returned when the request has no DPoP header.
+	ErrMissingDpopProof = errors.New("request has no DPoP proof")
+	// ErrInvalidDpopProof is wrapped by the errors returned for proofs that aren't valid for the
+	// request they were sent with.
+	ErrInvalidDpopProof = errors.New("invalid DPoP proof")
+	// ErrUseDpopNonce is returned for proofs that don't include a current nonce. The client should
+	// retry with the nonce the verifier issues.
+	ErrUseDpopNonce = errors.New("DPoP proof must include the current nonce")
+)
+
+// DpopProof is a verified DPoP proof, showing the request was made by the holder of a key.
+type DpopProof struct {
+	// Thumbprint is the JWK SHA-256 thumbprint of the key the proof was signed with, which tokens
+	// bound to the key carry as their cnf.jkt.
+	Thumbprint string
+	ID         string
+	IssuedAt   time.Time
+}
+
+// DpopVerifier verifies the DPoP proofs of requests made to a server, as described in RFC 9449.
+// It issues the nonces proofs must include and rejects proofs that have already been used.
+//
+// Nonces are derived from the current time with the verifier's keys, so they need no storage
+// and stay valid across restarts. Used proofs are only remembered in memory, for as long as they
+// would be accepted.
+type DpopVerifier struct {
+	// nonceKeys[0] derives the nonces issued, while those derived from any of them are accepted.
+	nonceKeys [][]byte
+	now       func() time.Time
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // When each used proof expires, by key thumbprint and jti
+	nextSweep time.Time
+}
+
+// NewDpopVerifier creates a verifier issuing nonces derived from the first of the given keys.
+func NewDpopVerifier(nonceKeys ...[]byte) *DpopVerifier {
+	return &DpopVerifier{
+		nonceKeys: nonceKeys,
+		now:       time.Now,
+		seen:      map[string]time.Time{},
+	}
+}
+
+// Nonce returns the nonce proofs must currently include, which servers send to clients in the
+// DPoP-Nonce header.
+func (v *DpopVerifier) Nonce() string {
+	return dpopNonce(v.nonceKeys[0], v.now().Unix()/int64(dpopNonceRotation.Seconds()))
+}
+
+func (v *DpopVerifier) validNonce(nonce string, now time.Time) bool {
+	window := now.Unix() / int64(dpopNonceRotation.Seconds())
+	for _, key := range v.nonceKeys {
+		for _, w := range []int64{window, window - 1} {
+			if hmac.Equal([]byte(nonce), []byte(dpopNonce(key, w))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func dpopNonce(key []byte, window int64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(window))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:])
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Verify checks the DPoP proof of the request, which must have been made to htu. If accessToken
+// is set, the proof must also be bound to it, as for requests to resource servers.
+func (v *DpopVerifier) Verify(
+	r *http.Request,
+	htu string,
+	accessToken string,
+) (*DpopProof, error) {
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) == 0 {
+		return nil, ErrMissingDpopProof
+	} else if len(proofs) > 1 {
+		return nil, fmt.Errorf("%w: request has more than one proof", ErrInvalidDpopProof)
+	}
+	token, err := jwt.ParseSigned(proofs[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDpopProof, err)
+	}
+	if len(token.Headers) != 1 {
+		return nil, fmt.Errorf("%w: proof must have a single signature", ErrInvalidDpopProof)
+	}
+	header := token.Headers[0]
+	if header.ExtraHeaders[jose.HeaderType] != "dpop+jwt" {
+		return nil, fmt.Errorf("%w: typ must be dpop+jwt", ErrInvalidDpopProof)
+	}
+	if header.Algorithm != string(jose.ES256) {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidDpopProof, header.Algorithm)
+	}
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.Valid() || !jwk.IsPublic() {
+		return nil, fmt.Errorf("%w: jwk must be a valid public key", ErrInvalidDpopProof)
+	}
+	var claims dpopClaims
+	err = token.Claims(jwk.Key, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDpopProof, err)
+	}
+
+	now := v.now()
+	switch {
+	case claims.ID == "":
+		return nil, fmt.Errorf("%w: missing jti", ErrInvalidDpopProof)
+	case claims.Method != r.Method:
+		return nil, fmt.Errorf("%w: htm %q doesn't match the request", ErrInvalidDpopProof, claims.Method)
+	case !sameHTU(claims.URL, htu):
+		return nil, fmt.Errorf("%w: htu %q doesn't match the request", ErrInvalidDpopProof, claims.URL)
+	case claims.IssuedAt == nil:
+		return nil, fmt.Errorf("%w: missing iat", ErrInvalidDpopProof)
+	case claims.IssuedAt.Time().Before(now.Add(-dpopProofMaxAge)),
+		claims.IssuedAt.Time().After(now.Add(dpopProofMaxSkew)):
+		return nil, fmt.Errorf("%w: proof is expired or issued in the future", ErrInvalidDpopProof)
+	case accessToken != "" && claims.AccessTokenHash != hashAccessToken(accessToken):
+		return nil, fmt.Errorf("%w: ath doesn't match the access token", ErrInvalidDpopProof)
+	case !v.validNonce(claims.Nonce, now):
+		return nil, ErrUseDpopNonce
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDpopProof, err)
+	}
+	proof := &DpopProof{
+		Thumbprint: base64.RawURLEncoding.EncodeToString(thumbprint),
+		ID:         claims.ID,
+		IssuedAt:   claims.IssuedAt.Time(),
+	}
+	if !v.markUsed(proof, now) {
+		return nil, fmt.Errorf("%w: proof has already been used", ErrInvalidDpopProof)
+	}
+	return proof, nil
+}
+
+// markUsed remembers the proof until it expires, returning false if it was already used.
+func (v *DpopVerifier) markUsed(proof *DpopProof, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.After(v.nextSweep) {
+		for key, expiresAt := range v.seen {
+			if now.After(expiresAt) {
+				delete(v.seen, key)
+			}
+		}
+		v.nextSweep = now.Add(dpopProofMaxAge)
+	}
+	key := proof.Thumbprint + " " + proof.ID
+	if expiresAt, ok := v.seen[key]; ok && !now.After(expiresAt) {
+		return false
+	}
+	v.seen[key] = proof.IssuedAt.Add(dpopProofMaxAge)
+	return true
+}
+
+// sameHTU reports whether the htu claim of a proof is the URL the request was made to. As in RFC
+// 9449, the query and fragment are ignored.
+func sameHTU(claim string, htu string) bool {
+	a, err := url.Parse(claim)
+	if err != nil {
+		return false
+	}
+	b, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	return a.IsAbs() &&
+		strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(a.Host, b.Host) &&
+		a.EscapedPath() == b.EscapedPath()
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDpopVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	thumbprint, err := SessionID(key)
+	require.NoError(t, err)
+
+	now := time.Now()
+	verifier := NewDpopVerifier([]byte("nonce key"))
+	verifier.now = func() time.Time { return now }
+	nonces := &TestNonceProvider{}
+	client := NewDpopHttpClient(key, nonces, WithAccessToken("access-token"))
+	proofFor := func(method string, target string) *http.Request {
+		req, err := http.NewRequest(method, target, nil)
+		require.NoError(t, err)
+		require.NoError(t, client.sign(req))
+		return req
+	}
+	htu := "https://habitat.example.com/xrpc/com.habitat.getRecord"
+
+	// Proofs must include a nonce the verifier issued
+	req := proofFor(http.MethodGet, htu)
+	_, err = verifier.Verify(req, htu, "access-token")
+	require.ErrorIs(t, err, ErrUseDpopNonce)
+	nonces.nonce = verifier.Nonce()
+
+	req = proofFor(http.MethodGet, htu+"?collection=com.example.notes")
+	proof, err := verifier.Verify(req, htu, "access-token")
+	require.NoError(t, err)
+	require.Equal(t, thumbprint, proof.Thumbprint)
+
+	// Proofs can only be used once
+	_, err = verifier.Verify(req, htu, "access-token")
+	require.ErrorIs(t, err, ErrInvalidDpopProof)
+
+	// Proofs are only valid for the request and token they were made for
+	req = proofFor(http.MethodPost, htu)
+	req.Method = http.MethodGet
+	_, err = verifier.Verify(req, htu, "access-token")
+	require.ErrorIs(t, err, ErrInvalidDpopProof)
+	_, err = verifier.Verify(proofFor(http.MethodGet, "https://evil.example.com/"), htu, "access-token")
+	require.ErrorIs(t, err, ErrInvalidDpopProof)
+	_, err = verifier.Verify(proofFor(http.MethodGet, htu), htu, "other-token")
+	require.ErrorIs(t, err, ErrInvalidDpopProof)
+	_, err = verifier.Verify(&http.Request{Method: http.MethodGet, Header: http.Header{}}, htu, "")
+	require.ErrorIs(t, err, ErrMissingDpopProof)
+
+	// Nonces are accepted until the one after them has been issued, including those derived from
+	// rotated keys
+	nonce := verifier.Nonce()
+	require.True(t, verifier.validNonce(nonce, now.Add(dpopNonceRotation)))
+	require.False(t, verifier.validNonce(nonce, now.Add(2*dpopNonceRotation)))
+	rotated := NewDpopVerifier([]byte("new nonce key"), []byte("nonce key"))
+	require.True(t, rotated.validNonce(nonce, now))
+	require.NotEqual(t, nonce, rotated.Nonce())
+
+	// Proofs expire
+	req = proofFor(http.MethodGet, htu)
+	now = now.Add(dpopProofMaxAge + time.Second)
+	_, err = verifier.Verify(req, htu, "access-token")
+	require.ErrorIs(t, err, ErrInvalidDpopProof)
+}
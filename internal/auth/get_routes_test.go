@@ -1,8 +1,10 @@
 package auth
 
 import (
+	"path/filepath"
 	"testing"
 
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/eagraf/habitat-new/internal/node/config"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/require"
@@ -16,9 +18,18 @@ func TestGetRoutes(t *testing.T) {
 	// Create a session store
 	sessionStore := sessions.NewCookieStore([]byte("test-key"))
 
+	clientKeys, err := LoadOrCreateClientKeys(filepath.Join(t.TempDir(), "client_keys.json"))
+	require.NoError(t, err)
+
 	// Call GetRoutes
-	routes, err := GetRoutes(testConfig, sessionStore)
+	routes, err := GetRoutes(
+		t.Context(),
+		testConfig,
+		sessionStore,
+		clientKeys,
+		&identity.MockDirectory{},
+	)
 	require.NoError(t, err)
 
-	require.Len(t, routes, 4)
+	require.Len(t, routes, 8)
 }
@@ -1,11 +1,11 @@
 package auth
 
 import (
-	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
@@ -13,6 +13,7 @@ import (
 	"github.com/eagraf/habitat-new/internal/node/config"
 	jose "github.com/go-jose/go-jose/v3"
 	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
 )
 
 type loginHandler struct {
@@ -27,57 +28,87 @@ type metadataHandler struct {
 	oauthClient OAuthClient
 }
 
+// jwksHandler publishes the public keys PDSes verify the node's client assertions with.
+type jwksHandler struct {
+	jwks *jose.JSONWebKeySet
+}
+
 type callbackHandler struct {
 	oauthClient  OAuthClient
+	tokens       *TokenManager
+	sessionStore sessions.Store
+}
+
+// sessionRegenerator is implemented by session stores that can issue a session a new ID.
+type sessionRegenerator interface {
+	Regenerate(session *sessions.Session) error
+}
+
+type logoutHandler struct {
+	oauthClient  OAuthClient
+	tokens       *TokenManager
+	sessionStore sessions.Store
+}
+
+// accountsHandler lists the accounts logged in to the session.
+type accountsHandler struct {
+	sessionStore sessions.Store
+}
+
+// switchAccountHandler changes the session's active account.
+type switchAccountHandler struct {
 	sessionStore sessions.Store
 }
 
+// tokenRefreshMargin is how long before they expire PDS access tokens are refreshed.
+const tokenRefreshMargin = 5 * time.Minute
+
+// GetRoutes returns the node's login routes. The node authenticates to PDSes with the given client
+// keys, such as those returned by LoadOrCreateClientKeys, and finds users' PDSes with dir. Until ctx
+// is cancelled, the PDS tokens of logged in sessions are refreshed in the background before they
+// expire.
 func GetRoutes(
+	ctx context.Context,
 	nodeConfig *config.NodeConfig,
 	sessionStore sessions.Store,
+	clientKeys *ClientKeys,
+	dir identity.Directory,
 ) ([]api.Route, error) {
-	// TODO persist this key
-	key, err := ecdsa.GenerateKey(
-		elliptic.P256(),
-		bytes.NewReader(bytes.Repeat([]byte("hello world"), 1024)),
-	)
-	if err != nil {
-		return nil, err
-	}
-	jwk, err := json.Marshal(jose.JSONWebKey{
-		Key:       key,
-		KeyID:     "habitat",
-		Algorithm: string(jose.ES256),
-		Use:       "sig",
-	})
-	if err != nil {
-		return nil, err
-	}
-
 	baseClientURL := nodeConfig.ExternalURL()
-	oauthClient, err := NewOAuthClient(
+	oauthClient := NewOAuthClientWithKeys(
 		baseClientURL+"/habitat/api/client-metadata.json", /*clientId*/
 		baseClientURL, /*clientUri*/
 		baseClientURL+"/habitat/api/auth-callback", /*redirectUri*/
-		jwk, /*secretJwk*/
+		baseClientURL+"/habitat/api/jwks.json",     /*jwksUri*/
+		clientKeys,
 	)
-	if err != nil {
-		return nil, err
-	}
+	tokens := NewTokenManager(oauthClient, tokenRefreshMargin)
+	go tokens.RefreshExpiringEvery(ctx, time.Minute)
 
 	return []api.Route{
 		&loginHandler{
 			oauthClient:       oauthClient,
 			sessionStore:      sessionStore,
 			habitatNodeDomain: nodeConfig.Domain(),
-			identityDir:       identity.DefaultDirectory(),
+			identityDir:       dir,
 		}, &metadataHandler{
 			oauthClient: oauthClient,
+		}, &jwksHandler{
+			jwks: clientKeys.PublicJWKS(),
 		}, &callbackHandler{
 			oauthClient:  oauthClient,
+			tokens:       tokens,
 			sessionStore: sessionStore,
-		}, &xrpcBrokerHandler{
+		}, &logoutHandler{
 			oauthClient:  oauthClient,
+			tokens:       tokens,
+			sessionStore: sessionStore,
+		}, &accountsHandler{
+			sessionStore: sessionStore,
+		}, &switchAccountHandler{
+			sessionStore: sessionStore,
+		}, &xrpcBrokerHandler{
+			tokens:       tokens,
 			sessionStore: sessionStore,
 			htuURL:       nodeConfig.ExternalURL(),
 		},
@@ -190,6 +221,31 @@ func (m *metadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Method implements api.Route.
+func (j *jwksHandler) Method() string {
+	return http.MethodGet
+}
+
+// Pattern implements api.Route.
+func (j *jwksHandler) Pattern() string {
+	return "/jwks.json"
+}
+
+// ServeHTTP implements api.Route.
+func (j *jwksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(j.jwks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 // Method implements api.Route.
 func (c *callbackHandler) Method() string {
 	return http.MethodGet
@@ -233,12 +289,11 @@ func (c *callbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 	issuer := r.URL.Query().Get("iss")
 
-	dpopSession, err := getCookieSession(r, c.sessionStore)
+	dpopSession, err := getPendingLogin(r, c.sessionStore)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// defer dpopSession.Save(r, w)
 
 	// Get the key from the session
 	key, ok, err := dpopSession.GetDpopKey()
@@ -270,16 +325,308 @@ func (c *callbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	identity, ok, err := dpopSession.GetIdentity()
+	account, replaced, err := dpopSession.completeLogin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Logging in to an account again replaces its earlier login
+	if replaced != nil {
+		err = revokeRefreshToken(c.oauthClient, c.tokens, replaced)
+		if err != nil {
+			log.Error().Err(err).Msg("error revoking replaced refresh token")
+		}
+	}
+
+	err = c.regenerateSessionID(account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = setAccountCookies(w, account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account.Save(r, w)
+
+	http.Redirect(
+		w,
+		r,
+		"/",
+		http.StatusSeeOther,
+	)
+}
+
+// regenerateSessionID issues the session a new ID now that an account has logged in to it, if the
+// store supports it. Refreshed tokens of the session's other accounts are persisted under the old
+// ID, so their latest tokens are moved into the session and they are tracked afresh on their next
+// request.
+func (c *callbackHandler) regenerateSessionID(account *cookieSession) error {
+	regenerator, ok := c.sessionStore.(sessionRegenerator)
 	if !ok {
-		http.Error(w, "no identity in session", http.StatusInternalServerError)
+		return nil
+	}
+	for _, did := range account.Accounts() {
+		if did == account.account {
+			continue
+		}
+		other := &cookieSession{session: account.session, account: did}
+		key, ok, err := other.GetDpopKey()
+		if err != nil || !ok {
+			continue
+		}
+		sessionID, err := SessionID(key)
+		if err != nil {
+			return err
+		}
+		tokenInfo := c.tokens.Forget(sessionID)
+		if tokenInfo != nil {
+			err = other.SetTokenInfo(tokenInfo)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return regenerator.Regenerate(account.session)
+}
+
+// Method implements api.Route.
+func (l *logoutHandler) Method() string {
+	return http.MethodPost
+}
+
+// Pattern implements api.Route.
+func (l *logoutHandler) Pattern() string {
+	return "/logout"
+}
+
+// ServeHTTP implements api.Route. It logs out the account the request selects, or the active
+// account. The session is deleted once no accounts remain in it.
+func (l *logoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	did := requestedAccount(r)
+	// A missing or broken session still needs its cookies cleared, so revoking the upstream token
+	// is best effort.
+	dpopSession, err := getAccountSession(r, l.sessionStore, did)
+	if err == nil {
+		err = revokeRefreshToken(l.oauthClient, l.tokens, dpopSession)
+		if err != nil {
+			log.Error().Err(err).Msg("error revoking refresh token on logout")
+		}
+		dpopSession.remove()
+
+		if len(dpopSession.Accounts()) > 0 {
+			active, err := getCookieSession(r, l.sessionStore)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			err = setAccountCookies(w, active)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			active.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+	} else if did != "" {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else {
+		log.Warn().Err(err).Msg("logging out without a valid session")
+		dpopSession = &cookieSession{session: sessions.NewSession(l.sessionStore, SessionKeyDpop)}
+		dpopSession.session.Options = &sessions.Options{Path: "/"}
 	}
+
+	dpopSession.session.Options.MaxAge = -1
+	err = dpopSession.session.Save(r, w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Clear the cookies the frontend reads to know who is logged in
+	for _, name := range []string{"handle", "did", "pds_url"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// revokeRefreshToken stops refreshing the account's tokens and revokes its refresh token.
+func revokeRefreshToken(
+	oauthClient OAuthClient,
+	tokens *TokenManager,
+	dpopSession *cookieSession,
+) error {
+	key, ok, err := dpopSession.GetDpopKey()
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("no key in session")
+	}
+	sessionID, err := SessionID(key)
+	if err != nil {
+		return err
+	}
+	// The token manager has the latest tokens if they were refreshed since the session was saved
+	tokenInfo := tokens.Forget(sessionID)
+	if tokenInfo == nil {
+		tokenInfo, ok, err = dpopSession.GetTokenInfo()
+		if err != nil {
+			return err
+		} else if !ok {
+			// The login never completed, so there is nothing to revoke
+			return nil
+		}
+	}
+	if tokenInfo.RefreshToken == "" {
+		return nil
+	}
+	id, ok, err := dpopSession.GetIdentity()
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("no identity in session")
+	}
+
+	return oauthClient.RevokeToken(
+		NewDpopHttpClient(key, dpopSession),
+		id,
+		tokenInfo.RefreshToken,
+		"refresh_token",
+	)
+}
+
+// Account describes one of the accounts logged in to a session.
+type Account struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle"`
+	PDSURL string `json:"pdsUrl"`
+	Active bool   `json:"active"`
+}
+
+// Method implements api.Route.
+func (a *accountsHandler) Method() string {
+	return http.MethodGet
+}
+
+// Pattern implements api.Route.
+func (a *accountsHandler) Pattern() string {
+	return "/accounts"
+}
+
+// ServeHTTP implements api.Route.
+func (a *accountsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := a.sessionStore.Get(r, SessionKeyDpop)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accounts := []Account{}
+	for _, did := range (&cookieSession{session: session}).Accounts() {
+		dpopSession, err := getAccountSession(r, a.sessionStore, did)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, ok, err := dpopSession.GetIdentity()
+		if !ok || err != nil {
+			http.Error(w, "no identity in session", http.StatusInternalServerError)
+			return
+		}
+		pdsURL, _, err := dpopSession.GetPDSURL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, Account{
+			DID:    did,
+			Handle: id.Handle.String(),
+			PDSURL: pdsURL,
+			Active: dpopSession.IsActive(),
+		})
+	}
+
+	bytes, err := json.Marshal(accounts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Method implements api.Route.
+func (s *switchAccountHandler) Method() string {
+	return http.MethodPost
+}
+
+// Pattern implements api.Route.
+func (s *switchAccountHandler) Pattern() string {
+	return "/switch-account"
+}
+
+// ServeHTTP implements api.Route. The DID of the account to switch to is given in the "did" form
+// value.
+func (s *switchAccountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	did := r.Form.Get("did")
+	if did == "" {
+		http.Error(w, "no account to switch to", http.StatusBadRequest)
+		return
+	}
+
+	dpopSession, err := getAccountSession(r, s.sessionStore, did)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = dpopSession.SetActive()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = setAccountCookies(w, dpopSession)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dpopSession.Save(r, w)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// setAccountCookies sets the cookies the frontend reads to know who is logged in to the account.
+func setAccountCookies(w http.ResponseWriter, dpopSession *cookieSession) error {
+	identity, ok, err := dpopSession.GetIdentity()
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("no identity in session")
+	}
+	pdsURL, ok, err := dpopSession.GetPDSURL()
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("no pds url in session")
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "handle",
 		Value:    string(identity.Handle),
@@ -294,15 +641,6 @@ func (c *callbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 	})
 
-	pdsURL, ok, err := dpopSession.GetPDSURL()
-	if !ok {
-		http.Error(w, "no pds url in session", http.StatusInternalServerError)
-		return
-	}
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 	if pdsURL != "" {
 		http.SetCookie(w, &http.Cookie{
 			Name:     "pds_url",
@@ -311,12 +649,5 @@ func (c *callbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			SameSite: http.SameSiteLaxMode,
 		})
 	}
-	dpopSession.Save(r, w)
-
-	http.Redirect(
-		w,
-		r,
-		"/",
-		http.StatusSeeOther,
-	)
+	return nil
 }
@@ -6,18 +6,39 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/eagraf/habitat-new/internal/directory"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/require"
 )
 
 // setupTestLoginHandler creates a loginHandler with test dependencies
-func setupTestLoginHandler(oauthClient OAuthClient, fakeOAuthServerURL string) *loginHandler {
+func setupTestLoginHandler(
+	t *testing.T,
+	oauthClient OAuthClient,
+	fakeOAuthServerURL string,
+) *loginHandler {
+	// The test users' identities are hosted on the fake PDS
+	identities := directory.NewLocalIdentities()
+	identities.Add(identity.Identity{
+		DID:      "did:plc:test",
+		Handle:   "test.bsky.app",
+		Services: map[string]identity.ServiceEndpoint{"atproto_pds": {URL: fakeOAuthServerURL}},
+	})
+	identities.Add(identity.Identity{
+		DID:      "did:plc:bsky",
+		Handle:   "bsky.app",
+		Services: map[string]identity.ServiceEndpoint{"atproto_pds": {URL: fakeOAuthServerURL}},
+	})
+	identitiesServer := httptest.NewServer(identities)
+	t.Cleanup(identitiesServer.Close)
+
 	sessionStore := sessions.NewCookieStore([]byte("test-key"))
 	return &loginHandler{
 		oauthClient:       oauthClient,
 		sessionStore:      sessionStore,
 		habitatNodeDomain: "bsky.app",
-		identityDir:       NewDummyDirectory(fakeOAuthServerURL),
+		identityDir:       directory.New(directory.WithLocalIdentities(identitiesServer.URL)),
 	}
 }
 
@@ -28,7 +49,7 @@ func TestLoginHandler_SuccessfulLogin(t *testing.T) {
 
 	// Create real OAuth client
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	// Create request
 	req := httptest.NewRequest("GET", "/login?handle=test.bsky.app", nil)
@@ -59,7 +80,7 @@ func TestLoginHandler_WithPDSURL(t *testing.T) {
 
 	// Create real OAuth client
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	// Create request
 	req := httptest.NewRequest("GET", "/login?handle=test.bsky.app", nil)
@@ -93,7 +114,7 @@ func TestLoginHandler_InvalidHandle(t *testing.T) {
 	defer fakeOAuthServer.Close()
 
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	// Test with invalid handle
 	req := httptest.NewRequest("GET", "/login?handle=invalid-handle", nil)
@@ -111,7 +132,7 @@ func TestLoginHandler_MissingHandle(t *testing.T) {
 	defer fakeOAuthServer.Close()
 
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	// Test with missing handle
 	req := httptest.NewRequest("GET", "/login", nil)
@@ -141,7 +162,7 @@ func TestLoginHandler_OAuthAuthorizeError(t *testing.T) {
 	})
 
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	req := httptest.NewRequest("GET", "/login?handle=test.bsky.app", nil)
 	w := httptest.NewRecorder()
@@ -158,7 +179,7 @@ func TestLoginHandler_IntegrationWithRealOAuthFlow(t *testing.T) {
 
 	// Create real OAuth client
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	req := httptest.NewRequest("GET", "/login?handle=test.bsky.app", nil)
 	w := httptest.NewRecorder()
@@ -189,7 +210,7 @@ func TestLoginHandler_FormParsingError(t *testing.T) {
 	defer fakeOAuthServer.Close()
 
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	// Create request with malformed form data
 	req := httptest.NewRequest("POST", "/login", strings.NewReader("invalid form data"))
@@ -208,7 +229,7 @@ func TestLoginHandler_DefaultDirectoryLookup(t *testing.T) {
 
 	// Test the case where pdsURL is empty and we use the default directory
 	oauthClient := testOAuthClient(t)
-	handler := setupTestLoginHandler(oauthClient, fakeOAuthServer.URL)
+	handler := setupTestLoginHandler(t, oauthClient, fakeOAuthServer.URL)
 
 	// Use a handle that should be resolvable by the default directory
 	req := httptest.NewRequest("GET", "/login?handle=bsky.app", nil)
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthClient_RevokeToken(t *testing.T) {
+	revoked := []string{}
+	server := fakeAuthServer(t, map[string]interface{}{"revoked": &revoked})
+	defer server.Close()
+
+	client := testOAuthClient(t)
+	dpopClient := testDpopClient(t, testIdentity(server.URL))
+	err := client.RevokeToken(dpopClient, testIdentity(server.URL), "refresh-token", "refresh_token")
+	require.NoError(t, err)
+	require.Equal(t, []string{"refresh-token"}, revoked)
+
+	failing := fakeAuthServer(t, map[string]interface{}{"revoke-status": http.StatusBadRequest})
+	defer failing.Close()
+	err = client.RevokeToken(dpopClient, testIdentity(failing.URL), "refresh-token", "refresh_token")
+	require.Error(t, err)
+}
+
+func TestLogoutHandler(t *testing.T) {
+	revoked := []string{}
+	server := fakeAuthServer(t, map[string]interface{}{"revoked": &revoked})
+	defer server.Close()
+
+	store := testSQLiteSessionStore(t)
+	oauthClient := testOAuthClient(t)
+	handler := &logoutHandler{
+		oauthClient:  oauthClient,
+		tokens:       NewTokenManager(oauthClient, time.Minute),
+		sessionStore: store,
+	}
+
+	// Log in
+	req := httptest.NewRequest(http.MethodGet, "/auth-callback", nil)
+	w := httptest.NewRecorder()
+	dpopSession := testLogin(t, req, store, testIdentity(server.URL), server.URL)
+	require.NoError(t, dpopSession.SetTokenInfo(&TokenResponse{RefreshToken: "refresh-token"}))
+	dpopSession.Save(req, w)
+
+	// Log out
+	logoutReq := requestWithCookies(w)
+	logoutReq.Method = http.MethodPost
+	logoutW := httptest.NewRecorder()
+	handler.ServeHTTP(logoutW, logoutReq)
+	require.Equal(t, http.StatusSeeOther, logoutW.Code)
+	require.Equal(t, []string{"refresh-token"}, revoked)
+
+	cleared := map[string]bool{}
+	for _, cookie := range logoutW.Result().Cookies() {
+		cleared[cookie.Name] = cookie.MaxAge < 0
+	}
+	require.Equal(t, map[string]bool{
+		SessionKeyDpop: true,
+		"handle":       true,
+		"did":          true,
+		"pds_url":      true,
+	}, cleared)
+
+	// The old cookie no longer refers to a session
+	_, err := getCookieSession(requestWithCookies(w), store)
+	require.Error(t, err)
+}
+
+func TestLogoutHandlerWithoutSession(t *testing.T) {
+	oauthClient := testOAuthClient(t)
+	handler := &logoutHandler{
+		oauthClient:  oauthClient,
+		tokens:       NewTokenManager(oauthClient, time.Minute),
+		sessionStore: testSQLiteSessionStore(t),
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/logout", nil))
+	require.Equal(t, http.StatusSeeOther, w.Code)
+}
+
+func TestLogoutHandlerKeepsOtherAccounts(t *testing.T) {
+	revoked := []string{}
+	server := fakeAuthServer(t, map[string]interface{}{"revoked": &revoked})
+	defer server.Close()
+
+	store := testSQLiteSessionStore(t)
+	oauthClient := testOAuthClient(t)
+	handler := &logoutHandler{
+		oauthClient:  oauthClient,
+		tokens:       NewTokenManager(oauthClient, time.Minute),
+		sessionStore: store,
+	}
+
+	// Log in to two accounts
+	req := httptest.NewRequest(http.MethodGet, "/auth-callback", nil)
+	w := httptest.NewRecorder()
+	personal := testLogin(t, req, store, testIdentity(server.URL), server.URL)
+	require.NoError(t, personal.SetTokenInfo(&TokenResponse{RefreshToken: "personal-token"}))
+	project := testLogin(t, req, store, &identity.Identity{
+		DID:    "did:plc:project",
+		Handle: "project.bsky.app",
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {URL: server.URL},
+		},
+	}, server.URL)
+	require.NoError(t, project.SetTokenInfo(&TokenResponse{RefreshToken: "project-token"}))
+	project.Save(req, w)
+
+	// Logging out of the active account switches to the other one
+	logoutReq := requestWithCookies(w)
+	logoutReq.Method = http.MethodPost
+	logoutW := httptest.NewRecorder()
+	handler.ServeHTTP(logoutW, logoutReq)
+	require.Equal(t, http.StatusSeeOther, logoutW.Code)
+	require.Equal(t, []string{"project-token"}, revoked)
+
+	cookies := map[string]string{}
+	for _, cookie := range logoutW.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	require.Equal(t, "did:plc:test123", cookies["did"])
+
+	active, err := getCookieSession(requestWithCookies(w), store)
+	require.NoError(t, err)
+	require.Equal(t, "did:plc:test123", active.Account())
+	require.Equal(t, []string{"did:plc:test123"}, active.Accounts())
+
+	// Accounts that aren't logged in can't be logged out
+	logoutReq = requestWithCookies(w)
+	logoutReq.Method = http.MethodPost
+	logoutReq.Header.Set(AccountHeader, "did:plc:project")
+	logoutW = httptest.NewRecorder()
+	handler.ServeHTTP(logoutW, logoutReq)
+	require.Equal(t, http.StatusBadRequest, logoutW.Code)
+}
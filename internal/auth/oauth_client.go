@@ -24,6 +24,7 @@ type ClientMetadata struct {
 	ClientName              string              `json:"client_name"`
 	ClientId                string              `json:"client_id"`
 	ClientUri               string              `json:"client_uri"`
+	LogoUri                 string              `json:"logo_uri,omitempty"`
 	ApplicationType         string              `json:"application_type"`
 	GrantTypes              []string            `json:"grant_types"`
 	Scope                   string              `json:"scope"`
@@ -32,7 +33,8 @@ type ClientMetadata struct {
 	TokenEndpointAuthMethod string              `json:"token_endpoint_auth_method"`
 	TokenEndpointAuthSigner string              `json:"token_endpoint_auth_signing_alg"`
 	DpopBoundAccessTokens   bool                `json:"dpop_bound_access_tokens"`
-	Jwks                    *jose.JSONWebKeySet `json:"jwks"`
+	Jwks                    *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	JwksUri                 string              `json:"jwks_uri,omitempty"`
 }
 
 type OAuthClient interface {
@@ -53,13 +55,24 @@ type OAuthClient interface {
 		issuer string,
 		refreshToken string,
 	) (*TokenResponse, error)
+	// RevokeToken revokes the given token at the authorization server of the identity's PDS,
+	// following RFC 7009.
+	RevokeToken(
+		dpopClient *DpopHttpClient,
+		identity *identity.Identity,
+		token string,
+		tokenTypeHint string,
+	) error
 }
 
 type oauthClientImpl struct {
 	clientId    string
 	clientUri   string
 	redirectUri string
-	secretJwk   jose.JSONWebKey
+	keys        *ClientKeys
+	// jwksUri is where the public keys are served. If empty, they are embedded in the client
+	// metadata instead.
+	jwksUri string
 }
 
 func NewOAuthClient(
@@ -73,17 +86,36 @@ func NewOAuthClient(
 	if err != nil {
 		return nil, err
 	}
+	return NewOAuthClientWithKeys(clientId, clientUri, redirectUri, "", &ClientKeys{
+		Current: secret,
+	}), nil
+}
+
+// NewOAuthClientWithKeys creates a client that authenticates with the current of the given keys,
+// publishing the public keys at jwksUri, which the client metadata points PDSes to. Serving them
+// separately lets PDSes pick up a new key without refetching the client metadata.
+func NewOAuthClientWithKeys(
+	clientId string,
+	clientUri string,
+	redirectUri string,
+	jwksUri string,
+	keys *ClientKeys,
+) OAuthClient {
 	return &oauthClientImpl{
 		clientId:    clientId,
 		clientUri:   clientUri,
 		redirectUri: redirectUri,
-		secretJwk:   secret,
-	}, nil
+		keys:        keys,
+		jwksUri:     jwksUri,
+	}
 }
 
 // ClientMetadata implements OAuthClient.
 func (o *oauthClientImpl) ClientMetadata() *ClientMetadata {
-	publicJwk := o.secretJwk.Public()
+	var jwks *jose.JSONWebKeySet
+	if o.jwksUri == "" {
+		jwks = o.keys.PublicJWKS()
+	}
 	return &ClientMetadata{
 		ClientName:              "Habitat",
 		ClientUri:               o.clientUri,
@@ -96,7 +128,8 @@ func (o *oauthClientImpl) ClientMetadata() *ClientMetadata {
 		TokenEndpointAuthMethod: "private_key_jwt",
 		TokenEndpointAuthSigner: "ES256",
 		DpopBoundAccessTokens:   true,
-		Jwks:                    &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{publicJwk}},
+		Jwks:                    jwks,
+		JwksUri:                 o.jwksUri,
 	}
 }
 
@@ -160,6 +193,23 @@ type TokenResponse struct {
 	Scope        string `json:"scope" cbor:"3,keyasint"`
 	TokenType    string `json:"token_type" cbor:"4,keyasint"`
 	ExpiresIn    int    `json:"expires_in" cbor:"5,keyasint"`
+	// ExpiresAt is when the access token expires, computed from ExpiresIn when the tokens are
+	// received. It is zero if the server didn't say.
+	ExpiresAt time.Time `json:"expires_at,omitempty" cbor:"6,keyasint,omitempty"`
+	// Sub is the DID of the account the tokens were issued for.
+	Sub string `json:"sub,omitempty" cbor:"7,keyasint,omitempty"`
+}
+
+func decodeTokenResponse(raw []byte) (*TokenResponse, error) {
+	var tokenResp TokenResponse
+	err := json.NewDecoder(bytes.NewReader(raw)).Decode(&tokenResp)
+	if err != nil {
+		return nil, err
+	}
+	if tokenResp.ExpiresIn > 0 {
+		tokenResp.ExpiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	return &tokenResp, nil
 }
 
 // ExchangeCode implements OAuthClient.
@@ -212,13 +262,7 @@ func (o *oauthClientImpl) ExchangeCode(
 		return nil, err
 	}
 
-	var tokenResp TokenResponse
-	err = json.NewDecoder(bytes.NewReader(rawTokenResp)).Decode(&tokenResp)
-	if err != nil {
-		return nil, err
-	}
-
-	return &tokenResp, nil
+	return decodeTokenResponse(rawTokenResp)
 }
 
 func (o *oauthClientImpl) RefreshToken(
@@ -238,6 +282,10 @@ func (o *oauthClientImpl) RefreshToken(
 	}
 
 	tokenEndpoint := serverMetadata.TokenEndpoint
+	if issuer == "" {
+		// Sessions from before the issuer was recorded
+		issuer = serverMetadata.Issuer
+	}
 
 	clientAssertion, err := o.getClientAssertion(issuer)
 	if err != nil {
@@ -276,13 +324,64 @@ func (o *oauthClientImpl) RefreshToken(
 		return nil, err
 	}
 
-	var tokenResp TokenResponse
-	err = json.NewDecoder(bytes.NewReader(rawRefreshResp)).Decode(&tokenResp)
+	return decodeTokenResponse(rawRefreshResp)
+}
+
+// RevokeToken implements OAuthClient.
+func (o *oauthClientImpl) RevokeToken(
+	dpopClient *DpopHttpClient,
+	identity *identity.Identity,
+	token string,
+	tokenTypeHint string,
+) error {
+	pr, err := fetchOAuthProtectedResource(identity)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &tokenResp, nil
+	serverMetadata, err := fetchOauthAuthorizationServer(pr)
+	if err != nil {
+		return err
+	}
+	if serverMetadata.RevocationEndpoint == "" {
+		return errors.New("authorization server does not support token revocation")
+	}
+
+	clientAssertion, err := o.getClientAssertion(serverMetadata.Issuer)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"client_id": []string{o.clientId},
+		"token":     []string{token},
+		"client_assertion_type": []string{
+			"urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+		},
+		"client_assertion": []string{clientAssertion},
+	}
+	if tokenTypeHint != "" {
+		form.Set("token_type_hint", tokenTypeHint)
+	}
+	req, _ := http.NewRequest(
+		http.MethodPost,
+		serverMetadata.RevocationEndpoint,
+		strings.NewReader(form.Encode()),
+	)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := dpopClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		var errMsg json.RawMessage
+		_ = json.NewDecoder(resp.Body).Decode(&errMsg)
+		return fmt.Errorf("failed to revoke token: %s - %s", resp.Status, string(errMsg))
+	}
+	return nil
 }
 
 type oauthProtectedResource struct {
@@ -321,6 +420,8 @@ type oauthAuthorizationServer struct {
 	TokenEndpoint string `json:"token_endpoint"`
 	PAREndpoint   string `json:"pushed_authorization_request_endpoint"`
 	AuthEndpoint  string `json:"authorization_endpoint"`
+
+	RevocationEndpoint string `json:"revocation_endpoint"`
 }
 
 func fetchOauthAuthorizationServer(
@@ -364,10 +465,10 @@ type parResponse struct {
 
 func (o *oauthClientImpl) getClientAssertion(audience string) (string, error) {
 	signer, err := jose.NewSigner(
-		jose.SigningKey{Algorithm: jose.ES256, Key: o.secretJwk},
+		jose.SigningKey{Algorithm: jose.ES256, Key: o.keys.Current},
 		&jose.SignerOptions{
 			ExtraHeaders: map[jose.HeaderKey]interface{}{
-				"kid": o.secretJwk.KeyID,
+				"kid": o.keys.Current.KeyID,
 			},
 		},
 	)
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// maxInMemoryBodySize is how much of a request body is kept in memory so that the request can
+	// be retried. Anything larger is spooled to a temporary file.
+	maxInMemoryBodySize = 1 << 20 // 1 MiB
+	// maxReplayableBodySize is the largest body that is recorded at all. Larger bodies are still
+	// streamed, but the request can't be retried.
+	maxReplayableBodySize = 32 << 20 // 32 MiB
+)
+
+// errBodyNotReplayable is returned when a body has outgrown the recording limit and can't be
+// sent again.
+var errBodyNotReplayable = errors.New("request body is too large to be resent")
+
+// replayableBody lets a streamed request body be sent more than once, as needed to retry requests
+// after a DPoP nonce error or token refresh, without buffering it all in memory.
+//
+// The first reader streams the original body while recording it. Later readers drain whatever
+// the previous attempt didn't read, then replay the recording. Bodies larger than the limit stop
+// being recorded, and can only be sent once.
+type replayableBody struct {
+	src   io.Reader
+	limit int64
+
+	mu     sync.Mutex
+	reads  int // how many readers GetBody has returned
+	prev   *trackedReader
+	mem    bytes.Buffer
+	file   *os.File
+	size   int64
+	closed bool
+	// Set once the body has outgrown limit and the recording has been dropped.
+	tooLarge bool
+}
+
+func newReplayableBody(src io.Reader) *replayableBody {
+	return &replayableBody{src: src, limit: maxReplayableBodySize}
+}
+
+// replayable reports whether the body can still be sent again. A body that hasn't been fully read
+// yet may still turn out to be too large.
+func (b *replayableBody) replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.tooLarge
+}
+
+// GetBody has the signature of http.Request.GetBody, and returns a new reader over the body.
+func (b *replayableBody) GetBody() (io.ReadCloser, error) {
+	b.mu.Lock()
+	prev := b.prev
+	b.reads++
+	if b.reads == 1 {
+		first := newTrackedReader(io.TeeReader(b.src, b))
+		b.prev = first
+		b.mu.Unlock()
+		return first, nil
+	}
+	b.mu.Unlock()
+
+	// The transport may still be reading the previous body in the background, so wait for it to
+	// be closed before touching the recording.
+	<-prev.done
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errors.New("request body has already been closed")
+	}
+	if b.tooLarge {
+		return nil, errBodyNotReplayable
+	}
+	_, err := io.Copy(b.writer(), b.src)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = bytes.NewReader(b.mem.Bytes())
+	if b.file != nil {
+		r = io.NewSectionReader(b.file, 0, b.size)
+	}
+	next := newTrackedReader(r)
+	b.prev = next
+	return next, nil
+}
+
+// Write records body bytes as they are read by the first reader. Errors recording the body are not
+// returned, since they would fail the first attempt, but make the body unreplayable.
+func (b *replayableBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.writer().Write(p)
+	if err != nil && !b.tooLarge {
+		_ = b.drop()
+	}
+	return len(p), nil
+}
+
+// writer returns where to record the next bytes, moving the recording to a temporary file once
+// it outgrows maxInMemoryBodySize, and dropping it once it outgrows the limit. It must be called
+// with mu held.
+func (b *replayableBody) writer() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if b.tooLarge || b.closed {
+			return 0, errBodyNotReplayable
+		}
+		if b.size+int64(len(p)) > b.limit {
+			return 0, errors.Join(errBodyNotReplayable, b.drop())
+		}
+		if b.file == nil && int64(b.mem.Len()+len(p)) > maxInMemoryBodySize {
+			file, err := os.CreateTemp("", "habitat-request-body-*")
+			if err != nil {
+				return 0, err
+			}
+			_, err = file.Write(b.mem.Bytes())
+			if err != nil {
+				return 0, errors.Join(err, file.Close(), os.Remove(file.Name()))
+			}
+			b.file = file
+			b.mem = bytes.Buffer{}
+		}
+
+		var n int
+		var err error
+		if b.file != nil {
+			n, err = b.file.WriteAt(p, b.size)
+		} else {
+			n, err = b.mem.Write(p)
+		}
+		b.size += int64(n)
+		return n, err
+	})
+}
+
+// drop discards the recording, after which the body can't be replayed. It must be called with mu
+// held.
+func (b *replayableBody) drop() error {
+	b.tooLarge = true
+	return b.release()
+}
+
+// release frees the memory and temporary file holding the recording. It must be called with mu
+// held.
+func (b *replayableBody) release() error {
+	b.mem = bytes.Buffer{}
+	if b.file == nil {
+		return nil
+	}
+	file := b.file
+	b.file = nil
+	return errors.Join(file.Close(), os.Remove(file.Name()))
+}
+
+// Close releases the recording. It must be called once the body is no longer needed.
+func (b *replayableBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.release()
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// trackedReader signals when it has been closed.
+type trackedReader struct {
+	io.Reader
+	once sync.Once
+	done chan struct{}
+}
+
+func newTrackedReader(r io.Reader) *trackedReader {
+	return &trackedReader{Reader: r, done: make(chan struct{})}
+}
+
+func (r *trackedReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return nil
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayableBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+		// How much of the body the first attempt reads before giving up
+		firstRead int
+	}{
+		{name: "small body", size: 1024, firstRead: 1024},
+		{name: "small body partially read", size: 1024, firstRead: 10},
+		{name: "large body", size: 3 * maxInMemoryBodySize, firstRead: 3 * maxInMemoryBodySize},
+		{name: "large body partially read", size: 3 * maxInMemoryBodySize, firstRead: 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([]byte, tc.size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			body := newReplayableBody(bytes.NewReader(data))
+			defer func() { require.NoError(t, body.Close()) }()
+
+			first, err := body.GetBody()
+			require.NoError(t, err)
+			got := make([]byte, tc.firstRead)
+			_, err = io.ReadFull(first, got)
+			require.NoError(t, err)
+			require.Equal(t, data[:tc.firstRead], got)
+			require.NoError(t, first.Close())
+
+			for range 2 {
+				replay, err := body.GetBody()
+				require.NoError(t, err)
+				got, err := io.ReadAll(replay)
+				require.NoError(t, err)
+				require.Equal(t, data, got)
+				require.NoError(t, replay.Close())
+			}
+			require.Equal(t, tc.size > maxInMemoryBodySize, body.file != nil)
+		})
+	}
+}
+
+func TestReplayableBodyOverLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 3*maxInMemoryBodySize)
+	for _, firstRead := range []int{len(data), 100} {
+		body := newReplayableBody(bytes.NewReader(data))
+		body.limit = 2 * maxInMemoryBodySize
+
+		// The first attempt still streams the whole body
+		first, err := body.GetBody()
+		require.NoError(t, err)
+		got := make([]byte, firstRead)
+		_, err = io.ReadFull(first, got)
+		require.NoError(t, err)
+		require.Equal(t, data[:firstRead], got)
+		require.NoError(t, first.Close())
+
+		_, err = body.GetBody()
+		require.ErrorIs(t, err, errBodyNotReplayable)
+		require.False(t, body.replayable())
+		require.Nil(t, body.file)
+		require.NoError(t, body.Close())
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/gorilla/sessions"
@@ -45,8 +46,26 @@ const (
 	cIssuerSessionKey    = "issuer"
 	cIdentitySessionKey  = "identity"
 	cPDSURLSessionKey    = "pds_url"
+
+	// The DIDs of the accounts logged in to the session, and the one used by default
+	cAccountsSessionKey      = "accounts"
+	cActiveAccountSessionKey = "active_account"
 )
 
+// accountValueKeys are the keys of the values stored for each of a session's accounts.
+var accountValueKeys = []string{
+	cKeySessionKey,
+	cNonceSessionKey,
+	cTokenInfoSessionKey,
+	cIssuerSessionKey,
+	cIdentitySessionKey,
+	cPDSURLSessionKey,
+}
+
+// pendingLogin holds the values of a login until it completes, so that an abandoned login doesn't
+// disturb an account that is already logged in.
+const pendingLogin = "login"
+
 type ErrorSessionValueNotFound struct {
 	Key string
 }
@@ -55,30 +74,38 @@ func (e *ErrorSessionValueNotFound) Error() string {
 	return fmt.Sprintf("session value not found: %s", e.Key)
 }
 
+// cookieSession is one of the accounts logged in to a browser's session. A session can hold
+// several accounts, each with its own DPoP key and tokens, and one of them is active.
 type cookieSession struct {
 	// Internally, use a Gorilla session to store the session data
 	session *sessions.Session
+	// account is the DID of the account whose values are accessed, or pendingLogin
+	account string
 }
 
+// newCookieSession starts logging in to the account with the given identity, replacing any other
+// login in progress. The account is added to the session by completeLogin.
 func newCookieSession(
 	r *http.Request,
 	sessionStore sessions.Store,
 	id *identity.Identity,
 	pdsURL string,
 ) (*cookieSession, error) {
-	session, err := sessionStore.New(r, SessionKeyDpop)
+	// The login is added to the browser's existing session, if it has one
+	session, err := sessionStore.Get(r, SessionKeyDpop)
 	if err != nil {
 		return nil, err
 	}
 
+	dpopSession := &cookieSession{session: session, account: pendingLogin}
+	dpopSession.clear()
+
 	// TODO inject the key
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, err
 	}
 
-	dpopSession := &cookieSession{session: session}
-
 	// Use session class methods instead of manually modifying session values
 	err = dpopSession.SetDpopKey(key)
 	if err != nil {
@@ -98,19 +125,163 @@ func newCookieSession(
 	return dpopSession, nil
 }
 
+var (
+	// errNotLoggedIn is returned when a session has no usable account.
+	errNotLoggedIn = errors.New("not logged in")
+	// errUnknownAccount is returned when a request selects an account that isn't logged in to the
+	// session.
+	errUnknownAccount = errors.New("account is not logged in to this session")
+)
+
+// getCookieSession returns the session's active account.
 func getCookieSession(r *http.Request, sessionStore sessions.Store) (*cookieSession, error) {
+	return getAccountSession(r, sessionStore, "")
+}
+
+// getAccountSession returns the account with the given DID, or the active account if did is empty.
+// It fails if the account isn't logged in to the session.
+func getAccountSession(
+	r *http.Request,
+	sessionStore sessions.Store,
+	did string,
+) (*cookieSession, error) {
+	session, err := sessionStore.Get(r, SessionKeyDpop)
+	if err != nil {
+		return nil, err
+	}
+	dpopSession := &cookieSession{session: session}
+	if did == "" {
+		active, ok := session.Values[cActiveAccountSessionKey].(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: no active account in session", errNotLoggedIn)
+		}
+		did = active
+	}
+	if !slices.Contains(dpopSession.Accounts(), did) {
+		return nil, fmt.Errorf("%w: %s", errUnknownAccount, did)
+	}
+	dpopSession.account = did
+	return dpopSession.checkKey()
+}
+
+// getPendingLogin returns the login started by newCookieSession.
+func getPendingLogin(r *http.Request, sessionStore sessions.Store) (*cookieSession, error) {
 	session, err := sessionStore.Get(r, SessionKeyDpop)
 	if err != nil {
 		return nil, err
 	}
+	return (&cookieSession{session: session, account: pendingLogin}).checkKey()
+}
 
-	// Check that the session has a valid key, so we can fail fast if the session is somehow invalid
-	_, ok := session.Values[cKeySessionKey]
+// checkKey returns the session if it has a DPoP key, so we can fail fast if the session is somehow
+// invalid.
+func (s *cookieSession) checkKey() (*cookieSession, error) {
+	_, ok := s.session.Values[s.valueKey(cKeySessionKey)]
 	if !ok {
-		return nil, errors.New("invalid/missing key in session")
+		return nil, fmt.Errorf("%w: invalid/missing key in session", errNotLoggedIn)
+	}
+	return s, nil
+}
+
+// Accounts returns the DIDs of the accounts logged in to the session, in the order they logged in.
+func (s *cookieSession) Accounts() []string {
+	accounts, _ := s.session.Values[cAccountsSessionKey].([]string)
+	return accounts
+}
+
+// Account returns the DID of the account, or an empty string if its login hasn't completed.
+func (s *cookieSession) Account() string {
+	if s.account == pendingLogin {
+		return ""
+	}
+	return s.account
+}
+
+// IsActive reports whether the account is the one used by default.
+func (s *cookieSession) IsActive() bool {
+	return s.session.Values[cActiveAccountSessionKey] == s.account
+}
+
+// SetActive makes the account the one used by default.
+func (s *cookieSession) SetActive() error {
+	if s.Account() == "" {
+		return errors.New("login has not completed")
+	}
+	s.session.Values[cActiveAccountSessionKey] = s.account
+	return nil
+}
+
+// completeLogin adds the account being logged in to the session and makes it active, replacing an
+// earlier login to the same account. It returns the completed account, and the account it replaced
+// if there was one; the replaced account's values are no longer in the session.
+func (s *cookieSession) completeLogin() (*cookieSession, *cookieSession, error) {
+	if s.account != pendingLogin {
+		return nil, nil, errors.New("no login in progress")
+	}
+	id, ok, err := s.GetIdentity()
+	if err != nil {
+		return nil, nil, err
+	} else if !ok {
+		return nil, nil, errors.New("no identity in session")
 	}
+	did := id.DID.String()
+
+	var replaced *cookieSession
+	account := &cookieSession{session: s.session, account: did}
+	accounts := s.Accounts()
+	if slices.Contains(accounts, did) {
+		replaced = &cookieSession{
+			session: sessions.NewSession(s.session.Store(), s.session.Name()),
+			account: did,
+		}
+		for _, key := range accountValueKeys {
+			if v, ok := s.session.Values[account.valueKey(key)]; ok {
+				replaced.session.Values[account.valueKey(key)] = v
+			}
+		}
+	} else {
+		accounts = append(slices.Clone(accounts), did)
+	}
+
+	account.clear()
+	for _, key := range accountValueKeys {
+		if v, ok := s.session.Values[s.valueKey(key)]; ok {
+			s.session.Values[account.valueKey(key)] = v
+		}
+	}
+	s.clear()
+	s.session.Values[cAccountsSessionKey] = accounts
+	s.session.Values[cActiveAccountSessionKey] = did
+	return account, replaced, nil
+}
+
+// remove logs the account out of the session. If it was active, the most recently logged in of the
+// remaining accounts becomes active.
+func (s *cookieSession) remove() {
+	s.clear()
+	accounts := slices.DeleteFunc(slices.Clone(s.Accounts()), func(did string) bool {
+		return did == s.account
+	})
+	s.session.Values[cAccountsSessionKey] = accounts
+	if s.IsActive() {
+		if len(accounts) == 0 {
+			delete(s.session.Values, cActiveAccountSessionKey)
+		} else {
+			s.session.Values[cActiveAccountSessionKey] = accounts[len(accounts)-1]
+		}
+	}
+}
+
+// clear deletes the account's values from the session.
+func (s *cookieSession) clear() {
+	for _, key := range accountValueKeys {
+		delete(s.session.Values, s.valueKey(key))
+	}
+}
 
-	return &cookieSession{session: session}, nil
+// valueKey returns the key the account's value is stored under in the session.
+func (s *cookieSession) valueKey(key string) string {
+	return s.account + "/" + key
 }
 
 // Save writes the session out to the response writer. It is designed to be called with defer.
@@ -131,12 +302,12 @@ func (s *cookieSession) SetDpopKey(key *ecdsa.PrivateKey) error {
 	if err != nil {
 		return err
 	}
-	s.session.Values[cKeySessionKey] = keyBytes
+	s.session.Values[s.valueKey(cKeySessionKey)] = keyBytes
 	return nil
 }
 
 func (s *cookieSession) GetDpopKey() (*ecdsa.PrivateKey, bool, error) {
-	keyBytes, ok := s.session.Values[cKeySessionKey]
+	keyBytes, ok := s.session.Values[s.valueKey(cKeySessionKey)]
 	if !ok {
 		return nil, false, nil
 	}
@@ -157,13 +328,13 @@ func (s *cookieSession) SetTokenInfo(tokenResp *TokenResponse) error {
 		return err
 	}
 
-	s.session.Values[cTokenInfoSessionKey] = marshalled
+	s.session.Values[s.valueKey(cTokenInfoSessionKey)] = marshalled
 
 	return nil
 }
 
 func (s *cookieSession) GetTokenInfo() (*TokenResponse, bool, error) {
-	marshalled, ok := s.session.Values[cTokenInfoSessionKey]
+	marshalled, ok := s.session.Values[s.valueKey(cTokenInfoSessionKey)]
 	if !ok {
 		return nil, false, nil
 	}
@@ -180,12 +351,12 @@ func (s *cookieSession) GetTokenInfo() (*TokenResponse, bool, error) {
 }
 
 func (s *cookieSession) SetIssuer(issuer string) error {
-	s.session.Values[cIssuerSessionKey] = issuer
+	s.session.Values[s.valueKey(cIssuerSessionKey)] = issuer
 	return nil
 }
 
 func (s *cookieSession) GetIssuer() (string, bool, error) {
-	v, ok := s.session.Values[cIssuerSessionKey]
+	v, ok := s.session.Values[s.valueKey(cIssuerSessionKey)]
 	if !ok {
 		return "", false, nil
 	}
@@ -197,12 +368,12 @@ func (s *cookieSession) GetIssuer() (string, bool, error) {
 }
 
 func (s *cookieSession) SetPDSURL(pdsURL string) error {
-	s.session.Values[cPDSURLSessionKey] = pdsURL
+	s.session.Values[s.valueKey(cPDSURLSessionKey)] = pdsURL
 	return nil
 }
 
 func (s *cookieSession) GetPDSURL() (string, bool, error) {
-	v, ok := s.session.Values[cPDSURLSessionKey]
+	v, ok := s.session.Values[s.valueKey(cPDSURLSessionKey)]
 	if !ok {
 		return "", false, nil
 	}
@@ -214,7 +385,7 @@ func (s *cookieSession) GetPDSURL() (string, bool, error) {
 }
 
 func (s *cookieSession) GetIdentity() (*identity.Identity, bool, error) {
-	v, ok := s.session.Values[cIdentitySessionKey]
+	v, ok := s.session.Values[s.valueKey(cIdentitySessionKey)]
 	if !ok {
 		return nil, false, nil
 	}
@@ -235,17 +406,17 @@ func (s *cookieSession) SetIdentity(id *identity.Identity) error {
 	if err != nil {
 		return err
 	}
-	s.session.Values[cIdentitySessionKey] = identityBytes
+	s.session.Values[s.valueKey(cIdentitySessionKey)] = identityBytes
 	return nil
 }
 
 func (s *cookieSession) SetDpopNonce(nonce string) error {
-	s.session.Values[cNonceSessionKey] = nonce
+	s.session.Values[s.valueKey(cNonceSessionKey)] = nonce
 	return nil
 }
 
 func (s *cookieSession) GetDpopNonce() (string, bool, error) {
-	v, ok := s.session.Values[cNonceSessionKey]
+	v, ok := s.session.Values[s.valueKey(cNonceSessionKey)]
 	if !ok {
 		return "", false, nil
 	}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const defaultSessionMaxAge = 30 * 24 * 60 * 60 // 30 days, in seconds
+
+// serverSession is the server-side row backing a session. Its data is encoded with the store's
+// codecs, so it is authenticated and, given a block key, encrypted at rest.
+type serverSession struct {
+	ID        string `gorm:"primaryKey"`
+	Name      string
+	Data      string
+	ExpiresAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+}
+
+// SQLiteSessionStore is a sessions.Store that keeps session values in a database, so that the
+// cookie sent to the browser only carries an opaque, signed session ID.
+type SQLiteSessionStore struct {
+	db *gorm.DB
+	// codecs encode the session ID cookie, which is held to securecookie's default size limit.
+	// dataCodecs encode the values stored server-side, which have no size limit.
+	codecs     []securecookie.Codec
+	dataCodecs []securecookie.Codec
+	options    *sessions.Options
+	now        func() time.Time
+}
+
+var _ sessions.Store = (*SQLiteSessionStore)(nil)
+
+// NewSQLiteSessionStore returns a session store backed by the given database. The key pairs are
+// passed to securecookie.CodecsFromPairs: a hash key, optionally followed by a block key, with
+// older pairs listed after the current one to support rotation.
+func NewSQLiteSessionStore(db *gorm.DB, keyPairs ...[]byte) (*SQLiteSessionStore, error) {
+	if len(keyPairs) == 0 {
+		return nil, errors.New("at least one session key is required")
+	}
+	err := db.AutoMigrate(&serverSession{})
+	if err != nil {
+		return nil, err
+	}
+	dataCodecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range dataCodecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			codec.MaxLength(0)
+		}
+	}
+	return &SQLiteSessionStore{
+		db:         db,
+		codecs:     securecookie.CodecsFromPairs(keyPairs...),
+		dataCodecs: dataCodecs,
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   defaultSessionMaxAge,
+			HttpOnly: true,
+		},
+		now: time.Now,
+	}, nil
+}
+
+// Get returns the named session for the request, creating a new one if there is none.
+func (s *SQLiteSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session referenced by the request's cookie, or a new session if the cookie is
+// missing, invalid or refers to an expired session. Cookies that can't be decoded, such as those
+// left by an earlier cookie store or signed with a retired key, are treated as no session.
+func (s *SQLiteSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		// No cookie, so this is a new session
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...)
+	if err != nil {
+		log.Debug().Err(err).Msgf("ignoring undecodable %s cookie", name)
+		session.ID = ""
+		return session, nil
+	}
+
+	row := &serverSession{}
+	res := s.db.Where("id = ? AND name = ? AND expires_at > ?", session.ID, name, s.now().UTC()).
+		Limit(1).
+		Find(row)
+	if res.Error != nil {
+		return session, res.Error
+	} else if res.RowsAffected == 0 {
+		// Start over with a fresh ID so an expired or deleted session can't be revived
+		session.ID = ""
+		return session, nil
+	}
+
+	err = securecookie.DecodeMulti(name, row.Data, &session.Values, s.dataCodecs...)
+	if err != nil {
+		log.Debug().Err(err).Msgf("ignoring undecodable %s session", name)
+		session.ID = ""
+		session.Values = map[any]any{}
+		return session, nil
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Regenerate gives the session a new ID, which is issued when it is next saved, and deletes the
+// row stored under the old one. It is called when a user logs in, so that a session ID planted in
+// their browser beforehand can't be used to act as them.
+func (s *SQLiteSessionStore) Regenerate(session *sessions.Session) error {
+	if session.ID != "" {
+		err := s.db.Delete(&serverSession{ID: session.ID}).Error
+		if err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
+
+// Save persists the session's values and writes the session ID cookie. A session with a negative
+// MaxAge is deleted along with its cookie.
+func (s *SQLiteSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.db.Delete(&serverSession{ID: session.ID}).Error
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(
+			base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)),
+			"=",
+		)
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.dataCodecs...)
+	if err != nil {
+		return err
+	}
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		// Browser sessions still need to expire on the server eventually
+		maxAge = defaultSessionMaxAge
+	}
+	err = s.db.Save(&serverSession{
+		ID:        session.ID,
+		Name:      session.Name(),
+		Data:      data,
+		ExpiresAt: s.now().UTC().Add(time.Duration(maxAge) * time.Second),
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	encodedID, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encodedID, session.Options))
+	return nil
+}
+
+// Update applies fn to the named session with the given ID and saves the result without changing
+// its expiry. It is for changes made outside of a request, such as refreshing tokens in the
+// background.
+func (s *SQLiteSessionStore) Update(name, id string, fn func(*sessions.Session) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		row := &serverSession{}
+		res := tx.Where("id = ? AND name = ? AND expires_at > ?", id, name, s.now().UTC()).
+			Limit(1).
+			Find(row)
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return fmt.Errorf("session %s not found", id)
+		}
+
+		session := sessions.NewSession(s, name)
+		session.ID = id
+		err := securecookie.DecodeMulti(name, row.Data, &session.Values, s.dataCodecs...)
+		if err != nil {
+			return err
+		}
+		err = fn(session)
+		if err != nil {
+			return err
+		}
+		row.Data, err = securecookie.EncodeMulti(name, session.Values, s.dataCodecs...)
+		if err != nil {
+			return err
+		}
+		return tx.Save(row).Error
+	})
+}
+
+// PurgeExpiredSessions deletes every session that has expired, returning how many were deleted.
+func (s *SQLiteSessionStore) PurgeExpiredSessions() (int64, error) {
+	res := s.db.Where("expires_at <= ?", s.now().UTC()).Delete(&serverSession{})
+	return res.RowsAffected, res.Error
+}
+
+// PurgeExpiredSessionsEvery runs PurgeExpiredSessions on the given interval until ctx is cancelled.
+func (s *SQLiteSessionStore) PurgeExpiredSessionsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.PurgeExpiredSessions()
+			if err != nil {
+				log.Err(err).Msg("error purging expired sessions")
+			} else if n > 0 {
+				log.Info().Msgf("purged %d expired sessions", n)
+			}
+		}
+	}
+}
+
+type sessionKeys struct {
+	HashKey  []byte `json:"hashKey"`
+	BlockKey []byte `json:"blockKey"`
+}
+
+// LoadOrCreateSessionKeys reads the session hash and block keys from the file at path, generating
+// and persisting new ones if the file does not exist. The keys are returned as a pair suitable
+// for NewSQLiteSessionStore.
+func LoadOrCreateSessionKeys(path string) ([][]byte, error) {
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		keys := &sessionKeys{
+			HashKey:  securecookie.GenerateRandomKey(64),
+			BlockKey: securecookie.GenerateRandomKey(32),
+		}
+		if keys.HashKey == nil || keys.BlockKey == nil {
+			return nil, errors.New("unable to generate session keys")
+		}
+		bytes, err = json.Marshal(keys)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, bytes, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{keys.HashKey, keys.BlockKey}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := &sessionKeys{}
+	err = json.Unmarshal(bytes, keys)
+	if err != nil {
+		return nil, fmt.Errorf("parsing session keys at %s: %w", path, err)
+	}
+	if len(keys.HashKey) == 0 {
+		return nil, fmt.Errorf("session keys at %s are missing a hash key", path)
+	}
+	return [][]byte{keys.HashKey, keys.BlockKey}, nil
+}
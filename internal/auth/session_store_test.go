@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testSQLiteSessionStore(t *testing.T) *SQLiteSessionStore {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	keys, err := LoadOrCreateSessionKeys(filepath.Join(t.TempDir(), "session_keys.json"))
+	require.NoError(t, err)
+	store, err := NewSQLiteSessionStore(db, keys...)
+	require.NoError(t, err)
+	return store
+}
+
+// requestWithCookies returns a request carrying the cookies set on the recorder.
+func requestWithCookies(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestSQLiteSessionStoreRoundTrip(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	session := testLogin(t, r, store, testIdentity("https://pds.example.com"), "https://pds.example.com")
+	require.NoError(t, session.SetTokenInfo(&TokenResponse{AccessToken: "access-token"}))
+	session.Save(r, w)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Only the session ID is stored in the cookie
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Less(t, len(cookies[0].Value), 200)
+
+	loaded, err := getCookieSession(requestWithCookies(w), store)
+	require.NoError(t, err)
+	tokenInfo, ok, err := loaded.GetTokenInfo()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "access-token", tokenInfo.AccessToken)
+	pdsURL, ok, err := loaded.GetPDSURL()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "https://pds.example.com", pdsURL)
+
+	// Deleting the session clears it on the server too
+	loaded.session.Options.MaxAge = -1
+	w2 := httptest.NewRecorder()
+	loaded.Save(requestWithCookies(w), w2)
+	_, err = getCookieSession(requestWithCookies(w), store)
+	require.Error(t, err)
+}
+
+func TestSQLiteSessionStoreExpiry(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, SessionKeyDpop)
+	require.NoError(t, err)
+	session.Options.MaxAge = 60
+	session.Values["key"] = []byte("value")
+	require.NoError(t, session.Save(r, w))
+
+	session, err = store.New(requestWithCookies(w), SessionKeyDpop)
+	require.NoError(t, err)
+	require.False(t, session.IsNew)
+
+	store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	session, err = store.New(requestWithCookies(w), SessionKeyDpop)
+	require.NoError(t, err)
+	require.True(t, session.IsNew)
+	require.Empty(t, session.ID)
+	require.Empty(t, session.Values)
+
+	n, err := store.PurgeExpiredSessions()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+}
+
+func TestSQLiteSessionStoreUpdate(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	session := testLogin(t, r, store, testIdentity("https://pds.example.com"), "https://pds.example.com")
+	require.NoError(t, session.SetTokenInfo(&TokenResponse{AccessToken: "access-token"}))
+	session.Save(r, w)
+
+	err := store.Update(SessionKeyDpop, session.session.ID, func(s *sessions.Session) error {
+		refreshed := &cookieSession{session: s, account: session.account}
+		return refreshed.SetTokenInfo(&TokenResponse{AccessToken: "refreshed"})
+	})
+	require.NoError(t, err)
+
+	loaded, err := getCookieSession(requestWithCookies(w), store)
+	require.NoError(t, err)
+	tokenInfo, ok, err := loaded.GetTokenInfo()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "refreshed", tokenInfo.AccessToken)
+
+	err = store.Update(SessionKeyDpop, "missing", func(s *sessions.Session) error { return nil })
+	require.Error(t, err)
+}
+
+func TestSQLiteSessionStoreLargeSession(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+
+	// Larger than securecookie's default limit of 4096 bytes, which only applies to the cookie
+	value := []byte(strings.Repeat("x", 16*1024))
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, SessionKeyDpop)
+	require.NoError(t, err)
+	session.Values["key"] = value
+	require.NoError(t, session.Save(r, w))
+
+	loaded, err := store.New(requestWithCookies(w), SessionKeyDpop)
+	require.NoError(t, err)
+	require.False(t, loaded.IsNew)
+	require.Equal(t, value, loaded.Values["key"])
+
+	// Updates aren't limited either
+	err = store.Update(SessionKeyDpop, session.ID, func(s *sessions.Session) error {
+		s.Values["other"] = value
+		return nil
+	})
+	require.NoError(t, err)
+	loaded, err = store.New(requestWithCookies(w), SessionKeyDpop)
+	require.NoError(t, err)
+	require.Equal(t, value, loaded.Values["other"])
+}
+
+func TestSQLiteSessionStoreUndecodableCookie(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+
+	// A cookie left by the old cookie store, which signed whole sessions with another key
+	old := sessions.NewCookieStore([]byte("old-cookie-store-key"))
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	oldSession, err := old.New(r, SessionKeyDpop)
+	require.NoError(t, err)
+	oldSession.Values["key"] = []byte("value")
+	require.NoError(t, oldSession.Save(r, w))
+
+	session, err := store.New(requestWithCookies(w), SessionKeyDpop)
+	require.NoError(t, err)
+	require.True(t, session.IsNew)
+	require.Empty(t, session.ID)
+	require.Empty(t, session.Values)
+
+	_, err = getCookieSession(requestWithCookies(w), store)
+	require.ErrorIs(t, err, errNotLoggedIn)
+}
+
+func TestSQLiteSessionStoreRegenerate(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, SessionKeyDpop)
+	require.NoError(t, err)
+	session.Values["key"] = []byte("value")
+	require.NoError(t, session.Save(r, w))
+	oldID := session.ID
+
+	require.NoError(t, store.Regenerate(session))
+	w2 := httptest.NewRecorder()
+	require.NoError(t, session.Save(requestWithCookies(w), w2))
+	require.NotEqual(t, oldID, session.ID)
+
+	// The old cookie no longer refers to the session, while the new one does
+	stale, err := store.New(requestWithCookies(w), SessionKeyDpop)
+	require.NoError(t, err)
+	require.True(t, stale.IsNew)
+	loaded, err := store.New(requestWithCookies(w2), SessionKeyDpop)
+	require.NoError(t, err)
+	require.False(t, loaded.IsNew)
+	require.Equal(t, []byte("value"), loaded.Values["key"])
+}
+
+func TestLoadOrCreateSessionKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets", "session_keys.json")
+	keys, err := LoadOrCreateSessionKeys(path)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	reloaded, err := LoadOrCreateSessionKeys(path)
+	require.NoError(t, err)
+	require.Equal(t, keys, reloaded)
+}
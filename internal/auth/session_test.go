@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"fmt"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/require"
 )
@@ -39,9 +43,8 @@ func TestSession(t *testing.T) {
 		ExpiresIn:    3600,
 	}
 
-	// Step 1: Create a new session
-	session, err := newCookieSession(req, sessionStore, testIdentity, "https://test.pds.com")
-	require.NoError(t, err)
+	// Step 1: Log in to a new session
+	session := testLogin(t, req, sessionStore, testIdentity, "https://test.pds.com")
 	require.NotNil(t, session)
 
 	// Get the key that was generated during session creation
@@ -130,3 +133,163 @@ func TestSession(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, "test-nonce-123", retrievedNonce)
 }
+
+func TestSessionMultipleAccounts(t *testing.T) {
+	sessionStore := sessions.NewCookieStore([]byte("test-key"))
+	req := httptest.NewRequest("GET", "/test", nil)
+
+	personal := testIdentity("https://personal.pds.com")
+	project := &identity.Identity{
+		DID:    "did:plc:project",
+		Handle: "project.bsky.app",
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {URL: "https://project.pds.com"},
+		},
+	}
+
+	first := testLogin(t, req, sessionStore, personal, "https://personal.pds.com")
+	require.NoError(t, first.SetTokenInfo(&TokenResponse{AccessToken: "personal-token"}))
+
+	// An abandoned login leaves the logged in accounts alone
+	_, err := newCookieSession(req, sessionStore, project, "https://project.pds.com")
+	require.NoError(t, err)
+	active, err := getCookieSession(req, sessionStore)
+	require.NoError(t, err)
+	require.Equal(t, personal.DID.String(), active.Account())
+	_, err = getAccountSession(req, sessionStore, project.DID.String())
+	require.Error(t, err)
+
+	// The most recent login becomes active
+	second := testLogin(t, req, sessionStore, project, "https://project.pds.com")
+	require.NoError(t, second.SetTokenInfo(&TokenResponse{AccessToken: "project-token"}))
+	require.True(t, second.IsActive())
+	require.False(t, first.IsActive())
+
+	w := httptest.NewRecorder()
+	second.Save(req, w)
+	newReq := httptest.NewRequest("GET", "/test", nil)
+	for _, cookie := range w.Result().Cookies() {
+		newReq.AddCookie(cookie)
+	}
+
+	// Each account keeps its own values
+	active, err = getCookieSession(newReq, sessionStore)
+	require.NoError(t, err)
+	require.Equal(t, []string{personal.DID.String(), project.DID.String()}, active.Accounts())
+	require.Equal(t, project.DID.String(), active.Account())
+	tokenInfo, ok, err := active.GetTokenInfo()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "project-token", tokenInfo.AccessToken)
+
+	personalSession, err := getAccountSession(newReq, sessionStore, personal.DID.String())
+	require.NoError(t, err)
+	tokenInfo, ok, err = personalSession.GetTokenInfo()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "personal-token", tokenInfo.AccessToken)
+	pdsURL, ok, err := personalSession.GetPDSURL()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "https://personal.pds.com", pdsURL)
+
+	// Logging in to an account again replaces its earlier login
+	firstKey, _, err := personalSession.GetDpopKey()
+	require.NoError(t, err)
+	login, err := newCookieSession(newReq, sessionStore, personal, "https://personal.pds.com")
+	require.NoError(t, err)
+	relogin, replaced, err := login.completeLogin()
+	require.NoError(t, err)
+	require.NotNil(t, replaced)
+	replacedKey, _, err := replaced.GetDpopKey()
+	require.NoError(t, err)
+	require.True(t, firstKey.Equal(replacedKey))
+	newKey, _, err := relogin.GetDpopKey()
+	require.NoError(t, err)
+	require.False(t, firstKey.Equal(newKey))
+	require.Equal(t, []string{personal.DID.String(), project.DID.String()}, relogin.Accounts())
+	require.True(t, relogin.IsActive())
+
+	// Removing the active account activates the most recent remaining login
+	relogin.remove()
+	require.Equal(t, []string{project.DID.String()}, relogin.Accounts())
+	active, err = getCookieSession(newReq, sessionStore)
+	require.NoError(t, err)
+	require.Equal(t, project.DID.String(), active.Account())
+
+	active.remove()
+	require.Empty(t, active.Accounts())
+	_, err = getCookieSession(newReq, sessionStore)
+	require.Error(t, err)
+}
+
+// realisticIdentity returns an identity about the size of a resolved DID document.
+func realisticIdentity(did, handle, pdsURL string) *identity.Identity {
+	return &identity.Identity{
+		DID:         syntax.DID(did),
+		Handle:      syntax.Handle(handle),
+		AlsoKnownAs: []string{"at://" + handle},
+		Keys: map[string]identity.VerificationMethod{
+			"atproto": {
+				Type:               "Multikey",
+				PublicKeyMultibase: "zQ3shXjHeiBuRCKmM36cuYnm7YEMzhGnCmCyW92sRJ9pribSF",
+			},
+		},
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: pdsURL},
+			"habitat":     {Type: "HabitatServer", URL: pdsURL + "/habitat"},
+		},
+	}
+}
+
+// realisticTokens returns tokens about the size of the ones a PDS issues.
+func realisticTokens(did string) *TokenResponse {
+	return &TokenResponse{
+		AccessToken:  "eyJ" + strings.Repeat("a", 1100),
+		RefreshToken: "ref-" + strings.Repeat("r", 400),
+		Scope:        "atproto transition:generic",
+		TokenType:    "DPoP",
+		ExpiresIn:    3600,
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Sub:          did,
+	}
+}
+
+func TestSessionMultipleAccountsSQLiteStore(t *testing.T) {
+	store := testSQLiteSessionStore(t)
+	req := httptest.NewRequest("GET", "/test", nil)
+
+	var dids []string
+	for i := range 3 {
+		did := fmt.Sprintf("did:plc:account%d", i)
+		pdsURL := fmt.Sprintf("https://pds%d.example.com", i)
+		id := realisticIdentity(did, fmt.Sprintf("account%d.example.com", i), pdsURL)
+		session := testLogin(t, req, store, id, pdsURL)
+		require.NoError(t, session.SetTokenInfo(realisticTokens(did)))
+		require.NoError(t, session.SetDpopNonce("nonce-"+strings.Repeat("n", 40)))
+		dids = append(dids, did)
+	}
+
+	// The session is well beyond what fits in a cookie, but saves and reloads
+	active, err := getCookieSession(req, store)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	active.Save(req, w)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	loaded, err := getCookieSession(requestWithCookies(w), store)
+	require.NoError(t, err)
+	require.Equal(t, dids, loaded.Accounts())
+	for _, did := range dids {
+		account, err := getAccountSession(requestWithCookies(w), store, did)
+		require.NoError(t, err)
+		tokenInfo, ok, err := account.GetTokenInfo()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, did, tokenInfo.Sub)
+		id, ok, err := account.GetIdentity()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, did, id.DID.String())
+	}
+}
@@ -74,8 +74,20 @@ func fakeAuthServer(t *testing.T, responses map[string]interface{}) *httptest.Se
 				TokenEndpoint: "http://" + r.Host + "/token",
 				PAREndpoint:   "http://" + r.Host + "/par",
 				AuthEndpoint:  "http://" + r.Host + "/auth",
+
+				RevocationEndpoint: "http://" + r.Host + "/revoke",
 			})
 
+		case "/revoke":
+			if status, ok := responses["revoke-status"]; ok {
+				w.WriteHeader(status.(int))
+				return
+			}
+			// Record the revoked token if the test asked for it
+			if revoked, ok := responses["revoked"]; ok {
+				*revoked.(*[]string) = append(*revoked.(*[]string), r.FormValue("token"))
+			}
+
 		case "/par":
 			if resp, ok := responses["par"]; ok {
 				if status, ok := responses["par-status"]; ok {
@@ -235,7 +247,7 @@ func testDpopSession(t *testing.T, opts DpopSessionOptions) *cookieSession {
 
 	// Remove identity if explicitly requested
 	if opts.RemoveIdentity {
-		delete(dpopSession.session.Values, cIdentitySessionKey)
+		delete(dpopSession.session.Values, dpopSession.valueKey(cIdentitySessionKey))
 	}
 
 	// Save the session
@@ -244,6 +256,22 @@ func testDpopSession(t *testing.T, opts DpopSessionOptions) *cookieSession {
 	return dpopSession
 }
 
+// testLogin logs in to the account with the given identity, as the login and callback handlers
+// would, returning the logged in account.
+func testLogin(
+	t *testing.T,
+	r *http.Request,
+	sessionStore sessions.Store,
+	id *identity.Identity,
+	pdsURL string,
+) *cookieSession {
+	login, err := newCookieSession(r, sessionStore, id, pdsURL)
+	require.NoError(t, err)
+	dpopSession, _, err := login.completeLogin()
+	require.NoError(t, err)
+	return dpopSession
+}
+
 // stringPtr returns a pointer to the given string
 func stringPtr(s string) *string {
 	return &s
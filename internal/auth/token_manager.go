@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// sessionIdleTTL is how long a session can go unused before the TokenManager stops tracking it,
+// and so stops refreshing its tokens. Refreshed tokens are persisted, so a session that is used
+// again later is simply tracked anew.
+const sessionIdleTTL = 24 * time.Hour
+
+// ErrSessionNotTracked is returned for sessions the TokenManager doesn't know about.
+var ErrSessionNotTracked = errors.New("session is not tracked")
+
+// TokenSession is what a TokenManager needs to use and refresh a session's PDS tokens.
+type TokenSession struct {
+	DpopKey   *ecdsa.PrivateKey
+	Identity  *identity.Identity
+	Issuer    string
+	TokenInfo *TokenResponse
+	// Persist, if set, is called with refreshed tokens so they outlive the manager.
+	Persist func(*TokenResponse) error
+}
+
+type managedSession struct {
+	// mu serializes refreshes, since refresh tokens can only be used once.
+	mu      sync.Mutex
+	session TokenSession
+	nonce   *syncNonce
+
+	// lastUsed is guarded by the TokenManager's mutex.
+	lastUsed time.Time
+}
+
+// TokenManager keeps the PDS tokens of active sessions fresh, refreshing them before they expire
+// rather than waiting for the PDS to reject them.
+type TokenManager struct {
+	oauthClient   OAuthClient
+	refreshBefore time.Duration
+	idleTTL       time.Duration
+	now           func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*managedSession
+}
+
+// NewTokenManager returns a TokenManager that refreshes tokens once they are within
+// refreshBefore of expiring.
+func NewTokenManager(oauthClient OAuthClient, refreshBefore time.Duration) *TokenManager {
+	return &TokenManager{
+		oauthClient:   oauthClient,
+		refreshBefore: refreshBefore,
+		idleTTL:       sessionIdleTTL,
+		now:           time.Now,
+		sessions:      make(map[string]*managedSession),
+	}
+}
+
+// SessionID returns the ID a session is tracked under: the thumbprint of its DPoP key, which is
+// unique to the session and stable across refreshes.
+func SessionID(dpopKey *ecdsa.PrivateKey) (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: dpopKey.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// Track starts tracking the session with the given ID. load is only called if the session isn't
+// tracked yet, so the current tokens held by the manager are never replaced by stale ones.
+func (m *TokenManager) Track(id string, load func() (*TokenSession, error)) error {
+	if _, err := m.get(id); err == nil {
+		return nil
+	}
+	// load may need the network, so it is called without holding the lock
+	session, err := load()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		m.sessions[id] = &managedSession{
+			session:  *session,
+			nonce:    &syncNonce{},
+			lastUsed: m.now(),
+		}
+	}
+	return nil
+}
+
+// Forget stops tracking the session, e.g. once it has been logged out. It returns the session's
+// latest tokens, or nil if it wasn't tracked.
+func (m *TokenManager) Forget(id string) *TokenResponse {
+	m.mu.Lock()
+	session, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	// Wait for any refresh in progress, so its tokens are the ones returned
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.session.TokenInfo
+}
+
+func (m *TokenManager) get(id string) (*managedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotTracked
+	}
+	session.lastUsed = m.now()
+	return session, nil
+}
+
+// TokenInfo returns the session's current tokens, refreshing them first if they are about to
+// expire.
+func (m *TokenManager) TokenInfo(id string) (*TokenResponse, error) {
+	session, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if m.expiring(session.session.TokenInfo) {
+		err = m.refresh(session)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return session.session.TokenInfo, nil
+}
+
+// Refresh refreshes the session's tokens after the PDS rejected staleAccessToken. If another
+// request already replaced that token, the current tokens are returned without refreshing again.
+func (m *TokenManager) Refresh(id string, staleAccessToken string) (*TokenResponse, error) {
+	session, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.session.TokenInfo.AccessToken == staleAccessToken {
+		err = m.refresh(session)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return session.session.TokenInfo, nil
+}
+
+// Client returns a DPoP client that makes requests to the PDS as the session. Clients for the
+// same session share its DPoP nonce.
+func (m *TokenManager) Client(id string, opts ...DpopOption) (*DpopHttpClient, error) {
+	tokenInfo, err := m.TokenInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	session, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]DpopOption{WithAccessToken(tokenInfo.AccessToken)}, opts...)
+	return NewDpopHttpClient(session.session.DpopKey, session.nonce, opts...), nil
+}
+
+// RefreshExpiringEvery refreshes the tokens of every session that is about to expire on the
+// given interval, until ctx is cancelled. Sessions whose refresh fails, or that haven't been used
+// within the idle TTL, are no longer tracked.
+func (m *TokenManager) RefreshExpiringEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refreshExpiring()
+		}
+	}
+}
+
+func (m *TokenManager) refreshExpiring() {
+	m.mu.Lock()
+	sessions := make(map[string]*managedSession, len(m.sessions))
+	for id, session := range m.sessions {
+		if m.now().Sub(session.lastUsed) > m.idleTTL {
+			delete(m.sessions, id)
+			continue
+		}
+		sessions[id] = session
+	}
+	m.mu.Unlock()
+
+	for id, session := range sessions {
+		session.mu.Lock()
+		var err error
+		if m.expiring(session.session.TokenInfo) {
+			err = m.refresh(session)
+		}
+		session.mu.Unlock()
+		if err != nil {
+			log.Error().Err(err).Msgf("error refreshing tokens for session of %s", session.session.Identity.DID)
+			m.Forget(id)
+		}
+	}
+}
+
+// expiring reports whether the tokens need refreshing. Tokens with an unknown expiry are left to
+// be refreshed when the PDS rejects them.
+func (m *TokenManager) expiring(tokenInfo *TokenResponse) bool {
+	if tokenInfo.ExpiresAt.IsZero() {
+		return false
+	}
+	return !m.now().Add(m.refreshBefore).Before(tokenInfo.ExpiresAt)
+}
+
+// refresh must be called with the session's mutex held.
+func (m *TokenManager) refresh(session *managedSession) error {
+	tokenResp, err := m.oauthClient.RefreshToken(
+		NewDpopHttpClient(session.session.DpopKey, session.nonce),
+		session.session.Identity,
+		session.session.Issuer,
+		session.session.TokenInfo.RefreshToken,
+	)
+	if err != nil {
+		return err
+	}
+	session.session.TokenInfo = tokenResp
+
+	if session.session.Persist != nil {
+		err = session.session.Persist(tokenResp)
+		if err != nil {
+			log.Error().Err(err).Msg("error persisting refreshed tokens")
+		}
+	}
+	return nil
+}
+
+// syncNonce is a DpopNonceProvider that is safe to share between concurrent requests.
+type syncNonce struct {
+	mu    sync.RWMutex
+	nonce string
+}
+
+var _ DpopNonceProvider = (*syncNonce)(nil)
+
+// GetDpopNonce implements DpopNonceProvider.
+func (n *syncNonce) GetDpopNonce() (string, bool, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.nonce, n.nonce != "", nil
+}
+
+// SetDpopNonce implements DpopNonceProvider.
+func (n *syncNonce) SetDpopNonce(nonce string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nonce = nonce
+	return nil
+}
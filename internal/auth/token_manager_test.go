@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/stretchr/testify/require"
+)
+
+// refreshingOAuthClient hands out numbered tokens, counting how often it is asked to refresh.
+type refreshingOAuthClient struct {
+	OAuthClient
+
+	mu        sync.Mutex
+	refreshes int
+	err       error
+}
+
+func (c *refreshingOAuthClient) RefreshToken(
+	dpopClient *DpopHttpClient,
+	identity *identity.Identity,
+	issuer string,
+	refreshToken string,
+) (*TokenResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.refreshes++
+	return &TokenResponse{
+		AccessToken:  fmt.Sprintf("access-token-%d", c.refreshes),
+		RefreshToken: fmt.Sprintf("refresh-token-%d", c.refreshes),
+		ExpiresIn:    3600,
+		ExpiresAt:    time.Now().Add(time.Hour),
+	}, nil
+}
+
+func (c *refreshingOAuthClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshes
+}
+
+func trackTestSession(t *testing.T, m *TokenManager, expiresAt time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	id, err := SessionID(key)
+	require.NoError(t, err)
+	err = m.Track(id, func() (*TokenSession, error) {
+		return &TokenSession{
+			DpopKey:  key,
+			Identity: testIdentity("https://pds.example.com"),
+			Issuer:   "https://pds.example.com",
+			TokenInfo: &TokenResponse{
+				AccessToken:  "access-token-0",
+				RefreshToken: "refresh-token-0",
+				ExpiresAt:    expiresAt,
+			},
+		}, nil
+	})
+	require.NoError(t, err)
+	return id
+}
+
+func TestTokenManagerRefreshesBeforeExpiry(t *testing.T) {
+	client := &refreshingOAuthClient{}
+	m := NewTokenManager(client, 5*time.Minute)
+
+	fresh := trackTestSession(t, m, time.Now().Add(time.Hour))
+	expiring := trackTestSession(t, m, time.Now().Add(time.Minute))
+	unknown := trackTestSession(t, m, time.Time{})
+
+	tokenInfo, err := m.TokenInfo(fresh)
+	require.NoError(t, err)
+	require.Equal(t, "access-token-0", tokenInfo.AccessToken)
+
+	tokenInfo, err = m.TokenInfo(unknown)
+	require.NoError(t, err)
+	require.Equal(t, "access-token-0", tokenInfo.AccessToken)
+
+	tokenInfo, err = m.TokenInfo(expiring)
+	require.NoError(t, err)
+	require.Equal(t, "access-token-1", tokenInfo.AccessToken)
+	require.Equal(t, 1, client.count())
+
+	// Tracking an already tracked session doesn't replace its refreshed tokens
+	require.NoError(t, m.Track(expiring, func() (*TokenSession, error) {
+		return nil, errors.New("should not be called")
+	}))
+	tokenInfo, err = m.TokenInfo(expiring)
+	require.NoError(t, err)
+	require.Equal(t, "access-token-1", tokenInfo.AccessToken)
+
+	_, err = m.TokenInfo("unknown")
+	require.ErrorIs(t, err, ErrSessionNotTracked)
+}
+
+func TestTokenManagerConcurrentRefresh(t *testing.T) {
+	client := &refreshingOAuthClient{}
+	m := NewTokenManager(client, 5*time.Minute)
+	id := trackTestSession(t, m, time.Now().Add(time.Hour))
+
+	// Every request sees the PDS reject the same token, but it must only be refreshed once, as
+	// the refresh token can't be reused.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokenInfo, err := m.Refresh(id, "access-token-0")
+			require.NoError(t, err)
+			require.Equal(t, "access-token-1", tokenInfo.AccessToken)
+
+			dpopClient, err := m.Client(id)
+			require.NoError(t, err)
+			require.NoError(t, dpopClient.nonceProvider.SetDpopNonce("nonce"))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, client.count())
+}
+
+func TestTokenManagerRefreshExpiring(t *testing.T) {
+	client := &refreshingOAuthClient{}
+	m := NewTokenManager(client, 5*time.Minute)
+	fresh := trackTestSession(t, m, time.Now().Add(time.Hour))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	expiring, err := SessionID(key)
+	require.NoError(t, err)
+	persisted := []string{}
+	require.NoError(t, m.Track(expiring, func() (*TokenSession, error) {
+		return &TokenSession{
+			DpopKey:  key,
+			Identity: testIdentity("https://pds.example.com"),
+			TokenInfo: &TokenResponse{
+				RefreshToken: "refresh-token-0",
+				ExpiresAt:    time.Now().Add(time.Minute),
+			},
+			Persist: func(tokenInfo *TokenResponse) error {
+				persisted = append(persisted, tokenInfo.AccessToken)
+				return nil
+			},
+		}, nil
+	}))
+
+	m.refreshExpiring()
+	require.Equal(t, 1, client.count())
+	require.Equal(t, []string{"access-token-1"}, persisted)
+
+	// Sessions that can no longer be refreshed are dropped
+	m.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	client.err = errors.New("invalid_grant")
+	m.refreshExpiring()
+	_, err = m.TokenInfo(fresh)
+	require.ErrorIs(t, err, ErrSessionNotTracked)
+	require.Nil(t, m.Forget(expiring))
+}
+
+func TestTokenManagerEvictsIdleSessions(t *testing.T) {
+	client := &refreshingOAuthClient{}
+	m := NewTokenManager(client, 5*time.Minute)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.idleTTL = 10 * time.Minute
+	idle := trackTestSession(t, m, now.Add(time.Minute))
+	active := trackTestSession(t, m, now.Add(time.Minute))
+
+	// Only the session used within the idle TTL is kept, and refreshed
+	now = now.Add(m.idleTTL)
+	_, err := m.TokenInfo(active)
+	require.NoError(t, err)
+	require.Equal(t, 1, client.count())
+	now = now.Add(time.Minute)
+	m.refreshExpiring()
+	_, err = m.TokenInfo(idle)
+	require.ErrorIs(t, err, ErrSessionNotTracked)
+	require.Equal(t, 1, client.count())
+
+	tokenInfo, err := m.TokenInfo(active)
+	require.NoError(t, err)
+	require.Equal(t, "access-token-1", tokenInfo.AccessToken)
+}
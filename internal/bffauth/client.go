@@ -1,28 +1,212 @@
 package bffauth
 
-import "github.com/bluesky-social/indigo/atproto/atcrypto"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenRefreshMargin is how long before a cached token expires the client fetches a new one, so
+// that requests made with it don't fail in flight.
+const tokenRefreshMargin = time.Minute
+
+// habitatServiceID is the service in a DID document that points at the user's Habitat node.
+const habitatServiceID = "habitat"
+
+// ExternalHabitatUser is a user on another Habitat node that this node can request tokens from.
 type ExternalHabitatUser struct {
-	DID       string
-	PublicKey atcrypto.PublicKey
-	Host      string
+	DID string
+	// Host is the base URL the user's node serves the Provider routes under, e.g.
+	// https://node.example.com
+	Host string
 }
 
+// Client gets tokens this node can use to authenticate with other Habitat nodes.
 type Client interface {
 	GetToken(did string) (string, error)
 }
 
 type client struct {
-	// This is the store of temporary friends that are added to the BFF.
-	// Helps us avoid implementing full public key resolution from DIDs with TailScale / localhost  setups
-	// tempFriendStore map[string]*ExternalHabitatUser
+	did        string
+	privateKey atcrypto.PrivateKey
+	httpClient *http.Client
+	now        func() time.Time
+
+	// Resolves the DID documents of users whose node isn't given explicitly.
+	dir identity.Directory
+
+	mu    sync.Mutex
+	peers map[string]*peer
 }
 
-func NewClient() Client {
-	return &client{}
+// peer is an external user whose node we have resolved, along with the last token their node issued us.
+type peer struct {
+	user *ExternalHabitatUser
+
+	// Held while fetching a token, so concurrent callers share a single handshake
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
 }
 
+// NewClient returns a client that authenticates as did to the nodes of other users, proving it
+// holds privateKey. The key must be published in the DID document of did.
+//
+// A user's node is found through the habitat service in their DID document, resolved with dir. The
+// given peers override this, which is useful for nodes that can't be resolved, e.g. on localhost.
+func NewClient(
+	did string,
+	privateKey atcrypto.PrivateKey,
+	dir identity.Directory,
+	peers ...*ExternalHabitatUser,
+) Client {
+	c := &client{
+		did:        did,
+		privateKey: privateKey,
+		httpClient: http.DefaultClient,
+		now:        time.Now,
+		dir:        dir,
+		peers:      make(map[string]*peer),
+	}
+	for _, user := range peers {
+		c.peers[user.DID] = &peer{user: user}
+	}
+	return c
+}
+
+// GetToken returns a token for the node of the user with the given DID. Tokens are cached until
+// shortly before they expire, after which a new one is requested.
 func (c *client) GetToken(did string) (string, error) {
-	// Stub - not implemented
-	return "", nil
+	p, err := c.peer(did)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && c.now().Add(tokenRefreshMargin).Before(p.expiresAt) {
+		return p.token, nil
+	}
+
+	token, expiresAt, err := c.authenticate(p.user.Host)
+	if err != nil {
+		return "", fmt.Errorf("authenticating with the node of %s: %w", did, err)
+	}
+	p.token = token
+	p.expiresAt = expiresAt
+	return token, nil
+}
+
+// peer returns the entry for the user with the given DID, resolving their node from their DID
+// document the first time they are seen.
+func (c *client) peer(did string) (*peer, error) {
+	c.mu.Lock()
+	p, ok := c.peers[did]
+	c.mu.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	host, err := c.resolveHost(context.Background(), did)
+	if err != nil {
+		return nil, fmt.Errorf("resolving the node of %s: %w", did, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another caller may have resolved the same user in the meantime
+	if p, ok := c.peers[did]; ok {
+		return p, nil
+	}
+	p = &peer{user: &ExternalHabitatUser{DID: did, Host: host}}
+	c.peers[did] = p
+	return p, nil
+}
+
+// resolveHost returns the habitat service endpoint declared in the DID document of did.
+func (c *client) resolveHost(ctx context.Context, did string) (string, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return "", err
+	}
+	id, err := c.dir.LookupDID(ctx, parsed)
+	if err != nil {
+		return "", err
+	}
+	endpoint := id.GetServiceEndpoint(habitatServiceID)
+	if endpoint == "" {
+		return "", fmt.Errorf("%s does not declare a habitat node", did)
+	}
+	return endpoint, nil
+}
+
+// authenticate performs the challenge handshake with the node at host, returning the token it
+// issues and when the token expires.
+func (c *client) authenticate(host string) (string, time.Time, error) {
+	host = strings.TrimSuffix(host, "/")
+
+	var challenge ChallengeResponse
+	err := c.post(host+"/node/bff/challenge", ChallengeRequest{
+		DID: c.did,
+	}, &challenge)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("requesting challenge: %w", err)
+	}
+
+	proof, err := GenerateProof(challenge.Challenge, c.privateKey)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("generating proof: %w", err)
+	}
+
+	var auth AuthResponse
+	err = c.post(host+"/node/bff/auth", AuthRequest{
+		SessionID: challenge.Session,
+		Proof:     proof,
+	}, &auth)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("submitting proof: %w", err)
+	}
+
+	// The token is validated by the node that issued it, so we only need its expiry here
+	claims := &jwt.RegisteredClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(auth.Token, claims)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing token: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return "", time.Time{}, fmt.Errorf("token has no expiry")
+	}
+	return auth.Token, claims.ExpiresAt.Time, nil
+}
+
+func (c *client) post(url string, body any, result any) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Post(url, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d: %s", url, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return json.Unmarshal(respBody, result)
 }
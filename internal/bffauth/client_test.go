@@ -0,0 +1,105 @@
+package bffauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eagraf/habitat-new/internal/node/api"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientGetToken(t *testing.T) {
+	// The other node serves the provider routes
+	signingKey, dir := newTestNode(t)
+	p := NewProvider(NewInMemorySessionPersister(), testNodeDID, signingKey, dir)
+	logger := zerolog.Nop()
+	router := api.NewRouter(p.GetRoutes(), &logger)
+	handshakes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/node/bff/challenge" {
+			handshakes++
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	privateKey, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	insertNode(dir, "did:plc:alice", privateKey)
+	c := NewClient("did:plc:alice", privateKey, dir, &ExternalHabitatUser{
+		DID:  "did:plc:bob",
+		Host: server.URL + "/",
+	}).(*client)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	// The token is issued for our DID
+	token, err := c.GetToken("did:plc:bob")
+	require.NoError(t, err)
+	did, err := p.ValidateToken(token)
+	require.NoError(t, err)
+	require.Equal(t, "did:plc:alice", did)
+	require.Equal(t, 1, handshakes)
+
+	// It is reused until shortly before it expires
+	cached, err := c.GetToken("did:plc:bob")
+	require.NoError(t, err)
+	require.Equal(t, token, cached)
+	require.Equal(t, 1, handshakes)
+
+	now = now.Add(15*time.Minute - tokenRefreshMargin)
+	_, err = c.GetToken("did:plc:bob")
+	require.NoError(t, err)
+	require.Equal(t, 2, handshakes)
+
+	// Users whose node can't be resolved can't be authenticated with
+	_, err = c.GetToken("did:plc:carol")
+	require.ErrorContains(t, err, "resolving the node of did:plc:carol")
+
+	// Handshakes the other node rejects are reported
+	other, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	c.peers["did:plc:bob"].token = ""
+	c.privateKey = other
+	_, err = c.GetToken("did:plc:bob")
+	require.ErrorContains(t, err, "401")
+}
+
+func TestClientGetTokenResolvesNode(t *testing.T) {
+	signingKey, dir := newTestNode(t)
+	p := NewProvider(NewInMemorySessionPersister(), testNodeDID, signingKey, dir)
+	logger := zerolog.Nop()
+	server := httptest.NewServer(api.NewRouter(p.GetRoutes(), &logger))
+	defer server.Close()
+
+	privateKey, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	insertNode(dir, "did:plc:alice", privateKey)
+
+	// Bob's node is only known through the habitat service in his DID document
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID("did:plc:bob"),
+		Handle: syntax.HandleInvalid,
+		Services: map[string]identity.ServiceEndpoint{
+			habitatServiceID: {Type: "HabitatServer", URL: server.URL},
+		},
+	})
+	c := NewClient("did:plc:alice", privateKey, dir)
+
+	token, err := c.GetToken("did:plc:bob")
+	require.NoError(t, err)
+	did, err := p.ValidateToken(token)
+	require.NoError(t, err)
+	require.Equal(t, "did:plc:alice", did)
+
+	// Users without a habitat node are rejected
+	insertNode(dir, "did:plc:carol", privateKey)
+	_, err = c.GetToken("did:plc:carol")
+	require.ErrorContains(t, err, "does not declare a habitat node")
+}
@@ -9,16 +9,24 @@ import (
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/eagraf/habitat-new/internal/bffauth"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 type TestServer struct {
 	challengePersister bffauth.ChallengeSessionPersister
 
-	// Used for HMAC signing of JWTs.
-	signingKey []byte
+	// The server's DID, and the key it signs JWTs with.
+	did        string
+	signingKey atcrypto.PrivateKey
+
+	// Resolves the server's own DID document, so that it can validate the tokens it issues.
+	dir identity.Directory
 
 	// This is a toy example. In the real world there would be a mapping of
 	// DIDs to public keys.
@@ -73,18 +81,12 @@ func (s *TestServer) authHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := s.challengePersister.GetSession(req.SessionID)
+	session, err := s.challengePersister.ConsumeSession(req.SessionID)
 	if err != nil {
 		http.Error(w, "Invalid session", http.StatusBadRequest)
 		return
 	}
 
-	err = s.challengePersister.DeleteSession(req.SessionID)
-	if err != nil {
-		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
-		return
-	}
-
 	// Verify proof
 	valid, err := bffauth.VerifyProof(session.Challenge, req.Proof, s.publicKey)
 	if err != nil || !valid {
@@ -93,7 +95,7 @@ func (s *TestServer) authHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate JWT
-	token, err := bffauth.GenerateJWT(s.signingKey, "test-did")
+	token, err := bffauth.GenerateJWT(s.signingKey, s.did, "did:plc:alice", s.did)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
@@ -115,7 +117,7 @@ func (s *TestServer) HelloWorldAuthenticatedHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err := bffauth.ValidateRequest(r, s.signingKey)
+	_, err := bffauth.ValidateRequest(r, s.did, s.dir)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -145,12 +147,39 @@ func main() {
 		log.Fatalf("failed to parse public key: %v", err)
 	}
 
-	// In-memory session storage for demo purposes
-	sessionPersister := bffauth.NewInMemorySessionPersister()
+	// Sessions are kept in sqlite, so handshakes survive a restart of the server
+	sessionDB, err := gorm.Open(sqlite.Open("bffauth.db"), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("failed to open session database: %v", err)
+	}
+	sessionPersister, err := bffauth.NewSQLiteSessionPersister(sessionDB)
+	if err != nil {
+		log.Fatalf("failed to create session persister: %v", err)
+	}
+
+	signingKey, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		log.Fatalf("failed to generate signing key: %v", err)
+	}
+	signingPublicKey, err := signingKey.PublicKey()
+	if err != nil {
+		log.Fatalf("failed to get signing public key: %v", err)
+	}
+	did := "did:web:localhost"
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.HandleInvalid,
+		Keys: map[string]identity.VerificationMethod{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: signingPublicKey.Multibase()},
+		},
+	})
 
 	server := &TestServer{
 		challengePersister: sessionPersister,
-		signingKey:         []byte("test-signing-key"),
+		did:                did,
+		signingKey:         signingKey,
+		dir:                &dir,
 		publicKey:          publicKey,
 	}
 
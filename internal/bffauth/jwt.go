@@ -1,24 +1,41 @@
 package bffauth
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/golang-jwt/jwt/v5"
+
+	// Registers the ES256 signing method for atcrypto keys
+	_ "github.com/bluesky-social/indigo/atproto/auth"
 )
 
-// GenerateJWT creates a signed JWT token containing the provided claims
-// The claims are signed using HMAC with the provided signing key
-func GenerateJWT(signingKey []byte, did string) (string, error) {
+// tokenTTL is how long tokens are valid for after they are issued.
+const tokenTTL = 15 * time.Minute
+
+// GenerateJWT creates a token showing that its holder authenticated as the subject DID.
+// The token is issued by the node with the issuer DID and signed with that node's P-256 key, and
+// is only accepted by the node with the audience DID.
+func GenerateJWT(signingKey atcrypto.PrivateKey, issuer, subject, audience string) (string, error) {
+	if _, ok := signingKey.(*atcrypto.PrivateKeyP256); !ok {
+		return "", fmt.Errorf("tokens must be signed with a P-256 key")
+	}
+	now := time.Now()
 	claims := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Audience:  jwt.ClaimStrings([]string{did}),
+		Issuer:    issuer,
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings([]string{audience}),
+		ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod("ES256"), claims)
 	signedToken, err := token.SignedString(signingKey)
 	if err != nil {
 		return "", fmt.Errorf("error signing token: %w", err)
@@ -27,56 +44,93 @@ func GenerateJWT(signingKey []byte, did string) (string, error) {
 	return signedToken, nil
 }
 
-// ValidateJWT validates a JWT token and returns the claims
-// The token is parsed, with the claims validated using the signing key
-func ValidateJWT(tokenString string, signingKey []byte) (*jwt.RegisteredClaims, error) {
-	claims := &jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+// ValidateJWT validates a token issued for the audience DID and returns its claims.
+// The signature is checked against the key the issuer publishes in its DID document, so any node
+// can validate the tokens another node issues.
+func ValidateJWT(
+	ctx context.Context,
+	tokenString string,
+	audience string,
+	dir identity.Directory,
+) (*jwt.RegisteredClaims, error) {
+	return parseJWT(tokenString, audience, func(issuer syntax.DID) (atcrypto.PublicKey, error) {
+		id, err := dir.LookupDID(ctx, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("resolving issuer %s: %w", issuer, err)
 		}
-		return signingKey, nil
+		return id.PublicKey()
 	})
+}
 
+// parseJWT validates a token issued for audience, checking its signature against the key
+// issuerKey returns for the issuer.
+func parseJWT(
+	tokenString string,
+	audience string,
+	issuerKey func(issuer syntax.DID) (atcrypto.PublicKey, error),
+) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		issuer, err := syntax.ParseDID(claims.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid issuer: %w", err)
+		}
+		key, err := issuerKey(issuer)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(*atcrypto.PublicKeyP256); !ok {
+			return nil, fmt.Errorf("issuer %s does not have a P-256 key", issuer)
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{"ES256"}),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing token: %w", err)
 	}
 
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+	if _, err := syntax.ParseDID(claims.Subject); err != nil {
+		return nil, fmt.Errorf("invalid subject: %w", err)
+	}
+
+	return claims, nil
+}
+
+// ValidateRequest validates the bearer token of a request made to the node with the audience DID,
+// and returns the DID the token was issued to.
+func ValidateRequest(r *http.Request, audience string, dir identity.Directory) (string, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return "", err
 	}
 
-	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(time.Now()) {
-		return nil, fmt.Errorf("token has expired")
+	claims, err := ValidateJWT(r.Context(), token, audience, dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %w", err)
 	}
 
-	return claims, nil
+	return claims.Subject, nil
 }
 
-func ValidateRequest(r *http.Request, signingKey []byte) error {
+func bearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return fmt.Errorf("missing Authorization header")
+		return "", fmt.Errorf("missing Authorization header")
 	}
 
 	const prefix = "Bearer "
 	if !strings.HasPrefix(authHeader, prefix) {
-		return fmt.Errorf("invalid Authorization header format")
+		return "", fmt.Errorf("invalid Authorization header format")
 	}
 
 	token := authHeader[len(prefix):]
 	if token == "" {
-		return fmt.Errorf("missing token")
-	}
-
-	claims, err := ValidateJWT(token, signingKey)
-	if err != nil {
-		return fmt.Errorf("invalid token: %w", err)
-	}
-
-	if claims == nil {
-		return fmt.Errorf("invalid claims")
+		return "", fmt.Errorf("missing token")
 	}
 
-	return nil
+	return token, nil
 }
@@ -1,26 +1,57 @@
 package bffauth
 
 import (
+	"context"
 	"net/http"
 	"testing"
 	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 )
 
+const testNodeDID = "did:web:bob.example.com"
+
+// insertNode adds a node publishing the public part of key to dir.
+func insertNode(dir *identity.MockDirectory, did string, key atcrypto.PrivateKey) {
+	pub, _ := key.PublicKey()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.HandleInvalid,
+		Keys: map[string]identity.VerificationMethod{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+}
+
+func newTestNode(t *testing.T) (atcrypto.PrivateKey, *identity.MockDirectory) {
+	signingKey, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	dir := identity.NewMockDirectory()
+	insertNode(&dir, testNodeDID, signingKey)
+	return signingKey, &dir
+}
+
 func TestJWTFlow(t *testing.T) {
-	// Create a test signing key
-	signingKey := []byte("test-signing-key")
+	signingKey, dir := newTestNode(t)
 
-	// Generate JWT with the challenge
-	token, err := GenerateJWT(signingKey, "test-did")
+	// Generate JWT for a user of another node
+	token, err := GenerateJWT(signingKey, testNodeDID, "did:plc:alice", testNodeDID)
 	if err != nil {
 		t.Fatalf("Failed to generate JWT: %v", err)
 	}
 
-	// Validate the JWT
-	claims, err := ValidateJWT(token, signingKey)
+	// Validate the JWT against the issuer's DID document
+	claims, err := ValidateJWT(context.Background(), token, testNodeDID, dir)
 	if err != nil {
 		t.Fatalf("Failed to validate JWT: %v", err)
 	}
+	if claims.Issuer != testNodeDID || claims.Subject != "did:plc:alice" {
+		t.Errorf("Unexpected claims. Got iss %s and sub %s", claims.Issuer, claims.Subject)
+	}
 
 	// Verify expiration time is set correctly (15 minutes from now)
 	expectedExpiry := time.Now().Add(15 * time.Minute)
@@ -28,13 +59,43 @@ func TestJWTFlow(t *testing.T) {
 		t.Errorf("Unexpected expiration time. Got %v, want approximately %v",
 			claims.ExpiresAt.Time, expectedExpiry)
 	}
+
+	// Tokens are only accepted by their audience
+	_, err = ValidateJWT(context.Background(), token, "did:web:carol.example.com", dir)
+	if err == nil {
+		t.Error("Expected token for another audience to fail validation")
+	}
+
+	// Tokens must be signed with the key the issuer publishes
+	otherKey, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	forged, err := GenerateJWT(otherKey, testNodeDID, "did:plc:alice", testNodeDID)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT: %v", err)
+	}
+	_, err = ValidateJWT(context.Background(), forged, testNodeDID, dir)
+	if err == nil {
+		t.Error("Expected token signed with another key to fail validation")
+	}
+
+	// Only P-256 keys sign tokens
+	k256Key, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	_, err = GenerateJWT(k256Key, testNodeDID, "did:plc:alice", testNodeDID)
+	if err == nil {
+		t.Error("Expected signing with a K-256 key to fail")
+	}
 }
 
 func TestValidateRequest(t *testing.T) {
-	signingKey := []byte("test-signing-key")
+	signingKey, dir := newTestNode(t)
 
 	// Generate a valid JWT token
-	token, err := GenerateJWT(signingKey, "test-did")
+	token, err := GenerateJWT(signingKey, testNodeDID, "did:plc:alice", testNodeDID)
 	if err != nil {
 		t.Fatalf("Failed to generate JWT: %v", err)
 	}
@@ -45,10 +106,13 @@ func TestValidateRequest(t *testing.T) {
 	}
 	validReq.Header.Set("Authorization", "Bearer "+token)
 
-	err = ValidateRequest(validReq, signingKey)
+	did, err := ValidateRequest(validReq, testNodeDID, dir)
 	if err != nil {
 		t.Errorf("Expected valid request to pass validation, got error: %v", err)
 	}
+	if did != "did:plc:alice" {
+		t.Errorf("Expected request from did:plc:alice, got %s", did)
+	}
 
 	// Test invalid request (bad token)
 	invalidReq := &http.Request{
@@ -56,7 +120,7 @@ func TestValidateRequest(t *testing.T) {
 	}
 	invalidReq.Header.Set("Authorization", "Bearer invalid-token")
 
-	err = ValidateRequest(invalidReq, signingKey)
+	_, err = ValidateRequest(invalidReq, testNodeDID, dir)
 	if err == nil {
 		t.Error("Expected invalid request to fail validation")
 	}
@@ -66,7 +130,7 @@ func TestValidateRequest(t *testing.T) {
 		Header: make(http.Header),
 	}
 
-	err = ValidateRequest(missingAuthReq, signingKey)
+	_, err = ValidateRequest(missingAuthReq, testNodeDID, dir)
 	if err == nil {
 		t.Error("Expected request with missing Authorization header to fail validation")
 	}
@@ -77,7 +141,7 @@ func TestValidateRequest(t *testing.T) {
 	}
 	malformedReq.Header.Set("Authorization", "BadPrefix "+token)
 
-	err = ValidateRequest(malformedReq, signingKey)
+	_, err = ValidateRequest(malformedReq, testNodeDID, dir)
 	if err == nil {
 		t.Error("Expected request with malformed Authorization header to fail validation")
 	}
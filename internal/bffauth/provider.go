@@ -1,12 +1,17 @@
 package bffauth
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/eagraf/habitat-new/internal/node/api"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
@@ -15,13 +20,27 @@ import (
 // BFF Auth - Allow for Habitat node's to authenticate with each other.
 type Provider struct {
 	challengePersister ChallengeSessionPersister
-	signingKey         []byte
+
+	// The node's DID and the P-256 key it publishes in its DID document, which tokens are signed
+	// with.
+	did        string
+	signingKey atcrypto.PrivateKey
+
+	// Resolves the DID documents callers must prove they hold a key from.
+	dir identity.Directory
 }
 
-func NewProvider(challengePersister ChallengeSessionPersister, signingKey []byte) *Provider {
+func NewProvider(
+	challengePersister ChallengeSessionPersister,
+	did string,
+	signingKey atcrypto.PrivateKey,
+	dir identity.Directory,
+) *Provider {
 	return &Provider{
 		challengePersister: challengePersister,
+		did:                did,
 		signingKey:         signingKey,
+		dir:                dir,
 	}
 }
 
@@ -33,16 +52,16 @@ func (p *Provider) GetRoutes() []api.Route {
 	}
 }
 
-// p.handleChallenge takes the following http request
+// p.handleChallenge takes the following http request. The caller must prove it holds one of the
+// keys in the DID document of the DID.
 type ChallengeRequest struct {
-	DID                string `json:"did"`
-	PublicKeyMultibase []byte `json:"public_key_bytes"`
+	DID string `json:"did"`
 }
 
 // p.handleChallenge responds with the following response
 type ChallengeResponse struct {
 	Challenge string `json:"challenge"`
-	Session   string `jsno:"session"`
+	Session   string `json:"session"`
 }
 
 func (p *Provider) handleChallenge(w http.ResponseWriter, r *http.Request) {
@@ -52,15 +71,20 @@ func (p *Provider) handleChallenge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	challenge, err := GenerateChallenge()
+	// Only issue challenges that can be answered with a published key
+	keys, err := p.publishedKeys(r.Context(), req.DID)
 	if err != nil {
-		http.Error(w, "Failed to generate challenge", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to resolve DID: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(keys) == 0 {
+		http.Error(w, "DID document has no supported keys", http.StatusBadRequest)
 		return
 	}
 
-	key, err := atcrypto.ParsePublicBytesP256([]byte(req.PublicKeyMultibase))
+	challenge, err := GenerateChallenge()
 	if err != nil {
-		http.Error(w, "Failed to parse public key", http.StatusInternalServerError)
+		http.Error(w, "Failed to generate challenge", http.StatusInternalServerError)
 		return
 	}
 
@@ -69,7 +93,6 @@ func (p *Provider) handleChallenge(w http.ResponseWriter, r *http.Request) {
 	session := &ChallengeSession{
 		SessionID: sessionID,
 		DID:       req.DID,
-		PublicKey: key,
 		Challenge: challenge,
 		ExpiresAt: time.Now().Add(15 * time.Minute),
 	}
@@ -109,34 +132,40 @@ func (p *Provider) handleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := p.challengePersister.GetSession(req.SessionID)
-	if err != nil {
+	// Each challenge can only be answered once
+	session, err := p.challengePersister.ConsumeSession(req.SessionID)
+	if errors.Is(err, ErrSessionNotFound) {
 		http.Error(w, "Invalid session", http.StatusBadRequest)
 		return
+	} else if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
 	}
 
-	err = p.challengePersister.DeleteSession(req.SessionID)
+	// Verify proof against the keys the DID currently publishes
+	keys, err := p.publishedKeys(r.Context(), session.DID)
 	if err != nil {
-		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to resolve DID: %s", err), http.StatusBadRequest)
 		return
 	}
-
-	// Verify proof
-	valid, err := VerifyProof(session.Challenge, req.Proof, session.PublicKey)
-	if err != nil || !valid {
+	valid := slices.ContainsFunc(keys, func(key atcrypto.PublicKey) bool {
+		valid, err := VerifyProof(session.Challenge, req.Proof, key)
+		return err == nil && valid
+	})
+	if !valid {
 		http.Error(w, "Invalid proof", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate JWT
-	token, err := GenerateJWT(p.signingKey, session.DID)
+	// Generate JWT, accepted only by this node
+	token, err := GenerateJWT(p.signingKey, p.did, session.DID, p.did)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	// Sanity check by validating the token
-	_, err = ValidateJWT(token, p.signingKey)
+	_, err = p.ValidateToken(token)
 	if err != nil {
 		http.Error(w, "Failed to validate token", http.StatusInternalServerError)
 		return
@@ -156,7 +185,10 @@ func (p *Provider) handleAuth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *Provider) handleTest(w http.ResponseWriter, r *http.Request) {
-	err := ValidateRequest(r, p.signingKey)
+	token, err := bearerToken(r)
+	if err == nil {
+		_, err = p.ValidateToken(token)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unauthorized: %s", err), http.StatusUnauthorized)
 		return
@@ -176,14 +208,39 @@ func (p *Provider) handleTest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// publishedKeys resolves the DID and returns the keys of the verification methods in its DID
+// document.
+func (p *Provider) publishedKeys(ctx context.Context, did string) ([]atcrypto.PublicKey, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return nil, err
+	}
+	id, err := p.dir.LookupDID(ctx, parsed)
+	if err != nil {
+		return nil, err
+	}
+	keys := []atcrypto.PublicKey{}
+	for name := range id.Keys {
+		key, err := id.GetPublicKey(name)
+		if err != nil {
+			// Keys of unsupported types can't have signed a proof
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ValidateToken validates a token this node issued for itself, returning the DID it was issued to.
 func (p *Provider) ValidateToken(token string) (string, error) {
-	claims, err := ValidateJWT(token, p.signingKey)
+	claims, err := parseJWT(token, p.did, func(issuer syntax.DID) (atcrypto.PublicKey, error) {
+		if issuer.String() != p.did {
+			return nil, fmt.Errorf("token was issued by %s", issuer)
+		}
+		return p.signingKey.PublicKey()
+	})
 	if err != nil {
 		return "", err
 	}
-	dids := []string(claims.Audience)
-	if len(dids) > 1 || len(dids) <= 0 {
-		return "", fmt.Errorf("invalidly formatted jwt claims audience")
-	}
-	return dids[0], nil
+	return claims.Subject, nil
 }
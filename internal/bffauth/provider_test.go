@@ -15,19 +15,18 @@ import (
 
 func TestBffProvider(t *testing.T) {
 	persister := NewInMemorySessionPersister()
-	signingKey := []byte("test-signing-key")
-	p := NewProvider(persister, signingKey)
+	signingKey, dir := newTestNode(t)
+	p := NewProvider(persister, testNodeDID, signingKey, dir)
 
-	// The caller of the provider (i.e. another PDS) has its own set of keys
+	// The caller of the provider (i.e. another PDS) has its own set of keys, published in its DID
+	// document
 	privateKey, err := atcrypto.GeneratePrivateKeyP256()
 	require.NoError(t, err)
-	publicKey, err := privateKey.PublicKey()
-	require.NoError(t, err)
+	insertNode(dir, "did:plc:alice", privateKey)
 
 	// The caller requests a challenge
 	b, err := json.Marshal(ChallengeRequest{
-		DID:                "my-did",
-		PublicKeyMultibase: publicKey.Bytes(),
+		DID: "did:plc:alice",
 	})
 	require.NoError(t, err)
 	rec := httptest.NewRecorder()
@@ -81,4 +80,47 @@ func TestBffProvider(t *testing.T) {
 	require.NoError(t, err)
 	require.Contains(t, testResp, "message")
 	require.Equal(t, testResp["message"], "Hello, world!")
+
+	// The token was issued to the caller, and isn't accepted by other nodes
+	did, err := p.ValidateToken(authResp.Token)
+	require.NoError(t, err)
+	require.Equal(t, "did:plc:alice", did)
+	other := NewProvider(persister, "did:web:carol.example.com", signingKey, dir)
+	_, err = other.ValidateToken(authResp.Token)
+	require.Error(t, err)
+}
+
+func TestBffProviderRequiresPublishedKey(t *testing.T) {
+	signingKey, dir := newTestNode(t)
+	p := NewProvider(NewInMemorySessionPersister(), testNodeDID, signingKey, dir)
+	publishedKey, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	insertNode(dir, "did:plc:alice", publishedKey)
+
+	post := func(handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/doesntmatter", bytes.NewBuffer(b)))
+		return rec
+	}
+
+	// Challenges are only issued for DIDs that can be resolved
+	rec := post(p.handleChallenge, ChallengeRequest{DID: "did:plc:mallory"})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = post(p.handleChallenge, ChallengeRequest{DID: "not-a-did"})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Proofs signed with a key the DID doesn't publish are rejected
+	rec = post(p.handleChallenge, ChallengeRequest{DID: "did:plc:alice"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var challenge ChallengeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &challenge))
+
+	otherKey, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	proof, err := GenerateProof(challenge.Challenge, otherKey)
+	require.NoError(t, err)
+	rec = post(p.handleAuth, AuthRequest{SessionID: challenge.Session, Proof: proof})
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
 }
@@ -1,56 +1,95 @@
 package bffauth
 
 import (
-	"fmt"
+	"errors"
+	"sync"
 	"time"
-
-	"github.com/bluesky-social/indigo/atproto/atcrypto"
 )
 
+// ErrSessionNotFound is returned for sessions that don't exist, have been used, or have expired.
+var ErrSessionNotFound = errors.New("session not found")
+
 type ChallengeSessionPersister interface {
 	SaveSession(session *ChallengeSession) error
 	GetSession(sessionID string) (*ChallengeSession, error)
 	DeleteSession(sessionID string) error
+	// ConsumeSession returns and deletes the session in one step, so that concurrent requests
+	// can't answer the same challenge twice.
+	ConsumeSession(sessionID string) (*ChallengeSession, error)
 }
 
+// InMemoryChallengeSessionPersister keeps sessions in memory, so in-flight handshakes are lost
+// when the node restarts. Expired sessions are swept as new ones are saved.
 type InMemoryChallengeSessionPersister struct {
-	store          map[string]*ChallengeSession
-	usedChallenges map[string]bool
+	// now returns the current time; overridden in tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	store map[string]*ChallengeSession
 }
 
 func NewInMemorySessionPersister() *InMemoryChallengeSessionPersister {
 	return &InMemoryChallengeSessionPersister{
-		store:          make(map[string]*ChallengeSession),
-		usedChallenges: make(map[string]bool),
+		now:   time.Now,
+		store: make(map[string]*ChallengeSession),
 	}
 }
 
 func (p *InMemoryChallengeSessionPersister) SaveSession(session *ChallengeSession) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for id, s := range p.store {
+		if s.Expired(now) {
+			delete(p.store, id)
+		}
+	}
 	p.store[session.SessionID] = session
-	p.usedChallenges[session.Challenge] = true
 	return nil
 }
 
 func (p *InMemoryChallengeSessionPersister) GetSession(sessionID string) (*ChallengeSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	session, ok := p.store[sessionID]
-	if !ok {
-		return nil, fmt.Errorf("session not found")
+	if !ok || session.Expired(p.now()) {
+		return nil, ErrSessionNotFound
 	}
 	return session, nil
 }
 
 func (p *InMemoryChallengeSessionPersister) DeleteSession(sessionID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	delete(p.store, sessionID)
 	return nil
 }
 
+func (p *InMemoryChallengeSessionPersister) ConsumeSession(sessionID string) (*ChallengeSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	session, ok := p.store[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	delete(p.store, sessionID)
+	if session.Expired(p.now()) {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
 // ChallengeSession represents a session for a challenge.
 // This session is used to keep track of challenges that
 // have not yet been used, and to prevent replay attacks.
 type ChallengeSession struct {
-	SessionID string
-	DID       string
-	PublicKey atcrypto.PublicKey
-	Challenge string
-	ExpiresAt time.Time
+	SessionID string    `gorm:"primaryKey"`
+	DID       string    `gorm:"not null"`
+	Challenge string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// Expired reports whether the challenge can no longer be answered as of now.
+func (s *ChallengeSession) Expired(now time.Time) bool {
+	return !s.ExpiresAt.After(now)
 }
@@ -1,21 +1,73 @@
 package bffauth
 
 import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func TestInMemorySessionPersister(t *testing.T) {
 	persister := NewInMemorySessionPersister()
+	testSessionPersister(t, persister, func(now func() time.Time) { persister.now = now })
+}
+
+func TestSQLiteSessionPersister(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	// Each connection would otherwise get its own in-memory database
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	persister, err := NewSQLiteSessionPersister(db)
+	require.NoError(t, err)
+	testSessionPersister(t, persister, func(now func() time.Time) { persister.now = now })
+}
+
+func TestSQLiteSessionPersisterSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	require.NoError(t, err)
+	persister, err := NewSQLiteSessionPersister(db)
+	require.NoError(t, err)
+	require.NoError(t, persister.SaveSession(&ChallengeSession{
+		SessionID: "test-session",
+		DID:       "did:test:123",
+		Challenge: "test-challenge",
+		ExpiresAt: time.Now().Add(15 * time.Minute),
+	}))
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Close())
+
+	db, err = gorm.Open(sqlite.Open(path), &gorm.Config{})
+	require.NoError(t, err)
+	persister, err = NewSQLiteSessionPersister(db)
+	require.NoError(t, err)
+	session, err := persister.ConsumeSession("test-session")
+	require.NoError(t, err)
+	require.Equal(t, "test-challenge", session.Challenge)
+}
+
+func testSessionPersister(
+	t *testing.T,
+	persister ChallengeSessionPersister,
+	setNow func(func() time.Time),
+) {
+	now := time.Now()
+	setNow(func() time.Time { return now })
 
 	// Test saving and retrieving a session
 	session := &ChallengeSession{
 		SessionID: "test-session",
 		DID:       "did:test:123",
 		Challenge: "test-challenge",
-		ExpiresAt: time.Now().Add(15 * time.Minute),
+		ExpiresAt: now.Add(15 * time.Minute),
 	}
 
 	err := persister.SaveSession(session)
@@ -31,7 +83,7 @@ func TestInMemorySessionPersister(t *testing.T) {
 
 	// Test retrieving non-existent session
 	_, err = persister.GetSession("non-existent")
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrSessionNotFound)
 
 	// Test deleting a session
 	err = persister.DeleteSession(session.SessionID)
@@ -39,9 +91,48 @@ func TestInMemorySessionPersister(t *testing.T) {
 
 	// Verify session was deleted
 	_, err = persister.GetSession(session.SessionID)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrSessionNotFound)
 
 	// Test deleting non-existent session
 	err = persister.DeleteSession("non-existent")
 	require.NoError(t, err)
+
+	// Sessions can only be consumed once, even by concurrent requests
+	require.NoError(t, persister.SaveSession(session))
+	var consumed atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := persister.ConsumeSession(session.SessionID); err == nil {
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), consumed.Load())
+	_, err = persister.GetSession(session.SessionID)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+
+	// Expired sessions can't be retrieved or consumed, and are swept when new sessions are saved
+	require.NoError(t, persister.SaveSession(session))
+	now = now.Add(15 * time.Minute)
+	_, err = persister.GetSession(session.SessionID)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = persister.ConsumeSession(session.SessionID)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+
+	require.NoError(t, persister.SaveSession(session))
+	require.NoError(t, persister.SaveSession(&ChallengeSession{
+		SessionID: "other-session",
+		DID:       "did:test:123",
+		Challenge: "other-challenge",
+		ExpiresAt: now.Add(15 * time.Minute),
+	}))
+	now = now.Add(-15 * time.Minute)
+	_, err = persister.GetSession(session.SessionID)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = persister.GetSession("other-session")
+	require.NoError(t, err)
 }
@@ -0,0 +1,97 @@
+package bffauth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SQLiteChallengeSessionPersister stores sessions in sqlite, so that handshakes in flight when
+// the node restarts can still be completed. Expired sessions are swept as new ones are saved.
+type SQLiteChallengeSessionPersister struct {
+	db *gorm.DB
+	// now returns the current time; overridden in tests.
+	now func() time.Time
+}
+
+var _ ChallengeSessionPersister = (*SQLiteChallengeSessionPersister)(nil)
+
+func NewSQLiteSessionPersister(db *gorm.DB) (*SQLiteChallengeSessionPersister, error) {
+	err := db.AutoMigrate(&ChallengeSession{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate challenge sessions table: %w", err)
+	}
+	return &SQLiteChallengeSessionPersister{db: db, now: time.Now}, nil
+}
+
+func (p *SQLiteChallengeSessionPersister) SaveSession(session *ChallengeSession) error {
+	_, err := p.DeleteExpiredSessions()
+	if err != nil {
+		return err
+	}
+	// Times are stored in UTC so that they compare correctly in sqlite
+	stored := *session
+	stored.ExpiresAt = stored.ExpiresAt.UTC()
+	err = p.db.Create(&stored).Error
+	if err != nil {
+		return fmt.Errorf("failed to save challenge session: %w", err)
+	}
+	return nil
+}
+
+func (p *SQLiteChallengeSessionPersister) GetSession(sessionID string) (*ChallengeSession, error) {
+	var session ChallengeSession
+	err := p.db.
+		Where("session_id = ? AND expires_at > ?", sessionID, p.now().UTC()).
+		First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get challenge session: %w", err)
+	}
+	return &session, nil
+}
+
+func (p *SQLiteChallengeSessionPersister) DeleteSession(sessionID string) error {
+	err := p.db.Where("session_id = ?", sessionID).Delete(&ChallengeSession{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete challenge session: %w", err)
+	}
+	return nil
+}
+
+func (p *SQLiteChallengeSessionPersister) ConsumeSession(sessionID string) (*ChallengeSession, error) {
+	var session *ChallengeSession
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		txp := &SQLiteChallengeSessionPersister{db: tx, now: p.now}
+		var err error
+		session, err = txp.GetSession(sessionID)
+		if err != nil {
+			return err
+		}
+		// Only the request whose delete removes the session gets to use it
+		result := tx.Where("session_id = ?", sessionID).Delete(&ChallengeSession{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete challenge session: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrSessionNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// DeleteExpiredSessions deletes sessions whose challenges can no longer be answered.
+func (p *SQLiteChallengeSessionPersister) DeleteExpiredSessions() (int64, error) {
+	result := p.db.Where("expires_at <= ?", p.now().UTC()).Delete(&ChallengeSession{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete expired challenge sessions: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
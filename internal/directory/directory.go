@@ -0,0 +1,140 @@
+// Package directory resolves the atproto identities Habitat nodes and their users are known by.
+//
+// Lookups are cached, and can be pointed at a local stand-in for the PLC directory and the hosts
+// of did:web documents and handles, so that a multi-node setup can resolve itself offline.
+package directory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+)
+
+const (
+	defaultCapacity = 10_000
+	defaultTTL      = time.Hour
+	// Failed lookups are retried sooner, so that a node coming online is found quickly
+	defaultErrTTL = 2 * time.Minute
+	// Handles that don't match their DID document are rechecked after this long
+	defaultInvalidHandleTTL = 5 * time.Minute
+	lookupTimeout           = 10 * time.Second
+)
+
+// Option configures a directory created with New.
+type Option func(*options)
+
+type options struct {
+	resolver identity.Directory
+	plcURL   string
+	localURL string
+	capacity int
+	ttl      time.Duration
+}
+
+// WithResolver caches the identities resolver looks up, instead of resolving them over the
+// network.
+func WithResolver(resolver identity.Directory) Option {
+	return func(o *options) {
+		o.resolver = resolver
+	}
+}
+
+// WithPLCURL resolves did:plc identities with the PLC directory at url, instead of
+// https://plc.directory.
+func WithPLCURL(url string) Option {
+	return func(o *options) {
+		o.plcURL = url
+	}
+}
+
+// WithLocalIdentities resolves every identity with the LocalIdentities served at url, which stands
+// in for the PLC directory and for the hosts of did:web documents and handles.
+func WithLocalIdentities(url string) Option {
+	return func(o *options) {
+		o.localURL = url
+	}
+}
+
+// WithCache sets how many identities are cached, and for how long.
+func WithCache(capacity int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.capacity = capacity
+		o.ttl = ttl
+	}
+}
+
+// New returns a directory that caches the identities it resolves, evicting the least recently used
+// once it is full.
+func New(opts ...Option) identity.Directory {
+	o := &options{
+		capacity: defaultCapacity,
+		ttl:      defaultTTL,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	resolver := o.resolver
+	if resolver == nil {
+		resolver = o.baseDirectory()
+	}
+	cached := identity.NewCacheDirectory(
+		resolver,
+		o.capacity,
+		o.ttl,
+		defaultErrTTL,
+		defaultInvalidHandleTTL,
+	)
+	return &cached
+}
+
+// baseDirectory returns a directory resolving identities over HTTP and DNS.
+func (o *options) baseDirectory() *identity.BaseDirectory {
+	base := &identity.BaseDirectory{
+		PLCURL: o.plcURL,
+		HTTPClient: http.Client{
+			Timeout: lookupTimeout,
+		},
+		Resolver: net.Resolver{
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 3 * time.Second}
+				return d.DialContext(ctx, network, address)
+			},
+		},
+		TryAuthoritativeDNS: true,
+		// bsky.social only supports HTTP handle resolution
+		SkipDNSDomainSuffixes: []string{".bsky.social"},
+	}
+	if o.localURL != "" {
+		base.PLCURL = o.localURL
+		target, err := url.Parse(o.localURL)
+		base.HTTPClient.Transport = &localTransport{target: target, err: err}
+		// Handles are resolved with their HTTP well-known endpoint, which the local identities
+		// serve, rather than DNS
+		base.SkipDNSDomainSuffixes = []string{""}
+	}
+	return base
+}
+
+// localTransport sends every request to the LocalIdentities server at target, keeping the host the
+// request was meant for in its Host header.
+type localTransport struct {
+	target *url.URL
+	// err is returned for every request if the URL of the server couldn't be parsed
+	err error
+}
+
+func (t *localTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.err != nil {
+		return nil, fmt.Errorf("invalid local identities URL: %w", t.err)
+	}
+	r = r.Clone(r.Context())
+	r.Host = r.URL.Host
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
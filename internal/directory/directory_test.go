@@ -0,0 +1,87 @@
+package directory
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalIdentities(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocalIdentities()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		local.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	dir := New(WithLocalIdentities(server.URL))
+
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	pub, err := key.PublicKey()
+	require.NoError(t, err)
+	local.Add(identity.Identity{
+		DID:    "did:plc:alice",
+		Handle: "alice.habitat.test",
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: "https://pds.habitat.test"},
+		},
+	})
+	local.Add(identity.Identity{
+		DID: "did:web:bob.habitat.test",
+		Keys: map[string]identity.VerificationMethod{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+
+	// did:plc identities and their handles resolve through the PLC stand-in
+	alice, err := dir.LookupHandle(ctx, "alice.habitat.test")
+	require.NoError(t, err)
+	require.Equal(t, syntax.DID("did:plc:alice"), alice.DID)
+	require.Equal(t, "https://pds.habitat.test", alice.PDSEndpoint())
+
+	// did:web documents are served for their host
+	bob, err := dir.LookupDID(ctx, "did:web:bob.habitat.test")
+	require.NoError(t, err)
+	bobKey, err := bob.PublicKey()
+	require.NoError(t, err)
+	require.Equal(t, pub.Multibase(), bobKey.Multibase())
+
+	_, err = dir.LookupDID(ctx, "did:web:carol.habitat.test")
+	require.ErrorIs(t, err, identity.ErrDIDNotFound)
+	_, err = dir.LookupDID(ctx, "did:plc:carol")
+	require.ErrorIs(t, err, identity.ErrDIDNotFound)
+
+	// Lookups are cached until they are purged
+	before := requests.Load()
+	_, err = dir.LookupDID(ctx, "did:web:bob.habitat.test")
+	require.NoError(t, err)
+	require.Equal(t, before, requests.Load())
+
+	require.NoError(t, dir.Purge(ctx, syntax.DID("did:web:bob.habitat.test").AtIdentifier()))
+	_, err = dir.LookupDID(ctx, "did:web:bob.habitat.test")
+	require.NoError(t, err)
+	require.Equal(t, before+1, requests.Load())
+}
+
+func TestWithResolver(t *testing.T) {
+	mock := identity.NewMockDirectory()
+	mock.Insert(identity.Identity{
+		DID:         "did:plc:alice",
+		Handle:      "alice.habitat.test",
+		AlsoKnownAs: []string{"at://alice.habitat.test"},
+	})
+	dir := New(WithResolver(&mock), WithCache(1, defaultTTL))
+
+	id, err := dir.Lookup(context.Background(), syntax.Handle("alice.habitat.test").AtIdentifier())
+	require.NoError(t, err)
+	require.Equal(t, syntax.DID("did:plc:alice"), id.DID)
+}
@@ -0,0 +1,101 @@
+package directory
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/rs/zerolog/log"
+)
+
+// LocalIdentities serves the DID documents and handles of the identities added to it, standing in
+// for the PLC directory and for the hosts of did:web documents and handles. Directories created
+// with WithLocalIdentities send all their lookups to it, so nodes can resolve each other offline.
+//
+// did:plc documents are served at /{did} as by the PLC directory. did:web documents and handles
+// are served at their usual well-known paths, for the host in the request's Host header.
+type LocalIdentities struct {
+	mu   sync.RWMutex
+	docs map[syntax.DID]identity.DIDDocument
+}
+
+func NewLocalIdentities() *LocalIdentities {
+	return &LocalIdentities{
+		docs: make(map[syntax.DID]identity.DIDDocument),
+	}
+}
+
+// Add publishes the DID document of id, replacing any earlier one. Its handle, if any, resolves to
+// its DID.
+func (l *LocalIdentities) Add(id identity.Identity) {
+	if id.Handle != "" && !id.Handle.IsInvalidHandle() {
+		aka := "at://" + id.Handle.String()
+		if !slices.Contains(id.AlsoKnownAs, aka) {
+			id.AlsoKnownAs = append([]string{aka}, id.AlsoKnownAs...)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.docs[id.DID] = id.DIDDocument()
+}
+
+func (l *LocalIdentities) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	switch r.URL.Path {
+	case "/.well-known/did.json":
+		l.writeDocument(w, syntax.DID("did:web:"+host))
+	case "/.well-known/atproto-did":
+		did, ok := l.handleDID(host)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := w.Write([]byte(did.String())); err != nil {
+			log.Err(err).Msgf("error sending response in LocalIdentities")
+		}
+	default:
+		did, err := syntax.ParseDID(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil || did.Method() != "plc" {
+			http.NotFound(w, r)
+			return
+		}
+		l.writeDocument(w, did)
+	}
+}
+
+func (l *LocalIdentities) writeDocument(w http.ResponseWriter, did syntax.DID) {
+	l.mu.RLock()
+	doc, ok := l.docs[did]
+	l.mu.RUnlock()
+	if !ok {
+		http.Error(w, "DID not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/did+ld+json")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		log.Err(err).Msgf("error sending response in LocalIdentities")
+	}
+}
+
+// handleDID returns the DID whose document declares handle.
+func (l *LocalIdentities) handleDID(handle string) (syntax.DID, bool) {
+	aka := "at://" + strings.ToLower(handle)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for did, doc := range l.docs {
+		if slices.Contains(doc.AlsoKnownAs, aka) {
+			return did, true
+		}
+	}
+	return "", false
+}
@@ -3,6 +3,8 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/rs/zerolog"
 )
@@ -15,6 +17,12 @@ type Route interface {
 	Method() string
 }
 
+// MultiMethodRoute is implemented by routes that accept more than one HTTP method. When
+// implemented, Methods takes precedence over Method.
+type MultiMethodRoute interface {
+	Methods() []string
+}
+
 type processedRoute struct {
 	Route
 }
@@ -24,15 +32,20 @@ func processRoute(route Route) processedRoute {
 }
 
 func (p processedRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != p.Method() {
+	methods := []string{p.Method()}
+	if m, ok := p.Route.(MultiMethodRoute); ok {
+		methods = m.Methods()
+	}
+	if !slices.Contains(methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
 		http.Error(
 			w,
-			fmt.Sprintf("invalid method, require %s", p.Method()),
+			fmt.Sprintf("invalid method, require %s", strings.Join(methods, " or ")),
 			http.StatusMethodNotAllowed,
 		)
 		return
 	}
-	p.ServeHTTP(w, r)
+	p.Route.ServeHTTP(w, r)
 }
 
 func NewRouter(
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+type getAndPostRoute struct {
+	Route
+}
+
+func (r *getAndPostRoute) Methods() []string {
+	return []string{http.MethodGet, http.MethodPost}
+}
+
+func TestRouterMethods(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	logger := zerolog.Nop()
+	router := NewRouter([]Route{
+		NewBasicRoute(http.MethodPost, "/post", ok),
+		&getAndPostRoute{NewBasicRoute(http.MethodPost, "/both", ok)},
+	}, &logger)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/post", http.StatusOK},
+		{http.MethodGet, "/post", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/both", http.StatusOK},
+		{http.MethodPost, "/both", http.StatusOK},
+		{http.MethodDelete, "/both", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		require.Equal(t, tc.status, w.Code, "%s %s", tc.method, tc.path)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/eagraf/habitat-new/internal/app"
+	"github.com/eagraf/habitat-new/internal/directory"
 	"github.com/eagraf/habitat-new/internal/node/constants"
 	"github.com/eagraf/habitat-new/internal/node/controller"
 	"github.com/eagraf/habitat-new/internal/node/reverse_proxy"
@@ -77,6 +78,16 @@ func loadEnv(v *viper.Viper) error {
 		return err
 	}
 	v.SetDefault("frontend_dev", false)
+
+	err = v.BindEnv("plc_url", "PLC_URL")
+	if err != nil {
+		return err
+	}
+
+	err = v.BindEnv("local_identities_url", "LOCAL_IDENTITIES_URL")
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -363,10 +374,51 @@ func (n *NodeConfig) PriviRepoFile() string {
 	return filepath.Join(n.HabitatPath(), "privi-repo.db")
 }
 
+// SessionDBFile returns the path to the sqlite database holding login sessions.
+func (n *NodeConfig) SessionDBFile() string {
+	return filepath.Join(n.HabitatPath(), "sessions.db")
+}
+
+// SessionKeysFile returns the path to the keys used to sign and encrypt login sessions.
+func (n *NodeConfig) SessionKeysFile() string {
+	return filepath.Join(n.HabitatPath(), "secrets", "session_keys.json")
+}
+
+// ClientKeysFile returns the path to the keys the node authenticates to PDSes with as an atproto
+// OAuth client.
+func (n *NodeConfig) ClientKeysFile() string {
+	return filepath.Join(n.HabitatPath(), "secrets", "oauth_client_keys.json")
+}
+
+// NodeSigningKeyFile returns the path to the key the node signs requests to other Habitat nodes
+// with, e.g. when delivering notifications.
+func (n *NodeConfig) NodeSigningKeyFile() string {
+	return filepath.Join(n.HabitatPath(), "secrets", "node_signing_key")
+}
+
+// WellKnownDir returns the directory served at /.well-known/, which holds the node's DID document.
+func (n *NodeConfig) WellKnownDir() string {
+	return filepath.Join(n.HabitatPath(), "well-known")
+}
+
 func (n *NodeConfig) FrontendDev() bool {
 	return n.viper.GetBool("frontend_dev")
 }
 
+// DirectoryOptions configures where the node resolves identities. By default they are resolved
+// over the network with the public PLC directory; plc_url points at another PLC directory, and
+// local_identities_url at a directory.LocalIdentities server, e.g. to run nodes offline in tests.
+func (n *NodeConfig) DirectoryOptions() []directory.Option {
+	opts := []directory.Option{}
+	if url := n.viper.GetString("plc_url"); url != "" {
+		opts = append(opts, directory.WithPLCURL(url))
+	}
+	if url := n.viper.GetString("local_identities_url"); url != "" {
+		opts = append(opts, directory.WithLocalIdentities(url))
+	}
+	return opts
+}
+
 func (n *NodeConfig) ReverseProxyRules() ([]*reverse_proxy.Rule, error) {
 	var rules []*reverse_proxy.Rule
 	err := n.viper.UnmarshalKey("reverse_proxy_rules", &rules, viper.DecoderConfigOption(
@@ -0,0 +1,96 @@
+package oauthserver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// authorizeRequestTTL is how long users have to authorize with their PDS once a flow is started.
+const authorizeRequestTTL = 10 * time.Minute
+
+// ErrAuthorizeRequestNotFound is returned for flows that were never started, have expired or have
+// already been completed.
+var ErrAuthorizeRequestNotFound = errors.New("authorization request not found or expired")
+
+// errUnknownFlow is returned for callbacks without the cookie set when their flow was started.
+var errUnknownFlow = errors.New("no authorization flow for state in this browser")
+
+// oauthAuthorizeRequest is the persisted state of an authorization flow that is waiting for the
+// user to come back from their PDS. It is keyed by the state parameter sent to the PDS, so that
+// any number of flows can be in progress at once.
+type oauthAuthorizeRequest struct {
+	State string `gorm:"primaryKey"`
+	// Data is the strategy-encrypted pendingAuthorization, as it holds the flow's DPoP key.
+	Data      string
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (oauthAuthorizeRequest) TableName() string {
+	return "oauth_authorize_requests"
+}
+
+// saveAuthorizeRequest stores a pending authorization under the given state until it expires.
+func (s *store) saveAuthorizeRequest(
+	ctx context.Context,
+	state string,
+	pending *pendingAuthorization,
+) error {
+	data, err := s.strategy.encrypt(pending)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	// Abandoned flows are cleaned up as new ones start
+	err = s.db.WithContext(ctx).
+		Where("expires_at <= ?", now).
+		Delete(&oauthAuthorizeRequest{}).
+		Error
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Create(&oauthAuthorizeRequest{
+		State:     state,
+		Data:      data,
+		ExpiresAt: now.Add(authorizeRequestTTL),
+	}).Error
+}
+
+// popAuthorizeRequest returns the pending authorization stored under the given state, deleting
+// it so that it can only be completed once.
+func (s *store) popAuthorizeRequest(
+	ctx context.Context,
+	state string,
+) (*pendingAuthorization, error) {
+	row := &oauthAuthorizeRequest{}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("state = ? AND expires_at > ?", state, time.Now().UTC()).
+			Limit(1).
+			Find(row)
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return ErrAuthorizeRequestNotFound
+		}
+		res = tx.Delete(row)
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			// A concurrent callback completed the flow first
+			return ErrAuthorizeRequestNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &pendingAuthorization{}
+	err = s.strategy.decrypt(row.Data, pending)
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
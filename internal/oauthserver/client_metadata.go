@@ -0,0 +1,316 @@
+package oauthserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eagraf/habitat-new/internal/auth"
+)
+
+const (
+	// clientMetadataTimeout bounds fetching an app's client metadata, which happens while the user
+	// or the app is waiting.
+	clientMetadataTimeout = 10 * time.Second
+	// clientMetadataMaxSize is the largest client metadata document accepted, in bytes.
+	clientMetadataMaxSize = 64 << 10
+	// clientMetadataDefaultTTL is how long client metadata is cached when its response has no
+	// cache headers.
+	clientMetadataDefaultTTL = 10 * time.Minute
+	// clientMetadataMaxTTL caps how long client metadata is cached, so changes to it are picked
+	// up eventually.
+	clientMetadataMaxTTL = 24 * time.Hour
+	// clientMetadataMaxEntries caps the number of apps whose metadata is cached.
+	clientMetadataMaxEntries = 1024
+)
+
+var (
+	supportedGrantTypes    = []string{"authorization_code", "refresh_token"}
+	supportedResponseTypes = []string{"code"}
+)
+
+// clientMetadataCache fetches and validates the client metadata of apps, caching it for as long
+// as its response allows.
+type clientMetadataCache struct {
+	httpClient *http.Client
+	// allowInsecure allows client IDs served over plain HTTP or from IP addresses.
+	allowInsecure bool
+	now           func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cachedClientMetadata
+}
+
+type cachedClientMetadata struct {
+	metadata  *auth.ClientMetadata
+	expiresAt time.Time
+}
+
+func newClientMetadataCache() *clientMetadataCache {
+	return &clientMetadataCache{
+		httpClient: &http.Client{Timeout: clientMetadataTimeout},
+		now:        time.Now,
+		entries:    map[string]*cachedClientMetadata{},
+	}
+}
+
+// get returns the validated client metadata of the app with the given client ID.
+func (c *clientMetadataCache) get(
+	ctx context.Context,
+	clientID string,
+) (*auth.ClientMetadata, error) {
+	clientURL, err := url.Parse(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client ID: %w", err)
+	}
+	// Development clients have no metadata document to fetch
+	if isLocalhostClientID(clientURL) {
+		return localhostClientMetadata(clientURL)
+	}
+	err = c.validateClientID(clientURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[clientID]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expiresAt) {
+		return entry.metadata, nil
+	}
+
+	metadata, ttl, err := c.fetch(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	err = validateClientMetadata(clientID, clientURL, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		c.put(clientID, metadata, c.now().Add(ttl))
+	}
+	return metadata, nil
+}
+
+func (c *clientMetadataCache) put(
+	clientID string,
+	metadata *auth.ClientMetadata,
+	expiresAt time.Time,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= clientMetadataMaxEntries {
+		now := c.now()
+		for id, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, id)
+			}
+		}
+	}
+	if len(c.entries) >= clientMetadataMaxEntries {
+		// Still full of fresh entries, so make room by dropping any one of them
+		for id := range c.entries {
+			delete(c.entries, id)
+			break
+		}
+	}
+	c.entries[clientID] = &cachedClientMetadata{metadata: metadata, expiresAt: expiresAt}
+}
+
+// fetch fetches the client metadata document, returning how long it may be cached for.
+func (c *clientMetadataCache) fetch(
+	ctx context.Context,
+	clientID string,
+) (*auth.ClientMetadata, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, clientID, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch client metadata: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to fetch client metadata: %s", resp.Status)
+	}
+	var metadata auth.ClientMetadata
+	err = json.NewDecoder(io.LimitReader(resp.Body, clientMetadataMaxSize)).Decode(&metadata)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode client metadata: %w", err)
+	}
+	return &metadata, cacheTTL(resp.Header, c.now()), nil
+}
+
+// cacheTTL returns how long a response may be cached for according to its Cache-Control and
+// Expires headers, capped at clientMetadataMaxTTL.
+func cacheTTL(header http.Header, now time.Time) time.Duration {
+	ttl := clientMetadataDefaultTTL
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			ttl = t.Sub(now)
+		} else {
+			// Invalid dates mean the response has already expired
+			ttl = 0
+		}
+	}
+	// Cache-Control takes precedence over Expires
+	for directive := range strings.SplitSeq(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				return 0
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return max(0, min(ttl, clientMetadataMaxTTL))
+}
+
+// validateClientID checks that the client ID is a URL client metadata may be fetched from.
+func (c *clientMetadataCache) validateClientID(clientURL *url.URL) error {
+	switch {
+	case clientURL.Scheme != "https" && !(c.allowInsecure && clientURL.Scheme == "http"):
+		return fmt.Errorf("client ID %s must be an https URL", clientURL)
+	case clientURL.Hostname() == "":
+		return fmt.Errorf("client ID %s has no host", clientURL)
+	case clientURL.User != nil:
+		return fmt.Errorf("client ID %s must not include credentials", clientURL)
+	case clientURL.Fragment != "":
+		return fmt.Errorf("client ID %s must not include a fragment", clientURL)
+	case clientURL.Path == "" || clientURL.Path == "/":
+		return fmt.Errorf("client ID %s must include a path", clientURL)
+	case c.allowInsecure:
+		return nil
+	case net.ParseIP(clientURL.Hostname()) != nil:
+		return fmt.Errorf("client ID %s must use a domain name, not an IP address", clientURL)
+	case clientURL.Hostname() == "localhost":
+		return fmt.Errorf("client ID %s must not be a localhost URL with a path", clientURL)
+	}
+	return nil
+}
+
+// validateClientMetadata checks the client metadata against the atproto rules for clients that
+// Habitat supports: public clients using the authorization code flow.
+func validateClientMetadata(
+	clientID string,
+	clientURL *url.URL,
+	metadata *auth.ClientMetadata,
+) error {
+	if metadata.ClientId != clientID {
+		return fmt.Errorf("client metadata is for client ID %q, not %q", metadata.ClientId, clientID)
+	}
+	if len(metadata.RedirectUris) == 0 {
+		return errors.New("client metadata has no redirect URIs")
+	}
+	for _, redirectURI := range metadata.RedirectUris {
+		u, err := url.Parse(redirectURI)
+		if err != nil {
+			return fmt.Errorf("invalid redirect URI %q: %w", redirectURI, err)
+		}
+		if !sameOrigin(clientURL, u) && !isLoopbackRedirectURI(u) {
+			return fmt.Errorf(
+				"redirect URI %q must have the same origin as the client ID or be a loopback URL",
+				redirectURI,
+			)
+		}
+	}
+	if !slices.Contains(metadata.GrantTypes, "authorization_code") {
+		return errors.New("client metadata must allow the authorization_code grant type")
+	}
+	for _, grantType := range metadata.GrantTypes {
+		if !slices.Contains(supportedGrantTypes, grantType) {
+			return fmt.Errorf("unsupported grant type %q", grantType)
+		}
+	}
+	if !slices.Contains(metadata.ResponseTypes, "code") {
+		return errors.New("client metadata must allow the code response type")
+	}
+	for _, responseType := range metadata.ResponseTypes {
+		if !slices.Contains(supportedResponseTypes, responseType) {
+			return fmt.Errorf("unsupported response type %q", responseType)
+		}
+	}
+	if metadata.TokenEndpointAuthMethod != "" && metadata.TokenEndpointAuthMethod != "none" {
+		return fmt.Errorf(
+			"unsupported token endpoint auth method %q, only public clients are supported",
+			metadata.TokenEndpointAuthMethod,
+		)
+	}
+	return nil
+}
+
+func sameOrigin(a *url.URL, b *url.URL) bool {
+	return a.Scheme == b.Scheme && strings.EqualFold(a.Host, b.Host)
+}
+
+// isLoopbackRedirectURI reports whether u redirects to an app on the user's device. As in RFC
+// 8252, the loopback IP is used rather than "localhost", and any port is allowed.
+func isLoopbackRedirectURI(u *url.URL) bool {
+	return u.Scheme == "http" && (u.Hostname() == "127.0.0.1" || u.Hostname() == "::1")
+}
+
+// isLocalhostClientID reports whether the client ID is an atproto development client, which is
+// "http://localhost" optionally followed by redirect_uri and scope query parameters.
+func isLocalhostClientID(clientURL *url.URL) bool {
+	return clientURL.Scheme == "http" && clientURL.Host == "localhost"
+}
+
+// localhostClientMetadata returns the implicit client metadata of a development client. Its
+// redirect URIs and scopes are taken from the client ID, defaulting to the loopback IPs and the
+// atproto scope.
+func localhostClientMetadata(clientURL *url.URL) (*auth.ClientMetadata, error) {
+	if clientURL.Path != "" && clientURL.Path != "/" {
+		return nil, fmt.Errorf("development client ID %s must not include a path", clientURL)
+	}
+	if clientURL.Fragment != "" {
+		return nil, fmt.Errorf("development client ID %s must not include a fragment", clientURL)
+	}
+	query := clientURL.Query()
+	redirectURIs := query["redirect_uri"]
+	if len(redirectURIs) == 0 {
+		redirectURIs = []string{"http://127.0.0.1/", "http://[::1]/"}
+	}
+	for _, redirectURI := range redirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil || !isLoopbackRedirectURI(u) {
+			return nil, fmt.Errorf(
+				"development client redirect URI %q must be a loopback URL",
+				redirectURI,
+			)
+		}
+	}
+	scope := query.Get("scope")
+	if scope == "" {
+		scope = "atproto"
+	}
+	return &auth.ClientMetadata{
+		ClientId:                clientURL.String(),
+		ApplicationType:         "native",
+		GrantTypes:              supportedGrantTypes,
+		ResponseTypes:           supportedResponseTypes,
+		RedirectUris:            redirectURIs,
+		Scope:                   scope,
+		TokenEndpointAuthMethod: "none",
+		DpopBoundAccessTokens:   true,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package oauthserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-new/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientMetadataCache(t *testing.T) {
+	var fetches atomic.Int64
+	cacheControl := "max-age=60"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", cacheControl)
+		require.NoError(t, json.NewEncoder(w).Encode(&auth.ClientMetadata{
+			ClientId:      "http://" + r.Host + r.URL.Path,
+			RedirectUris:  []string{"http://" + r.Host + "/callback"},
+			GrantTypes:    []string{"authorization_code"},
+			ResponseTypes: []string{"code"},
+		}))
+	}))
+	defer server.Close()
+	clientID := server.URL + "/client-metadata.json"
+
+	now := time.Now()
+	cache := newClientMetadataCache()
+	cache.allowInsecure = true
+	cache.now = func() time.Time { return now }
+
+	metadata, err := cache.get(context.Background(), clientID)
+	require.NoError(t, err)
+	require.Equal(t, clientID, metadata.ClientId)
+	_, err = cache.get(context.Background(), clientID)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), fetches.Load())
+
+	// Metadata is fetched again once it has expired
+	now = now.Add(time.Minute)
+	cacheControl = "no-store"
+	_, err = cache.get(context.Background(), clientID)
+	require.NoError(t, err)
+	_, err = cache.get(context.Background(), clientID)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), fetches.Load())
+
+	// Only secure client IDs are fetched by default
+	cache.allowInsecure = false
+	_, err = cache.get(context.Background(), clientID)
+	require.ErrorContains(t, err, "https")
+}
+
+func TestClientMetadataTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cache := newClientMetadataCache()
+	cache.allowInsecure = true
+	cache.httpClient.Timeout = 10 * time.Millisecond
+	_, err := cache.get(context.Background(), server.URL+"/client-metadata.json")
+	require.ErrorContains(t, err, "failed to fetch client metadata")
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		header http.Header
+		ttl    time.Duration
+	}{
+		{http.Header{}, clientMetadataDefaultTTL},
+		{http.Header{"Cache-Control": {"public, max-age=300"}}, 5 * time.Minute},
+		{http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}}, 200 * time.Second},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=300, no-store"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=invalid"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=31536000"}}, clientMetadataMaxTTL},
+		{http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Hour},
+		{http.Header{"Expires": {"0"}}, 0},
+		{http.Header{
+			"Expires":       {now.Add(time.Hour).UTC().Format(http.TimeFormat)},
+			"Cache-Control": {"max-age=60"},
+		}, time.Minute},
+	} {
+		// Expires only has second precision
+		require.InDelta(t, tc.ttl, cacheTTL(tc.header, now), float64(time.Second), "%v", tc.header)
+	}
+}
+
+func TestValidateClientMetadata(t *testing.T) {
+	clientID := "https://app.example.com/client-metadata.json"
+	valid := func() *auth.ClientMetadata {
+		return &auth.ClientMetadata{
+			ClientId:                clientID,
+			RedirectUris:            []string{"https://app.example.com/callback"},
+			GrantTypes:              []string{"authorization_code", "refresh_token"},
+			ResponseTypes:           []string{"code"},
+			TokenEndpointAuthMethod: "none",
+		}
+	}
+	clientURL, err := url.Parse(clientID)
+	require.NoError(t, err)
+	require.NoError(t, validateClientMetadata(clientID, clientURL, valid()))
+
+	loopback := valid()
+	loopback.RedirectUris = []string{"http://127.0.0.1:8080/callback", "http://[::1]/callback"}
+	require.NoError(t, validateClientMetadata(clientID, clientURL, loopback))
+
+	for name, modify := range map[string]func(*auth.ClientMetadata){
+		"other client ID":     func(m *auth.ClientMetadata) { m.ClientId = "https://evil.example.com/client-metadata.json" },
+		"no redirect URIs":    func(m *auth.ClientMetadata) { m.RedirectUris = nil },
+		"other origin":        func(m *auth.ClientMetadata) { m.RedirectUris = []string{"https://evil.example.com/callback"} },
+		"insecure origin":     func(m *auth.ClientMetadata) { m.RedirectUris = []string{"http://app.example.com/callback"} },
+		"localhost redirect":  func(m *auth.ClientMetadata) { m.RedirectUris = []string{"http://localhost/callback"} },
+		"no code grant":       func(m *auth.ClientMetadata) { m.GrantTypes = []string{"refresh_token"} },
+		"implicit grant":      func(m *auth.ClientMetadata) { m.GrantTypes = append(m.GrantTypes, "implicit") },
+		"token response":      func(m *auth.ClientMetadata) { m.ResponseTypes = []string{"code", "token"} },
+		"confidential client": func(m *auth.ClientMetadata) { m.TokenEndpointAuthMethod = "private_key_jwt" },
+	} {
+		metadata := valid()
+		modify(metadata)
+		require.Error(t, validateClientMetadata(clientID, clientURL, metadata), name)
+	}
+}
+
+func TestValidateClientID(t *testing.T) {
+	cache := newClientMetadataCache()
+	for clientID, ok := range map[string]bool{
+		"https://app.example.com/client-metadata.json":        true,
+		"http://app.example.com/client-metadata.json":         false,
+		"https://app.example.com":                             false,
+		"https://app.example.com/client-metadata.json#frag":   false,
+		"https://user@app.example.com/client-metadata.json":   false,
+		"https://127.0.0.1/client-metadata.json":              false,
+		"https://localhost/client-metadata.json":              false,
+		"https://app.example.com:8443/client-metadata.json":   true,
+		"https://app.example.com/client-metadata.json?v=1234": true,
+	} {
+		u, err := url.Parse(clientID)
+		require.NoError(t, err)
+		if ok {
+			require.NoError(t, cache.validateClientID(u), clientID)
+		} else {
+			require.Error(t, cache.validateClientID(u), clientID)
+		}
+	}
+}
+
+func TestLocalhostClientMetadata(t *testing.T) {
+	cache := newClientMetadataCache()
+
+	metadata, err := cache.get(context.Background(), "http://localhost")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost", metadata.ClientId)
+	require.Equal(t, []string{"http://127.0.0.1/", "http://[::1]/"}, metadata.RedirectUris)
+	require.Equal(t, "atproto", metadata.Scope)
+
+	clientID := "http://localhost?" + url.Values{
+		"redirect_uri": {"http://127.0.0.1:5173/callback"},
+		"scope":        {"atproto repo:com.example.notes"},
+	}.Encode()
+	metadata, err = cache.get(context.Background(), clientID)
+	require.NoError(t, err)
+	require.Equal(t, clientID, metadata.ClientId)
+	require.Equal(t, []string{"http://127.0.0.1:5173/callback"}, metadata.RedirectUris)
+	require.Equal(t, "atproto repo:com.example.notes", metadata.Scope)
+
+	for _, invalid := range []string{
+		"http://localhost/client-metadata.json",
+		"http://localhost?redirect_uri=https%3A%2F%2Fevil.example.com%2Fcallback",
+	} {
+		_, err := cache.get(context.Background(), invalid)
+		require.Error(t, err, invalid)
+	}
+}
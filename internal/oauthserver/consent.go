@@ -0,0 +1,236 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eagraf/habitat-new/internal/utils"
+	"github.com/ory/fosite"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// consentDecisionApprove is the decision the consent screen posts when the user allows access.
+const consentDecisionApprove = "approve"
+
+//go:embed consent.html
+var consentHTML string
+
+var consentTemplate = template.Must(template.New("consent").Parse(consentHTML))
+
+// ErrApprovalNotFound is returned when the user hasn't approved the given app.
+var ErrApprovalNotFound = errors.New("approval not found")
+
+// Approval records that a user has consented to an app's access, so they aren't asked again when
+// the app requests the same scopes.
+type Approval struct {
+	ClientID   string    `json:"clientId"`
+	Scopes     []string  `json:"scopes"`
+	ApprovedAt time.Time `json:"approvedAt"`
+}
+
+// oauthApproval is the persisted state of an approval.
+type oauthApproval struct {
+	Subject    string `gorm:"primaryKey"`
+	ClientID   string `gorm:"primaryKey"`
+	Scopes     string // space separated
+	ApprovedAt time.Time
+}
+
+func (oauthApproval) TableName() string {
+	return "oauth_approvals"
+}
+
+// consentPage is what the consent screen shows the user.
+type consentPage struct {
+	Action    string
+	ConsentID string
+	// Subject is the handle or DID the user logged in with. The approval is stored under their
+	// DID either way.
+	Subject    string
+	ClientID   string
+	ClientName string
+	ClientURI  string
+	LogoURI    string
+	Scopes     []string
+}
+
+// approved reports whether the user has already approved every scope the app is requesting.
+func (s *store) approved(
+	ctx context.Context,
+	subject string,
+	clientID string,
+	scopes []string,
+) (bool, error) {
+	approval := &oauthApproval{}
+	res := s.db.WithContext(ctx).
+		Where("subject = ? AND client_id = ?", subject, clientID).
+		Limit(1).
+		Find(approval)
+	if res.Error != nil {
+		return false, res.Error
+	} else if res.RowsAffected == 0 {
+		return false, nil
+	}
+	approvedScopes := strings.Fields(approval.Scopes)
+	for _, scope := range scopes {
+		if scope != "" && !scopeStrategy(approvedScopes, scope) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// approve records the user's approval of the scopes, adding them to any they approved before.
+func (s *store) approve(
+	ctx context.Context,
+	subject string,
+	clientID string,
+	scopes []string,
+) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		approval := &oauthApproval{}
+		err := tx.Where("subject = ? AND client_id = ?", subject, clientID).
+			Limit(1).
+			Find(approval).
+			Error
+		if err != nil {
+			return err
+		}
+		approved := strings.Fields(approval.Scopes)
+		for _, scope := range scopes {
+			if scope != "" && !slices.Contains(approved, scope) {
+				approved = append(approved, scope)
+			}
+		}
+		return tx.Save(&oauthApproval{
+			Subject:    subject,
+			ClientID:   clientID,
+			Scopes:     strings.Join(approved, " "),
+			ApprovedAt: time.Now().UTC(),
+		}).Error
+	})
+}
+
+// ListApprovals returns the apps the user with the given DID has consented to, most recently
+// approved first.
+func (o *OAuthServer) ListApprovals(ctx context.Context, subject string) ([]Approval, error) {
+	var rows []oauthApproval
+	err := o.storage.db.WithContext(ctx).
+		Where("subject = ?", subject).
+		Order("approved_at DESC").
+		Find(&rows).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	approvals := make([]Approval, 0, len(rows))
+	for _, row := range rows {
+		approvals = append(approvals, Approval{
+			ClientID:   row.ClientID,
+			Scopes:     strings.Fields(row.Scopes),
+			ApprovedAt: row.ApprovedAt,
+		})
+	}
+	return approvals, nil
+}
+
+// RevokeApproval forgets the user's consent to an app, so they are asked again the next time it
+// requests access. Tokens the app already has are revoked separately, with RevokeGrant.
+func (o *OAuthServer) RevokeApproval(ctx context.Context, subject string, clientID string) error {
+	res := o.storage.db.WithContext(ctx).
+		Where("subject = ? AND client_id = ?", subject, clientID).
+		Delete(&oauthApproval{})
+	if res.Error != nil {
+		return res.Error
+	} else if res.RowsAffected == 0 {
+		return ErrApprovalNotFound
+	}
+	return nil
+}
+
+// askConsent shows the user the consent screen for the app, keeping the flow pending until they
+// decide.
+func (o *OAuthServer) askConsent(
+	w http.ResponseWriter,
+	r *http.Request,
+	authRequest fosite.AuthorizeRequester,
+	pending *pendingAuthorization,
+) {
+	consentID := rand.Text()
+	err := o.saveFlow(w, r, consentID, pending)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to save authorization request", http.StatusInternalServerError)
+		return
+	}
+	page := &consentPage{
+		Action:    r.URL.Path,
+		ConsentID: consentID,
+		Subject:   pending.Form.Get("handle"),
+		ClientID:  authRequest.GetClient().GetID(),
+		Scopes:    describeScopes(authRequest.GetRequestedScopes()),
+	}
+	if c, ok := authRequest.GetClient().(*client); ok {
+		page.ClientName = c.ClientName
+		page.ClientURI = c.ClientUri
+		page.LogoURI = c.LogoUri
+	}
+	if page.ClientName == "" {
+		page.ClientName = page.ClientID
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep other sites from framing the page to trick users into approving
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	err = consentTemplate.Execute(w, page)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to render consent screen")
+	}
+}
+
+// handleConsent completes or denies the authorization flow with the user's decision on the
+// consent screen.
+func (o *OAuthServer) handleConsent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	err := r.ParseForm()
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to parse form", http.StatusBadRequest)
+		return
+	}
+	pending, ok := o.resumeFlow(w, r, r.PostForm.Get("consent"))
+	if !ok {
+		return
+	}
+	authRequest, err := o.recreateAuthorizeRequest(ctx, pending)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to recreate request", http.StatusBadRequest)
+		return
+	}
+	session := newAuthorizeSession(authRequest, pending)
+	if r.PostForm.Get("decision") != consentDecisionApprove {
+		// The PDS session was only started for the app, so it isn't needed anymore
+		o.revokeUpstream(ctx, session)
+		o.provider.WriteAuthorizeError(
+			ctx,
+			w,
+			authRequest,
+			fosite.ErrAccessDenied.WithHint("The user denied the app access."),
+		)
+		return
+	}
+	err = o.storage.approve(ctx, session.Subject, session.ClientID, session.Scopes)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to save approval", http.StatusInternalServerError)
+		return
+	}
+	o.completeAuthorization(w, r, authRequest, session)
+}
@@ -0,0 +1,78 @@
+package oauthserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/eagraf/habitat-new/internal/auth"
+	"github.com/eagraf/habitat-new/internal/utils"
+	"github.com/ory/fosite"
+)
+
+// dpopSigningAlgs are the algorithms apps may sign DPoP proofs with.
+var dpopSigningAlgs = []string{"ES256"}
+
+var (
+	// errUseDpopNonce tells apps to retry their token request with the nonce in the DPoP-Nonce
+	// header, as described in RFC 9449.
+	errUseDpopNonce = &fosite.RFC6749Error{
+		ErrorField:       "use_dpop_nonce",
+		DescriptionField: "Authorization server requires nonce in DPoP proof.",
+		CodeField:        http.StatusBadRequest,
+	}
+	// errInvalidDpopProof is returned for token requests without a valid DPoP proof.
+	errInvalidDpopProof = &fosite.RFC6749Error{
+		ErrorField:       "invalid_dpop_proof",
+		DescriptionField: "The DPoP proof is missing or invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+)
+
+// verifyDpopProof checks the DPoP proof of a request to the server, made with accessToken if it is
+// a resource request. The nonce the next proof must include is set on the response either way.
+func (o *OAuthServer) verifyDpopProof(
+	w http.ResponseWriter,
+	r *http.Request,
+	accessToken string,
+) (*auth.DpopProof, error) {
+	w.Header().Set("DPoP-Nonce", o.dpop.Nonce())
+	return o.dpop.Verify(r, o.issuerOf(r)+r.URL.Path, accessToken)
+}
+
+// tokenDpopError converts an error verifying the DPoP proof of a token request to the OAuth error
+// returned for it.
+func tokenDpopError(err error) error {
+	if errors.Is(err, auth.ErrUseDpopNonce) {
+		return errUseDpopNonce.WithWrap(err)
+	}
+	return errInvalidDpopProof.WithWrap(err).WithDebug(err.Error())
+}
+
+// dpopAccessToken returns the access token of a resource request, which must be sent with the
+// DPoP scheme rather than as a bearer token.
+func dpopAccessToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "DPoP") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// writeDpopChallenge rejects a resource request whose token or DPoP proof isn't valid, telling the
+// app how to authenticate in the WWW-Authenticate header, as described in RFC 9449.
+func writeDpopChallenge(w http.ResponseWriter, code string, err error) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+		`DPoP algs="%s", error="%s", error_description=%q`,
+		strings.Join(dpopSigningAlgs, " "),
+		code,
+		err.Error(),
+	))
+	if code == "use_dpop_nonce" {
+		// Apps are expected to hit this whenever the nonce changes, so it isn't worth logging
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	utils.LogAndHTTPError(w, err, "invalid access token", http.StatusUnauthorized)
+}
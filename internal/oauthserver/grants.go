@@ -0,0 +1,230 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eagraf/habitat-new/internal/auth"
+	"gorm.io/gorm"
+)
+
+// ErrGrantNotFound is returned when a grant doesn't exist or doesn't belong to the given user.
+var ErrGrantNotFound = errors.New("grant not found")
+
+// Grant is an authorization a user has given a client app. Every token issued to the app through
+// the same authorization flow belongs to the grant.
+type Grant struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"clientId"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// oauthGrant is the persisted state of a grant.
+type oauthGrant struct {
+	ID       string `gorm:"primaryKey"`
+	Subject  string `gorm:"index"`
+	ClientID string
+	Scopes   string // space separated
+	// Upstream is the strategy-encrypted authSession holding the latest PDS tokens for the grant,
+	// which replace the ones embedded in tokens once they have been refreshed.
+	Upstream  string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+func (oauthGrant) TableName() string {
+	return "oauth_grants"
+}
+
+// oauthRefreshToken records a refresh token issued for a grant. Refresh tokens are rotated on use,
+// so presenting one that is no longer active means it has leaked.
+type oauthRefreshToken struct {
+	// Signature is a hash of the token, as the token itself carries the upstream session.
+	Signature string `gorm:"primaryKey"`
+	GrantID   string `gorm:"index"`
+	Active    bool
+	CreatedAt time.Time
+}
+
+func (oauthRefreshToken) TableName() string {
+	return "oauth_refresh_tokens"
+}
+
+// oauthAuthorizeCode records an authorization code issued for a grant. Codes can only be exchanged
+// once, so presenting one that has been used means it has leaked.
+type oauthAuthorizeCode struct {
+	// Signature is a hash of the code, as the code itself carries the upstream session.
+	Signature string `gorm:"primaryKey"`
+	GrantID   string `gorm:"index"`
+	Active    bool
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (oauthAuthorizeCode) TableName() string {
+	return "oauth_authorize_codes"
+}
+
+// oauthClientAssertion records the ID of a client assertion JWT until it expires, so that the
+// assertion can't be replayed.
+type oauthClientAssertion struct {
+	// JTI is a hash of the assertion's ID.
+	JTI       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (oauthClientAssertion) TableName() string {
+	return "oauth_client_assertions"
+}
+
+func hashSignature(signature string) string {
+	sum := sha256.Sum256([]byte(signature))
+	return hex.EncodeToString(sum[:])
+}
+
+// createGrant records the grant the session belongs to, if it isn't recorded yet.
+func (s *store) createGrant(ctx context.Context, session *authSession) error {
+	if session.GrantID == "" {
+		return errors.New("session has no grant ID")
+	}
+	upstream, err := s.strategy.encrypt(upstreamSession(session, session.TokenInfo))
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).
+		Where(&oauthGrant{ID: session.GrantID}).
+		Attrs(&oauthGrant{
+			Subject:  session.Subject,
+			ClientID: session.ClientID,
+			Scopes:   strings.Join(session.Scopes, " "),
+			Upstream: upstream,
+		}).
+		FirstOrCreate(&oauthGrant{}).
+		Error
+}
+
+// activeGrant returns the grant with the given ID if it hasn't been revoked.
+func (s *store) activeGrant(ctx context.Context, grantID string) (*oauthGrant, error) {
+	grant := &oauthGrant{}
+	res := s.db.WithContext(ctx).
+		Where("id = ? AND revoked_at IS NULL", grantID).
+		Limit(1).
+		Find(grant)
+	if res.Error != nil {
+		return nil, res.Error
+	} else if res.RowsAffected == 0 {
+		return nil, ErrGrantNotFound
+	}
+	return grant, nil
+}
+
+// upstreamSession returns the latest PDS session of the grant.
+func (s *store) upstreamSession(ctx context.Context, grantID string) (*authSession, error) {
+	grant, err := s.activeGrant(ctx, grantID)
+	if err != nil {
+		return nil, err
+	}
+	var session authSession
+	err = s.strategy.decrypt(grant.Upstream, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// setUpstreamTokens persists refreshed PDS tokens for the grant the session belongs to.
+func (s *store) setUpstreamTokens(
+	ctx context.Context,
+	session *authSession,
+	tokenInfo *auth.TokenResponse,
+) error {
+	upstream, err := s.strategy.encrypt(upstreamSession(session, tokenInfo))
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).
+		Model(&oauthGrant{}).
+		Where("id = ?", session.GrantID).
+		Update("upstream", upstream).
+		Error
+}
+
+func upstreamSession(session *authSession, tokenInfo *auth.TokenResponse) *authSession {
+	return &authSession{
+		Subject:   session.Subject,
+		DpopKey:   session.DpopKey,
+		TokenInfo: tokenInfo,
+		Issuer:    session.Issuer,
+		GrantID:   session.GrantID,
+	}
+}
+
+// revokeGrant revokes the grant along with every token issued under it.
+func (s *store) revokeGrant(ctx context.Context, grantID string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&oauthGrant{}).
+			Where("id = ? AND revoked_at IS NULL", grantID).
+			Update("revoked_at", time.Now().UTC()).
+			Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&oauthRefreshToken{}).
+			Where("grant_id = ?", grantID).
+			Update("active", false).
+			Error
+	})
+}
+
+// listGrants returns the grants the user hasn't revoked, oldest first.
+func (s *store) listGrants(ctx context.Context, subject string) ([]Grant, error) {
+	var rows []oauthGrant
+	err := s.db.WithContext(ctx).
+		Where("subject = ? AND revoked_at IS NULL", subject).
+		Order("created_at ASC").
+		Find(&rows).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	grants := make([]Grant, 0, len(rows))
+	for _, row := range rows {
+		grants = append(grants, Grant{
+			ID:        row.ID,
+			ClientID:  row.ClientID,
+			Scopes:    strings.Fields(row.Scopes),
+			CreatedAt: row.CreatedAt,
+		})
+	}
+	return grants, nil
+}
+
+// ListGrants returns the apps the user has authorized and not since revoked.
+func (o *OAuthServer) ListGrants(ctx context.Context, subject string) ([]Grant, error) {
+	return o.storage.listGrants(ctx, subject)
+}
+
+// RevokeGrant revokes one of the user's grants, so the app's tokens are no longer accepted, and
+// ends the PDS session behind it.
+func (o *OAuthServer) RevokeGrant(ctx context.Context, subject string, grantID string) error {
+	grant, err := o.storage.activeGrant(ctx, grantID)
+	if err != nil {
+		return err
+	} else if grant.Subject != subject {
+		return ErrGrantNotFound
+	}
+	session, err := o.storage.upstreamSession(ctx, grantID)
+	if err != nil {
+		return err
+	}
+	err = o.storage.revokeGrant(ctx, grantID)
+	if err != nil {
+		return err
+	}
+	o.revokeUpstream(ctx, session)
+	return nil
+}
@@ -0,0 +1,119 @@
+package oauthserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/eagraf/habitat-new/internal/utils"
+)
+
+// Paths the OAuth server's handlers are expected to be served at, which its metadata documents
+// point apps to.
+const (
+	AuthorizePath                   = "/oauth/authorize"
+	TokenPath                       = "/oauth/token"
+	RevokePath                      = "/oauth/revoke"
+	AuthorizationServerMetadataPath = "/.well-known/oauth-authorization-server"
+	ProtectedResourceMetadataPath   = "/.well-known/oauth-protected-resource"
+)
+
+// AuthorizationServerMetadata describes the OAuth server to apps, as defined by RFC 8414.
+type AuthorizationServerMetadata struct {
+	Issuer                                 string   `json:"issuer"`
+	AuthorizationEndpoint                  string   `json:"authorization_endpoint"`
+	TokenEndpoint                          string   `json:"token_endpoint"`
+	RevocationEndpoint                     string   `json:"revocation_endpoint"`
+	ResponseTypesSupported                 []string `json:"response_types_supported"`
+	GrantTypesSupported                    []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported          []string `json:"code_challenge_methods_supported"`
+	ScopesSupported                        []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported      []string `json:"token_endpoint_auth_methods_supported"`
+	RevocationEndpointAuthMethodsSupported []string `json:"revocation_endpoint_auth_methods_supported"`
+	DpopSigningAlgValuesSupported          []string `json:"dpop_signing_alg_values_supported,omitempty"`
+	// ClientIDMetadataDocumentSupported tells apps to use the URL of their client metadata as
+	// their client ID, as in atproto OAuth.
+	ClientIDMetadataDocumentSupported bool `json:"client_id_metadata_document_supported"`
+}
+
+// ProtectedResourceMetadata describes the resources Habitat tokens grant access to, and where to
+// get them, as defined by RFC 9728.
+type ProtectedResourceMetadata struct {
+	Resource                      string   `json:"resource"`
+	AuthorizationServers          []string `json:"authorization_servers"`
+	ScopesSupported               []string `json:"scopes_supported"`
+	BearerMethodsSupported        []string `json:"bearer_methods_supported"`
+	DpopSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported,omitempty"`
+}
+
+// issuerOf returns the issuer identifier of the server, which is the URL its endpoints are served
+// under. Unless configured with WithIssuer, it is taken from the request.
+func (o *OAuthServer) issuerOf(r *http.Request) string {
+	if o.issuer != "" {
+		return o.issuer
+	}
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
+
+// AuthorizationServerMetadata returns the metadata of the OAuth server, generated from its
+// configuration.
+func (o *OAuthServer) AuthorizationServerMetadata(r *http.Request) *AuthorizationServerMetadata {
+	issuer := o.issuerOf(r)
+	codeChallengeMethods := []string{"S256"}
+	if o.config.GetEnablePKCEPlainChallengeMethod(r.Context()) {
+		codeChallengeMethods = append(codeChallengeMethods, "plain")
+	}
+	return &AuthorizationServerMetadata{
+		Issuer:                                 issuer,
+		AuthorizationEndpoint:                  issuer + AuthorizePath,
+		TokenEndpoint:                          issuer + TokenPath,
+		RevocationEndpoint:                     issuer + RevokePath,
+		ResponseTypesSupported:                 supportedResponseTypes,
+		GrantTypesSupported:                    supportedGrantTypes,
+		CodeChallengeMethodsSupported:          codeChallengeMethods,
+		ScopesSupported:                        supportedScopes,
+		TokenEndpointAuthMethodsSupported:      []string{"none"},
+		RevocationEndpointAuthMethodsSupported: []string{"none"},
+		DpopSigningAlgValuesSupported:          dpopSigningAlgs,
+		ClientIDMetadataDocumentSupported:      true,
+	}
+}
+
+// ProtectedResourceMetadata returns the metadata of the resources the OAuth server's tokens
+// grant access to, which are served alongside it.
+func (o *OAuthServer) ProtectedResourceMetadata(r *http.Request) *ProtectedResourceMetadata {
+	issuer := o.issuerOf(r)
+	return &ProtectedResourceMetadata{
+		Resource:                      issuer,
+		AuthorizationServers:          []string{issuer},
+		ScopesSupported:               supportedScopes,
+		BearerMethodsSupported:        []string{"header"},
+		DpopSigningAlgValuesSupported: dpopSigningAlgs,
+	}
+}
+
+// HandleAuthorizationServerMetadata serves the metadata of the OAuth server, so that apps can
+// discover its endpoints and capabilities.
+func (o *OAuthServer) HandleAuthorizationServerMetadata(w http.ResponseWriter, r *http.Request) {
+	writeMetadata(w, o.AuthorizationServerMetadata(r))
+}
+
+// HandleProtectedResourceMetadata serves the metadata of the resources the OAuth server's tokens
+// grant access to.
+func (o *OAuthServer) HandleProtectedResourceMetadata(w http.ResponseWriter, r *http.Request) {
+	writeMetadata(w, o.ProtectedResourceMetadata(r))
+}
+
+func writeMetadata(w http.ResponseWriter, metadata any) {
+	w.Header().Set("Content-Type", "application/json")
+	// Apps running in the browser discover the server from other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := json.NewEncoder(w).Encode(metadata)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to encode metadata", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,72 @@
+package oauthserver_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eagraf/habitat-new/internal/oauthserver"
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	oauthServer, err := oauthserver.NewOAuthServer(
+		nil, /*oauthClient*/
+		nil, /*sessionStore*/
+		nil, /*directory*/
+		testDB(t),
+		&oauthserver.Secrets{Current: securecookie.GenerateRandomKey(32)},
+		oauthserver.WithIssuer("https://habitat.example.com/"),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	oauthServer.HandleAuthorizationServerMetadata(
+		w,
+		httptest.NewRequest(http.MethodGet, oauthserver.AuthorizationServerMetadataPath, nil),
+	)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	var server oauthserver.AuthorizationServerMetadata
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &server))
+	require.Equal(t, "https://habitat.example.com", server.Issuer)
+	require.Equal(t, "https://habitat.example.com/oauth/authorize", server.AuthorizationEndpoint)
+	require.Equal(t, "https://habitat.example.com/oauth/token", server.TokenEndpoint)
+	require.Equal(t, "https://habitat.example.com/oauth/revoke", server.RevocationEndpoint)
+	require.Equal(t, []string{"code"}, server.ResponseTypesSupported)
+	require.Equal(t, []string{"authorization_code", "refresh_token"}, server.GrantTypesSupported)
+	require.Equal(t, []string{"S256"}, server.CodeChallengeMethodsSupported)
+	require.Contains(t, server.ScopesSupported, "repo:*")
+	require.Equal(t, []string{"ES256"}, server.DpopSigningAlgValuesSupported)
+	require.True(t, server.ClientIDMetadataDocumentSupported)
+
+	w = httptest.NewRecorder()
+	oauthServer.HandleProtectedResourceMetadata(
+		w,
+		httptest.NewRequest(http.MethodGet, oauthserver.ProtectedResourceMetadataPath, nil),
+	)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resource oauthserver.ProtectedResourceMetadata
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resource))
+	require.Equal(t, "https://habitat.example.com", resource.Resource)
+	require.Equal(t, []string{"https://habitat.example.com"}, resource.AuthorizationServers)
+	require.Equal(t, server.ScopesSupported, resource.ScopesSupported)
+	require.Equal(t, []string{"ES256"}, resource.DpopSigningAlgValuesSupported)
+}
+
+func TestMetadataIssuerFromRequest(t *testing.T) {
+	oauthServer, err := oauthserver.NewOAuthServer(
+		nil, /*oauthClient*/
+		nil, /*sessionStore*/
+		nil, /*directory*/
+		testDB(t),
+		&oauthserver.Secrets{Current: securecookie.GenerateRandomKey(32)},
+	)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost:8000/", nil)
+	metadata := oauthServer.AuthorizationServerMetadata(r)
+	require.Equal(t, "http://localhost:8000", metadata.Issuer)
+	require.Equal(t, "http://localhost:8000/oauth/token", metadata.TokenEndpoint)
+}
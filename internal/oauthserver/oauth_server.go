@@ -3,13 +3,17 @@
 package oauthserver
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
@@ -18,21 +22,35 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 )
 
 const (
-	// this is the cookie name.
-	// TODO: hardcoding this means that only one oauth flow can be in progress at a time
-	sessionName = "auth-session"
+	// flowSessionPrefix prefixes the names of the cookies binding authorization flows to the
+	// browser that started them. Each flow gets its own cookie so flows don't overwrite each other.
+	flowSessionPrefix = "auth-flow-"
+	// cFlowStateKey is the key in a flow cookie holding the flow's state.
+	cFlowStateKey = "state"
+
+	// tokenRefreshMargin is how long before they expire PDS access tokens are refreshed.
+	tokenRefreshMargin = 5 * time.Minute
 )
 
-// authRequestFlash stores the authorization request state in a session flash.
-// This data is temporarily stored during the OAuth authorization flow to preserve
+// pendingAuthorization stores the authorization request state while the user authorizes with
+// their PDS. This data is temporarily stored during the OAuth authorization flow to preserve
 // request context across redirects.
-type authRequestFlash struct {
-	Form           url.Values // Original authorization request form data
-	DpopKey        []byte
-	AuthorizeState *auth.AuthorizeState // AT Protocol authorization state
+type pendingAuthorization struct {
+	Form           url.Values           `cbor:"1,keyasint"` // Original authorization request form data
+	DpopKey        []byte               `cbor:"2,keyasint"`
+	AuthorizeState *auth.AuthorizeState `cbor:"3,keyasint"` // AT Protocol authorization state
+	// Issuer and TokenInfo are set once the user has logged in with their PDS, while they are
+	// asked to consent to the app's access.
+	Issuer    string              `cbor:"4,keyasint"`
+	TokenInfo *auth.TokenResponse `cbor:"5,keyasint"`
+	// DID is the user's DID, resolved from the handle they logged in with. Grants and approvals
+	// are stored under it, so they don't depend on how the user spelled their handle.
+	DID string `cbor:"6,keyasint"`
 }
 
 // OAuthServer implements an OAuth 2.0 authorization server with AT Protocol integration.
@@ -40,9 +58,42 @@ type authRequestFlash struct {
 // for proof-of-possession token binding.
 type OAuthServer struct {
 	provider     fosite.OAuth2Provider
-	sessionStore sessions.Store     // Session storage for authorization flow state
+	config       *fosite.Config
+	issuer       string             // The URL the server is served under, published in its metadata
+	sessionStore sessions.Store     // Binds authorization flows to the browser that started them
 	oauthClient  auth.OAuthClient   // Client for communicating with AT Protocol services
 	directory    identity.Directory // AT Protocol identity directory for handle resolution
+	strategy     *strategy          // Used to read the upstream session out of revoked tokens
+	storage      *store             // Persists grants and the refresh tokens issued for them
+	tokens       *auth.TokenManager // Keeps the PDS tokens behind Habitat tokens fresh
+	dpop         *auth.DpopVerifier // Verifies the DPoP proofs apps bind Habitat tokens with
+}
+
+// Option configures an OAuthServer.
+type Option func(*OAuthServer)
+
+// WithClientMetadataHTTPClient sets the HTTP client used to fetch the client metadata of apps.
+func WithClientMetadataHTTPClient(client *http.Client) Option {
+	return func(o *OAuthServer) {
+		o.storage.clients.httpClient = client
+	}
+}
+
+// WithInsecureClientIDs accepts apps whose client IDs are served over plain HTTP or from IP
+// addresses, which atproto doesn't allow. It is meant for tests and local development.
+func WithInsecureClientIDs() Option {
+	return func(o *OAuthServer) {
+		o.storage.clients.allowInsecure = true
+	}
+}
+
+// WithIssuer sets the URL the server's endpoints are served under, such as
+// "https://habitat.example.com", which identifies it in its metadata. Otherwise it is taken from
+// each request.
+func WithIssuer(issuer string) Option {
+	return func(o *OAuthServer) {
+		o.issuer = strings.TrimSuffix(issuer, "/")
+	}
 }
 
 // NewOAuthServer creates a new OAuth 2.0 authorization server instance.
@@ -55,26 +106,45 @@ type OAuthServer struct {
 //
 // Parameters:
 //   - oauthClient: Client for AT Protocol OAuth operations
-//   - sessionStore: Store for managing user sessions during authorization flow
+//   - sessionStore: Store for the cookies binding authorization flows to the user's browser
 //   - directory: AT Protocol identity directory for resolving handles to DIDs
+//   - db: Database to persist grants in, which may be shared with other services
+//   - secrets: Secrets to derive the token encryption keys from
+//   - opts: Options, such as for fetching the client metadata of apps
 //
 // Returns a configured OAuthServer ready to handle authorization requests.
 func NewOAuthServer(
 	oauthClient auth.OAuthClient,
 	sessionStore sessions.Store,
 	directory identity.Directory,
+	db *gorm.DB,
+	secrets *Secrets,
+	opts ...Option,
 ) (*OAuthServer, error) {
-	secret := []byte("my super secret signing password")
+	globalSecrets, err := secrets.Keys("fosite global secret", 32)
+	if err != nil {
+		return nil, err
+	}
 	config := &fosite.Config{
-		GlobalSecret:               secret,
+		GlobalSecret:               globalSecrets[0],
+		RotatedGlobalSecrets:       globalSecrets[1:],
+		ScopeStrategy:              scopeStrategy,
 		SendDebugMessagesToClients: true,
 	}
-	strategy := newStrategy(secret)
-	storage := newStore(strategy)
-	// Register types for session serialization
-	gob.Register(&authRequestFlash{})
-	gob.Register(auth.AuthorizeState{})
-	return &OAuthServer{
+	tokenKeys, err := secrets.Keys("token encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	nonceKeys, err := secrets.Keys("dpop nonce", 32)
+	if err != nil {
+		return nil, err
+	}
+	strategy := newStrategy(tokenKeys...)
+	storage, err := newStore(strategy, db)
+	if err != nil {
+		return nil, err
+	}
+	server := &OAuthServer{
 		provider: compose.Compose(
 			config,
 			storage,
@@ -83,11 +153,28 @@ func NewOAuthServer(
 			compose.OAuth2RefreshTokenGrantFactory,
 			compose.OAuth2PKCEFactory,
 			compose.OAuth2TokenIntrospectionFactory,
+			compose.OAuth2TokenRevocationFactory,
 		),
+		config:       config,
 		oauthClient:  oauthClient,
 		sessionStore: sessionStore,
 		directory:    directory,
-	}, nil
+		strategy:     strategy,
+		storage:      storage,
+		tokens:       auth.NewTokenManager(oauthClient, tokenRefreshMargin),
+		dpop:         auth.NewDpopVerifier(nonceKeys...),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server, nil
+}
+
+// RefreshTokensEvery refreshes the PDS tokens of recently used grants before they expire, on the
+// given interval until ctx is cancelled. Habitat tokens outlive the PDS access tokens they were
+// issued with, so without this they would end up holding expired ones.
+func (o *OAuthServer) RefreshTokensEvery(ctx context.Context, interval time.Duration) {
+	o.tokens.RefreshExpiringEvery(ctx, interval)
 }
 
 // HandleAuthorize processes OAuth 2.0 authorization requests from the client.
@@ -96,7 +183,7 @@ func NewOAuthServer(
 //  1. Validating the client's authorize request
 //  2. Resolving the user's atproto handle
 //  3. Initiating authorization with the user's PDS
-//  4. Storing the request context in a cookie session
+//  4. Storing the request context server-side, keyed by the state sent to the PDS
 //  5. Redirecting to the PDS for user authentication
 //
 // The request must include a "handle" form parameter with the user's handle
@@ -115,6 +202,20 @@ func (o *OAuthServer) HandleAuthorize(
 		o.provider.WriteAuthorizeError(ctx, w, requester, err)
 		return
 	}
+	for _, requested := range requester.GetRequestedScopes() {
+		if !isResourceScope(requested) {
+			continue
+		}
+		if _, err := parseScope(requested); err != nil {
+			o.provider.WriteAuthorizeError(
+				ctx,
+				w,
+				requester,
+				fosite.ErrInvalidScope.WithWrap(err).WithHint(err.Error()),
+			)
+			return
+		}
+	}
 	if r.ParseForm() != nil {
 		utils.LogAndHTTPError(w, err, "failed to parse form", http.StatusBadRequest)
 		return
@@ -151,14 +252,14 @@ func (o *OAuthServer) HandleAuthorize(
 		utils.LogAndHTTPError(w, err, "failed to serialize key", http.StatusInternalServerError)
 		return
 	}
-	authorizeSession, _ := o.sessionStore.New(r, sessionName)
-	authorizeSession.AddFlash(&authRequestFlash{
+	err = o.saveFlow(w, r, state.State, &pendingAuthorization{
 		Form:           requester.GetRequestForm(),
 		AuthorizeState: state,
 		DpopKey:        dpopKeyBytes,
+		DID:            id.DID.String(),
 	})
-	if err := authorizeSession.Save(r, w); err != nil {
-		utils.LogAndHTTPError(w, err, "failed to save session", http.StatusInternalServerError)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to save authorization request", http.StatusInternalServerError)
 		return
 	}
 
@@ -168,54 +269,38 @@ func (o *OAuthServer) HandleAuthorize(
 // HandleCallback processes the OAuth callback from the user's PDS.
 //
 // This handler completes the authorization flow by:
-//  1. Retrieving the stored authorization request context from the cookie session
+//  1. Retrieving the stored authorization request context for the flow's state
 //  2. Exchanging the authorization code for access and refresh tokens from the PDS
-//  3. Storing the tokens in the user session
+//  3. Asking the user to consent to the app's access, unless they already have
 //  4. Generating an OAuth authorization response
 //  5. Redirecting back to the original OAuth client with an authorization code
 //
-// The callback URL must include "code" and "iss" query parameters from the PDS.
+// The callback URL must include "code", "state" and "iss" query parameters from the PDS. The
+// consent screen posts the user's decision back to the same URL.
 //
 // Returns an error if:
-//   - The session is invalid or expired
+//   - The flow wasn't started in the same browser, has expired or was already completed
 //   - The authorization code exchange fails
 //   - The response cannot be generated
 func (o *OAuthServer) HandleCallback(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	ctx := r.Context()
-	authorizeSession, err := o.sessionStore.Get(r, sessionName)
-	if err != nil {
-		utils.LogAndHTTPError(w, err, "failed to get session", http.StatusInternalServerError)
-		return
-	}
-	flashes := authorizeSession.Flashes()
-	_ = authorizeSession.Save(r, w)
-	if len(flashes) == 0 {
-		utils.LogAndHTTPError(w, err, "failed to get auth request flash", http.StatusBadRequest)
+	if r.Method == http.MethodPost {
+		o.handleConsent(w, r)
 		return
 	}
-	arf, ok := flashes[0].(*authRequestFlash)
+	ctx := r.Context()
+	pending, ok := o.resumeFlow(w, r, r.URL.Query().Get("state"))
 	if !ok {
-		utils.LogAndHTTPError(w, err, "failed to parse auth request flash", http.StatusBadRequest)
 		return
 	}
-	recreatedRequest, err := http.NewRequest(http.MethodGet, "/?"+arf.Form.Encode(), nil)
+	authRequest, err := o.recreateAuthorizeRequest(ctx, pending)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "failed to recreate request", http.StatusBadRequest)
 		return
 	}
-	authRequest, err := o.provider.NewAuthorizeRequest(ctx, recreatedRequest)
-	if err != nil {
-		utils.LogAndHTTPError(w, err, "failed to recreate request", http.StatusBadRequest)
-		return
-	}
-	authRequest.SetSession(&authSession{
-		DpopKey: arf.DpopKey,
-		Subject: arf.Form.Get("handle"),
-	})
-	dpopKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), arf.DpopKey)
+	dpopKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), pending.DpopKey)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "failed to parse dpop key", http.StatusBadRequest)
 		return
@@ -225,17 +310,116 @@ func (o *OAuthServer) HandleCallback(
 		dpopClient,
 		r.URL.Query().Get("code"),
 		r.URL.Query().Get("iss"),
-		arf.AuthorizeState,
+		pending.AuthorizeState,
 	)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "failed to exchange code", http.StatusInternalServerError)
 		return
 	}
-	resp, err := o.provider.NewAuthorizeResponse(
-		ctx,
-		authRequest,
-		newAuthorizeSession(authRequest, arf.DpopKey, tokenInfo),
-	)
+	// The user may have logged in to a different account at their PDS than the one they named
+	if tokenInfo.Sub != pending.DID {
+		utils.LogAndHTTPError(
+			w,
+			fmt.Errorf("PDS issued tokens for %q instead of %q", tokenInfo.Sub, pending.DID),
+			"logged in to the wrong account",
+			http.StatusForbidden,
+		)
+		return
+	}
+	pending.Issuer = r.URL.Query().Get("iss")
+	pending.TokenInfo = tokenInfo
+	session := newAuthorizeSession(authRequest, pending)
+	approved, err := o.storage.approved(ctx, session.Subject, session.ClientID, session.Scopes)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to check approvals", http.StatusInternalServerError)
+		return
+	}
+	if !approved {
+		o.askConsent(w, r, authRequest, pending)
+		return
+	}
+	o.completeAuthorization(w, r, authRequest, session)
+}
+
+// saveFlow stores the pending authorization under key until the browser comes back to continue
+// it, binding it to the browser with a cookie.
+func (o *OAuthServer) saveFlow(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	pending *pendingAuthorization,
+) error {
+	err := o.storage.saveAuthorizeRequest(r.Context(), key, pending)
+	if err != nil {
+		return err
+	}
+	flowSession, _ := o.sessionStore.New(r, flowSessionPrefix+key)
+	flowSession.Options.MaxAge = int(authorizeRequestTTL.Seconds())
+	flowSession.Values[cFlowStateKey] = key
+	return flowSession.Save(r, w)
+}
+
+// resumeFlow takes the pending authorization stored under key, if the flow was started in the
+// requesting browser. Otherwise it writes an error and returns false.
+func (o *OAuthServer) resumeFlow(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+) (*pendingAuthorization, bool) {
+	flowSession, err := o.sessionStore.Get(r, flowSessionPrefix+key)
+	if err == nil && (flowSession.IsNew || flowSession.Values[cFlowStateKey] != key) {
+		err = errUnknownFlow
+	}
+	if err != nil {
+		utils.LogAndHTTPError(
+			w,
+			err,
+			"authorization was not started in this browser",
+			http.StatusBadRequest,
+		)
+		return nil, false
+	}
+	flowSession.Options.MaxAge = -1
+	_ = flowSession.Save(r, w)
+	pending, err := o.storage.popAuthorizeRequest(r.Context(), key)
+	if errors.Is(err, ErrAuthorizeRequestNotFound) {
+		utils.LogAndHTTPError(w, err, "failed to get authorization request", http.StatusBadRequest)
+		return nil, false
+	} else if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to get authorization request", http.StatusInternalServerError)
+		return nil, false
+	}
+	return pending, true
+}
+
+// recreateAuthorizeRequest parses the app's original authorize request again.
+func (o *OAuthServer) recreateAuthorizeRequest(
+	ctx context.Context,
+	pending *pendingAuthorization,
+) (fosite.AuthorizeRequester, error) {
+	recreatedRequest, err := http.NewRequest(http.MethodGet, "/?"+pending.Form.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	authRequest, err := o.provider.NewAuthorizeRequest(ctx, recreatedRequest)
+	if err != nil {
+		return nil, err
+	}
+	authRequest.SetSession(&authSession{
+		DpopKey: pending.DpopKey,
+		Subject: pending.DID,
+	})
+	return authRequest, nil
+}
+
+// completeAuthorization redirects back to the app with an authorization code for the session.
+func (o *OAuthServer) completeAuthorization(
+	w http.ResponseWriter,
+	r *http.Request,
+	authRequest fosite.AuthorizeRequester,
+	session *authSession,
+) {
+	resp, err := o.provider.NewAuthorizeResponse(r.Context(), authRequest, session)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "failed to create response", http.StatusInternalServerError)
 		return
@@ -250,30 +434,135 @@ func (o *OAuthServer) HandleCallback(
 //   - refresh_token: Use a refresh token to obtain a new access token
 //
 // The handler:
-//  1. Validates the client's token request (client credentials, grant type, etc.)
-//  2. Generates new access and refresh tokens
-//  3. Returns the token response in JSON format
+//  1. Verifies the request's DPoP proof, asking the app to retry with a nonce if it has none
+//  2. Validates the client's token request (client credentials, grant type, etc.)
+//  3. Generates new access and refresh tokens, bound to the proof's key
+//  4. Returns the token response in JSON format
 //
 // Token requests must be POST requests with application/x-www-form-urlencoded content type
-// and include the appropriate grant_type and credentials.
+// and include the appropriate grant_type and credentials, along with a DPoP header. The tokens are
+// DPoP-bound as described in RFC 9449, so only the holder of the app's key can use them.
 //
 // Errors are written directly to the response using the OAuth error format.
 func (o *OAuthServer) HandleToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	w.Header().Set("Access-Control-Expose-Headers", "DPoP-Nonce")
 	ctx := r.Context()
+	proof, err := o.verifyDpopProof(w, r, "")
+	if err != nil {
+		o.provider.WriteAccessError(ctx, w, nil, tokenDpopError(err))
+		return
+	}
 	req, err := o.provider.NewAccessRequest(ctx, r, &fosite.DefaultSession{})
 	if err != nil {
 		o.provider.WriteAccessError(ctx, w, req, err)
 		return
 	}
+	// Refresh tokens, and codes the app bound up front, can only be used with the same key
+	session, ok := req.GetSession().(*authSession)
+	if !ok {
+		o.provider.WriteAccessError(ctx, w, req, fosite.ErrServerError.WithHint(
+			"The grant has an unexpected session type.",
+		))
+		return
+	}
+	if session.DpopJKT != "" && session.DpopJKT != proof.Thumbprint {
+		o.provider.WriteAccessError(ctx, w, req, errInvalidDpopProof.WithHint(
+			"The grant is bound to a different DPoP key.",
+		))
+		return
+	}
+	session.DpopJKT = proof.Thumbprint
 	resp, err := o.provider.NewAccessResponse(ctx, req)
 	if err != nil {
 		o.provider.WriteAccessError(ctx, w, req, err)
 		return
 	}
+	resp.SetTokenType("DPoP")
 	o.provider.WriteAccessResponse(ctx, w, req, resp)
 }
 
+// HandleRevoke processes OAuth 2.0 token revocation requests from the client, as described in
+// RFC 7009.
+//
+// Revoking either token of a grant invalidates every token issued under it. Once revoked, the
+// user's refresh token at their PDS is revoked as well, so that signing out of a Habitat client
+// app also ends the upstream session.
+//
+// Per the RFC, revoking an unknown or already revoked token succeeds.
+func (o *OAuthServer) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	ctx := r.Context()
+	// The upstream session can't be looked up once the grant is revoked
+	upstream := o.upstreamSessionOf(ctx, r.PostFormValue("token"))
+	err := o.provider.NewRevocationRequest(ctx, r)
+	if err == nil && upstream != nil {
+		o.revokeUpstream(ctx, upstream)
+	}
+	o.provider.WriteRevocationResponse(ctx, w, err)
+}
+
+// upstreamSessionOf returns the latest PDS session of the grant the given Habitat token belongs
+// to, or nil if there is none.
+func (o *OAuthServer) upstreamSessionOf(ctx context.Context, token string) *authSession {
+	var session authSession
+	err := o.strategy.decrypt(token, &session)
+	if err != nil {
+		return nil
+	}
+	upstream, err := o.storage.upstreamSession(ctx, session.GrantID)
+	if err != nil {
+		return nil
+	}
+	return upstream
+}
+
+// revokeUpstream revokes the PDS refresh token of the given upstream session. Failures are logged,
+// since the Habitat grant has already been revoked.
+func (o *OAuthServer) revokeUpstream(ctx context.Context, session *authSession) {
+	if session.TokenInfo == nil {
+		return
+	}
+	dpopKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), session.DpopKey)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to parse dpop key of revoked grant")
+		return
+	}
+	tokenInfo := session.TokenInfo
+	sessionID, err := auth.SessionID(dpopKey)
+	if err == nil {
+		// Stop refreshing the session, taking its latest tokens in case they weren't persisted
+		if latest := o.tokens.Forget(sessionID); latest != nil {
+			tokenInfo = latest
+		}
+	}
+	if tokenInfo.RefreshToken == "" {
+		return
+	}
+	id, err := o.lookupSubject(ctx, session.Subject)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to lookup identity of revoked grant")
+		return
+	}
+	err = o.oauthClient.RevokeToken(
+		auth.NewDpopHttpClient(dpopKey, &nonceProvider{}),
+		id,
+		tokenInfo.RefreshToken,
+		"refresh_token",
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to revoke upstream refresh token")
+	}
+}
+
+func (o *OAuthServer) lookupSubject(ctx context.Context, subject string) (*identity.Identity, error) {
+	atid, err := syntax.ParseAtIdentifier(subject)
+	if err != nil {
+		return nil, err
+	}
+	return o.directory.Lookup(ctx, *atid)
+}
+
 func (o *OAuthServer) HandleClientMetadata(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(o.oauthClient.ClientMetadata())
@@ -288,38 +577,99 @@ func (o *OAuthServer) HandleClientMetadata(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// Validate checks the Habitat access token of the request, which must have been granted every
+// given scope, such as the one returned by RepoScope. The token must be sent with the DPoP scheme,
+// along with a DPoP proof signed by the key it is bound to. It returns the user the token was
+// issued for and a client for making requests to their PDS. If the token isn't valid, an error has
+// been written to w and ok is false.
 func (o *OAuthServer) Validate(
 	w http.ResponseWriter,
 	r *http.Request,
 	scopes ...string,
 ) (did string, client *auth.DpopHttpClient, ok bool) {
 	ctx := r.Context()
-	_, ar, err := o.provider.IntrospectToken(
-		r.Context(),
-		fosite.AccessTokenFromRequest(r),
-		fosite.AccessToken,
-		nil,
-		scopes...,
-	)
-	if err != nil {
-		o.provider.WriteIntrospectionError(ctx, w, err)
+	token, found := dpopAccessToken(r)
+	if !found {
+		writeDpopChallenge(w, "invalid_token", errors.New("request has no DPoP-bound access token"))
+		return "", nil, false
+	}
+	proof, err := o.verifyDpopProof(w, r, token)
+	if errors.Is(err, auth.ErrUseDpopNonce) {
+		writeDpopChallenge(w, "use_dpop_nonce", err)
+		return "", nil, false
+	} else if err != nil {
+		writeDpopChallenge(w, "invalid_dpop_proof", err)
+		return "", nil, false
+	}
+	_, ar, err := o.provider.IntrospectToken(ctx, token, fosite.AccessToken, nil, scopes...)
+	if errors.Is(err, fosite.ErrInvalidScope) {
+		utils.LogAndHTTPError(w, err, "token lacks required scopes", http.StatusForbidden)
+		return "", nil, false
+	} else if err != nil {
+		writeDpopChallenge(w, "invalid_token", err)
+		return "", nil, false
+	}
+	session, ok := ar.GetSession().(*authSession)
+	if !ok {
+		utils.LogAndHTTPError(
+			w,
+			errors.New("unexpected session type"),
+			"failed to read token session",
+			http.StatusInternalServerError,
+		)
+		return "", nil, false
+	}
+	if session.DpopJKT != proof.Thumbprint {
+		writeDpopChallenge(w, "invalid_token", errors.New("token is bound to a different DPoP key"))
 		return "", nil, false
 	}
-	session := ar.GetSession().(*authSession)
 	dpopKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), session.DpopKey)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "failed to parse dpop key", http.StatusBadRequest)
 		return
 	}
 
-	return session.Subject, auth.NewDpopHttpClient(
-		dpopKey,
-		&nonceProvider{},
-		auth.WithAccessToken(session.TokenInfo.AccessToken),
-	), true
+	// The PDS tokens in the Habitat token are the ones it was issued with, which may since have
+	// been refreshed, so the latest ones are used instead.
+	sessionID, err := auth.SessionID(dpopKey)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to identify session", http.StatusInternalServerError)
+		return
+	}
+	err = o.tokens.Track(sessionID, func() (*auth.TokenSession, error) {
+		upstream, err := o.storage.upstreamSession(ctx, session.GrantID)
+		if err != nil {
+			return nil, err
+		}
+		id, err := o.lookupSubject(ctx, upstream.Subject)
+		if err != nil {
+			return nil, err
+		}
+		return &auth.TokenSession{
+			DpopKey:   dpopKey,
+			Identity:  id,
+			Issuer:    upstream.Issuer,
+			TokenInfo: upstream.TokenInfo,
+			Persist: func(tokenInfo *auth.TokenResponse) error {
+				// Refreshes happen in the background, outliving the request
+				return o.storage.setUpstreamTokens(context.Background(), upstream, tokenInfo)
+			},
+		}, nil
+	})
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to load session", http.StatusInternalServerError)
+		return
+	}
+	client, err = o.tokens.Client(sessionID)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "failed to refresh session", http.StatusUnauthorized)
+		return
+	}
+	return session.Subject, client, true
 }
 
-// This simple implementation stores a single nonce value in memory.
+// This simple implementation stores a single nonce value in memory, for use within a single
+// request. It is not safe for concurrent use.
 type nonceProvider struct{ nonce string }
 
 var _ auth.DpopNonceProvider = (*nonceProvider)(nil)
@@ -2,21 +2,49 @@ package oauthserver_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
 	"testing"
 
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/eagraf/habitat-new/internal/auth"
 	"github.com/eagraf/habitat-new/internal/oauthserver"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	return db
+}
+
+// testDirectory resolves the test user, whose PDS is at http://pds.url
+func testDirectory() identity.Directory {
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    "did:web:test",
+		Handle: "test.habitat.example",
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {URL: "http://pds.url"},
+		},
+	})
+	return &dir
+}
+
 func TestOAuthServerE2E(t *testing.T) {
 	// setup oauth server
 	serverMetadata := &auth.ClientMetadata{}
@@ -26,7 +54,10 @@ func TestOAuthServerE2E(t *testing.T) {
 	oauthServer, err := oauthserver.NewOAuthServer(
 		oauthClient,
 		sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
-		auth.NewDummyDirectory("http://pds.url"),
+		testDirectory(),
+		testDB(t),
+		&oauthserver.Secrets{Current: securecookie.GenerateRandomKey(32)},
+		oauthserver.WithInsecureClientIDs(),
 	)
 	require.NoError(t, err)
 
@@ -42,10 +73,27 @@ func TestOAuthServerE2E(t *testing.T) {
 		case "/token":
 			oauthServer.HandleToken(w, r)
 			return
+		case "/revoke":
+			oauthServer.HandleRevoke(w, r)
+			return
 		case "/resource":
-			did, _, ok := oauthServer.Validate(w, r)
-			require.True(t, ok, "failed to validate token")
+			did, _, ok := oauthServer.Validate(
+				w,
+				r,
+				oauthserver.RepoScope("com.example.notes", oauthserver.ActionRead),
+			)
+			if !ok {
+				// Validate has already written the error
+				return
+			}
 			require.Equal(t, "did:web:test", did)
+		case "/write-resource":
+			_, _, ok := oauthServer.Validate(
+				w,
+				r,
+				oauthserver.RepoScope("com.example.notes", oauthserver.ActionWrite),
+			)
+			require.False(t, ok, "token was only granted read access")
 		default:
 			t.Errorf("unknown server path: %s", r.URL.Path)
 			w.WriteHeader(http.StatusNotFound)
@@ -58,6 +106,15 @@ func TestOAuthServerE2E(t *testing.T) {
 	// set the server's oauthClient redirectUri now that we know the url
 	serverMetadata.RedirectUris = []string{server.URL + "/callback"}
 
+	// The app binds its tokens to its own DPoP key. The server's client has its TLS cert.
+	appKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	appNonces := &testNonces{}
+	appClient := func(opts ...auth.DpopOption) *auth.DpopHttpClient {
+		opts = append(opts, auth.WithHTTPClient(server.Client()))
+		return auth.NewDpopHttpClient(appKey, appNonces, opts...)
+	}
+
 	// setup client app that oauth server can make requests to
 	verifier := oauth2.GenerateVerifier()
 	config := &oauth2.Config{
@@ -65,6 +122,7 @@ func TestOAuthServerE2E(t *testing.T) {
 			AuthURL:  server.URL + "/authorize",
 			TokenURL: server.URL + "/token",
 		},
+		Scopes: []string{"repo:com.example.notes?action=read"},
 	}
 	clientApp := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -76,20 +134,31 @@ func TestOAuthServerE2E(t *testing.T) {
 					RedirectUris:  []string{"http://" + r.Host + "/callback"},
 					ResponseTypes: []string{"code"},
 					GrantTypes:    []string{"authorization_code"},
+					Scope:         "atproto repo:com.example.notes",
 				})
 				require.NoError(t, err, "failed to encode client metadata")
 				return
 			case "/callback":
-				ctx := context.WithValue(r.Context(), oauth2.HTTPClient, server.Client())
-				code := r.URL.Query().Get("code")
-				t.Logf("code: %s, codelen: %d", code, len(code))
-				token, err := config.Exchange(
-					ctx,
-					r.URL.Query().Get("code"),
-					oauth2.VerifierOption(verifier),
+				req, err := http.NewRequest(
+					http.MethodPost,
+					config.Endpoint.TokenURL,
+					strings.NewReader(url.Values{
+						"grant_type":    {"authorization_code"},
+						"code":          {r.URL.Query().Get("code")},
+						"redirect_uri":  {config.RedirectURL},
+						"client_id":     {config.ClientID},
+						"code_verifier": {verifier},
+					}.Encode()),
 				)
+				require.NoError(t, err)
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				// The first attempt is rejected for lacking a nonce, and retried with it
+				resp, err := appClient().Do(req)
 				require.NoError(t, err, "failed to exchange token")
-				require.NoError(t, json.NewEncoder(w).Encode(token))
+				defer func() { _ = resp.Body.Close() }()
+				w.WriteHeader(resp.StatusCode)
+				_, err = io.Copy(w, resp.Body)
+				require.NoError(t, err)
 				return
 			default:
 				t.Logf("unknown client app path: %v", r.URL.Path)
@@ -110,7 +179,7 @@ func TestOAuthServerE2E(t *testing.T) {
 	)+"&handle=did:web:test", nil)
 	require.NoError(t, err, "failed to create authorize request")
 
-	// make authorize requests which will follow redirects all thw way to token response
+	// make authorize requests which will follow redirects all the way to the consent screen
 	result, err := server.Client().Do(authRequest)
 	require.NoError(t, err, "failed to make authorize request")
 	respBytes, err := io.ReadAll(result.Body)
@@ -118,20 +187,97 @@ func TestOAuthServerE2E(t *testing.T) {
 	require.NoError(t, result.Body.Close())
 	require.Equal(t, http.StatusOK, result.StatusCode, "authorize request failed: %s", respBytes)
 
+	// approve the app, which will follow redirects all the way to token response
+	match := consentIDPattern.FindSubmatch(respBytes)
+	require.NotNil(t, match, "expected consent screen: %s", respBytes)
+	result, err = server.Client().PostForm(server.URL+"/callback", url.Values{
+		"consent":  {string(match[1])},
+		"decision": {"approve"},
+	})
+	require.NoError(t, err, "failed to approve app")
+	respBytes, err = io.ReadAll(result.Body)
+	require.NoError(t, err, "failed to read response body")
+	require.NoError(t, result.Body.Close())
+	require.Equal(t, http.StatusOK, result.StatusCode, "consent request failed: %s", respBytes)
+
 	token := &oauth2.Token{}
 	require.NoError(t, json.Unmarshal(respBytes, token), "failed to decode token")
 	require.NotEmpty(t, token.AccessToken, "access token should not be empty")
+	require.Equal(t, "DPoP", token.TokenType)
+
+	getResource := func(client *auth.DpopHttpClient, path string) (int, []byte) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err, "failed to make resource request")
+		respBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "failed to read response body")
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, respBytes
+	}
+	client := appClient(auth.WithAccessToken(token.AccessToken))
+	status, respBytes := getResource(client, "/resource")
+	require.Equal(t, http.StatusOK, status, "resource request failed: %s", respBytes)
 
-	// use server as the oauth client http client because of it has the tls cert
-	oauthClientCtx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
-	client := config.Client(oauthClientCtx, token)
+	status, _ = getResource(client, "/write-resource")
+	require.Equal(t, http.StatusForbidden, status)
 
-	resp, err := client.Get(server.URL + "/resource")
+	// The token can't be used as a bearer token, or with a proof from another key
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/resource", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	resp, err := server.Client().Do(req)
 	require.NoError(t, err, "failed to make resource request")
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("WWW-Authenticate"), `error="invalid_token"`)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	status, _ = getResource(auth.NewDpopHttpClient(
+		otherKey,
+		appNonces,
+		auth.WithAccessToken(token.AccessToken),
+		auth.WithHTTPClient(server.Client()),
+	), "/resource")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	grants, err := oauthServer.ListGrants(context.Background(), "did:web:test")
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	require.Equal(t, config.ClientID, grants[0].ClientID)
+	require.Equal(t, []string{"repo:com.example.notes?action=read"}, grants[0].Scopes)
+
+	// Revoke the token, which also revokes the upstream refresh token
+	resp, err = server.Client().PostForm(server.URL+"/revoke", url.Values{
+		"token":     []string{token.AccessToken},
+		"client_id": []string{config.ClientID},
+	})
+	require.NoError(t, err, "failed to make revoke request")
 	respBytes, err = io.ReadAll(resp.Body)
 	require.NoError(t, err, "failed to read response body")
 	require.NoError(t, resp.Body.Close())
-	require.Equal(t, http.StatusOK, resp.StatusCode, "resource request failed: %s", respBytes)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "revoke request failed: %s", respBytes)
+	require.Equal(t, []string{"dummy_refresh_token"}, oauthClient.RevokedTokens())
+
+	status, _ = getResource(client, "/resource")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	grants, err = oauthServer.ListGrants(context.Background(), "did:web:test")
+	require.NoError(t, err)
+	require.Empty(t, grants)
+}
+
+// testNonces remembers the last DPoP nonce a server issued.
+type testNonces struct{ nonce string }
+
+func (n *testNonces) GetDpopNonce() (string, bool, error) {
+	return n.nonce, n.nonce != "", nil
+}
+
+func (n *testNonces) SetDpopNonce(nonce string) error {
+	n.nonce = nonce
+	return nil
 }
 
 func TestValidate(t *testing.T) {
@@ -139,6 +285,8 @@ func TestValidate(t *testing.T) {
 		nil, /*oauthClient*/
 		nil, /*sessionStore*/
 		nil, /*directory*/
+		testDB(t),
+		&oauthserver.Secrets{Current: securecookie.GenerateRandomKey(32)},
 	)
 	require.NoError(t, err, "failed to create oauth server")
 	w := httptest.NewRecorder()
@@ -147,3 +295,366 @@ func TestValidate(t *testing.T) {
 	_, _, ok := oauthServer.Validate(w, r)
 	require.False(t, ok)
 }
+
+func TestTokenRequiresDpop(t *testing.T) {
+	oauthServer, err := oauthserver.NewOAuthServer(
+		nil, /*oauthClient*/
+		nil, /*sessionStore*/
+		nil, /*directory*/
+		testDB(t),
+		&oauthserver.Secrets{Current: securecookie.GenerateRandomKey(32)},
+	)
+	require.NoError(t, err, "failed to create oauth server")
+	r := httptest.NewRequest(
+		http.MethodPost,
+		oauthserver.TokenPath,
+		strings.NewReader(url.Values{"grant_type": {"authorization_code"}}.Encode()),
+	)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	oauthServer.HandleToken(w, r)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.NotEmpty(t, w.Header().Get("DPoP-Nonce"))
+	var body struct{ Error string }
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, "invalid_dpop_proof", body.Error)
+}
+
+// flowTest drives authorization flows through an OAuth server from a browser that stops at every
+// redirect, so that flows can be interleaved and each step checked.
+type flowTest struct {
+	t           *testing.T
+	oauthServer *oauthserver.OAuthServer
+	oauthClient interface {
+		RevokedTokens() []string
+		IssueTokensFor(did string)
+	}
+	server   *httptest.Server
+	config   *oauth2.Config
+	browser  *http.Client
+	app      *auth.DpopHttpClient
+	verifier string
+	// handle is what the user logs in with
+	handle string
+}
+
+var consentIDPattern = regexp.MustCompile(`name="consent" value="([^"]+)"`)
+
+func newFlowTest(t *testing.T) *flowTest {
+	serverMetadata := &auth.ClientMetadata{}
+	oauthClient := oauthserver.NewDummyOAuthClient(t, serverMetadata)
+	t.Cleanup(oauthClient.Close)
+
+	oauthServer, err := oauthserver.NewOAuthServer(
+		oauthClient,
+		sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+		testDirectory(),
+		testDB(t),
+		&oauthserver.Secrets{Current: securecookie.GenerateRandomKey(32)},
+		oauthserver.WithInsecureClientIDs(),
+	)
+	require.NoError(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/authorize":
+			oauthServer.HandleAuthorize(w, r)
+		case "/callback":
+			oauthServer.HandleCallback(w, r)
+		case "/token":
+			oauthServer.HandleToken(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	serverMetadata.RedirectUris = []string{server.URL + "/callback"}
+
+	clientApp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(&auth.ClientMetadata{
+			ClientId:      "http://" + r.Host + "/client-metadata.json",
+			ClientName:    "Notes",
+			RedirectUris:  []string{"http://" + r.Host + "/callback"},
+			ResponseTypes: []string{"code"},
+			GrantTypes:    []string{"authorization_code"},
+			Scope:         "repo:com.example.notes",
+		}))
+	}))
+	t.Cleanup(clientApp.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	appKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &flowTest{
+		t:           t,
+		oauthServer: oauthServer,
+		oauthClient: oauthClient,
+		server:      server,
+		config: &oauth2.Config{
+			ClientID:    clientApp.URL + "/client-metadata.json",
+			RedirectURL: clientApp.URL + "/callback",
+			Endpoint:    oauth2.Endpoint{AuthURL: server.URL + "/authorize"},
+			Scopes:      []string{"repo:com.example.notes?action=read"},
+		},
+		browser: newBrowser(server, jar),
+		app: auth.NewDpopHttpClient(
+			appKey,
+			&testNonces{},
+			auth.WithHTTPClient(server.Client()),
+		),
+		verifier: oauth2.GenerateVerifier(),
+		handle:   "did:web:test",
+	}
+}
+
+func newBrowser(server *httptest.Server, jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Transport: server.Client().Transport,
+		Jar:       jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// do makes the request in the browser, returning the response's status, redirect location and
+// body.
+func (f *flowTest) do(client *http.Client, req *http.Request) (int, *url.URL, []byte) {
+	resp, err := client.Do(req)
+	require.NoError(f.t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(f.t, err)
+	require.NoError(f.t, resp.Body.Close())
+	location, err := resp.Location()
+	if err != nil {
+		return resp.StatusCode, nil, body
+	}
+	return resp.StatusCode, location, body
+}
+
+func (f *flowTest) get(client *http.Client, target string) (int, *url.URL, []byte) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	require.NoError(f.t, err)
+	return f.do(client, req)
+}
+
+// login starts a flow with the given state and logs in with the PDS, returning the URL the PDS
+// redirects back to.
+func (f *flowTest) login(state string) string {
+	status, pdsURL, _ := f.get(f.browser, f.config.AuthCodeURL(
+		state,
+		oauth2.S256ChallengeOption(f.verifier),
+	)+"&handle="+url.QueryEscape(f.handle))
+	require.Equal(f.t, http.StatusSeeOther, status)
+	status, callbackURL, _ := f.get(f.browser, pdsURL.String())
+	require.Equal(f.t, http.StatusSeeOther, status)
+	return callbackURL.String()
+}
+
+// decide posts the user's decision on the consent screen.
+func (f *flowTest) decide(page []byte, decision string) (int, *url.URL, []byte) {
+	match := consentIDPattern.FindSubmatch(page)
+	require.NotNil(f.t, match, "not a consent screen: %s", page)
+	req, err := http.NewRequest(
+		http.MethodPost,
+		f.server.URL+"/callback",
+		strings.NewReader(url.Values{
+			"consent":  {string(match[1])},
+			"decision": {decision},
+		}.Encode()),
+	)
+	require.NoError(f.t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return f.do(f.browser, req)
+}
+
+// exchange exchanges an authorization code for tokens as the app, returning the token
+// endpoint's status and response.
+func (f *flowTest) exchange(code string) (int, []byte) {
+	req, err := http.NewRequest(
+		http.MethodPost,
+		f.server.URL+"/token",
+		strings.NewReader(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {f.config.RedirectURL},
+			"client_id":     {f.config.ClientID},
+			"code_verifier": {f.verifier},
+		}.Encode()),
+	)
+	require.NoError(f.t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.app.Do(req)
+	require.NoError(f.t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(f.t, err)
+	require.NoError(f.t, resp.Body.Close())
+	return resp.StatusCode, body
+}
+
+func TestConcurrentAuthorizeFlows(t *testing.T) {
+	f := newFlowTest(t)
+
+	// Start both flows before either returns from the PDS
+	callbacks := map[string]string{}
+	for _, state := range []string{"flow-state-a", "flow-state-b"} {
+		callbacks[state] = f.login(state)
+	}
+
+	// The flows complete independently, in any order. The user is only asked for consent once.
+	status, _, page := f.get(f.browser, callbacks["flow-state-b"])
+	require.Equal(t, http.StatusOK, status)
+	status, clientURL, _ := f.decide(page, "approve")
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Equal(t, "flow-state-b", clientURL.Query().Get("state"))
+	require.NotEmpty(t, clientURL.Query().Get("code"))
+
+	status, clientURL, _ = f.get(f.browser, callbacks["flow-state-a"])
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Equal(t, "flow-state-a", clientURL.Query().Get("state"))
+	require.NotEmpty(t, clientURL.Query().Get("code"))
+
+	// Each flow can only be completed once
+	status, _, _ = f.get(f.browser, callbacks["flow-state-a"])
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// A flow can't be completed in a browser that didn't start it
+	callback := f.login("flow-state-c")
+	status, _, _ = f.get(newBrowser(f.server, nil), callback)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestConsent(t *testing.T) {
+	f := newFlowTest(t)
+	ctx := context.Background()
+
+	// The consent screen shows the app and what it is asking for
+	status, _, page := f.get(f.browser, f.login("consent-state-1"))
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, string(page), "Notes")
+	require.Contains(t, string(page), "Read your records in com.example.notes")
+
+	// Denying access sends the user back to the app, and ends the PDS session
+	status, clientURL, _ := f.decide(page, "deny")
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Equal(t, "access_denied", clientURL.Query().Get("error"))
+	require.Equal(t, []string{"dummy_refresh_token"}, f.oauthClient.RevokedTokens())
+	approvals, err := f.oauthServer.ListApprovals(ctx, "did:web:test")
+	require.NoError(t, err)
+	require.Empty(t, approvals)
+
+	// The consent screen can only be answered once
+	status, _, _ = f.decide(page, "approve")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _, page = f.get(f.browser, f.login("consent-state-2"))
+	require.Equal(t, http.StatusOK, status)
+	status, clientURL, _ = f.decide(page, "approve")
+	require.Equal(t, http.StatusSeeOther, status)
+	require.NotEmpty(t, clientURL.Query().Get("code"))
+	approvals, err = f.oauthServer.ListApprovals(ctx, "did:web:test")
+	require.NoError(t, err)
+	require.Len(t, approvals, 1)
+	require.Equal(t, f.config.ClientID, approvals[0].ClientID)
+	require.Equal(t, []string{"repo:com.example.notes?action=read"}, approvals[0].Scopes)
+
+	// Approved apps aren't asked again for the same scopes, but are for new ones
+	status, clientURL, _ = f.get(f.browser, f.login("consent-state-3"))
+	require.Equal(t, http.StatusSeeOther, status)
+	require.NotEmpty(t, clientURL.Query().Get("code"))
+
+	f.config.Scopes = []string{"repo:com.example.notes?action=write"}
+	status, _, page = f.get(f.browser, f.login("consent-state-4"))
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, string(page), "Write your records in com.example.notes")
+
+	// Once the approval is revoked, the user is asked again
+	require.NoError(t, f.oauthServer.RevokeApproval(ctx, "did:web:test", f.config.ClientID))
+	require.ErrorIs(
+		t,
+		f.oauthServer.RevokeApproval(ctx, "did:web:test", f.config.ClientID),
+		oauthserver.ErrApprovalNotFound,
+	)
+	f.config.Scopes = []string{"repo:com.example.notes?action=read"}
+	status, _, _ = f.get(f.browser, f.login("consent-state-5"))
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestGrantsAreStoredUnderDID(t *testing.T) {
+	f := newFlowTest(t)
+	ctx := context.Background()
+
+	// The user logs in with their handle, but grants belong to their DID
+	f.handle = "test.habitat.example"
+	status, _, page := f.get(f.browser, f.login("did-state-1"))
+	require.Equal(t, http.StatusOK, status)
+	status, clientURL, _ := f.decide(page, "approve")
+	require.Equal(t, http.StatusSeeOther, status)
+	status, body := f.exchange(clientURL.Query().Get("code"))
+	require.Equal(t, http.StatusOK, status, "token request failed: %s", body)
+
+	grants, err := f.oauthServer.ListGrants(ctx, "did:web:test")
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	byHandle, err := f.oauthServer.ListGrants(ctx, f.handle)
+	require.NoError(t, err)
+	require.Empty(t, byHandle)
+
+	require.NoError(t, f.oauthServer.RevokeGrant(ctx, "did:web:test", grants[0].ID))
+
+	// The flow fails if the user logs in to a different account at their PDS
+	f.oauthClient.IssueTokensFor("did:plc:someoneelse")
+	status, _, _ = f.get(f.browser, f.login("did-state-3"))
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestApprovalsAreStoredUnderDID(t *testing.T) {
+	f := newFlowTest(t)
+	ctx := context.Background()
+
+	f.handle = "test.habitat.example"
+	status, _, page := f.get(f.browser, f.login("approval-state-1"))
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, string(page), f.handle)
+	status, _, _ = f.decide(page, "approve")
+	require.Equal(t, http.StatusSeeOther, status)
+
+	approvals, err := f.oauthServer.ListApprovals(ctx, "did:web:test")
+	require.NoError(t, err)
+	require.Len(t, approvals, 1)
+	byHandle, err := f.oauthServer.ListApprovals(ctx, f.handle)
+	require.NoError(t, err)
+	require.Empty(t, byHandle)
+
+	// Logging in with the DID is the same user, who has already approved the app
+	f.handle = "did:web:test"
+	status, clientURL, _ := f.get(f.browser, f.login("approval-state-2"))
+	require.Equal(t, http.StatusSeeOther, status)
+	require.NotEmpty(t, clientURL.Query().Get("code"))
+}
+
+func TestAuthorizeCodeReuse(t *testing.T) {
+	f := newFlowTest(t)
+	ctx := context.Background()
+
+	status, _, page := f.get(f.browser, f.login("reuse-state"))
+	require.Equal(t, http.StatusOK, status)
+	status, clientURL, _ := f.decide(page, "approve")
+	require.Equal(t, http.StatusSeeOther, status)
+	code := clientURL.Query().Get("code")
+	status, body := f.exchange(code)
+	require.Equal(t, http.StatusOK, status, "token request failed: %s", body)
+	grants, err := f.oauthServer.ListGrants(ctx, "did:web:test")
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+
+	// Codes can only be exchanged once. Presenting one again revokes the tokens issued for it.
+	status, body = f.exchange(code)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, string(body), "invalid_grant")
+	grants, err = f.oauthServer.ListGrants(ctx, "did:web:test")
+	require.NoError(t, err)
+	require.Empty(t, grants)
+}
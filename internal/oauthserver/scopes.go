@@ -0,0 +1,181 @@
+package oauthserver
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ory/fosite"
+)
+
+// Actions a repo scope can grant on a collection.
+const (
+	ActionRead  = "read"
+	ActionWrite = "write"
+)
+
+var repoActions = []string{ActionRead, ActionWrite}
+
+// Resources scopes can grant access to.
+const (
+	// repoResource scopes grant access to the records of a collection, such as
+	// "repo:com.example.notes?action=read". The collection may be "*" for every collection, and
+	// leaving out the action grants every action.
+	repoResource = "repo"
+	// blobResource scopes grant uploading blobs of a MIME type, such as "blob:image/*". The type
+	// may be "*/*" for any type.
+	blobResource = "blob"
+)
+
+// supportedScopes are the most general scopes apps can request, published in the server's
+// metadata. Scopes for specific collections, actions and MIME types are supported as well.
+var supportedScopes = []string{"repo:*", "blob:*/*"}
+
+// RepoScope returns the scope needed to perform the action on the records of a collection.
+func RepoScope(collection string, action string) string {
+	return repoResource + ":" + collection + "?" + url.Values{"action": {action}}.Encode()
+}
+
+// BlobScope returns the scope needed to upload a blob of the given MIME type.
+func BlobScope(mimeType string) string {
+	return blobResource + ":" + mimeType
+}
+
+// isResourceScope reports whether s is meant to be one of the resource scopes Habitat defines,
+// whether or not it is valid.
+func isResourceScope(s string) bool {
+	return strings.HasPrefix(s, repoResource+":") || strings.HasPrefix(s, blobResource+":")
+}
+
+// scope is a parsed Habitat resource scope.
+type scope struct {
+	resource string
+	target   string   // The collection or MIME type
+	actions  []string // Only set for repo scopes
+}
+
+// parseScope parses a Habitat resource scope. Scopes Habitat doesn't define, like "atproto", are
+// returned as errors.
+func parseScope(s string) (*scope, error) {
+	resource, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("%q is not a resource scope", s)
+	}
+	target, rawQuery, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("parsing scope %q: %w", s, err)
+	}
+	switch resource {
+	case repoResource:
+		if target == "" {
+			return nil, fmt.Errorf("scope %q has no collection", s)
+		}
+		actions := query["action"]
+		for _, action := range actions {
+			if !slices.Contains(repoActions, action) {
+				return nil, fmt.Errorf("scope %q has unknown action %q", s, action)
+			}
+		}
+		if len(actions) == 0 {
+			actions = repoActions
+		}
+		return &scope{resource: resource, target: target, actions: actions}, nil
+	case blobResource:
+		major, minor, ok := strings.Cut(target, "/")
+		if !ok || major == "" || minor == "" || (major == "*" && minor != "*") {
+			return nil, fmt.Errorf("scope %q has an invalid MIME type", s)
+		}
+		return &scope{resource: resource, target: target}, nil
+	default:
+		return nil, fmt.Errorf("%q is not a resource scope", s)
+	}
+}
+
+// covers reports whether a token granted s may do everything other grants.
+func (s *scope) covers(other *scope) bool {
+	if s.resource != other.resource {
+		return false
+	}
+	switch s.resource {
+	case repoResource:
+		if s.target != "*" && s.target != other.target {
+			return false
+		}
+		for _, action := range other.actions {
+			if !slices.Contains(s.actions, action) {
+				return false
+			}
+		}
+		return true
+	case blobResource:
+		if s.target == "*/*" || s.target == other.target {
+			return true
+		}
+		major, minor, _ := strings.Cut(s.target, "/")
+		otherMajor, _, _ := strings.Cut(other.target, "/")
+		return minor == "*" && major == otherMajor
+	}
+	return false
+}
+
+// scopeStrategy matches resource scopes by what they grant, so that a client declaring
+// "repo:*" may request "repo:com.example.notes?action=read", and a token granted that may be
+// used to read the collection. Other scopes are matched as fosite does by default.
+func scopeStrategy(haystack []string, needle string) bool {
+	wanted, err := parseScope(needle)
+	if err != nil {
+		return fosite.HierarchicScopeStrategy(haystack, needle)
+	}
+	for _, granted := range haystack {
+		s, err := parseScope(granted)
+		if err == nil && s.covers(wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeScopes describes what the scopes allow, for showing to the user. Scopes Habitat doesn't
+// define are shown as they are.
+func describeScopes(scopes []string) []string {
+	descriptions := []string{}
+	for _, s := range scopes {
+		if s == "" {
+			continue
+		}
+		parsed, err := parseScope(s)
+		if err != nil {
+			descriptions = append(descriptions, s)
+			continue
+		}
+		descriptions = append(descriptions, parsed.describe())
+	}
+	return descriptions
+}
+
+func (s *scope) describe() string {
+	switch s.resource {
+	case repoResource:
+		records := "your records in " + s.target
+		if s.target == "*" {
+			records = "all your records"
+		}
+		read, write := slices.Contains(s.actions, ActionRead), slices.Contains(s.actions, ActionWrite)
+		switch {
+		case read && write:
+			return "Read and write " + records
+		case write:
+			return "Write " + records
+		default:
+			return "Read " + records
+		}
+	case blobResource:
+		if s.target == "*/*" {
+			return "Upload files"
+		}
+		return "Upload " + s.target + " files"
+	}
+	return s.resource + ":" + s.target
+}
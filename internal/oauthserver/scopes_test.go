@@ -0,0 +1,59 @@
+package oauthserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScope(t *testing.T) {
+	s, err := parseScope("repo:com.example.notes?action=read")
+	require.NoError(t, err)
+	require.Equal(t, &scope{
+		resource: repoResource,
+		target:   "com.example.notes",
+		actions:  []string{ActionRead},
+	}, s)
+
+	// Leaving out the action grants every action
+	s, err = parseScope("repo:*")
+	require.NoError(t, err)
+	require.Equal(t, repoActions, s.actions)
+
+	for _, invalid := range []string{
+		"atproto",
+		"transition:generic",
+		"repo:",
+		"repo:com.example.notes?action=delete",
+		"blob:image",
+		"blob:*/png",
+	} {
+		_, err := parseScope(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestScopeStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		granted []string
+		needed  string
+		ok      bool
+	}{
+		{[]string{"repo:com.example.notes?action=read"}, RepoScope("com.example.notes", ActionRead), true},
+		{[]string{"repo:com.example.notes?action=read"}, RepoScope("com.example.notes", ActionWrite), false},
+		{[]string{"repo:com.example.notes?action=read"}, RepoScope("com.example.other", ActionRead), false},
+		{[]string{"repo:com.example.notes"}, RepoScope("com.example.notes", ActionWrite), true},
+		{[]string{"repo:*?action=read"}, RepoScope("com.example.notes", ActionRead), true},
+		{[]string{"repo:*?action=read"}, "repo:com.example.notes", false},
+		{[]string{"repo:*"}, "repo:com.example.notes?action=read&action=write", true},
+		{[]string{"blob:image/*"}, BlobScope("image/png"), true},
+		{[]string{"blob:image/*"}, BlobScope("video/mp4"), false},
+		{[]string{"blob:*/*"}, BlobScope("video/mp4"), true},
+		{[]string{"repo:*"}, BlobScope("image/png"), false},
+		{[]string{"atproto"}, "atproto", true},
+		{[]string{"atproto"}, RepoScope("com.example.notes", ActionRead), false},
+		{nil, RepoScope("com.example.notes", ActionRead), false},
+	} {
+		require.Equal(t, tc.ok, scopeStrategy(tc.granted, tc.needed), "%v covers %s", tc.granted, tc.needed)
+	}
+}
@@ -0,0 +1,194 @@
+package oauthserver
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// minSecretLength is the minimum length of a secret, in bytes.
+const minSecretLength = 32
+
+// Secrets are what the OAuth server derives its signing and encryption keys from. New tokens and
+// cookies use the current secret, while previous secrets are still accepted, so that rotating
+// secrets doesn't sign every user out.
+type Secrets struct {
+	Current  []byte
+	Previous [][]byte
+}
+
+// secretsFile is the on-disk format of Secrets.
+type secretsFile struct {
+	Current  []byte          `json:"current"`
+	Previous []retiredSecret `json:"previous,omitempty"`
+}
+
+// retiredSecret is a previous secret, accepted until it expires.
+type retiredSecret struct {
+	Secret    []byte    `json:"secret"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ParseSecrets parses base64 encoded secrets, with the current secret first.
+func ParseSecrets(encoded []string) (*Secrets, error) {
+	if len(encoded) == 0 {
+		return nil, errors.New("at least one secret is required")
+	}
+	secrets := &Secrets{}
+	for i, e := range encoded {
+		secret, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("decoding secret %d: %w", i, err)
+		}
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secret %d must be at least %d bytes", i, minSecretLength)
+		}
+		if i == 0 {
+			secrets.Current = secret
+		} else {
+			secrets.Previous = append(secrets.Previous, secret)
+		}
+	}
+	return secrets, nil
+}
+
+// LoadOrCreateSecrets reads the secrets file at path, generating and persisting a new secret if
+// the file does not exist. Previous secrets whose grace period has passed are left out.
+func LoadOrCreateSecrets(path string) (*Secrets, error) {
+	file, err := readSecretsFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		file = &secretsFile{}
+		file.Current, err = generateSecret()
+		if err != nil {
+			return nil, err
+		}
+		err = writeSecretsFile(path, file)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return file.secrets(time.Now()), nil
+}
+
+// RotateSecrets replaces the current secret in the file at path with a new one. The replaced
+// secret stays valid for the given grace period, and previous secrets that have expired are
+// removed. Servers pick up the new secrets when they are restarted.
+func RotateSecrets(path string, grace time.Duration) (*Secrets, error) {
+	file, err := readSecretsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rotated := &secretsFile{
+		Previous: []retiredSecret{{Secret: file.Current, ExpiresAt: now.Add(grace).UTC()}},
+	}
+	for _, prev := range file.Previous {
+		if prev.ExpiresAt.After(now) {
+			rotated.Previous = append(rotated.Previous, prev)
+		}
+	}
+	rotated.Current, err = generateSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = writeSecretsFile(path, rotated)
+	if err != nil {
+		return nil, err
+	}
+	return rotated.secrets(now), nil
+}
+
+// Keys derives a key of the given length from each secret for the given purpose, with the key of
+// the current secret first. Deriving separate keys keeps a secret from being reused across
+// algorithms.
+func (s *Secrets) Keys(purpose string, length int) ([][]byte, error) {
+	keys := make([][]byte, 0, 1+len(s.Previous))
+	for _, secret := range append([][]byte{s.Current}, s.Previous...) {
+		key, err := hkdf.Key(sha256.New, secret, nil, "habitat "+purpose, length)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// CookieKeyPairs returns hash and block key pairs for a gorilla cookie store, in the order
+// securecookie.CodecsFromPairs expects.
+func (s *Secrets) CookieKeyPairs() ([][]byte, error) {
+	hashKeys, err := s.Keys("cookie hash", 64)
+	if err != nil {
+		return nil, err
+	}
+	blockKeys, err := s.Keys("cookie block", 32)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([][]byte, 0, 2*len(hashKeys))
+	for i := range hashKeys {
+		pairs = append(pairs, hashKeys[i], blockKeys[i])
+	}
+	return pairs, nil
+}
+
+func (f *secretsFile) secrets(now time.Time) *Secrets {
+	secrets := &Secrets{Current: f.Current}
+	for _, prev := range f.Previous {
+		if prev.ExpiresAt.After(now) {
+			secrets.Previous = append(secrets.Previous, prev.Secret)
+		}
+	}
+	return secrets
+}
+
+func generateSecret() ([]byte, error) {
+	secret := make([]byte, minSecretLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("generating secret: %w", err)
+	}
+	return secret, nil
+}
+
+func readSecretsFile(path string) (*secretsFile, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &secretsFile{}
+	err = json.Unmarshal(bytes, file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing secrets at %s: %w", path, err)
+	}
+	if len(file.Current) < minSecretLength {
+		return nil, fmt.Errorf("current secret at %s must be at least %d bytes", path, minSecretLength)
+	}
+	return file, nil
+}
+
+func writeSecretsFile(path string, file *secretsFile) error {
+	bytes, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a failed write can't lose the current secret
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, bytes, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
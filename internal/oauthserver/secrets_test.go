@@ -0,0 +1,87 @@
+package oauthserver
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+
+	secrets, err := LoadOrCreateSecrets(path)
+	require.NoError(t, err)
+	require.Len(t, secrets.Current, minSecretLength)
+	require.Empty(t, secrets.Previous)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// The same secrets are loaded on the next run
+	loaded, err := LoadOrCreateSecrets(path)
+	require.NoError(t, err)
+	require.Equal(t, secrets, loaded)
+}
+
+func TestRotateSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	original, err := LoadOrCreateSecrets(path)
+	require.NoError(t, err)
+	oldKeys, err := original.Keys("token encryption", 32)
+	require.NoError(t, err)
+	token, err := newStrategy(oldKeys...).encrypt(&authSession{Subject: "did:web:test"})
+	require.NoError(t, err)
+
+	rotated, err := RotateSecrets(path, time.Hour)
+	require.NoError(t, err)
+	require.NotEqual(t, original.Current, rotated.Current)
+	require.Equal(t, [][]byte{original.Current}, rotated.Previous)
+
+	// Tokens encrypted with the old secret are still accepted during the grace period
+	newKeys, err := rotated.Keys("token encryption", 32)
+	require.NoError(t, err)
+	require.Len(t, newKeys, 2)
+	var session authSession
+	require.NoError(t, newStrategy(newKeys...).decrypt(token, &session))
+	require.Equal(t, "did:web:test", session.Subject)
+	require.Error(t, newStrategy(newKeys[0]).decrypt(token, nil))
+
+	// Secrets past their grace period are dropped
+	secondCurrent := rotated.Current
+	rotated, err = RotateSecrets(path, -time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{original.Current}, rotated.Previous)
+	loaded, err := LoadOrCreateSecrets(path)
+	require.NoError(t, err)
+	require.Equal(t, rotated.Current, loaded.Current)
+	require.NotContains(t, loaded.Previous, secondCurrent)
+	require.Len(t, loaded.Previous, 1)
+}
+
+func TestParseSecrets(t *testing.T) {
+	current := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	previous := base64.StdEncoding.EncodeToString(make([]byte, 48))
+
+	secrets, err := ParseSecrets([]string{current, previous})
+	require.NoError(t, err)
+	require.Len(t, secrets.Current, 32)
+	require.Len(t, secrets.Previous, 1)
+
+	pairs, err := secrets.CookieKeyPairs()
+	require.NoError(t, err)
+	require.Len(t, pairs, 4)
+	require.Len(t, pairs[0], 64)
+	require.Len(t, pairs[1], 32)
+
+	_, err = ParseSecrets(nil)
+	require.Error(t, err)
+	_, err = ParseSecrets([]string{"not base64!"})
+	require.Error(t, err)
+	_, err = ParseSecrets([]string{base64.StdEncoding.EncodeToString([]byte("too short"))})
+	require.Error(t, err)
+}
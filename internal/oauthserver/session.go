@@ -16,23 +16,36 @@ type authSession struct {
 	Scopes        []string            `cbor:"7,keyasint"`
 	State         string              `cbor:"8,keyasint"`
 	PKCEChallenge string              `cbor:"9,keyasint"`
+	// GrantID identifies the authorization grant the token was issued under, and is shared by
+	// every token derived from it so they can be revoked together.
+	GrantID string `cbor:"10,keyasint"`
+	// Issuer is the PDS authorization server that issued TokenInfo.
+	Issuer string `cbor:"11,keyasint"`
+	// DpopJKT is the thumbprint of the app's DPoP key, which the tokens are bound to as their
+	// cnf.jkt. Unlike DpopKey, the key is the app's own, and never leaves it.
+	DpopJKT string `cbor:"12,keyasint"`
 }
 
 var _ fosite.Session = (*authSession)(nil)
 
+// newAuthorizeSession returns the session of the authorization the user logged in to their PDS
+// for. The session's subject is the user's DID.
 func newAuthorizeSession(
 	req fosite.AuthorizeRequester,
-	dpopKey []byte,
-	tokenInfo *auth.TokenResponse,
+	pending *pendingAuthorization,
 ) *authSession {
 	return &authSession{
-		Subject:       req.GetRequestForm().Get("handle"),
+		Subject:       pending.DID,
 		Scopes:        req.GetRequestedScopes(),
-		DpopKey:       dpopKey,
-		TokenInfo:     tokenInfo,
+		DpopKey:       pending.DpopKey,
+		TokenInfo:     pending.TokenInfo,
 		State:         req.GetState(),
 		ClientID:      req.GetClient().GetID(),
 		PKCEChallenge: req.GetRequestForm().Get("code_challenge"),
+		GrantID:       req.GetID(),
+		Issuer:        pending.Issuer,
+		// Apps may bind the authorization code to their DPoP key up front, as in RFC 9449
+		DpopJKT: req.GetRequestForm().Get("dpop_jkt"),
 	}
 }
 
@@ -42,6 +55,10 @@ func newAccessTokenSession(session *authSession) *authSession {
 		DpopKey:   session.DpopKey,
 		TokenInfo: session.TokenInfo,
 		Scopes:    session.Scopes,
+		ClientID:  session.ClientID,
+		GrantID:   session.GrantID,
+		Issuer:    session.Issuer,
+		DpopJKT:   session.DpopJKT,
 	}
 }
 
@@ -2,10 +2,8 @@ package oauthserver
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"net/url"
 	"time"
 
@@ -13,19 +11,35 @@ import (
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/fosite/handler/pkce"
-	"github.com/ory/fosite/storage"
+	"gorm.io/gorm"
 )
 
+// store implements fosite's storage interfaces. Tokens are self-contained, so only the grants
+// they belong to and the codes and refresh tokens issued for them are persisted, which is enough
+// to revoke grants and detect code and refresh token reuse.
 type store struct {
-	memoryStore *storage.MemoryStore
-	strategy    *strategy
+	strategy *strategy
+	db       *gorm.DB
+	clients  *clientMetadataCache
 }
 
-func newStore(strat *strategy) *store {
-	return &store{
-		memoryStore: storage.NewMemoryStore(),
-		strategy:    strat,
+func newStore(strat *strategy, db *gorm.DB) (*store, error) {
+	err := db.AutoMigrate(
+		&oauthGrant{},
+		&oauthRefreshToken{},
+		&oauthAuthorizeRequest{},
+		&oauthApproval{},
+		&oauthAuthorizeCode{},
+		&oauthClientAssertion{},
+	)
+	if err != nil {
+		return nil, err
 	}
+	return &store{
+		strategy: strat,
+		db:       db,
+		clients:  newClientMetadataCache(),
+	}, nil
 }
 
 var (
@@ -37,28 +51,47 @@ var (
 
 // ClientAssertionJWTValid implements fosite.Storage.
 func (s *store) ClientAssertionJWTValid(ctx context.Context, jti string) error {
-	panic("not implemented")
+	var count int64
+	err := s.db.WithContext(ctx).
+		Model(&oauthClientAssertion{}).
+		Where("jti = ? AND expires_at > ?", hashSignature(jti), time.Now().UTC()).
+		Count(&count).
+		Error
+	if err != nil {
+		return err
+	} else if count > 0 {
+		return fosite.ErrJTIKnown
+	}
+	return nil
 }
 
 // GetClient implements fosite.Storage.
 func (s *store) GetClient(ctx context.Context, id string) (fosite.Client, error) {
-	// TODO: consider caching
-	resp, err := http.Get(id)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch client metadata: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-	var metadata auth.ClientMetadata
-	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	metadata, err := s.clients.get(ctx, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode client metadata: %w", err)
+		return nil, err
 	}
-	return &client{metadata}, nil
+	return &client{*metadata}, nil
 }
 
 // SetClientAssertionJWT implements fosite.Storage.
 func (s *store) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
-	return s.memoryStore.SetClientAssertionJWT(ctx, jti, exp)
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Expired assertions are rejected anyway, so they no longer need to be remembered
+		err := tx.Where("expires_at <= ?", time.Now().UTC()).Delete(&oauthClientAssertion{}).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Where(&oauthClientAssertion{JTI: hashSignature(jti)}).
+			Attrs(&oauthClientAssertion{ExpiresAt: exp.UTC()}).
+			FirstOrCreate(&oauthClientAssertion{})
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return fosite.ErrJTIKnown
+		}
+		return nil
+	})
 }
 
 // CreateAuthorizeCodeSession implements oauth2.CoreStorage.
@@ -67,8 +100,22 @@ func (s *store) CreateAuthorizeCodeSession(
 	code string,
 	request fosite.Requester,
 ) (err error) {
-	// Session data is encrypted in the code itself by the strategy
-	return nil
+	// Session data is encrypted in the code itself by the strategy, so only enough is stored to
+	// make sure the code is used once
+	now := time.Now().UTC()
+	err = s.db.WithContext(ctx).
+		Where("expires_at <= ?", now).
+		Delete(&oauthAuthorizeCode{}).
+		Error
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Create(&oauthAuthorizeCode{
+		Signature: hashSignature(code),
+		GrantID:   request.GetID(),
+		Active:    true,
+		ExpiresAt: request.GetSession().GetExpiresAt(fosite.AuthorizeCode).UTC(),
+	}).Error
 }
 
 // GetAuthorizeCodeSession implements oauth2.CoreStorage.
@@ -82,20 +129,47 @@ func (s *store) GetAuthorizeCodeSession(
 	if err != nil {
 		return nil, errors.Join(fosite.ErrNotFound, err)
 	}
+	issued := &oauthAuthorizeCode{}
+	res := s.db.WithContext(ctx).
+		Where("signature = ?", hashSignature(code)).
+		Limit(1).
+		Find(issued)
+	if res.Error != nil {
+		return nil, res.Error
+	} else if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: authorization code was never issued", fosite.ErrNotFound)
+	}
 	client, err := s.GetClient(ctx, data.ClientID)
 	if err != nil {
 		return nil, errors.Join(fosite.ErrNotFound, err)
 	}
-	return &fosite.Request{
+	request = &fosite.Request{
+		ID:             data.GrantID,
 		Client:         client,
 		Session:        &data,
 		RequestedScope: data.Scopes,
-	}, nil
+		GrantedScope:   data.Scopes,
+	}
+	if !issued.Active {
+		// fosite revokes the grant when it sees this, as the code has leaked
+		return request, fosite.ErrInvalidatedAuthorizeCode
+	}
+	return request, nil
 }
 
 // InvalidateAuthorizeCodeSession implements oauth2.CoreStorage.
 func (s *store) InvalidateAuthorizeCodeSession(ctx context.Context, code string) (err error) {
-	// Stateless - code is self-contained and single-use
+	// The record is kept until the code expires, so later reuse of it is still detected
+	res := s.db.WithContext(ctx).
+		Model(&oauthAuthorizeCode{}).
+		Where("signature = ? AND active = ?", hashSignature(code), true).
+		Update("active", false)
+	if res.Error != nil {
+		return res.Error
+	} else if res.RowsAffected == 0 {
+		// Another request exchanged the code after this one looked it up
+		return fosite.ErrInvalidatedAuthorizeCode
+	}
 	return nil
 }
 
@@ -129,11 +203,12 @@ func (s *store) GetPKCERequestSession(
 
 // CreateAccessTokenSession implements oauth2.CoreStorage.
 func (s *store) CreateAccessTokenSession(
-	_ context.Context,
+	ctx context.Context,
 	_ string,
-	_ fosite.Requester,
+	request fosite.Requester,
 ) (err error) {
-	return nil
+	// Clients that don't ask for offline access only get an access token
+	return s.createGrant(ctx, request.GetSession().(*authSession))
 }
 
 // GetAccessTokenSession implements oauth2.CoreStorage.
@@ -147,9 +222,21 @@ func (s *store) GetAccessTokenSession(
 	if err != nil {
 		return nil, errors.Join(fosite.ErrNotFound, err)
 	}
+	_, err = s.activeGrant(ctx, sess.GrantID)
+	if errors.Is(err, ErrGrantNotFound) {
+		return nil, fmt.Errorf("%w: token has been revoked", fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
 	return &fosite.AccessRequest{
 		Request: fosite.Request{
-			Session: &sess,
+			ID: sess.GrantID,
+			// Only the ID is needed to check which client a token belongs to, which saves
+			// fetching the client metadata on every request.
+			Client:         &client{auth.ClientMetadata{ClientId: sess.ClientID}},
+			Session:        &sess,
+			RequestedScope: sess.Scopes,
+			GrantedScope:   sess.Scopes,
 		},
 	}, nil
 }
@@ -161,7 +248,7 @@ func (s *store) DeleteAccessTokenSession(_ context.Context, _ string) error {
 
 // RevokeAccessToken implements oauth2.TokenRevocationStorage.
 func (s *store) RevokeAccessToken(ctx context.Context, requestID string) error {
-	return fmt.Errorf("access token revocation not supported")
+	return s.revokeGrant(ctx, requestID)
 }
 
 // CreateRefreshTokenSession implements oauth2.CoreStorage.
@@ -171,12 +258,26 @@ func (s *store) CreateRefreshTokenSession(
 	accessSignature string,
 	request fosite.Requester,
 ) error {
-	return nil
+	session := request.GetSession().(*authSession)
+	err := s.createGrant(ctx, session)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Create(&oauthRefreshToken{
+		Signature: hashSignature(signature),
+		GrantID:   session.GrantID,
+		Active:    true,
+	}).Error
 }
 
 // DeleteRefreshTokenSession implements oauth2.CoreStorage.
 func (s *store) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
-	return nil
+	// The record is kept so later reuse of the token is still detected
+	return s.db.WithContext(ctx).
+		Model(&oauthRefreshToken{}).
+		Where("signature = ?", hashSignature(signature)).
+		Update("active", false).
+		Error
 }
 
 // GetRefreshTokenSession implements oauth2.CoreStorage.
@@ -185,7 +286,44 @@ func (s *store) GetRefreshTokenSession(
 	signature string,
 	session fosite.Session,
 ) (fosite.Requester, error) {
-	return nil, nil
+	var data authSession
+	err := s.strategy.decrypt(signature, &data)
+	if err != nil {
+		return nil, errors.Join(fosite.ErrNotFound, err)
+	}
+	_, err = s.activeGrant(ctx, data.GrantID)
+	if errors.Is(err, ErrGrantNotFound) {
+		return nil, fmt.Errorf("%w: token has been revoked", fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	token := &oauthRefreshToken{}
+	res := s.db.WithContext(ctx).
+		Where("signature = ?", hashSignature(signature)).
+		Limit(1).
+		Find(token)
+	if res.Error != nil {
+		return nil, res.Error
+	} else if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: refresh token was never issued", fosite.ErrNotFound)
+	}
+
+	client, err := s.GetClient(ctx, data.ClientID)
+	if err != nil {
+		return nil, errors.Join(fosite.ErrNotFound, err)
+	}
+	request := &fosite.Request{
+		ID:             data.GrantID,
+		Client:         client,
+		Session:        &data,
+		RequestedScope: data.Scopes,
+		GrantedScope:   data.Scopes,
+	}
+	if !token.Active {
+		// fosite revokes the whole grant when it sees this, as the token has leaked
+		return request, fosite.ErrInactiveToken
+	}
+	return request, nil
 }
 
 // RotateRefreshToken implements oauth2.CoreStorage.
@@ -194,10 +332,20 @@ func (s *store) RotateRefreshToken(
 	requestID string,
 	refreshTokenSignature string,
 ) (err error) {
+	res := s.db.WithContext(ctx).
+		Model(&oauthRefreshToken{}).
+		Where("signature = ? AND active = ?", hashSignature(refreshTokenSignature), true).
+		Update("active", false)
+	if res.Error != nil {
+		return res.Error
+	} else if res.RowsAffected == 0 {
+		// Another request rotated the token after this one looked it up
+		return fosite.ErrSerializationFailure
+	}
 	return nil
 }
 
 // RevokeRefreshToken implements oauth2.TokenRevocationStorage.
-func (s *store) RevokeRefreshToken(_ context.Context, _ string) error {
-	return fmt.Errorf("refresh token revocation not supported")
+func (s *store) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	return s.revokeGrant(ctx, requestID)
 }
@@ -6,29 +6,146 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/eagraf/habitat-new/internal/auth"
+	"github.com/ory/fosite"
 	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
+func testStore(t *testing.T) *store {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	store, err := newStore(newStrategy([]byte("test-secret")), db)
+	require.NoError(t, err)
+	store.clients.allowInsecure = true
+	return store
+}
+
 func TestGetClient(t *testing.T) {
-	store := newStore(newStrategy([]byte("test-secret")))
+	store := testStore(t)
+	clientId := testClientMetadataServer(t).URL + "/client-metadata.json"
+
+	client, err := store.GetClient(context.Background(), clientId)
+	require.NoError(t, err)
+
+	require.Equal(t, clientId, client.GetID())
+	require.Equal(t, []string{"http://127.0.0.1/callback"}, client.GetRedirectURIs())
+}
+
+// testClientMetadataServer serves client metadata for any client ID under its URL.
+func testClientMetadataServer(t *testing.T) *httptest.Server {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		t.Logf("url: %s", r.Host)
-		if r.URL.Path == "/client-metadata.json" && r.Method == http.MethodGet {
-			w.Header().Set("Content-Type", "application/json")
-			_, err := fmt.Fprintf(w, `{
-					"client_id": "%s"
-				}`, "http://"+r.Host+r.URL.Path)
-			require.NoError(t, err)
-			return
-		}
-		w.WriteHeader(http.StatusNotFound)
+		w.Header().Set("Content-Type", "application/json")
+		_, err := fmt.Fprintf(w, `{
+			"client_id": "http://%s%s",
+			"redirect_uris": ["http://127.0.0.1/callback"],
+			"grant_types": ["authorization_code", "refresh_token"],
+			"response_types": ["code"]
+		}`, r.Host, r.URL.Path)
+		require.NoError(t, err)
 	}))
+	t.Cleanup(server.Close)
+	return server
+}
 
-	clientId := server.URL + "/client-metadata.json"
+func TestRefreshTokenReuse(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	clientID := testClientMetadataServer(t).URL + "/client-metadata.json"
 
-	client, err := store.GetClient(context.Background(), clientId)
+	session := &authSession{
+		Subject:   "did:web:test",
+		ClientID:  clientID,
+		GrantID:   "grant-1",
+		TokenInfo: &auth.TokenResponse{RefreshToken: "pds-refresh-token"},
+	}
+	first, err := store.strategy.encrypt(session)
 	require.NoError(t, err)
+	require.NoError(t, store.CreateRefreshTokenSession(ctx, first, "", &fosite.Request{Session: session}))
 
-	require.Equal(t, clientId, client.GetID())
+	req, err := store.GetRefreshTokenSession(ctx, first, nil)
+	require.NoError(t, err)
+	require.Equal(t, "grant-1", req.GetID())
+
+	// Rotating the token replaces it with a new one in the same family
+	require.NoError(t, store.RotateRefreshToken(ctx, "grant-1", first))
+	require.ErrorIs(t, store.RotateRefreshToken(ctx, "grant-1", first), fosite.ErrSerializationFailure)
+	second, err := store.strategy.encrypt(session)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateRefreshTokenSession(ctx, second, "", &fosite.Request{Session: session}))
+
+	// Using the rotated token again is detected, so fosite can revoke the grant
+	req, err = store.GetRefreshTokenSession(ctx, first, nil)
+	require.ErrorIs(t, err, fosite.ErrInactiveToken)
+	require.Equal(t, "grant-1", req.GetID())
+	require.NoError(t, store.RevokeRefreshToken(ctx, req.GetID()))
+
+	_, err = store.GetRefreshTokenSession(ctx, second, nil)
+	require.ErrorIs(t, err, fosite.ErrNotFound)
+	_, err = store.GetAccessTokenSession(ctx, second, nil)
+	require.ErrorIs(t, err, fosite.ErrNotFound)
+
+	// Tokens that were never issued are rejected
+	unknown, err := store.strategy.encrypt(&authSession{ClientID: clientID, GrantID: "grant-2"})
+	require.NoError(t, err)
+	_, err = store.GetRefreshTokenSession(ctx, unknown, nil)
+	require.ErrorIs(t, err, fosite.ErrNotFound)
+}
+
+func TestListAndRevokeGrants(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	oauthServer := &OAuthServer{storage: store, strategy: store.strategy}
+
+	for _, grant := range []*authSession{
+		{Subject: "did:web:alice", ClientID: "https://app-a.example.com", GrantID: "grant-a", Scopes: []string{"atproto"}},
+		{Subject: "did:web:alice", ClientID: "https://app-b.example.com", GrantID: "grant-b"},
+		{Subject: "did:web:bob", ClientID: "https://app-a.example.com", GrantID: "grant-c"},
+	} {
+		require.NoError(t, store.CreateAccessTokenSession(ctx, "", &fosite.Request{Session: grant}))
+	}
+	// Recording the same grant again is a no-op
+	require.NoError(t, store.CreateAccessTokenSession(ctx, "", &fosite.Request{Session: &authSession{
+		Subject:  "did:web:alice",
+		ClientID: "https://app-a.example.com",
+		GrantID:  "grant-a",
+	}}))
+
+	grants, err := oauthServer.ListGrants(ctx, "did:web:alice")
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	require.Equal(t, "grant-a", grants[0].ID)
+	require.Equal(t, []string{"atproto"}, grants[0].Scopes)
+
+	// Users can only revoke their own grants
+	require.ErrorIs(t, oauthServer.RevokeGrant(ctx, "did:web:bob", "grant-a"), ErrGrantNotFound)
+	require.NoError(t, oauthServer.RevokeGrant(ctx, "did:web:alice", "grant-a"))
+	require.ErrorIs(t, oauthServer.RevokeGrant(ctx, "did:web:alice", "grant-a"), ErrGrantNotFound)
+
+	grants, err = oauthServer.ListGrants(ctx, "did:web:alice")
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	require.Equal(t, "grant-b", grants[0].ID)
+}
+
+func TestClientAssertionJWTReplay(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+
+	require.NoError(t, store.ClientAssertionJWTValid(ctx, "jti-1"))
+	require.NoError(t, store.SetClientAssertionJWT(ctx, "jti-1", time.Now().Add(time.Minute)))
+	require.ErrorIs(t, store.ClientAssertionJWTValid(ctx, "jti-1"), fosite.ErrJTIKnown)
+	require.ErrorIs(
+		t,
+		store.SetClientAssertionJWT(ctx, "jti-1", time.Now().Add(time.Minute)),
+		fosite.ErrJTIKnown,
+	)
+
+	// Expired assertions are forgotten
+	require.NoError(t, store.SetClientAssertionJWT(ctx, "jti-2", time.Now().Add(-time.Minute)))
+	require.NoError(t, store.ClientAssertionJWTValid(ctx, "jti-2"))
+	require.NoError(t, store.SetClientAssertionJWT(ctx, "jti-2", time.Now().Add(time.Minute)))
 }
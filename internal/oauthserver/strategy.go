@@ -15,13 +15,19 @@ import (
 )
 
 type strategy struct {
-	key *[32]byte
+	// keys[0] encrypts new tokens, while any of them can decrypt, so tokens issued before a key
+	// rotation stay valid.
+	keys []*[32]byte
 }
 
-func newStrategy(key []byte) *strategy {
-	var k [32]byte
-	copy(k[:], key)
-	return &strategy{key: &k}
+func newStrategy(keys ...[]byte) *strategy {
+	s := &strategy{}
+	for _, key := range keys {
+		var k [32]byte
+		copy(k[:], key)
+		s.keys = append(s.keys, &k)
+	}
+	return s
 }
 
 var _ oauth2.CoreStrategy = &strategy{}
@@ -107,7 +113,7 @@ func (s *strategy) encrypt(data any) (string, error) {
 		return "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
 	return base64.RawURLEncoding.EncodeToString(
-		secretbox.Seal(nonce[:], b.Bytes(), &nonce, s.key),
+		secretbox.Seal(nonce[:], b.Bytes(), &nonce, s.keys[0]),
 	), nil
 }
 
@@ -116,9 +122,19 @@ func (s *strategy) decrypt(token string, data any) error {
 	if err != nil {
 		return fmt.Errorf("invalid token: %w", err)
 	}
+	if len(b) < 24 {
+		return fmt.Errorf("invalid token")
+	}
 	var nonce [24]byte
 	copy(nonce[:], b[:24])
-	decrypted, ok := secretbox.Open(nil, b[24:], &nonce, s.key)
+	var decrypted []byte
+	ok := false
+	for _, key := range s.keys {
+		decrypted, ok = secretbox.Open(nil, b[24:], &nonce, key)
+		if ok {
+			break
+		}
+	}
 	if !ok {
 		return fmt.Errorf("invalid token")
 	}
@@ -1,9 +1,13 @@
 package oauthserver
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
@@ -12,9 +16,15 @@ import (
 )
 
 type dummyOAuthClient struct {
-	metadata *auth.ClientMetadata
-	server   *httptest.Server
-	t        *testing.T
+	metadata   *auth.ClientMetadata
+	server     *httptest.Server
+	t          *testing.T
+	revoked    []string
+	authorizes atomic.Int64
+	// accounts holds the DID each flow's state was authorized for, which its tokens are issued for
+	accounts sync.Map
+	// issueTokensFor, if set, is the DID tokens are issued for instead
+	issueTokensFor atomic.Value
 }
 
 func NewDummyOAuthClient(t *testing.T, metadata *auth.ClientMetadata) *dummyOAuthClient {
@@ -47,12 +57,16 @@ func (d *dummyOAuthClient) Authorize(
 	_ *auth.DpopHttpClient,
 	i *identity.Identity,
 ) (string, *auth.AuthorizeState, error) {
+	// Each flow gets its own state, as with a real PDS
+	state := fmt.Sprintf("dummyState%d", d.authorizes.Add(1))
+	d.accounts.Store(state, i.DID.String())
 	q := url.Values{
 		"redirect_uri": []string{d.metadata.RedirectUris[0]},
+		"state":        []string{state},
 	}
 	return d.server.URL + "/authorize?" + q.Encode(), &auth.AuthorizeState{
 		Verifier:      "dummyVerifier",
-		State:         "dummyState",
+		State:         state,
 		TokenEndpoint: d.server.URL + "/token",
 	}, nil
 }
@@ -70,14 +84,19 @@ func (d *dummyOAuthClient) ExchangeCode(
 	state *auth.AuthorizeState,
 ) (*auth.TokenResponse, error) {
 	require.Equal(d.t, "dummyCode", code)
-	require.Equal(d.t, "dummyState", state.State)
+	require.True(d.t, strings.HasPrefix(state.State, "dummyState"))
 	require.Equal(d.t, "dummyVerifier", state.Verifier)
+	sub, _ := d.accounts.Load(state.State)
+	if override := d.issueTokensFor.Load(); override != nil {
+		sub = override
+	}
 	return &auth.TokenResponse{
 		AccessToken:  "dummy_access_token",
 		RefreshToken: "dummy_refresh_token",
 		TokenType:    "DPoP",
 		ExpiresIn:    3600,
 		Scope:        "atproto transition:generic",
+		Sub:          sub.(string),
 	}, nil
 }
 
@@ -98,6 +117,28 @@ func (d *dummyOAuthClient) RefreshToken(
 	}, nil
 }
 
+// RevokeToken implements OAuthClient.
+func (d *dummyOAuthClient) RevokeToken(
+	dpopClient *auth.DpopHttpClient,
+	identity *identity.Identity,
+	token string,
+	tokenTypeHint string,
+) error {
+	d.revoked = append(d.revoked, token)
+	return nil
+}
+
+// IssueTokensFor makes the PDS issue tokens for the given DID, whichever account the flow was
+// started for, as if the user logged in to another account at their PDS.
+func (d *dummyOAuthClient) IssueTokensFor(did string) {
+	d.issueTokensFor.Store(did)
+}
+
+// RevokedTokens returns the upstream tokens that have been revoked through the client.
+func (d *dummyOAuthClient) RevokedTokens() []string {
+	return d.revoked
+}
+
 func (d *dummyOAuthClient) Close() {
 	d.server.Close()
 }
@@ -0,0 +1,60 @@
+package permissions
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Both stores evaluate permissions the same way: a rule on an object covers that object and
+// everything under it, and the most specific active rule decides. Deny wins between rules on
+// the same object.
+
+func getObject(nsid string, rkey string) string {
+	if rkey == "" {
+		return nsid
+	}
+	return fmt.Sprintf("%s.%s", nsid, rkey)
+}
+
+// objectCovers reports whether a rule on ruleObject applies to object.
+func objectCovers(ruleObject string, object string) bool {
+	return ruleObject == object || strings.HasPrefix(object, ruleObject+".")
+}
+
+// sortByPrecedence orders rules from most to least specific, with denies first on ties.
+func sortByPrecedence(rules []Permission) {
+	slices.SortStableFunc(rules, func(a, b Permission) int {
+		if len(a.Object) != len(b.Object) {
+			return len(b.Object) - len(a.Object)
+		}
+		return strings.Compare(string(b.Effect), string(a.Effect))
+	})
+}
+
+// decide picks the first active rule from rules already sorted by precedence.
+func decide(rules []Permission, now time.Time) *Explanation {
+	explanation := &Explanation{Rules: rules}
+	for i, perm := range rules {
+		if !perm.Active(now) {
+			continue
+		}
+		explanation.DecidingRule = &rules[i]
+		explanation.Allowed = perm.Effect == EffectAllow
+		explanation.Reason = fmt.Sprintf("most specific active rule %s %s", perm.Effect, perm.Object)
+		return explanation
+	}
+
+	// No permission found, deny by default
+	explanation.Reason = "no active rule matches, denied by default"
+	return explanation
+}
+
+func ownerExplanation() *Explanation {
+	return &Explanation{
+		Allowed: true,
+		Reason:  "requester owns the record",
+		Rules:   []Permission{},
+	}
+}
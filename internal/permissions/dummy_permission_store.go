@@ -47,6 +47,49 @@ func (d *dummy) RemoveLexiconReadPermission(
 	return errors.ErrUnsupported
 }
 
+// AddPermission implements Store. Only lexicon-wide allows without time bounds are supported.
+func (d *dummy) AddPermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
+) error {
+	err := d.ValidatePermission(grantee, owner, nsid, rkey, effect, opts...)
+	if err != nil {
+		return err
+	}
+	return d.AddLexiconReadPermission(grantee, owner, nsid)
+}
+
+// ValidatePermission implements Store.
+func (d *dummy) ValidatePermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
+) error {
+	if rkey != "" || effect != EffectAllow || getGrantOptions(opts).timeBounded() {
+		return errors.ErrUnsupported
+	}
+	return nil
+}
+
+func (d *dummy) Explain(requester string, owner string, nsid string, rkey string) (*Explanation, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (d *dummy) RemovePermission(grantee string, owner string, nsid string, rkey string) error {
+	return errors.ErrUnsupported
+}
+
+func (d *dummy) ListPermissions(owner string) ([]Permission, error) {
+	return nil, errors.ErrUnsupported
+}
+
 func (d *dummy) ListReadPermissionsByLexicon(owner string) (map[string][]string, error) {
 	return nil, errors.ErrUnsupported
 }
@@ -60,6 +103,11 @@ func (d *dummy) ListReadPermissionsByUser(
 	return nil, nil, errors.ErrUnsupported
 }
 
+// Transaction implements Store. Changes are not rolled back if fn fails.
+func (d *dummy) Transaction(fn func(tx Store) error) error {
+	return fn(d)
+}
+
 // NewDummyStore returns a permissions store that always returns true
 func NewDummyStore() *dummy {
 	return &dummy{
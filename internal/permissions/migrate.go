@@ -0,0 +1,64 @@
+package permissions
+
+import (
+	"fmt"
+
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// MigrateCasbinPolicies copies every policy loaded by the casbin adapter into dst, returning the
+// number of rules written. Policies granted to a casbin role are expanded into one rule per
+// member of the role, since other stores have no notion of groups.
+func MigrateCasbinPolicies(adapter persist.Adapter, dst Store) (int, error) {
+	src, err := NewStore(adapter, false)
+	if err != nil {
+		return 0, fmt.Errorf("loading casbin policies: %w", err)
+	}
+	enforcer := src.(*casbinStore).enforcer
+
+	policies := [][]string{}
+	for _, ptype := range policyTypes {
+		named, err := enforcer.GetNamedPolicy(ptype)
+		if err != nil {
+			return 0, err
+		}
+		policies = append(policies, named...)
+	}
+
+	n := 0
+	for _, policy := range policies {
+		perm, err := getPermissionFromCasbin(policy)
+		if err != nil {
+			return n, err
+		}
+		effect, err := ParseEffect(string(perm.Effect))
+		if err != nil {
+			return n, err
+		}
+		opts := []GrantOption{}
+		if perm.NotBefore != nil {
+			opts = append(opts, WithNotBefore(*perm.NotBefore))
+		}
+		if perm.ExpiresAt != nil {
+			opts = append(opts, WithExpiresAt(*perm.ExpiresAt))
+		}
+
+		grantees, err := enforcer.GetImplicitUsersForRole(perm.Grantee)
+		if err != nil {
+			return n, err
+		}
+		if len(grantees) == 0 {
+			grantees = []string{perm.Grantee}
+		}
+
+		for _, grantee := range grantees {
+			// The object already includes the record key, if any.
+			err = dst.AddPermission(grantee, perm.Owner, perm.Object, "", effect, opts...)
+			if err != nil {
+				return n, fmt.Errorf("migrating policy %v: %w", policy, err)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
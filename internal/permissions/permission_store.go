@@ -2,14 +2,95 @@ package permissions
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/persist"
 )
 
+// Effect is the outcome a permission rule has when it matches a request.
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// ParseEffect validates the given string as an effect. An empty string defaults to allow.
+func ParseEffect(s string) (Effect, error) {
+	switch Effect(s) {
+	case "", EffectAllow:
+		return EffectAllow, nil
+	case EffectDeny:
+		return EffectDeny, nil
+	}
+	return "", fmt.Errorf("invalid permission effect %q: must be %q or %q", s, EffectAllow, EffectDeny)
+}
+
+// GrantOption configures optional properties of a permission rule.
+type GrantOption func(*grantOptions)
+
+type grantOptions struct {
+	notBefore *time.Time
+	expiresAt *time.Time
+}
+
+// WithNotBefore makes the rule take effect only once the given time is reached.
+func WithNotBefore(t time.Time) GrantOption {
+	t = t.UTC()
+	return func(o *grantOptions) {
+		o.notBefore = &t
+	}
+}
+
+// WithExpiresAt makes the rule stop taking effect at the given time.
+func WithExpiresAt(t time.Time) GrantOption {
+	t = t.UTC()
+	return func(o *grantOptions) {
+		o.expiresAt = &t
+	}
+}
+
+func getGrantOptions(opts []GrantOption) *grantOptions {
+	o := &grantOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// validatePermission checks the rules every store applies to a new permission: a time-bounded
+// rule must expire after it takes effect.
+func validatePermission(opts []GrantOption) error {
+	o := getGrantOptions(opts)
+	if o.notBefore != nil && o.expiresAt != nil && !o.expiresAt.After(*o.notBefore) {
+		return fmt.Errorf("permission must expire after it takes effect")
+	}
+	return nil
+}
+
+func (o *grantOptions) timeBounded() bool {
+	return o.notBefore != nil || o.expiresAt != nil
+}
+
+// Explanation describes how a permission decision was reached.
+type Explanation struct {
+	Allowed bool
+	// Reason is a human readable summary of the decision.
+	Reason string
+	// DecidingRule is the rule that determined the decision, or nil if access was decided
+	// without one (e.g. ownership, or no rule matching).
+	DecidingRule *Permission
+	// Rules are all rules matching the record, including inactive ones, in the order they
+	// are considered.
+	Rules []Permission
+}
+
 type Store interface {
 	HasPermission(
 		requester string,
@@ -27,19 +108,63 @@ type Store interface {
 		owner string,
 		nsid string,
 	) error
+	// AddPermission adds a rule with the given effect for an entire lexicon, or for a single
+	// record if rkey is non-empty. Adding a rule for an existing object replaces its effect
+	// and time bounds.
+	AddPermission(
+		grantee string,
+		owner string,
+		nsid string,
+		rkey string,
+		effect Effect,
+		opts ...GrantOption,
+	) error
+	// ValidatePermission reports whether AddPermission would accept the rule, without writing it.
+	ValidatePermission(
+		grantee string,
+		owner string,
+		nsid string,
+		rkey string,
+		effect Effect,
+		opts ...GrantOption,
+	) error
+	// RemovePermission removes the rule for the lexicon or record, whatever its effect.
+	RemovePermission(
+		grantee string,
+		owner string,
+		nsid string,
+		rkey string,
+	) error
+	// Explain reports the rules matching a record and the decision HasPermission makes from them.
+	Explain(requester string, owner string, nsid string, rkey string) (*Explanation, error)
+	// ListPermissions returns every rule the owner has defined, denies included.
+	ListPermissions(owner string) ([]Permission, error)
 	ListReadPermissionsByLexicon(owner string) (map[string][]string, error)
 	ListReadPermissionsByUser(
 		owner string,
 		requester string,
 		nsid string,
 	) (allow []string, deny []string, err error)
+	// Transaction runs fn against a store whose changes are all undone if fn returns an error.
+	Transaction(fn func(tx Store) error) error
 }
 
 type casbinStore struct {
 	enforcer *casbin.Enforcer
 	adapter  persist.Adapter
+	// now returns the current time; overridden in tests.
+	now func() time.Time
 }
 
+// Casbin requires every policy of a type to have the same fields, so time-bounded rules are
+// stored with their bounds under a second policy type, leaving existing policy files readable.
+const (
+	policyType        = "p"
+	boundedPolicyType = "p2"
+)
+
+var policyTypes = []string{policyType, boundedPolicyType}
+
 //go:embed model.conf
 var modelStr string
 
@@ -58,69 +183,209 @@ func NewStore(adapter persist.Adapter, autoSave bool) (Store, error) {
 	return &casbinStore{
 		enforcer: enforcer,
 		adapter:  adapter,
+		now:      time.Now,
 	}, nil
 }
 
-// HasPermission implements PermissionStore.
-// TODO: implement record key granularity for permissions
+// HasPermission implements Store.
 func (p *casbinStore) HasPermission(
 	requester string,
 	owner string,
 	nsid string,
 	rkey string,
 ) (bool, error) {
+	explanation, err := p.Explain(requester, owner, nsid, rkey)
+	if err != nil {
+		return false, err
+	}
+	return explanation.Allowed, nil
+}
+
+// Explain implements Store. Casbin is only used to store the policies; they are evaluated with
+// the same longest-match rules as the sqlite store rather than the enforcer's deny-wins effect,
+// so that both stores make the same decisions.
+func (p *casbinStore) Explain(
+	requester string,
+	owner string,
+	nsid string,
+	rkey string,
+) (*Explanation, error) {
 	if requester == owner {
-		return true, nil
+		return ownerExplanation(), nil
+	}
+
+	rules, err := p.rulesFor(requester, owner)
+	if err != nil {
+		return nil, err
 	}
-	return p.enforcer.Enforce(requester, owner, getCasbinObjectFromRecord(nsid, rkey))
+
+	object := getObject(nsid, rkey)
+	matching := []Permission{}
+	for _, rule := range rules {
+		if objectCovers(rule.Object, object) {
+			matching = append(matching, rule)
+		}
+	}
+	sortByPrecedence(matching)
+	return decide(matching, p.now()), nil
 }
 
-// TODO: do some validation on input, possible cases:
-// - duplicate policies
-// - conflicting policies
 func (p *casbinStore) AddLexiconReadPermission(
 	requester string,
 	owner string,
 	nsid string,
 ) error {
-	_, err := p.enforcer.AddPolicy(requester, owner, getCasbinObjectFromLexicon(nsid), "allow")
+	return p.AddPermission(requester, owner, nsid, "", EffectAllow)
+}
+
+func (p *casbinStore) RemoveLexiconReadPermission(
+	requester string,
+	owner string,
+	nsid string,
+) error {
+	return p.RemovePermission(requester, owner, nsid, "")
+}
+
+// AddPermission implements Store.
+func (p *casbinStore) AddPermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
+) error {
+	err := p.ValidatePermission(grantee, owner, nsid, rkey, effect, opts...)
+	if err != nil {
+		return err
+	}
+	// A grantee has at most one effect per object, so drop whatever was there before.
+	err = p.removeObject(grantee, owner, getObject(nsid, rkey))
+	if err != nil {
+		return err
+	}
+	policy := []string{grantee, owner, getCasbinObject(nsid, rkey), string(effect)}
+	o := getGrantOptions(opts)
+	if o.timeBounded() {
+		policy = append(policy, formatCasbinTime(o.notBefore), formatCasbinTime(o.expiresAt))
+		_, err = p.enforcer.AddNamedPolicy(boundedPolicyType, policy)
+	} else {
+		_, err = p.enforcer.AddPolicy(policy)
+	}
 	if err != nil {
 		return err
 	}
 	return p.adapter.SavePolicy(p.enforcer.GetModel())
 }
 
-// TODO: do some validation on input
-func (p *casbinStore) RemoveLexiconReadPermission(
-	requester string,
+// ValidatePermission implements Store.
+func (p *casbinStore) ValidatePermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
+) error {
+	return validatePermission(opts)
+}
+
+// RemovePermission implements Store.
+func (p *casbinStore) RemovePermission(
+	grantee string,
 	owner string,
 	nsid string,
+	rkey string,
 ) error {
-	// TODO: should we actually be adding a deny here instead of just removing allow?
-	_, err := p.enforcer.RemovePolicy(
-		requester,
-		owner,
-		getCasbinObjectFromLexicon(nsid),
-		"allow",
-	)
+	err := p.removeObject(grantee, owner, getObject(nsid, rkey))
 	if err != nil {
 		return err
 	}
 	return p.adapter.SavePolicy(p.enforcer.GetModel())
 }
 
+// removeObject removes the grantee's policies on the object, however the object was written
+// in the policy file (e.g. both "app.bsky.posts" and "app.bsky.posts.*").
+func (p *casbinStore) removeObject(grantee string, owner string, object string) error {
+	for _, ptype := range policyTypes {
+		policies, err := p.enforcer.GetFilteredNamedPolicy(ptype, 0, grantee, owner)
+		if err != nil {
+			return err
+		}
+		toRemove := [][]string{}
+		for _, policy := range policies {
+			if getObjectFromCasbin(policy[2]) == object {
+				toRemove = append(toRemove, policy)
+			}
+		}
+		if len(toRemove) == 0 {
+			continue
+		}
+		_, err = p.enforcer.RemoveNamedPolicies(ptype, toRemove)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filteredPermissions returns the rules of both policy types matching the field values.
+func (p *casbinStore) filteredPermissions(fieldIndex int, fieldValues ...string) ([]Permission, error) {
+	res := []Permission{}
+	for _, ptype := range policyTypes {
+		policies, err := p.enforcer.GetFilteredNamedPolicy(ptype, fieldIndex, fieldValues...)
+		if err != nil {
+			return nil, err
+		}
+		for _, policy := range policies {
+			perm, err := getPermissionFromCasbin(policy)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, perm)
+		}
+	}
+	return res, nil
+}
+
+// rulesFor returns the owner's rules that apply to the requester, directly or through one of
+// the requester's roles.
+func (p *casbinStore) rulesFor(requester string, owner string) ([]Permission, error) {
+	subjects := []string{requester}
+	roles, err := p.enforcer.GetImplicitRolesForUser(requester)
+	if err != nil {
+		return nil, err
+	}
+	subjects = append(subjects, roles...)
+
+	rules := []Permission{}
+	for _, subject := range subjects {
+		perms, err := p.filteredPermissions(0, subject, owner)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, perms...)
+	}
+	return rules, nil
+}
+
+// ListPermissions implements Store.
+func (p *casbinStore) ListPermissions(owner string) ([]Permission, error) {
+	return p.filteredPermissions(1, owner)
+}
+
 func (p *casbinStore) ListReadPermissionsByLexicon(owner string) (map[string][]string, error) {
-	policies, err := p.enforcer.GetFilteredPolicy(1, owner)
+	perms, err := p.filteredPermissions(1, owner)
 	if err != nil {
 		return nil, err
 	}
 
+	now := p.now()
 	res := make(map[string][]string)
-	for _, policy := range policies {
-		lexicon := strings.TrimSuffix(policy[2], ".*")
+	for _, perm := range perms {
 		// ignore denies for now
-		if policy[3] == "allow" {
-			res[lexicon] = append(res[lexicon], policy[0])
+		if perm.Effect == EffectAllow && perm.Active(now) {
+			res[perm.Object] = append(res[perm.Object], perm.Grantee)
 		}
 	}
 
@@ -133,7 +398,83 @@ func (p *casbinStore) ListReadPermissionsByUser(
 	requester string,
 	nsid string,
 ) ([]string, []string, error) {
-	panic("unimplemented")
+	if requester == owner {
+		return []string{fmt.Sprintf("%s.*", nsid)}, []string{}, nil
+	}
+
+	rules, err := p.rulesFor(requester, owner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := p.now()
+	allows := []string{}
+	denies := []string{}
+	for _, rule := range rules {
+		// Rules on the NSID or its parents, as well as rules on records within the NSID
+		if !objectCovers(rule.Object, nsid) && !objectCovers(nsid, rule.Object) {
+			continue
+		}
+		if !rule.Active(now) {
+			continue
+		}
+		switch rule.Effect {
+		case EffectAllow:
+			allows = append(allows, rule.Object)
+		case EffectDeny:
+			denies = append(denies, rule.Object)
+		}
+	}
+	return allows, denies, nil
+}
+
+// Transaction implements Store. The policies are snapshotted before fn runs and restored if it
+// fails.
+func (p *casbinStore) Transaction(fn func(tx Store) error) error {
+	snapshot := map[string][][]string{}
+	for _, ptype := range policyTypes {
+		policies, err := p.enforcer.GetNamedPolicy(ptype)
+		if err != nil {
+			return err
+		}
+		// The enforcer returns its own slice, which is modified as policies are removed.
+		snapshot[ptype] = make([][]string, len(policies))
+		for i, policy := range policies {
+			snapshot[ptype][i] = slices.Clone(policy)
+		}
+	}
+	err := fn(p)
+	if err == nil {
+		return nil
+	}
+
+	restoreErr := p.restorePolicies(snapshot)
+	if restoreErr != nil {
+		return errors.Join(err, fmt.Errorf("restoring policies: %w", restoreErr))
+	}
+	return err
+}
+
+func (p *casbinStore) restorePolicies(snapshot map[string][][]string) error {
+	for _, ptype := range policyTypes {
+		current, err := p.enforcer.GetNamedPolicy(ptype)
+		if err != nil {
+			return err
+		}
+		if len(current) > 0 {
+			_, err = p.enforcer.RemoveNamedPolicies(ptype, slices.Clone(current))
+			if err != nil {
+				return err
+			}
+		}
+		if len(snapshot[ptype]) > 0 {
+			_, err = p.enforcer.AddNamedPolicies(ptype, snapshot[ptype])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return p.adapter.SavePolicy(p.enforcer.GetModel())
 }
 
 // Helpers to translate lexicon + record references into object type required by casbin
@@ -148,6 +489,58 @@ func getCasbinObjectFromLexicon(lex string) string {
 	return fmt.Sprintf("%s.*", lex)
 }
 
-// List all permissions (lexicon -> [](users | groups))
-// Add a permission on a lexicon for a user or group
-// Remove a permission on a lexicon for a user or group
+func getCasbinObject(lex string, rkey string) string {
+	if rkey == "" {
+		return getCasbinObjectFromLexicon(lex)
+	}
+	return getCasbinObjectFromRecord(lex, rkey)
+}
+
+// getObjectFromCasbin translates a casbin object into the object format used by Permission, where
+// a rule on an object also covers everything under it.
+func getObjectFromCasbin(obj string) string {
+	return strings.TrimSuffix(obj, ".*")
+}
+
+// getPermissionFromCasbin translates a policy of either type into a Permission, including the
+// time bounds of a bounded policy.
+func getPermissionFromCasbin(policy []string) (Permission, error) {
+	perm := Permission{
+		Grantee: policy[0],
+		Owner:   policy[1],
+		Object:  getObjectFromCasbin(policy[2]),
+		Effect:  Effect(policy[3]),
+	}
+	if len(policy) < 6 {
+		return perm, nil
+	}
+	var err error
+	perm.NotBefore, err = parseCasbinTime(policy[4])
+	if err != nil {
+		return perm, fmt.Errorf("invalid not before in policy %v: %w", policy, err)
+	}
+	perm.ExpiresAt, err = parseCasbinTime(policy[5])
+	if err != nil {
+		return perm, fmt.Errorf("invalid expiry in policy %v: %w", policy, err)
+	}
+	return perm, nil
+}
+
+// formatCasbinTime formats an optional time bound, with an empty string for an open bound.
+func formatCasbinTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseCasbinTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
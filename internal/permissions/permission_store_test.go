@@ -2,7 +2,9 @@ package permissions
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	"github.com/stretchr/testify/require"
@@ -120,3 +122,51 @@ func TestList(t *testing.T) {
 		require.ElementsMatch(t, exp[lex], perm)
 	}
 }
+
+func TestAddPermissionWithDeny(t *testing.T) {
+	ps, err := NewStore(fileadapter.NewAdapter("test_policies/test_policy_1.csv"), false)
+	require.NoError(t, err)
+	// Use an in-memory copy of the policies so the fixture isn't rewritten
+	ps.(*casbinStore).adapter = fileadapter.NewAdapter(filepath.Join(t.TempDir(), "policies.csv"))
+
+	require.NoError(t, ps.AddPermission("did:requester1", "did:owner", "app.bsky.likes", "like1", EffectDeny))
+	ok, err := ps.HasPermission("did:requester1", "did:owner", "app.bsky.likes", "like1")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	perms, err := ps.ListPermissions("did:owner")
+	require.NoError(t, err)
+	require.Contains(t, perms, Permission{
+		Grantee: "did:requester1",
+		Owner:   "did:owner",
+		Object:  "app.bsky.likes.like1",
+		Effect:  EffectDeny,
+	})
+
+	require.NoError(t, ps.RemovePermission("did:requester1", "did:owner", "app.bsky.likes", "like1"))
+	ok, err = ps.HasPermission("did:requester1", "did:owner", "app.bsky.likes", "like1")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestTimeBoundedPoliciesArePersisted(t *testing.T) {
+	policies := filepath.Join(t.TempDir(), "policies.csv")
+	require.NoError(t, os.WriteFile(policies, []byte("p, did:bob, did:owner, app.bsky.likes.*, allow\n"), 0600))
+	ps, err := NewStore(fileadapter.NewAdapter(policies), true)
+	require.NoError(t, err)
+
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = ps.AddPermission("did:bob", "did:owner", "app.bsky.posts", "", EffectDeny, WithExpiresAt(expiresAt))
+	require.NoError(t, err)
+
+	// Both kinds of policy are read back from the file
+	reloaded, err := NewStore(fileadapter.NewAdapter(policies), false)
+	require.NoError(t, err)
+	perms, err := reloaded.ListPermissions("did:owner")
+	require.NoError(t, err)
+	require.Len(t, perms, 2)
+	require.Nil(t, perms[0].ExpiresAt)
+	require.Equal(t, "app.bsky.posts", perms[1].Object)
+	require.Nil(t, perms[1].NotBefore)
+	require.Equal(t, expiresAt, *perms[1].ExpiresAt)
+}
@@ -0,0 +1,253 @@
+package permissions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// PolicyDocumentVersion is the version of the policy document format written by ExportPolicies.
+const PolicyDocumentVersion = 1
+
+// PolicyDocument is a snapshot of every permission rule an owner has defined, used to back up and
+// restore their sharing configuration.
+type PolicyDocument struct {
+	Version     int           `json:"version"`
+	Owner       string        `json:"owner"`
+	Permissions []PolicyEntry `json:"permissions"`
+}
+
+// PolicyEntry is a single rule in a PolicyDocument.
+type PolicyEntry struct {
+	Grantee   string     `json:"grantee"`
+	Object    string     `json:"object"`
+	Effect    Effect     `json:"effect"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ImportMode controls what happens to an owner's existing rules when importing a document.
+type ImportMode string
+
+const (
+	// ImportMerge keeps existing rules, overwriting those on the same grantee and object.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace removes every existing rule before importing.
+	ImportReplace ImportMode = "replace"
+)
+
+// ErrConflictingPolicies is returned when a document both allows and denies the same object to
+// the same grantee.
+var ErrConflictingPolicies = errors.New("policy document contains conflicting allow and deny entries")
+
+// PolicyConflict describes two entries with different effects on the same grantee and object.
+type PolicyConflict struct {
+	Grantee string `json:"grantee"`
+	Object  string `json:"object"`
+	// Existing is the effect already in the store, or the first conflicting entry in the document.
+	Existing Effect `json:"existing"`
+	Imported Effect `json:"imported"`
+}
+
+// ImportResult summarizes the changes an import made.
+type ImportResult struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	// Conflicts lists the entries whose effect differs from the rule they conflict with. When the
+	// import fails with ErrConflictingPolicies these are the conflicts within the document;
+	// otherwise they are existing rules that were overwritten in merge mode.
+	Conflicts []PolicyConflict `json:"conflicts"`
+}
+
+// ParseImportMode validates the given string as an import mode. An empty string defaults to merge.
+func ParseImportMode(s string) (ImportMode, error) {
+	switch ImportMode(s) {
+	case "", ImportMerge:
+		return ImportMerge, nil
+	case ImportReplace:
+		return ImportReplace, nil
+	}
+	return "", fmt.Errorf("invalid import mode %q: must be %q or %q", s, ImportMerge, ImportReplace)
+}
+
+// ExportPolicies returns a document containing every rule the owner has defined.
+func ExportPolicies(store Store, owner string) (*PolicyDocument, error) {
+	perms, err := store.ListPermissions(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &PolicyDocument{
+		Version:     PolicyDocumentVersion,
+		Owner:       owner,
+		Permissions: make([]PolicyEntry, 0, len(perms)),
+	}
+	for _, perm := range perms {
+		doc.Permissions = append(doc.Permissions, PolicyEntry{
+			Grantee:   perm.Grantee,
+			Object:    perm.Object,
+			Effect:    perm.Effect,
+			NotBefore: perm.NotBefore,
+			ExpiresAt: perm.ExpiresAt,
+		})
+	}
+	return doc, nil
+}
+
+// ImportPolicies applies the document's rules to the owner's permissions. The whole document is
+// validated before anything is written, and the rules are written in a single transaction, so a
+// failed import leaves the store untouched.
+func ImportPolicies(
+	store Store,
+	owner string,
+	doc *PolicyDocument,
+	mode ImportMode,
+) (*ImportResult, error) {
+	result := &ImportResult{Conflicts: []PolicyConflict{}}
+	err := validatePolicyDocument(doc, owner)
+	if err != nil {
+		return result, err
+	}
+
+	// Check for entries that disagree with each other
+	seen := make(map[[2]string]Effect, len(doc.Permissions))
+	for _, entry := range doc.Permissions {
+		key := [2]string{entry.Grantee, entry.Object}
+		prev, ok := seen[key]
+		if ok && prev != entry.Effect {
+			result.Conflicts = append(result.Conflicts, PolicyConflict{
+				Grantee:  entry.Grantee,
+				Object:   entry.Object,
+				Existing: prev,
+				Imported: entry.Effect,
+			})
+		}
+		seen[key] = entry.Effect
+	}
+	if len(result.Conflicts) > 0 {
+		return result, ErrConflictingPolicies
+	}
+
+	// Make sure the store accepts every rule, e.g. time bounds, before removing anything.
+	errs := []error{}
+	for i, entry := range doc.Permissions {
+		err = store.ValidatePermission(entry.Grantee, owner, entry.Object, "", entry.Effect, entry.grantOptions()...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("entry %d: %w", i, err))
+		}
+	}
+	if err = errors.Join(errs...); err != nil {
+		return result, err
+	}
+
+	existing, err := store.ListPermissions(owner)
+	if err != nil {
+		return result, err
+	}
+	switch mode {
+	case ImportReplace:
+		// The existing rules are removed along with the import below.
+	case ImportMerge:
+		for _, perm := range existing {
+			imported, ok := seen[[2]string{perm.Grantee, perm.Object}]
+			if ok && imported != perm.Effect {
+				result.Conflicts = append(result.Conflicts, PolicyConflict{
+					Grantee:  perm.Grantee,
+					Object:   perm.Object,
+					Existing: perm.Effect,
+					Imported: imported,
+				})
+			}
+		}
+	default:
+		return result, fmt.Errorf("invalid import mode %q", mode)
+	}
+
+	// Apply the whole import or none of it, so a failure can't leave the owner with a partial
+	// policy.
+	var removed, added int
+	err = store.Transaction(func(tx Store) error {
+		if mode == ImportReplace {
+			for _, perm := range existing {
+				err := tx.RemovePermission(perm.Grantee, owner, perm.Object, "")
+				if err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+		for _, entry := range doc.Permissions {
+			// The object already includes the record key, if any.
+			err := tx.AddPermission(entry.Grantee, owner, entry.Object, "", entry.Effect, entry.grantOptions()...)
+			if err != nil {
+				return fmt.Errorf("importing rule for %s on %s: %w", entry.Grantee, entry.Object, err)
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Removed = removed
+	result.Added = added
+	return result, nil
+}
+
+func (e PolicyEntry) grantOptions() []GrantOption {
+	opts := []GrantOption{}
+	if e.NotBefore != nil {
+		opts = append(opts, WithNotBefore(*e.NotBefore))
+	}
+	if e.ExpiresAt != nil {
+		opts = append(opts, WithExpiresAt(*e.ExpiresAt))
+	}
+	return opts
+}
+
+func validatePolicyDocument(doc *PolicyDocument, owner string) error {
+	if doc.Version != PolicyDocumentVersion {
+		return fmt.Errorf("unsupported policy document version %d", doc.Version)
+	}
+	if doc.Owner != "" && doc.Owner != owner {
+		return fmt.Errorf("policy document belongs to %s, not %s", doc.Owner, owner)
+	}
+
+	errs := []error{}
+	for i, entry := range doc.Permissions {
+		if _, err := syntax.ParseDID(entry.Grantee); err != nil {
+			errs = append(errs, fmt.Errorf("entry %d: invalid grantee: %w", i, err))
+		}
+		if err := ValidateObject(entry.Object); err != nil {
+			errs = append(errs, fmt.Errorf("entry %d: %w", i, err))
+		}
+		if entry.Effect != EffectAllow && entry.Effect != EffectDeny {
+			errs = append(errs, fmt.Errorf("entry %d: invalid effect %q", i, entry.Effect))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateObject checks that the object is an NSID, a prefix of one, or an NSID followed by a
+// record key.
+func ValidateObject(object string) error {
+	if _, err := syntax.ParseNSID(object); err == nil {
+		return nil
+	}
+	// NSID prefixes, e.g. "com.habitat"
+	if _, err := syntax.ParseNSID(object + ".any"); err == nil {
+		return nil
+	}
+	i := strings.LastIndex(object, ".")
+	if i > 0 {
+		_, nsidErr := syntax.ParseNSID(object[:i])
+		_, rkeyErr := syntax.ParseRecordKey(object[i+1:])
+		if nsidErr == nil && rkeyErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid object %q: must be an NSID, NSID prefix, or NSID and record key", object)
+}
@@ -0,0 +1,184 @@
+package permissions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestExportImportPolicies(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db)
+	require.NoError(t, err)
+
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, store.AddPermission("did:plc:bob", "did:plc:alice", "com.habitat.posts", "", EffectAllow))
+	require.NoError(t, store.AddPermission(
+		"did:plc:bob", "did:plc:alice", "com.habitat.posts", "secret", EffectDeny, WithExpiresAt(expiresAt),
+	))
+
+	doc, err := ExportPolicies(store, "did:plc:alice")
+	require.NoError(t, err)
+	require.Equal(t, PolicyDocumentVersion, doc.Version)
+	require.Len(t, doc.Permissions, 2)
+
+	// Replace restores exactly the exported rules
+	require.NoError(t, store.AddPermission("did:plc:carol", "did:plc:alice", "com.habitat.likes", "", EffectAllow))
+	result, err := ImportPolicies(store, "did:plc:alice", doc, ImportReplace)
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Removed)
+	require.Equal(t, 2, result.Added)
+	restored, err := ExportPolicies(store, "did:plc:alice")
+	require.NoError(t, err)
+	require.Equal(t, doc, restored)
+
+	// Merge keeps existing rules and reports the ones it overwrites
+	require.NoError(t, store.AddPermission("did:plc:carol", "did:plc:alice", "com.habitat.likes", "", EffectAllow))
+	result, err = ImportPolicies(store, "did:plc:alice", &PolicyDocument{
+		Version: PolicyDocumentVersion,
+		Permissions: []PolicyEntry{
+			{Grantee: "did:plc:bob", Object: "com.habitat.posts", Effect: EffectDeny},
+		},
+	}, ImportMerge)
+	require.NoError(t, err)
+	require.Equal(t, 0, result.Removed)
+	require.Equal(t, []PolicyConflict{{
+		Grantee:  "did:plc:bob",
+		Object:   "com.habitat.posts",
+		Existing: EffectAllow,
+		Imported: EffectDeny,
+	}}, result.Conflicts)
+	perms, err := store.ListPermissions("did:plc:alice")
+	require.NoError(t, err)
+	require.Len(t, perms, 3)
+}
+
+func TestImportPoliciesValidation(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db)
+	require.NoError(t, err)
+
+	importEntries := func(entries ...PolicyEntry) (*ImportResult, error) {
+		doc := &PolicyDocument{Version: PolicyDocumentVersion, Permissions: entries}
+		return ImportPolicies(store, "did:plc:alice", doc, ImportMerge)
+	}
+
+	_, err = importEntries(PolicyEntry{Grantee: "bob", Object: "com.habitat.posts", Effect: EffectAllow})
+	require.ErrorContains(t, err, "invalid grantee")
+	_, err = importEntries(PolicyEntry{Grantee: "did:plc:bob", Object: "not an nsid", Effect: EffectAllow})
+	require.ErrorContains(t, err, "invalid object")
+	_, err = importEntries(PolicyEntry{Grantee: "did:plc:bob", Object: "com.habitat", Effect: "maybe"})
+	require.ErrorContains(t, err, "invalid effect")
+	notBefore := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := notBefore.Add(-time.Hour)
+	_, err = importEntries(PolicyEntry{
+		Grantee:   "did:plc:bob",
+		Object:    "com.habitat",
+		Effect:    EffectAllow,
+		NotBefore: &notBefore,
+		ExpiresAt: &expiresAt,
+	})
+	require.ErrorContains(t, err, "must expire after it takes effect")
+
+	result, err := importEntries(
+		PolicyEntry{Grantee: "did:plc:bob", Object: "com.habitat.posts.rkey", Effect: EffectAllow},
+		PolicyEntry{Grantee: "did:plc:bob", Object: "com.habitat.posts.rkey", Effect: EffectDeny},
+	)
+	require.ErrorIs(t, err, ErrConflictingPolicies)
+	require.Len(t, result.Conflicts, 1)
+
+	_, err = ImportPolicies(store, "did:plc:alice", &PolicyDocument{Version: 2}, ImportMerge)
+	require.Error(t, err)
+	_, err = ImportPolicies(store, "did:plc:alice", &PolicyDocument{Version: 1, Owner: "did:plc:bob"}, ImportMerge)
+	require.Error(t, err)
+
+	// Nothing was written by the failed imports
+	perms, err := store.ListPermissions("did:plc:alice")
+	require.NoError(t, err)
+	require.Empty(t, perms)
+}
+
+// failingStore fails to add rules on one object, after validation has passed.
+type failingStore struct {
+	Store
+	object string
+}
+
+func (s *failingStore) AddPermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
+) error {
+	if getObject(nsid, rkey) == s.object {
+		return errors.New("disk full")
+	}
+	return s.Store.AddPermission(grantee, owner, nsid, rkey, effect, opts...)
+}
+
+func (s *failingStore) Transaction(fn func(tx Store) error) error {
+	return s.Store.Transaction(func(tx Store) error {
+		return fn(&failingStore{Store: tx, object: s.object})
+	})
+}
+
+func TestImportReplaceIsAtomic(t *testing.T) {
+	doc := &PolicyDocument{
+		Version: PolicyDocumentVersion,
+		Permissions: []PolicyEntry{
+			{Grantee: "did:plc:carol", Object: "com.habitat.likes", Effect: EffectAllow},
+			{Grantee: "did:plc:carol", Object: "com.habitat.posts", Effect: EffectAllow},
+		},
+	}
+	requireOriginalRules := func(t *testing.T, store Store) {
+		perms, err := store.ListPermissions("did:plc:alice")
+		require.NoError(t, err)
+		require.Len(t, perms, 2)
+		ok, err := store.HasPermission("did:plc:bob", "did:plc:alice", "com.habitat.posts", "record1")
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = store.HasPermission("did:plc:carol", "did:plc:alice", "com.habitat.likes", "record1")
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+
+	for name, newStore := range map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+			require.NoError(t, err)
+			store, err := NewSQLiteStore(db)
+			require.NoError(t, err)
+			return store
+		},
+		"casbin": func(t *testing.T) Store {
+			policies := filepath.Join(t.TempDir(), "policies.csv")
+			require.NoError(t, os.WriteFile(policies, []byte{}, 0600))
+			store, err := NewStore(fileadapter.NewAdapter(policies), true)
+			require.NoError(t, err)
+			return store
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inner := newStore(t)
+			require.NoError(t, inner.AddPermission("did:plc:bob", "did:plc:alice", "com.habitat.posts", "", EffectAllow))
+			require.NoError(t, inner.AddPermission("did:plc:bob", "did:plc:alice", "com.habitat.likes", "", EffectDeny))
+
+			// The second rule fails to be added after the existing rules were removed
+			store := &failingStore{Store: inner, object: "com.habitat.posts"}
+			_, err := ImportPolicies(store, "did:plc:alice", doc, ImportReplace)
+			require.ErrorContains(t, err, "disk full")
+			requireOriginalRules(t, inner)
+		})
+	}
+}
@@ -1,13 +1,18 @@
 package permissions
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
 type sqliteStore struct {
 	db *gorm.DB
+	// now returns the current time; overridden in tests.
+	now func() time.Time
 }
 
 var _ Store = (*sqliteStore)(nil)
@@ -18,7 +23,27 @@ type Permission struct {
 	Grantee string `gorm:"not null;index:idx_permissions_grantee_owner,priority:1;uniqueIndex:idx_grantee_owner_object"`
 	Owner   string `gorm:"not null;index:idx_permissions_owner;index:idx_permissions_grantee_owner,priority:2;uniqueIndex:idx_grantee_owner_object"`
 	Object  string `gorm:"not null;uniqueIndex:idx_grantee_owner_object"`
-	Effect  string `gorm:"not null;check:effect IN ('allow', 'deny')"`
+	Effect  Effect `gorm:"not null;check:effect IN ('allow', 'deny')"`
+	// Optional bounds on when the rule takes effect. A nil bound is open-ended.
+	NotBefore *time.Time
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+// Active reports whether the rule is within its time bounds as of now.
+func (p Permission) Active(now time.Time) bool {
+	return (p.NotBefore == nil || !p.NotBefore.After(now)) && !p.Expired(now)
+}
+
+// Expired reports whether the rule has stopped taking effect as of now.
+func (p Permission) Expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !p.ExpiresAt.After(now)
+}
+
+// activeAt restricts a query to rules that are in effect at the given time.
+// Bounds are stored in UTC so that they compare correctly in sqlite.
+func activeAt(db *gorm.DB, now time.Time) *gorm.DB {
+	now = now.UTC()
+	return db.Where("(not_before IS NULL OR not_before <= ?) AND (expires_at IS NULL OR expires_at > ?)", now, now)
 }
 
 // NewSQLiteStore creates a new SQLite-backed permission store.
@@ -33,7 +58,7 @@ func NewSQLiteStore(db *gorm.DB) (*sqliteStore, error) {
 		return nil, fmt.Errorf("failed to migrate permissions table: %w", err)
 	}
 
-	return &sqliteStore{db: db}, nil
+	return &sqliteStore{db: db, now: time.Now}, nil
 }
 
 // HasPermission checks if a requester has permission to access a specific record.
@@ -48,16 +73,29 @@ func (s *sqliteStore) HasPermission(
 	nsid string,
 	rkey string,
 ) (bool, error) {
+	explanation, err := s.Explain(requester, owner, nsid, rkey)
+	if err != nil {
+		return false, err
+	}
+	return explanation.Allowed, nil
+}
+
+// Explain returns every rule matching the record along with the decision HasPermission makes.
+// Rules are ordered by precedence: the longest (most specific) object first, with deny ahead
+// of allow on the same object. The first rule that is within its time bounds wins.
+func (s *sqliteStore) Explain(
+	requester string,
+	owner string,
+	nsid string,
+	rkey string,
+) (*Explanation, error) {
 	// Owner always has permission
 	if requester == owner {
-		return true, nil
+		return ownerExplanation(), nil
 	}
 
 	// Build the full object path
-	object := nsid
-	if rkey != "" {
-		object = fmt.Sprintf("%s.%s", nsid, rkey)
-	}
+	object := getObject(nsid, rkey)
 
 	// Check for permissions using a single query that matches:
 	// 1. Exact object match: object = "com.habitat.posts.record1"
@@ -67,21 +105,16 @@ func (s *sqliteStore) HasPermission(
 	//    - "com.habitat"
 	//    - "com"
 	//    This works by checking if the object LIKE the stored permission + ".%"
-	var permission Permission
+	var permissions []Permission
 	err := s.db.Where("grantee = ? AND owner = ? AND (object = ? OR ? LIKE object || '.%')",
 		requester, owner, object, object).
 		Order("LENGTH(object) DESC, effect DESC").
-		Limit(1).
-		First(&permission).Error
-
-	if err == gorm.ErrRecordNotFound {
-		// No permission found, deny by default
-		return false, nil
-	} else if err != nil {
-		return false, fmt.Errorf("failed to query permission: %w", err)
+		Find(&permissions).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permission: %w", err)
 	}
 
-	return permission.Effect == "allow", nil
+	return decide(permissions, s.now()), nil
 }
 
 // AddLexiconReadPermission grants read permission for an entire lexicon (NSID).
@@ -92,44 +125,106 @@ func (s *sqliteStore) AddLexiconReadPermission(
 	owner string,
 	nsid string,
 ) error {
+	return s.AddPermission(grantee, owner, nsid, "", EffectAllow)
+}
+
+// RemoveLexiconReadPermission removes read permission for an entire lexicon.
+func (s *sqliteStore) RemoveLexiconReadPermission(
+	grantee string,
+	owner string,
+	nsid string,
+) error {
+	return s.RemovePermission(grantee, owner, nsid, "")
+}
+
+// AddPermission stores a rule for the lexicon, or for a single record when rkey is set.
+// An existing rule on the same object is overwritten with the new effect.
+func (s *sqliteStore) AddPermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
+) error {
+	err := s.ValidatePermission(grantee, owner, nsid, rkey, effect, opts...)
+	if err != nil {
+		return err
+	}
+
+	o := getGrantOptions(opts)
+	object := getObject(nsid, rkey)
 	permission := Permission{
 		Grantee: grantee,
 		Owner:   owner,
-		Object:  nsid,
-		Effect:  "allow",
+		Object:  object,
 	}
 
-	// Use gorm.G for the generic GORM wrapper if available, or direct DB methods
-	result := s.db.Where("grantee = ? AND owner = ? AND object = ?", grantee, owner, nsid).
-		Assign(Permission{Effect: "allow"}).
+	// Assign with a map so that nil bounds clear any bounds set on an existing rule.
+	result := s.db.Where("grantee = ? AND owner = ? AND object = ?", grantee, owner, object).
+		Assign(map[string]any{
+			"effect":     effect,
+			"not_before": o.notBefore,
+			"expires_at": o.expiresAt,
+		}).
 		FirstOrCreate(&permission)
 
 	if result.Error != nil {
-		return fmt.Errorf("failed to add lexicon permission: %w", result.Error)
+		return fmt.Errorf("failed to add permission: %w", result.Error)
 	}
 	return nil
 }
 
-// RemoveLexiconReadPermission removes read permission for an entire lexicon.
-func (s *sqliteStore) RemoveLexiconReadPermission(
+// ValidatePermission reports whether AddPermission would accept the rule, without writing it.
+func (s *sqliteStore) ValidatePermission(
 	grantee string,
 	owner string,
 	nsid string,
+	rkey string,
+	effect Effect,
+	opts ...GrantOption,
 ) error {
-	result := s.db.Where("grantee = ? AND owner = ? AND object = ?", grantee, owner, nsid).
+	return validatePermission(opts)
+}
+
+// RemovePermission removes the rule for the lexicon or record, regardless of its effect.
+func (s *sqliteStore) RemovePermission(
+	grantee string,
+	owner string,
+	nsid string,
+	rkey string,
+) error {
+	// Permanently delete the row: a soft-deleted row would still hold the unique index and
+	// prevent the same rule from being added again.
+	result := s.db.Unscoped().
+		Where("grantee = ? AND owner = ? AND object = ?", grantee, owner, getObject(nsid, rkey)).
 		Delete(&Permission{})
 
 	if result.Error != nil {
-		return fmt.Errorf("failed to remove lexicon permission: %w", result.Error)
+		return fmt.Errorf("failed to remove permission: %w", result.Error)
 	}
 	return nil
 }
 
+// ListPermissions returns all allow and deny rules defined by the owner, including expired
+// rules that have not been purged yet so the owner can see what lapsed.
+func (s *sqliteStore) ListPermissions(owner string) ([]Permission, error) {
+	var permissions []Permission
+	err := s.db.Where("owner = ?", owner).
+		Order("object ASC, grantee ASC").
+		Find(&permissions).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permissions: %w", err)
+	}
+	return permissions, nil
+}
+
 // ListReadPermissionsByLexicon returns a map of lexicon NSIDs to lists of grantees
 // who have permission to read that lexicon.
 func (s *sqliteStore) ListReadPermissionsByLexicon(owner string) (map[string][]string, error) {
 	var permissions []Permission
-	err := s.db.Where("owner = ? AND effect = ?", owner, "allow").
+	err := activeAt(s.db, s.now()).
+		Where("owner = ? AND effect = ?", owner, EffectAllow).
 		Find(&permissions).Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to query permissions: %w", err)
@@ -160,9 +255,11 @@ func (s *sqliteStore) ListReadPermissionsByUser(
 	// We need to check:
 	// 1. Exact match: object = "nsid"
 	// 2. Parent prefix that matches: nsid LIKE object || ".%"
+	// 3. Record-level rules within the NSID: object LIKE "nsid.%"
 	var permissions []Permission
-	err := s.db.Where("grantee = ? AND owner = ? AND (object = ? OR ? LIKE object || '.%')",
-		requester, owner, nsid, nsid).
+	err := activeAt(s.db, s.now()).
+		Where("grantee = ? AND owner = ? AND (object = ? OR ? LIKE object || '.%' OR object LIKE ?)",
+			requester, owner, nsid, nsid, nsid+".%").
 		Find(&permissions).Error
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to query permissions: %w", err)
@@ -173,12 +270,54 @@ func (s *sqliteStore) ListReadPermissionsByUser(
 
 	for _, perm := range permissions {
 		switch perm.Effect {
-		case "allow":
+		case EffectAllow:
 			allows = append(allows, perm.Object)
-		case "deny":
+		case EffectDeny:
 			denies = append(denies, perm.Object)
 		}
 	}
 
 	return allows, denies, nil
 }
+
+// Transaction runs fn inside a database transaction, rolling it back if fn returns an error.
+func (s *sqliteStore) Transaction(fn func(tx Store) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&sqliteStore{db: tx, now: s.now})
+	})
+}
+
+// PurgeExpiredPermissions permanently deletes rules that expired more than retention ago.
+// Keeping expired rules around for a while lets owners see which grants have lapsed.
+func (s *sqliteStore) PurgeExpiredPermissions(retention time.Duration) (int64, error) {
+	result := s.db.Unscoped().
+		Where("expires_at IS NOT NULL AND expires_at <= ?", s.now().UTC().Add(-retention)).
+		Delete(&Permission{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to purge expired permissions: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// PurgeExpiredPermissionsEvery runs PurgeExpiredPermissions on the given interval until ctx is done.
+func (s *sqliteStore) PurgeExpiredPermissionsEvery(
+	ctx context.Context,
+	interval time.Duration,
+	retention time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.PurgeExpiredPermissions(retention)
+			if err != nil {
+				log.Err(err).Msg("error purging expired permissions")
+			} else if n > 0 {
+				log.Info().Msgf("purged %d expired permissions", n)
+			}
+		}
+	}
+}
@@ -2,7 +2,9 @@ package permissions
 
 import (
 	"testing"
+	"time"
 
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -274,3 +276,173 @@ func TestSQLiteStoreDenyOverridesAllow(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, hasPermission, "deny should apply to all records under likes")
 }
+
+func TestSQLiteStoreRecordLevelRules(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	store, err := NewSQLiteStore(db)
+	require.NoError(t, err)
+
+	// Allow a single record, and deny a single record under a lexicon-wide allow
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "record1", EffectAllow))
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.likes", "", EffectAllow))
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.likes", "secret", EffectDeny))
+
+	hasPermission, err := store.HasPermission("bob", "alice", "com.habitat.posts", "record1")
+	require.NoError(t, err)
+	require.True(t, hasPermission)
+
+	hasPermission, err = store.HasPermission("bob", "alice", "com.habitat.posts", "record2")
+	require.NoError(t, err)
+	require.False(t, hasPermission)
+
+	hasPermission, err = store.HasPermission("bob", "alice", "com.habitat.likes", "secret")
+	require.NoError(t, err)
+	require.False(t, hasPermission)
+
+	allows, denies, err := store.ListReadPermissionsByUser("alice", "bob", "com.habitat.likes")
+	require.NoError(t, err)
+	require.Equal(t, []string{"com.habitat.likes"}, allows)
+	require.Equal(t, []string{"com.habitat.likes.secret"}, denies)
+
+	perms, err := store.ListPermissions("alice")
+	require.NoError(t, err)
+	require.Len(t, perms, 3)
+	require.Equal(t, "com.habitat.likes.secret", perms[1].Object)
+	require.Equal(t, EffectDeny, perms[1].Effect)
+
+	// Flipping the effect on an existing object replaces the rule
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.likes", "secret", EffectAllow))
+	hasPermission, err = store.HasPermission("bob", "alice", "com.habitat.likes", "secret")
+	require.NoError(t, err)
+	require.True(t, hasPermission)
+
+	// Removed rules can be added again
+	require.NoError(t, store.RemovePermission("bob", "alice", "com.habitat.posts", "record1"))
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "record1", EffectDeny))
+	perms, err = store.ListPermissions("alice")
+	require.NoError(t, err)
+	require.Len(t, perms, 3)
+}
+
+func TestSQLiteStoreTimeBoundedGrants(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	store, err := NewSQLiteStore(db)
+	require.NoError(t, err)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.FixedZone("PST", -8*60*60))
+	store.now = func() time.Time { return now }
+
+	// Share posts for the next day, and likes starting tomorrow
+	tomorrow := now.Add(24 * time.Hour)
+	err = store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectAllow, WithExpiresAt(tomorrow))
+	require.NoError(t, err)
+	err = store.AddPermission("bob", "alice", "com.habitat.likes", "", EffectAllow, WithNotBefore(tomorrow))
+	require.NoError(t, err)
+
+	hasPermission, err := store.HasPermission("bob", "alice", "com.habitat.posts", "record1")
+	require.NoError(t, err)
+	require.True(t, hasPermission)
+	hasPermission, err = store.HasPermission("bob", "alice", "com.habitat.likes", "record1")
+	require.NoError(t, err)
+	require.False(t, hasPermission, "grant should not be active before its start")
+
+	now = now.Add(25 * time.Hour)
+	hasPermission, err = store.HasPermission("bob", "alice", "com.habitat.posts", "record1")
+	require.NoError(t, err)
+	require.False(t, hasPermission, "grant should not be active after it expires")
+	allows, _, err := store.ListReadPermissionsByUser("alice", "bob", "com.habitat.posts")
+	require.NoError(t, err)
+	require.Empty(t, allows)
+	hasPermission, err = store.HasPermission("bob", "alice", "com.habitat.likes", "record1")
+	require.NoError(t, err)
+	require.True(t, hasPermission)
+
+	// Expired grants are still listed for the owner until they are purged
+	perms, err := store.ListPermissions("alice")
+	require.NoError(t, err)
+	require.Len(t, perms, 2)
+	require.True(t, perms[1].Expired(now))
+	require.False(t, perms[0].Expired(now))
+
+	n, err := store.PurgeExpiredPermissions(2 * time.Hour)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	n, err = store.PurgeExpiredPermissions(time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	// Re-adding a grant without bounds makes it permanent again
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.likes", "", EffectAllow))
+	perms, err = store.ListPermissions("alice")
+	require.NoError(t, err)
+	require.Len(t, perms, 1)
+	require.Nil(t, perms[0].NotBefore)
+
+	// Grants must expire after they take effect
+	opts := []GrantOption{WithNotBefore(now), WithExpiresAt(now)}
+	require.Error(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectAllow, opts...))
+}
+
+func TestSQLiteStoreExplain(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	store, err := NewSQLiteStore(db)
+	require.NoError(t, err)
+
+	explanation, err := store.Explain("bob", "alice", "com.habitat.posts", "record1")
+	require.NoError(t, err)
+	require.False(t, explanation.Allowed)
+	require.Nil(t, explanation.DecidingRule)
+	require.Empty(t, explanation.Rules)
+
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat", "", EffectAllow))
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectDeny))
+	expired := WithExpiresAt(time.Now().Add(-time.Hour))
+	require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "record1", EffectAllow, expired))
+
+	// The expired record-level allow is skipped, so the collection-level deny wins
+	explanation, err = store.Explain("bob", "alice", "com.habitat.posts", "record1")
+	require.NoError(t, err)
+	require.False(t, explanation.Allowed)
+	require.Equal(t, "com.habitat.posts", explanation.DecidingRule.Object)
+	require.Equal(t, EffectDeny, explanation.DecidingRule.Effect)
+	objects := []string{}
+	for _, rule := range explanation.Rules {
+		objects = append(objects, rule.Object)
+	}
+	require.Equal(t, []string{"com.habitat.posts.record1", "com.habitat.posts", "com.habitat"}, objects)
+
+	explanation, err = store.Explain("bob", "alice", "com.habitat.likes", "record1")
+	require.NoError(t, err)
+	require.True(t, explanation.Allowed)
+	require.Equal(t, "com.habitat", explanation.DecidingRule.Object)
+}
+
+func TestMigrateCasbinPolicies(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db)
+	require.NoError(t, err)
+
+	n, err := MigrateCasbinPolicies(fileadapter.NewAdapter("test_policies/test_policy_1.csv"), store)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	perms, err := store.ListPermissions("did:owner")
+	require.NoError(t, err)
+	require.Len(t, perms, 3)
+
+	hasPermission, err := store.HasPermission("did:requester1", "did:owner", "app.bsky.likes", "like1")
+	require.NoError(t, err)
+	require.True(t, hasPermission)
+	hasPermission, err = store.HasPermission("did:requester2", "did:owner", "app.bsky.posts", "post1")
+	require.NoError(t, err)
+	require.False(t, hasPermission)
+	hasPermission, err = store.HasPermission("did:requester2", "did:owner2", "app.habitat.notes", "note1")
+	require.NoError(t, err)
+	require.True(t, hasPermission)
+}
@@ -0,0 +1,182 @@
+package permissions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) Store {
+		db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+		require.NoError(t, err)
+		store, err := NewSQLiteStore(db)
+		require.NoError(t, err)
+		return store
+	})
+}
+
+func TestCasbinStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) Store {
+		policies := filepath.Join(t.TempDir(), "policies.csv")
+		require.NoError(t, os.WriteFile(policies, []byte{}, 0600))
+		store, err := NewStore(fileadapter.NewAdapter(policies), true)
+		require.NoError(t, err)
+		return store
+	})
+}
+
+// testStoreConformance checks the behaviour every Store implementation must share.
+func testStoreConformance(t *testing.T, newStore func(t *testing.T) Store) {
+	requireAccess := func(t *testing.T, store Store, requester, nsid, rkey string, exp bool) {
+		ok, err := store.HasPermission(requester, "alice", nsid, rkey)
+		require.NoError(t, err)
+		require.Equal(t, exp, ok, "%s reading %s.%s", requester, nsid, rkey)
+	}
+
+	t.Run("owner and default deny", func(t *testing.T) {
+		store := newStore(t)
+		requireAccess(t, store, "alice", "com.habitat.posts", "record1", true)
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", false)
+
+		allows, denies, err := store.ListReadPermissionsByUser("alice", "alice", "com.habitat.posts")
+		require.NoError(t, err)
+		require.Equal(t, []string{"com.habitat.posts.*"}, allows)
+		require.Empty(t, denies)
+	})
+
+	t.Run("lexicon and prefix grants", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.AddLexiconReadPermission("bob", "alice", "com.habitat.posts"))
+		require.NoError(t, store.AddLexiconReadPermission("charlie", "alice", "com.habitat"))
+
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", true)
+		requireAccess(t, store, "bob", "com.habitat.posts", "", true)
+		requireAccess(t, store, "bob", "com.habitat.likes", "record1", false)
+		requireAccess(t, store, "charlie", "com.habitat.likes", "record1", true)
+		requireAccess(t, store, "charlie", "org.example.likes", "record1", false)
+
+		byLexicon, err := store.ListReadPermissionsByLexicon("alice")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]string{
+			"com.habitat.posts": {"bob"},
+			"com.habitat":       {"charlie"},
+		}, byLexicon)
+
+		require.NoError(t, store.RemoveLexiconReadPermission("bob", "alice", "com.habitat.posts"))
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", false)
+		require.NoError(t, store.AddLexiconReadPermission("bob", "alice", "com.habitat.posts"))
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", true)
+	})
+
+	t.Run("most specific rule wins", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat", "", EffectAllow))
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectDeny))
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "public", EffectAllow))
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.likes", "secret", EffectDeny))
+
+		requireAccess(t, store, "bob", "com.habitat.likes", "record1", true)
+		requireAccess(t, store, "bob", "com.habitat.likes", "secret", false)
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", false)
+		requireAccess(t, store, "bob", "com.habitat.posts", "public", true)
+
+		explanation, err := store.Explain("bob", "alice", "com.habitat.posts", "record1")
+		require.NoError(t, err)
+		require.False(t, explanation.Allowed)
+		require.Equal(t, "com.habitat.posts", explanation.DecidingRule.Object)
+		require.Len(t, explanation.Rules, 2)
+
+		allows, denies, err := store.ListReadPermissionsByUser("alice", "bob", "com.habitat.posts")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"com.habitat", "com.habitat.posts.public"}, allows)
+		require.ElementsMatch(t, []string{"com.habitat.posts"}, denies)
+	})
+
+	t.Run("adding a rule replaces its effect", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectDeny))
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectAllow))
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", true)
+
+		perms, err := store.ListPermissions("alice")
+		require.NoError(t, err)
+		require.Len(t, perms, 1)
+		require.Equal(t, EffectAllow, perms[0].Effect)
+
+		require.NoError(t, store.RemovePermission("bob", "alice", "com.habitat.posts", ""))
+		perms, err = store.ListPermissions("alice")
+		require.NoError(t, err)
+		require.Empty(t, perms)
+	})
+
+	t.Run("time-bounded rules", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now()
+		// Bob's window has not opened yet, Carol's is open and Dave's has closed
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectAllow,
+			WithNotBefore(now.Add(time.Hour)), WithExpiresAt(now.Add(2*time.Hour))))
+		require.NoError(t, store.AddPermission("carol", "alice", "com.habitat.posts", "", EffectAllow,
+			WithNotBefore(now.Add(-time.Hour)), WithExpiresAt(now.Add(time.Hour))))
+		require.NoError(t, store.AddPermission("dave", "alice", "com.habitat.posts", "", EffectAllow,
+			WithNotBefore(now.Add(-2*time.Hour)), WithExpiresAt(now.Add(-time.Hour))))
+
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", false)
+		requireAccess(t, store, "carol", "com.habitat.posts", "record1", true)
+		requireAccess(t, store, "dave", "com.habitat.posts", "record1", false)
+
+		byLexicon, err := store.ListReadPermissionsByLexicon("alice")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]string{"com.habitat.posts": {"carol"}}, byLexicon)
+		for requester, exp := range map[string][]string{"bob": {}, "carol": {"com.habitat.posts"}, "dave": {}} {
+			allows, _, err := store.ListReadPermissionsByUser("alice", requester, "com.habitat.posts")
+			require.NoError(t, err)
+			require.Equal(t, exp, allows, requester)
+		}
+
+		// Inactive rules are still listed, with their bounds
+		perms, err := store.ListPermissions("alice")
+		require.NoError(t, err)
+		require.Len(t, perms, 3)
+		for _, perm := range perms {
+			require.NotNil(t, perm.NotBefore)
+			require.NotNil(t, perm.ExpiresAt)
+		}
+
+		// An expired deny no longer overrides a broader allow
+		require.NoError(t, store.AddPermission("carol", "alice", "com.habitat.posts", "secret", EffectDeny,
+			WithExpiresAt(now.Add(-time.Minute))))
+		requireAccess(t, store, "carol", "com.habitat.posts", "secret", true)
+
+		// Re-adding a rule without bounds clears them
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectAllow))
+		requireAccess(t, store, "bob", "com.habitat.posts", "record1", true)
+
+		err = store.AddPermission("bob", "alice", "com.habitat.likes", "", EffectAllow,
+			WithNotBefore(now), WithExpiresAt(now.Add(-time.Hour)))
+		require.Error(t, err)
+	})
+
+	t.Run("owners are isolated", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.AddPermission("bob", "alice", "com.habitat.posts", "", EffectAllow))
+		require.NoError(t, store.AddPermission("bob", "dave", "com.habitat.likes", "", EffectDeny))
+
+		ok, err := store.HasPermission("bob", "dave", "com.habitat.posts", "record1")
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		perms, err := store.ListPermissions("dave")
+		require.NoError(t, err)
+		require.Len(t, perms, 1)
+		require.Equal(t, "bob", perms[0].Grantee)
+		require.Equal(t, "com.habitat.likes", perms[0].Object)
+		require.Equal(t, EffectDeny, perms[0].Effect)
+	})
+}
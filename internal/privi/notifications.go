@@ -0,0 +1,439 @@
+package privi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	atauth "github.com/bluesky-social/indigo/atproto/auth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eagraf/habitat-new/api/habitat"
+	"github.com/eagraf/habitat-new/internal/oauthserver"
+	"github.com/eagraf/habitat-new/internal/utils"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	notificationKindGrant  = "grant"
+	notificationKindRevoke = "revoke"
+
+	// The id of the service entry in a DID document pointing at the user's Habitat node.
+	habitatServiceID = "habitat"
+
+	// Page sizes for listNotifications, matching the bounds in its lexicon.
+	defaultNotificationsLimit = 50
+	maxNotificationsLimit     = 100
+
+	// How many notifications can wait to be delivered before new ones are dropped.
+	notificationQueueSize = 256
+)
+
+var deliverNotificationNSID = syntax.NSID("network.habitat.notifications.deliverNotification")
+
+// notificationsCollection is the collection apps need read access to in order to list the user's
+// notifications.
+const notificationsCollection = "network.habitat.notifications"
+
+// Notification is an entry in a grantee's inbox, recording that an owner gave them access to
+// some records or took it away.
+type Notification struct {
+	gorm.Model
+	Grantee   string `gorm:"not null;index"`
+	Kind      string `gorm:"not null;check:kind IN ('grant', 'revoke')"`
+	Owner     string `gorm:"not null"`
+	Object    string `gorm:"not null"`
+	Effect    string
+	NotBefore *time.Time
+	ExpiresAt *time.Time
+}
+
+func (r *sqliteRepo) addNotification(n *Notification) error {
+	return r.db.Create(n).Error
+}
+
+// listNotifications returns the grantee's notifications, newest first. The cursor is the ID of the
+// last notification on the previous page.
+func (r *sqliteRepo) listNotifications(grantee string, cursor string, limit int) ([]Notification, error) {
+	query := r.db.Where("grantee = ?", grantee)
+	if cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+		query = query.Where("id < ?", id)
+	}
+	if limit != 0 {
+		query = query.Limit(limit)
+	}
+
+	var notifications []Notification
+	err := query.Order("id DESC").Find(&notifications).Error
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// notificationSender delivers notifications to grantees whose Habitat node is elsewhere, signing
+// requests as this node.
+type notificationSender struct {
+	did      syntax.DID
+	endpoint string
+	key      atcrypto.PrivateKey
+	client   *http.Client
+}
+
+// WithNotificationSender lets the server deliver notifications to remote grantees, and accept
+// notifications delivered by other nodes. did is this node's DID, which must publish key as its
+// #atproto verification method, and endpoint is the URL other nodes reach it at.
+func WithNotificationSender(did syntax.DID, endpoint string, key atcrypto.PrivateKey) ServerOption {
+	return func(s *Server) {
+		s.sender = &notificationSender{
+			did:      did,
+			endpoint: endpoint,
+			key:      key,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+}
+
+// queueNotification hands the notification to the background worker, so that resolving and
+// contacting the grantee's node doesn't hold up the owner's request.
+func (s *Server) queueNotification(n *Notification) {
+	select {
+	case s.notifications <- n:
+	default:
+		log.Error().Msgf("notification queue is full, dropping %s notification for %s", n.Kind, n.Grantee)
+	}
+}
+
+// deliverNotifications delivers queued notifications one at a time until ctx is done.
+func (s *Server) deliverNotifications(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-s.notifications:
+			s.notifyGrantee(ctx, n)
+		}
+	}
+}
+
+// notifyGrantee records the notification in the grantee's inbox, delivering it to their own
+// Habitat node if they are hosted elsewhere. Failures are logged rather than returned, since a
+// notification that can't be delivered should not undo a permission change.
+func (s *Server) notifyGrantee(ctx context.Context, n *Notification) {
+	endpoint := s.remoteHabitatEndpoint(ctx, n.Grantee)
+	if endpoint == "" {
+		err := s.repo.addNotification(n)
+		if err != nil {
+			log.Err(err).Msgf("error adding notification for %s", n.Grantee)
+		}
+		return
+	}
+
+	err := s.sender.deliver(ctx, endpoint, n)
+	if err != nil {
+		log.Err(err).Msgf("error delivering notification to %s at %s", n.Grantee, endpoint)
+	}
+}
+
+// remoteHabitatEndpoint returns the Habitat node endpoint of the given DID, or an empty string if
+// the DID is hosted by this node (or can't be delivered to).
+func (s *Server) remoteHabitatEndpoint(ctx context.Context, did string) string {
+	if s.sender == nil {
+		return ""
+	}
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return ""
+	}
+	id, err := s.dir.LookupDID(ctx, parsed)
+	if err != nil {
+		log.Err(err).Msgf("error looking up habitat node for %s", did)
+		return ""
+	}
+	endpoint := id.GetServiceEndpoint(habitatServiceID)
+	if endpoint == "" || sameHost(endpoint, s.sender.endpoint) {
+		return ""
+	}
+	return endpoint
+}
+
+func (sender *notificationSender) deliver(ctx context.Context, endpoint string, n *Notification) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	token, err := atauth.SignServiceAuth(
+		sender.did,
+		nodeDIDForHost(u.Host),
+		time.Minute,
+		&deliverNotificationNSID,
+		sender.key,
+	)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(habitat.NetworkHabitatNotificationsDeliverNotificationInput{
+		Notification: habitat.NetworkHabitatNotificationsDeliverNotificationNotification(
+			toNotificationView(n),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		strings.TrimSuffix(endpoint, "/")+"/xrpc/"+deliverNotificationNSID.String(),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sender.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delivering notification: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// nodeDIDForHost returns the did:web a Habitat node serves at the given host.
+func nodeDIDForHost(host string) string {
+	return "did:web:" + strings.ReplaceAll(host, ":", "%3A")
+}
+
+func sameHost(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
+
+func toNotificationView(n *Notification) habitat.NetworkHabitatNotificationsListNotificationsNotification {
+	view := habitat.NetworkHabitatNotificationsListNotificationsNotification{
+		Kind:      n.Kind,
+		Owner:     n.Owner,
+		Grantee:   n.Grantee,
+		Object:    n.Object,
+		Effect:    n.Effect,
+		CreatedAt: n.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if n.NotBefore != nil {
+		view.NotBefore = n.NotBefore.Format(time.RFC3339)
+	}
+	if n.ExpiresAt != nil {
+		view.ExpiresAt = n.ExpiresAt.Format(time.RFC3339)
+	}
+	return view
+}
+
+func fromNotificationView(
+	view habitat.NetworkHabitatNotificationsDeliverNotificationNotification,
+) (*Notification, error) {
+	if view.Kind != notificationKindGrant && view.Kind != notificationKindRevoke {
+		return nil, fmt.Errorf("invalid notification kind %q", view.Kind)
+	}
+	notBefore, err := parseOptionalTime(view.NotBefore)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := parseOptionalTime(view.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &Notification{
+		Kind:      view.Kind,
+		Owner:     view.Owner,
+		Grantee:   view.Grantee,
+		Object:    view.Object,
+		Effect:    view.Effect,
+		NotBefore: notBefore,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func parseOptionalTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListNotifications lists the grant and revoke notifications sent to the caller.
+func (s *Server) ListNotifications(w http.ResponseWriter, r *http.Request) {
+	callerDID, ok := s.getAuthedUser(
+		w,
+		r,
+		oauthserver.RepoScope(notificationsCollection, oauthserver.ActionRead),
+	)
+	if !ok {
+		return
+	}
+	var params habitat.NetworkHabitatNotificationsListNotificationsParams
+	err := formDecoder.Decode(&params, r.URL.Query())
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "parsing url", http.StatusBadRequest)
+		return
+	}
+	limit, err := notificationsLimit(params.Limit)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "parsing limit", http.StatusBadRequest)
+		return
+	}
+
+	notifications, err := s.repo.listNotifications(callerDID.String(), params.Cursor, limit)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "listing notifications", http.StatusInternalServerError)
+		return
+	}
+
+	output := &habitat.NetworkHabitatNotificationsListNotificationsOutput{
+		Notifications: []habitat.NetworkHabitatNotificationsListNotificationsNotification{},
+	}
+	for i := range notifications {
+		output.Notifications = append(output.Notifications, toNotificationView(&notifications[i]))
+	}
+	if len(notifications) == limit {
+		output.Cursor = strconv.FormatUint(uint64(notifications[len(notifications)-1].ID), 10)
+	}
+
+	err = json.NewEncoder(w).Encode(output)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "json marshal response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// notificationsLimit returns the page size for a listNotifications request, using the default if
+// none was given and capping it at the maximum.
+func notificationsLimit(limit int64) (int, error) {
+	switch {
+	case limit < 0:
+		return 0, fmt.Errorf("limit must not be negative, got %d", limit)
+	case limit == 0:
+		return defaultNotificationsLimit, nil
+	case limit > maxNotificationsLimit:
+		return maxNotificationsLimit, nil
+	}
+	return int(limit), nil
+}
+
+// DeliverNotification accepts a notification from the Habitat node of the owner, for a grantee
+// hosted on this node. The request must be signed by a node that the owner's DID document
+// declares as their Habitat node.
+func (s *Server) DeliverNotification(w http.ResponseWriter, r *http.Request) {
+	if s.sender == nil {
+		utils.LogAndHTTPError(
+			w,
+			fmt.Errorf("this node does not accept notifications"),
+			"delivering notification",
+			http.StatusNotImplemented,
+		)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		utils.LogAndHTTPError(
+			w,
+			fmt.Errorf("missing bearer token"),
+			"authenticating sender",
+			http.StatusUnauthorized,
+		)
+		return
+	}
+	validator := &atauth.ServiceAuthValidator{Audience: s.sender.did.String(), Dir: s.dir}
+	senderDID, err := validator.Validate(r.Context(), token, &deliverNotificationNSID)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "authenticating sender", http.StatusUnauthorized)
+		return
+	}
+
+	var input habitat.NetworkHabitatNotificationsDeliverNotificationInput
+	err = json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "decode json request", http.StatusBadRequest)
+		return
+	}
+	n, err := fromNotificationView(input.Notification)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "parsing notification", http.StatusBadRequest)
+		return
+	}
+
+	// The sending node may only speak for owners it hosts.
+	senderEndpoint, err := s.habitatEndpoint(r.Context(), senderDID.String())
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "resolving sender", http.StatusForbidden)
+		return
+	}
+	ownerEndpoint, err := s.habitatEndpoint(r.Context(), n.Owner)
+	if err != nil || !sameHost(ownerEndpoint, senderEndpoint) {
+		utils.LogAndHTTPError(
+			w,
+			fmt.Errorf("%s is not the habitat node of %s", senderDID, n.Owner),
+			"authorizing sender",
+			http.StatusForbidden,
+		)
+		return
+	}
+	granteeEndpoint, err := s.habitatEndpoint(r.Context(), n.Grantee)
+	if err != nil || !sameHost(granteeEndpoint, s.sender.endpoint) {
+		utils.LogAndHTTPError(
+			w,
+			fmt.Errorf("%s is not hosted on this node", n.Grantee),
+			"delivering notification",
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	err = s.repo.addNotification(n)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "adding notification", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) habitatEndpoint(ctx context.Context, did string) (string, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.dir.LookupDID(ctx, parsed)
+	if err != nil {
+		return "", err
+	}
+	endpoint := id.GetServiceEndpoint(habitatServiceID)
+	if endpoint == "" {
+		return "", fmt.Errorf("%s does not declare a habitat node", did)
+	}
+	return endpoint, nil
+}
@@ -0,0 +1,181 @@
+package privi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eagraf/habitat-new/internal/permissions"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newNotificationTestServer(t *testing.T, dir identity.Directory, opts ...ServerOption) *Server {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	// Notifications are written from the delivery goroutine, which must see the same database.
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	repo, err := NewSQLiteRepo(db)
+	require.NoError(t, err)
+	s := NewServer(t.Context(), permissions.NewDummyStore(), repo, nil, opts...)
+	s.dir = dir
+	return s
+}
+
+func insertHabitatUser(dir *identity.MockDirectory, did string, endpoint string, key atcrypto.PrivateKey) {
+	id := identity.Identity{
+		DID:      syntax.DID(did),
+		Handle:   syntax.HandleInvalid,
+		Services: map[string]identity.ServiceEndpoint{habitatServiceID: {Type: "HabitatServer", URL: endpoint}},
+	}
+	if key != nil {
+		pub, _ := key.PublicKey()
+		id.Keys = map[string]identity.VerificationMethod{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		}
+	}
+	dir.Insert(id)
+}
+
+func TestNotifyLocalGrantee(t *testing.T) {
+	dir := identity.NewMockDirectory()
+	s := newNotificationTestServer(t, &dir)
+
+	for _, kind := range []string{notificationKindGrant, notificationKindRevoke, notificationKindGrant} {
+		s.notifyGrantee(context.Background(), &Notification{
+			Grantee: "did:plc:grantee",
+			Kind:    kind,
+			Owner:   "did:plc:owner",
+			Object:  "com.habitat.posts",
+		})
+	}
+
+	// Newest first, paginated by cursor
+	page, err := s.repo.listNotifications("did:plc:grantee", "", 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, notificationKindGrant, page[0].Kind)
+	require.Equal(t, notificationKindRevoke, page[1].Kind)
+
+	page, err = s.repo.listNotifications("did:plc:grantee", "2", 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, uint(1), page[0].ID)
+
+	page, err = s.repo.listNotifications("did:plc:owner", "", 0)
+	require.NoError(t, err)
+	require.Empty(t, page)
+}
+
+func TestNotifyRemoteGrantee(t *testing.T) {
+	dir := identity.NewMockDirectory()
+	keyA, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	keyB, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+
+	// Node B hosts the grantee and receives notifications over HTTP
+	nodeB := newNotificationTestServer(t, &dir)
+	srvB := httptest.NewServer(http.HandlerFunc(nodeB.DeliverNotification))
+	defer srvB.Close()
+	WithNotificationSender(syntax.DID(nodeDIDForHost(srvB.Listener.Addr().String())), srvB.URL, keyB)(nodeB)
+
+	// Node A hosts the owner
+	endpointA := "https://node-a.example"
+	nodeA := newNotificationTestServer(t, &dir, WithNotificationSender("did:web:node-a.example", endpointA, keyA))
+
+	insertHabitatUser(&dir, "did:web:node-a.example", endpointA, keyA)
+	insertHabitatUser(&dir, "did:plc:owner", endpointA, nil)
+	insertHabitatUser(&dir, "did:plc:grantee", srvB.URL, nil)
+	insertHabitatUser(&dir, "did:plc:stranger", "https://elsewhere.example", nil)
+
+	n := &Notification{
+		Grantee: "did:plc:grantee",
+		Kind:    notificationKindGrant,
+		Owner:   "did:plc:owner",
+		Object:  "com.habitat.posts",
+		Effect:  "allow",
+	}
+	nodeA.notifyGrantee(context.Background(), n)
+
+	received, err := nodeB.repo.listNotifications("did:plc:grantee", "", 0)
+	require.NoError(t, err)
+	require.Len(t, received, 1)
+	require.Equal(t, "did:plc:owner", received[0].Owner)
+	require.Equal(t, "com.habitat.posts", received[0].Object)
+
+	local, err := nodeA.repo.listNotifications("did:plc:grantee", "", 0)
+	require.NoError(t, err)
+	require.Empty(t, local)
+
+	// Node A can't send notifications on behalf of owners it doesn't host
+	n.Owner = "did:plc:stranger"
+	require.Error(t, nodeA.sender.deliver(context.Background(), srvB.URL, n))
+
+	// Requests signed by an unknown key are rejected
+	forged, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	n.Owner = "did:plc:owner"
+	nodeA.sender.key = forged
+	require.Error(t, nodeA.sender.deliver(context.Background(), srvB.URL, n))
+}
+
+// blockingDirectory holds up identity lookups until release is closed.
+type blockingDirectory struct {
+	identity.Directory
+	release chan struct{}
+}
+
+func (d *blockingDirectory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	<-d.release
+	return d.Directory.LookupDID(ctx, did)
+}
+
+func TestQueueNotificationDoesNotBlock(t *testing.T) {
+	mock := identity.NewMockDirectory()
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	insertHabitatUser(&mock, "did:plc:grantee", "https://node.example", nil)
+	dir := &blockingDirectory{Directory: &mock, release: make(chan struct{})}
+	s := newNotificationTestServer(t, dir, WithNotificationSender("did:web:node.example", "https://node.example", key))
+
+	// Queueing returns while the grantee's node is still being resolved
+	s.queueNotification(&Notification{
+		Grantee: "did:plc:grantee",
+		Kind:    notificationKindGrant,
+		Owner:   "did:plc:owner",
+		Object:  "com.habitat.posts",
+		Effect:  "allow",
+	})
+	close(dir.release)
+
+	require.Eventually(t, func() bool {
+		received, err := s.repo.listNotifications("did:plc:grantee", "", 0)
+		return err == nil && len(received) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNotificationsLimit(t *testing.T) {
+	limit, err := notificationsLimit(0)
+	require.NoError(t, err)
+	require.Equal(t, defaultNotificationsLimit, limit)
+
+	limit, err = notificationsLimit(10)
+	require.NoError(t, err)
+	require.Equal(t, 10, limit)
+
+	limit, err = notificationsLimit(1_000_000)
+	require.NoError(t, err)
+	require.Equal(t, maxNotificationsLimit, limit)
+
+	_, err = notificationsLimit(-1)
+	require.Error(t, err)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eagraf/habitat-new/api/habitat"
 	"github.com/eagraf/habitat-new/internal/permissions"
 	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
@@ -43,10 +45,48 @@ func TestControllerPrivateDataPutGet(t *testing.T) {
 	got, err = p.getRecord(coll, "my-rkey", "my-did", "another-did")
 	require.NoError(t, err)
 
-	marshalled, err := json.Marshal(got)
-	require.NoError(t, err)
-	require.Equal(t, []byte(marshalled), marshalledVal)
+	require.Equal(t, string(marshalledVal), got.Rec)
 
 	err = p.putRecord("my-did", coll, val, rkey, &validate)
 	require.NoError(t, err)
 }
+
+func TestControllerListRecordsWithRecordRules(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	perms, err := permissions.NewSQLiteStore(db)
+	require.NoError(t, err)
+	repo, err := NewSQLiteRepo(db)
+	require.NoError(t, err)
+	p := newStore(perms, repo)
+
+	coll := "my.fake.collection"
+	for _, rkey := range []string{"rkey-1", "rkey-2", "rkey-3"} {
+		require.NoError(t, p.putRecord("my-did", coll, map[string]any{"k": rkey}, rkey, nil))
+	}
+	params := habitat.NetworkHabitatRepoListRecordsParams{Repo: "my-did", Collection: coll}
+	rkeys := func(caller syntax.DID) []string {
+		recs, err := p.listRecords(params, caller)
+		require.NoError(t, err)
+		res := []string{}
+		for _, rec := range recs {
+			res = append(res, rec.Rkey)
+		}
+		return res
+	}
+
+	// Single records can be shared without sharing the collection
+	require.NoError(t, perms.AddPermission("another-did", "my-did", coll, "rkey-2", permissions.EffectAllow))
+	require.Equal(t, []string{coll + ".rkey-2"}, rkeys("another-did"))
+
+	// Single records can be hidden from a shared collection
+	require.NoError(t, perms.AddPermission("another-did", "my-did", "my.fake", "", permissions.EffectAllow))
+	require.NoError(t, perms.AddPermission("another-did", "my-did", coll, "rkey-3", permissions.EffectDeny))
+	require.Equal(t, []string{coll + ".rkey-1", coll + ".rkey-2"}, rkeys("another-did"))
+
+	// A more specific deny on the collection overrides the broader allow
+	require.NoError(t, perms.AddPermission("another-did", "my-did", coll, "", permissions.EffectDeny))
+	require.Equal(t, []string{coll + ".rkey-2"}, rkeys("another-did"))
+
+	require.Len(t, rkeys("my-did"), 3)
+}
@@ -2,6 +2,7 @@ package privi
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/eagraf/habitat-new/api/habitat"
@@ -94,5 +95,48 @@ func (p *store) listRecords(
 		return nil, err
 	}
 
+	allow, deny = resolveReadFilters(params.Collection, allow, deny)
 	return p.repo.listRecords(params, allow, deny)
 }
+
+// resolveReadFilters turns the permission objects matching a collection into the rkey filters
+// understood by repo.listRecords. Rules on the collection or any of its parent NSIDs are resolved
+// by longest match, with deny winning ties, matching HasPermission. If the collection is readable,
+// every record is allowed except those denied individually; otherwise only individually allowed
+// records are returned.
+func resolveReadFilters(collection string, allow []string, deny []string) ([]string, []string) {
+	collectionLevel := -1
+	collectionAllowed := false
+	recordAllows := []string{}
+	recordDenies := []string{}
+
+	consider := func(object string, allowed bool) {
+		object = strings.TrimSuffix(object, ".*")
+		switch {
+		case object == collection || strings.HasPrefix(collection, object+"."):
+			if len(object) > collectionLevel {
+				collectionLevel = len(object)
+				collectionAllowed = allowed
+			} else if len(object) == collectionLevel && !allowed {
+				collectionAllowed = false
+			}
+		case strings.HasPrefix(object, collection+"."):
+			if allowed {
+				recordAllows = append(recordAllows, object)
+			} else {
+				recordDenies = append(recordDenies, object)
+			}
+		}
+	}
+	for _, a := range allow {
+		consider(a, true)
+	}
+	for _, d := range deny {
+		consider(d, false)
+	}
+
+	if collectionAllowed {
+		return []string{collection + ".*"}, recordDenies
+	}
+	return recordAllows, []string{}
+}
@@ -77,7 +77,7 @@ type Blob struct {
 
 // TODO: create table etc.
 func NewSQLiteRepo(db *gorm.DB) (*sqliteRepo, error) {
-	if err := db.AutoMigrate(&Record{}, &Blob{}); err != nil {
+	if err := db.AutoMigrate(&Record{}, &Blob{}, &Notification{}); err != nil {
 		return nil, err
 	}
 
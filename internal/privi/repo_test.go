@@ -1,6 +1,7 @@
 package privi
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -28,9 +29,11 @@ func TestSQLiteRepoPutAndGetRecord(t *testing.T) {
 	err = repo.putRecord("my-did", key, val, nil)
 	require.NoError(t, err)
 
-	got, err := repo.getRecord("my-did", key)
+	rec, err := repo.getRecord("my-did", key)
 	require.NoError(t, err)
 
+	got := map[string]any{}
+	require.NoError(t, json.Unmarshal([]byte(rec.Rec), &got))
 	for k, v := range val {
 		_, ok := got[k]
 		require.True(t, ok)
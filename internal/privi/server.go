@@ -1,6 +1,7 @@
 package privi
 
 import (
+	"context"
 	"crypto"
 	"encoding/json"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
@@ -15,6 +17,7 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/eagraf/habitat-new/api/habitat"
+	"github.com/eagraf/habitat-new/internal/directory"
 	"github.com/eagraf/habitat-new/internal/node/api"
 	"github.com/eagraf/habitat-new/internal/oauthserver"
 	"github.com/eagraf/habitat-new/internal/permissions"
@@ -31,20 +34,41 @@ type Server struct {
 	// TODO: should this really live here?
 	repo        *sqliteRepo
 	oauthServer *oauthserver.OAuthServer
+	// Delivers notifications to grantees on other nodes; nil if this node only keeps local inboxes.
+	sender *notificationSender
+	// Notifications waiting to be delivered by the background worker.
+	notifications chan *Notification
 }
 
-// NewServer returns a privi server.
+type ServerOption func(*Server)
+
+// WithDirectory sets the directory the server resolves identities with.
+func WithDirectory(dir identity.Directory) ServerOption {
+	return func(s *Server) {
+		s.dir = dir
+	}
+}
+
+// NewServer returns a privi server. Queued notifications are delivered in the background until
+// ctx is done.
 func NewServer(
+	ctx context.Context,
 	perms permissions.Store,
 	repo *sqliteRepo,
 	oauthServer *oauthserver.OAuthServer,
+	opts ...ServerOption,
 ) *Server {
 	server := &Server{
-		store:       newStore(perms, repo),
-		dir:         identity.DefaultDirectory(),
-		repo:        repo,
-		oauthServer: oauthServer,
+		store:         newStore(perms, repo),
+		dir:           directory.New(),
+		repo:          repo,
+		oauthServer:   oauthServer,
+		notifications: make(chan *Notification, notificationQueueSize),
+	}
+	for _, opt := range opts {
+		opt(server)
 	}
+	go server.deliverNotifications(ctx)
 	return server
 }
 
@@ -52,17 +76,20 @@ var formDecoder = schema.NewDecoder()
 
 // PutRecord puts a potentially encrypted record (see s.inner.putRecord)
 func (s *Server) PutRecord(w http.ResponseWriter, r *http.Request) {
-	callerDID, ok := s.getAuthedUser(w, r)
-	if !ok {
-		return
-	}
-	fmt.Println("callerDid: ", callerDID)
 	var req habitat.NetworkHabitatRepoPutRecordInput
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "reading request body", http.StatusBadRequest)
 		return
 	}
+	callerDID, ok := s.getAuthedUser(
+		w,
+		r,
+		oauthserver.RepoScope(req.Collection, oauthserver.ActionWrite),
+	)
+	if !ok {
+		return
+	}
 
 	atid, err := syntax.ParseAtIdentifier(req.Repo)
 	if err != nil {
@@ -121,16 +148,20 @@ func (s *Server) PutRecord(w http.ResponseWriter, r *http.Request) {
 
 // GetRecord gets a potentially encrypted record (see s.inner.getRecord)
 func (s *Server) GetRecord(w http.ResponseWriter, r *http.Request) {
-	callerDID, ok := s.getAuthedUser(w, r)
-	if !ok {
-		return
-	}
 	var params habitat.NetworkHabitatRepoGetRecordParams
 	err := formDecoder.Decode(&params, r.URL.Query())
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "parsing url", http.StatusBadRequest)
 		return
 	}
+	callerDID, ok := s.getAuthedUser(
+		w,
+		r,
+		oauthserver.RepoScope(params.Collection, oauthserver.ActionRead),
+	)
+	if !ok {
+		return
+	}
 
 	// Try handling both handles and dids
 	atid, err := syntax.ParseAtIdentifier(params.Repo)
@@ -171,9 +202,16 @@ func (s *Server) GetRecord(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) getAuthedUser(w http.ResponseWriter, r *http.Request) (did syntax.DID, ok bool) {
+// getAuthedUser authenticates the caller. Apps acting for the user through Habitat OAuth must have
+// been granted the given scopes, while other nodes acting for their own users are checked against
+// the permission store by the caller.
+func (s *Server) getAuthedUser(
+	w http.ResponseWriter,
+	r *http.Request,
+	scopes ...string,
+) (did syntax.DID, ok bool) {
 	if r.Header.Get("Habitat-Auth-Method") == "oauth" {
-		did, _, ok := s.oauthServer.Validate(w, r)
+		did, _, ok := s.oauthServer.Validate(w, r, scopes...)
 		return syntax.DID(did), ok
 	}
 	did, err := s.getCaller(r)
@@ -186,10 +224,6 @@ func (s *Server) getAuthedUser(w http.ResponseWriter, r *http.Request) (did synt
 }
 
 func (s *Server) UploadBlob(w http.ResponseWriter, r *http.Request) {
-	callerDID, ok := s.getAuthedUser(w, r)
-	if !ok {
-		return
-	}
 	mimeType := r.Header.Get("Content-Type")
 	if mimeType == "" {
 		utils.LogAndHTTPError(
@@ -200,6 +234,10 @@ func (s *Server) UploadBlob(w http.ResponseWriter, r *http.Request) {
 		)
 		return
 	}
+	callerDID, ok := s.getAuthedUser(w, r, oauthserver.BlobScope(mimeType))
+	if !ok {
+		return
+	}
 
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -234,16 +272,20 @@ func (s *Server) UploadBlob(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) ListRecords(w http.ResponseWriter, r *http.Request) {
-	callerDID, ok := s.getAuthedUser(w, r)
-	if !ok {
-		return
-	}
 	var params habitat.NetworkHabitatRepoListRecordsParams
 	err := formDecoder.Decode(&params, r.URL.Query())
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "parsing url", http.StatusBadRequest)
 		return
 	}
+	callerDID, ok := s.getAuthedUser(
+		w,
+		r,
+		oauthserver.RepoScope(params.Collection, oauthserver.ActionRead),
+	)
+	if !ok {
+		return
+	}
 
 	// Try handling both handles and dids
 	atid, err := syntax.ParseAtIdentifier(params.Repo)
@@ -327,6 +369,20 @@ func (s *Server) getCaller(r *http.Request) (syntax.DID, error) {
 	return syntax.DID(did), err
 }
 
+type permissionRule struct {
+	Grantee   string             `json:"grantee"`
+	Object    string             `json:"object"`
+	Effect    permissions.Effect `json:"effect"`
+	NotBefore *time.Time         `json:"notBefore,omitempty"`
+	ExpiresAt *time.Time         `json:"expiresAt,omitempty"`
+	// Expired rules no longer take effect and are kept until purged so the owner can see them.
+	Expired bool `json:"expired"`
+}
+
+type listPermissionsResponse struct {
+	Permissions []permissionRule `json:"permissions"`
+}
+
 func (s *Server) ListPermissions(w http.ResponseWriter, r *http.Request) {
 	callerDID, err := s.getCaller(r)
 	if err != nil {
@@ -334,13 +390,26 @@ func (s *Server) ListPermissions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	permissions, err := s.store.permissions.ListReadPermissionsByLexicon(callerDID.String())
+	perms, err := s.store.permissions.ListPermissions(callerDID.String())
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "list permissions from store", http.StatusInternalServerError)
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(permissions)
+	now := time.Now()
+	resp := listPermissionsResponse{Permissions: make([]permissionRule, 0, len(perms))}
+	for _, perm := range perms {
+		resp.Permissions = append(resp.Permissions, permissionRule{
+			Grantee:   perm.Grantee,
+			Object:    perm.Object,
+			Effect:    perm.Effect,
+			NotBefore: perm.NotBefore,
+			ExpiresAt: perm.ExpiresAt,
+			Expired:   perm.Expired(now),
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "json marshal response", http.StatusInternalServerError)
 		log.Err(err).Msgf("error sending response for ListPermissions request")
@@ -348,9 +417,126 @@ func (s *Server) ListPermissions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ExplainPermission reports how a permission decision for one of the caller's records is made.
+func (s *Server) ExplainPermission(w http.ResponseWriter, r *http.Request) {
+	callerDID, err := s.getCaller(r)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "getting caller did", http.StatusForbidden)
+		return
+	}
+	var params habitat.NetworkHabitatPermissionsExplainParams
+	err = formDecoder.Decode(&params, r.URL.Query())
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "parsing url", http.StatusBadRequest)
+		return
+	}
+	if params.Grantee == "" || params.Collection == "" {
+		utils.LogAndHTTPError(
+			w,
+			fmt.Errorf("grantee and collection are required"),
+			"parsing url",
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	explanation, err := s.store.permissions.Explain(
+		params.Grantee,
+		callerDID.String(),
+		params.Collection,
+		params.Rkey,
+	)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "explaining permission", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	output := &habitat.NetworkHabitatPermissionsExplainOutput{
+		Allowed: explanation.Allowed,
+		Reason:  explanation.Reason,
+		Rules:   []habitat.NetworkHabitatPermissionsExplainRule{},
+	}
+	if explanation.DecidingRule != nil {
+		decidingRule := toExplainRule(*explanation.DecidingRule, now)
+		output.DecidingRule = &decidingRule
+	}
+	for _, rule := range explanation.Rules {
+		output.Rules = append(output.Rules, toExplainRule(rule, now))
+	}
+
+	err = json.NewEncoder(w).Encode(output)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "json marshal response", http.StatusInternalServerError)
+		log.Err(err).Msgf("error sending response for ExplainPermission request")
+		return
+	}
+}
+
+func toExplainRule(
+	perm permissions.Permission,
+	now time.Time,
+) habitat.NetworkHabitatPermissionsExplainRule {
+	rule := habitat.NetworkHabitatPermissionsExplainRule{
+		Object: perm.Object,
+		Effect: string(perm.Effect),
+		Active: perm.Active(now),
+	}
+	if perm.NotBefore != nil {
+		rule.NotBefore = perm.NotBefore.Format(time.RFC3339)
+	}
+	if perm.ExpiresAt != nil {
+		rule.ExpiresAt = perm.ExpiresAt.Format(time.RFC3339)
+	}
+	return rule
+}
+
+// editPermissionRequest targets a whole lexicon, or a single record within it if Rkey is set.
+// Effect and the optional time bounds are only read when adding a permission; effect defaults
+// to allow.
 type editPermissionRequest struct {
-	DID     string `json:"did"`
-	Lexicon string `json:"lexicon"`
+	DID       string     `json:"did"`
+	Lexicon   string     `json:"lexicon"`
+	Rkey      string     `json:"rkey,omitempty"`
+	Effect    string     `json:"effect,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// object returns the permission object the request targets.
+func (req *editPermissionRequest) object() string {
+	if req.Rkey == "" {
+		return req.Lexicon
+	}
+	return fmt.Sprintf("%s.%s", req.Lexicon, req.Rkey)
+}
+
+func (req *editPermissionRequest) grantOptions() []permissions.GrantOption {
+	opts := []permissions.GrantOption{}
+	if req.NotBefore != nil {
+		opts = append(opts, permissions.WithNotBefore(*req.NotBefore))
+	}
+	if req.ExpiresAt != nil {
+		opts = append(opts, permissions.WithExpiresAt(*req.ExpiresAt))
+	}
+	return opts
+}
+
+func (req *editPermissionRequest) validate() error {
+	if req.DID == "" || req.Lexicon == "" {
+		return fmt.Errorf("did and lexicon are required")
+	}
+	if req.Rkey == "" {
+		// Whole lexicons may also be granted by NSID prefix
+		return permissions.ValidateObject(req.Lexicon)
+	}
+	if _, err := syntax.ParseNSID(req.Lexicon); err != nil {
+		return err
+	}
+	if _, err := syntax.ParseRecordKey(req.Rkey); err != nil {
+		return err
+	}
+	return nil
 }
 
 func (s *Server) AddPermission(w http.ResponseWriter, r *http.Request) {
@@ -360,17 +546,44 @@ func (s *Server) AddPermission(w http.ResponseWriter, r *http.Request) {
 		utils.LogAndHTTPError(w, err, "decode json request", http.StatusBadRequest)
 		return
 	}
+	err = req.validate()
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "validating request", http.StatusBadRequest)
+		return
+	}
+	effect, err := permissions.ParseEffect(req.Effect)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "parsing effect", http.StatusBadRequest)
+		return
+	}
 	callerDID, err := s.getCaller(r)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "getting caller did", http.StatusForbidden)
 		return
 	}
 
-	err = s.store.permissions.AddLexiconReadPermission(req.DID, callerDID.String(), req.Lexicon)
+	err = s.store.permissions.AddPermission(
+		req.DID,
+		callerDID.String(),
+		req.Lexicon,
+		req.Rkey,
+		effect,
+		req.grantOptions()...,
+	)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "adding permission", http.StatusInternalServerError)
 		return
 	}
+
+	s.queueNotification(&Notification{
+		Grantee:   req.DID,
+		Kind:      notificationKindGrant,
+		Owner:     callerDID.String(),
+		Object:    req.object(),
+		Effect:    string(effect),
+		NotBefore: req.NotBefore,
+		ExpiresAt: req.ExpiresAt,
+	})
 }
 
 func (s *Server) RemovePermission(w http.ResponseWriter, r *http.Request) {
@@ -380,17 +593,97 @@ func (s *Server) RemovePermission(w http.ResponseWriter, r *http.Request) {
 		utils.LogAndHTTPError(w, err, "decode json request", http.StatusBadRequest)
 		return
 	}
+	err = req.validate()
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "validating request", http.StatusBadRequest)
+		return
+	}
 	callerDID, err := s.getCaller(r)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "getting caller did", http.StatusForbidden)
 		return
 	}
 
-	err = s.store.permissions.RemoveLexiconReadPermission(req.DID, callerDID.String(), req.Lexicon)
+	err = s.store.permissions.RemovePermission(req.DID, callerDID.String(), req.Lexicon, req.Rkey)
 	if err != nil {
 		utils.LogAndHTTPError(w, err, "removing permission", http.StatusInternalServerError)
 		return
 	}
+
+	s.queueNotification(&Notification{
+		Grantee: req.DID,
+		Kind:    notificationKindRevoke,
+		Owner:   callerDID.String(),
+		Object:  req.object(),
+	})
+}
+
+// ExportPermissions returns every permission rule the caller has defined as a versioned policy
+// document, which can later be restored with ImportPermissions.
+func (s *Server) ExportPermissions(w http.ResponseWriter, r *http.Request) {
+	callerDID, err := s.getCaller(r)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "getting caller did", http.StatusForbidden)
+		return
+	}
+
+	doc, err := permissions.ExportPolicies(s.store.permissions, callerDID.String())
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "exporting permissions", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(doc)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "json marshal response", http.StatusInternalServerError)
+		return
+	}
+}
+
+type importPermissionsRequest struct {
+	Mode     string                     `json:"mode,omitempty"`
+	Document permissions.PolicyDocument `json:"document"`
+}
+
+// ImportPermissions applies a policy document to the caller's permissions, either merging it with
+// or replacing their existing rules. Documents with conflicting entries are rejected with the
+// conflicts listed in the response.
+func (s *Server) ImportPermissions(w http.ResponseWriter, r *http.Request) {
+	req := &importPermissionsRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "decode json request", http.StatusBadRequest)
+		return
+	}
+	mode, err := permissions.ParseImportMode(req.Mode)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "parsing import mode", http.StatusBadRequest)
+		return
+	}
+	callerDID, err := s.getCaller(r)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "getting caller did", http.StatusForbidden)
+		return
+	}
+
+	result, err := permissions.ImportPolicies(
+		s.store.permissions,
+		callerDID.String(),
+		&req.Document,
+		mode,
+	)
+	if errors.Is(err, permissions.ErrConflictingPolicies) {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		utils.LogAndHTTPError(w, err, "importing permissions", http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		utils.LogAndHTTPError(w, err, "json marshal response", http.StatusInternalServerError)
+		return
+	}
 }
 
 func (s *Server) GetRoutes() []api.Route {
@@ -412,5 +705,30 @@ func (s *Server) GetRoutes() []api.Route {
 			s.RemovePermission,
 		),
 		api.NewBasicRoute(http.MethodGet, "/xrpc/com.habitat.listPermissions", s.ListPermissions),
+		api.NewBasicRoute(
+			http.MethodGet,
+			"/xrpc/com.habitat.exportPermissions",
+			s.ExportPermissions,
+		),
+		api.NewBasicRoute(
+			http.MethodPost,
+			"/xrpc/com.habitat.importPermissions",
+			s.ImportPermissions,
+		),
+		api.NewBasicRoute(
+			http.MethodGet,
+			"/xrpc/network.habitat.permissions.explain",
+			s.ExplainPermission,
+		),
+		api.NewBasicRoute(
+			http.MethodGet,
+			"/xrpc/network.habitat.notifications.listNotifications",
+			s.ListNotifications,
+		),
+		api.NewBasicRoute(
+			http.MethodPost,
+			"/xrpc/network.habitat.notifications.deliverNotification",
+			s.DeliverNotification,
+		),
 	}
 }
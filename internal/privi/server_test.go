@@ -0,0 +1,41 @@
+package privi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditPermissionValidation(t *testing.T) {
+	dir := identity.NewMockDirectory()
+	s := newNotificationTestServer(t, &dir)
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"missing lexicon", `{"did": "did:plc:bob"}`, http.StatusBadRequest},
+		{"bad nsid", `{"did": "did:plc:bob", "lexicon": "not an nsid"}`, http.StatusBadRequest},
+		{"bad nsid with rkey", `{"did": "did:plc:bob", "lexicon": "com.habitat", "rkey": "abc"}`, http.StatusBadRequest},
+		{"bad rkey", `{"did": "did:plc:bob", "lexicon": "com.habitat.posts", "rkey": "a/b"}`, http.StatusBadRequest},
+		// Valid requests get as far as authenticating the caller
+		{"nsid", `{"did": "did:plc:bob", "lexicon": "com.habitat.posts"}`, http.StatusForbidden},
+		{"nsid prefix", `{"did": "did:plc:bob", "lexicon": "com.habitat"}`, http.StatusForbidden},
+		{"record", `{"did": "did:plc:bob", "lexicon": "com.habitat.posts", "rkey": "abc"}`, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, handler := range []http.HandlerFunc{s.AddPermission, s.RemovePermission} {
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+				r.Header.Set("Authorization", "Bearer invalid")
+				w := httptest.NewRecorder()
+				handler(w, r)
+				require.Equal(t, tc.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}